@@ -1,19 +1,25 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spaceuptech/galaxy/cmd"
 	"github.com/spaceuptech/galaxy/model"
 	"github.com/spaceuptech/galaxy/proxy"
 	"github.com/spaceuptech/galaxy/runner"
+	"github.com/spaceuptech/galaxy/runner/activator"
 	"github.com/spaceuptech/galaxy/runner/driver"
-  "github.com/spaceuptech/galaxy/runner/services"
+	"github.com/spaceuptech/galaxy/runner/services"
 	"github.com/spaceuptech/galaxy/server"
+	"github.com/spaceuptech/galaxy/utils"
 	"github.com/spaceuptech/galaxy/utils/auth"
+	"github.com/spaceuptech/galaxy/utils/certs"
 	"github.com/urfave/cli"
 )
 
@@ -38,18 +44,53 @@ func actionRunner(c *cli.Context) error {
 
 	// Create a new runner object
 	r, err := runner.New(&runner.Config{
-		Port:      port,
-		ProxyPort: proxyPort,
+		Port:            port,
+		ProxyPort:       proxyPort,
+		ShutdownTimeout: c.Duration("shutdown-timeout"),
+		DataDir:         c.String("data-dir"),
+		DB: &runner.DBConfig{
+			SyncWrites:       c.Bool("db-sync-writes"),
+			Truncate:         c.Bool("db-truncate"),
+			ValueLogFileSize: c.Int64("db-value-log-file-size"),
+			MaxTableSize:     c.Int64("db-max-table-size"),
+			GCInterval:       c.Duration("db-gc-interval"),
+			GCDiscardRatio:   c.Float64("db-gc-discard-ratio"),
+		},
+		MetricStore:    runner.MetricStoreType(c.String("metric-store")),
+		AuditRetention: c.Duration("audit-retention"),
+		TLS:            tlsConfig(c),
+		Cors:           corsConfig(c),
+		Proxy: &activator.Config{
+			MaxBodyBytes:        c.Int64("proxy-max-body-size"),
+			WaitTimeout:         c.Duration("proxy-wait-timeout"),
+			MaxQueuedPerService: c.Int("proxy-max-queued-per-service"),
+			MaxQueued:           c.Int("proxy-max-queued"),
+			RetryAfter:          c.Duration("proxy-retry-after"),
+		},
+		Election: &runner.ElectionConfig{
+			Mode:          runner.ElectionMode(c.String("election")),
+			AdvertiseAddr: c.String("advertise-addr"),
+			LockFile:      c.String("election-lock-file"),
+		},
 		Auth: &auth.Config{
 			Mode:         auth.Runner,
 			JWTAlgorithm: jwtAlgo,
 			Secret:       jwtSecret,
 			ProxySecret:  jwtProxySecret,
+
+			PreviousProxySecret:    c.String("jwt-proxy-previous-secret"),
+			ProxySecretGracePeriod: c.Duration("jwt-proxy-secret-grace-period"),
+			ProxyTokenTTL:          c.Duration("jwt-proxy-token-ttl"),
+
+			KeyURL:             c.String("jwt-key-url"),
+			KeyFile:            c.String("jwt-key-file"),
+			KeyRefreshInterval: c.Duration("jwt-key-refresh-interval"),
 		},
 		Driver: &driver.Config{
 			DriverType:     model.DriverType(driverType),
 			ConfigFilePath: driverConfig,
 			IsInCluster:    !outsideCluster,
+			NodeAgent:      c.Bool("node-agent"),
 		},
 		Providers: &services.Config{
 			DOToken:   c.String("do-token"),
@@ -62,7 +103,9 @@ func actionRunner(c *cli.Context) error {
 		os.Exit(-1)
 	}
 
-	return r.Start()
+	ctx, cancel := shutdownContext()
+	defer cancel()
+	return r.Start(ctx)
 }
 
 func actionProxy(c *cli.Context) error {
@@ -74,14 +117,33 @@ func actionProxy(c *cli.Context) error {
 	// Set the log level
 	setLogLevel(loglevel)
 
-	// Throw an error if invalid token provided
-	if len(strings.Split(token, ".")) != 3 {
+	// Throw an error if invalid token provided. Proxies presenting a client certificate don't need a token.
+	if len(strings.Split(token, ".")) != 3 && !(c.Bool("tls") && c.String("tls-cert-file") != "") {
 		return errors.New("invalid token provided")
 	}
 
 	// Start the proxy
-	p := proxy.New(addr, token)
-	return p.Start()
+	ctx, cancel := shutdownContext()
+	defer cancel()
+	p, err := proxy.New(&proxy.Config{
+		Addr:       addr,
+		Token:      token,
+		Source:     proxy.SourceType(c.String("source")),
+		SourceAddr: c.String("source-addr"),
+		Filter:     c.String("filter"),
+		Interval:   c.Duration("interval"),
+
+		TLS:   c.Bool("tls"),
+		Certs: tlsConfig(c),
+
+		NodeAgent:      c.Bool("node-agent"),
+		NodeName:       c.String("node-name"),
+		KubeConfigPath: c.String("kube-config"),
+	})
+	if err != nil {
+		return err
+	}
+	return p.Start(ctx)
 }
 
 func actionServer(c *cli.Context) error {
@@ -92,8 +154,70 @@ func actionServer(c *cli.Context) error {
 	// Set the log level
 	setLogLevel(loglevel)
 
-	s := server.New(&server.Config{Port: port})
-	return s.Start()
+	ctx, cancel := shutdownContext()
+	defer cancel()
+	s, err := server.New(&server.Config{
+		Port:                port,
+		ShutdownTimeout:     c.Duration("shutdown-timeout"),
+		TLS:                 tlsConfig(c),
+		Cors:                corsConfig(c),
+		DataDir:             c.String("data-dir"),
+		Store:               server.StoreType(c.String("store")),
+		AuditRetention:      c.Duration("audit-retention"),
+		Auth:                &auth.Config{Secret: c.String("jwt-secret")},
+		TokenTTL:            c.Duration("jwt-token-ttl"),
+		KeyRotationInterval: c.Duration("jwt-key-rotation-interval"),
+		KeyGracePeriod:      c.Duration("jwt-key-grace-period"),
+		DeployAttempts:      c.Int("deploy-attempts"),
+		DeployRetryBackoff:  c.Duration("deploy-retry-backoff"),
+		DeployTimeout:       c.Duration("deploy-timeout"),
+		LoginAttempts:       c.Int("login-attempts"),
+		LoginLockout:        c.Duration("login-lockout"),
+		AdminUser:           c.String("admin-user"),
+		AdminKey:            c.String("admin-key"),
+	})
+	if err != nil {
+		return err
+	}
+	return s.Start(ctx)
+}
+
+// tlsConfig returns the certificates provided through the tls flags
+func tlsConfig(c *cli.Context) *certs.Config {
+	return &certs.Config{
+		CertFile:       c.String("tls-cert-file"),
+		KeyFile:        c.String("tls-key-file"),
+		CAFile:         c.String("tls-ca-file"),
+		ReloadInterval: c.Duration("tls-reload-interval"),
+	}
+}
+
+// corsConfig returns the cross origin requests allowed through the cors flags
+func corsConfig(c *cli.Context) *utils.CorsConfig {
+	return &utils.CorsConfig{
+		AllowedOrigins: c.StringSlice("cors-allowed-origins"),
+		AllowedMethods: c.StringSlice("cors-allowed-methods"),
+		AllowedHeaders: c.StringSlice("cors-allowed-headers"),
+		MaxAge:         c.Duration("cors-max-age"),
+	}
+}
+
+// shutdownContext returns a context which gets cancelled once the process receives SIGINT or SIGTERM
+func shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(ch)
+
+		select {
+		case sig := <-ch:
+			logrus.Infof("Received %s. Shutting down gracefully", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
 }
 
 func setLogLevel(loglevel string) {
@@ -2,9 +2,13 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+
+	"github.com/spaceuptech/galaxy/proxy"
+	"github.com/spaceuptech/galaxy/runner"
 )
 
 const (
@@ -39,20 +43,194 @@ func main() {
 					Usage:  "The port the proxy will bind too",
 					Value:  "4055",
 				},
+
+				// TLS config
+				cli.StringFlag{
+					Name:   "tls-cert-file",
+					EnvVar: "TLS_CERT_FILE",
+					Usage:  "The path of the certificate to serve the runner and its proxy over tls",
+				},
+				cli.StringFlag{
+					Name:   "tls-key-file",
+					EnvVar: "TLS_KEY_FILE",
+					Usage:  "The path of the private key of the tls certificate",
+				},
+				cli.StringFlag{
+					Name:   "tls-ca-file",
+					EnvVar: "TLS_CA_FILE",
+					Usage:  "The path of the authorities used to verify the client certificates of the metrics proxies and the certificates of the other runner replicas",
+				},
+				cli.DurationFlag{
+					Name:   "tls-reload-interval",
+					EnvVar: "TLS_RELOAD_INTERVAL",
+					Usage:  "The interval at which the tls files are checked for changes",
+					Value:  time.Minute,
+				},
+
+				// CORS config
+				cli.StringSliceFlag{
+					Name:   "cors-allowed-origins",
+					EnvVar: "CORS_ALLOWED_ORIGINS",
+					Usage:  "The origins allowed to make cross origin requests. Use * to allow all origins without credentials",
+				},
+				cli.StringSliceFlag{
+					Name:   "cors-allowed-methods",
+					EnvVar: "CORS_ALLOWED_METHODS",
+					Usage:  "The methods allowed in cross origin requests (default: GET, PUT, POST, DELETE)",
+				},
+				cli.StringSliceFlag{
+					Name:   "cors-allowed-headers",
+					EnvVar: "CORS_ALLOWED_HEADERS",
+					Usage:  "The headers allowed in cross origin requests (default: Authorization, Content-Type)",
+				},
+				cli.DurationFlag{
+					Name:   "cors-max-age",
+					EnvVar: "CORS_MAX_AGE",
+					Usage:  "The duration the results of a preflight request can be cached for",
+					Value:  10 * time.Minute,
+				},
+				cli.Int64Flag{
+					Name:   "proxy-max-body-size",
+					EnvVar: "PROXY_MAX_BODY_SIZE",
+					Usage:  "The maximum size in bytes of a request body buffered by the proxy while a service scales up",
+					Value:  10 << 20,
+				},
+				cli.DurationFlag{
+					Name:   "proxy-wait-timeout",
+					EnvVar: "PROXY_WAIT_TIMEOUT",
+					Usage:  "The maximum time a request waits in the proxy for a service to scale up",
+					Value:  3 * time.Minute,
+				},
+				cli.IntFlag{
+					Name:   "proxy-max-queued-per-service",
+					EnvVar: "PROXY_MAX_QUEUED_PER_SERVICE",
+					Usage:  "The maximum number of requests waiting in the proxy for a single service to scale up",
+					Value:  250,
+				},
+				cli.IntFlag{
+					Name:   "proxy-max-queued",
+					EnvVar: "PROXY_MAX_QUEUED",
+					Usage:  "The maximum number of requests waiting in the proxy across all services",
+					Value:  1000,
+				},
+				cli.DurationFlag{
+					Name:   "proxy-retry-after",
+					EnvVar: "PROXY_RETRY_AFTER",
+					Usage:  "The duration clients are asked to wait before retrying requests rejected by the proxy",
+					Value:  10 * time.Second,
+				},
+				cli.BoolFlag{
+					Name:   "node-agent",
+					EnvVar: "NODE_AGENT",
+					Usage:  "Collect metrics with a node agent on every node instead of injecting a metrics container in every pod",
+				},
 				cli.StringFlag{
 					Name:   "log-level",
 					EnvVar: "LOG_LEVEL",
 					Usage:  "Set the log level [debug | info | error]",
 					Value:  loglevelInfo,
 				},
+				cli.DurationFlag{
+					Name:   "shutdown-timeout",
+					EnvVar: "SHUTDOWN_TIMEOUT",
+					Usage:  "The time given to in-flight requests to complete on shutdown. This should cover the time taken to scale a service up from zero.",
+					Value:  3 * time.Minute,
+				},
+				cli.StringFlag{
+					Name:   "data-dir",
+					EnvVar: "DATA_DIR",
+					Usage:  "The directory in which the runner persists its state",
+					Value:  "/var/lib/galaxy",
+				},
+				cli.StringFlag{
+					Name:   "metric-store",
+					EnvVar: "METRIC_STORE",
+					Usage:  "The store to use for the autoscaler metrics [ memory | badger ]",
+					Value:  string(runner.MetricStoreMemory),
+				},
+				cli.DurationFlag{
+					Name:   "audit-retention",
+					EnvVar: "AUDIT_RETENTION",
+					Usage:  "The duration the audit log entries are retained for",
+					Value:  90 * 24 * time.Hour,
+				},
+
+				// Leader election config
+				cli.StringFlag{
+					Name:   "election",
+					EnvVar: "ELECTION",
+					Usage:  "The mechanism used to elect the leader amongst the runner replicas [ none | driver | file ]",
+					Value:  string(runner.ElectionNone),
+				},
+				cli.StringFlag{
+					Name:   "advertise-addr",
+					EnvVar: "ADVERTISE_ADDR",
+					Usage:  "The address (host:port) at which the other runner replicas can reach this replica",
+				},
+				cli.StringFlag{
+					Name:   "election-lock-file",
+					EnvVar: "ELECTION_LOCK_FILE",
+					Usage:  "The lock file shared by the runner replicas when the election mechanism is file",
+				},
+
+				// Database config
+				cli.BoolFlag{
+					Name:   "db-sync-writes",
+					EnvVar: "DB_SYNC_WRITES",
+					Usage:  "Sync all writes to disk before acknowledging them",
+				},
+				cli.BoolFlag{
+					Name:   "db-truncate",
+					EnvVar: "DB_TRUNCATE",
+					Usage:  "Truncate corrupt data to recover the database after a crash",
+				},
+				cli.Int64Flag{
+					Name:   "db-value-log-file-size",
+					EnvVar: "DB_VALUE_LOG_FILE_SIZE",
+					Usage:  "The size of each value log file in MB",
+				},
+				cli.Int64Flag{
+					Name:   "db-max-table-size",
+					EnvVar: "DB_MAX_TABLE_SIZE",
+					Usage:  "The maximum size of each table in MB",
+				},
+				cli.DurationFlag{
+					Name:   "db-gc-interval",
+					EnvVar: "DB_GC_INTERVAL",
+					Usage:  "The interval at which the value log garbage collection runs",
+					Value:  5 * time.Minute,
+				},
+				cli.Float64Flag{
+					Name:   "db-gc-discard-ratio",
+					EnvVar: "DB_GC_DISCARD_RATIO",
+					Usage:  "The ratio of stale data required to rewrite a value log file",
+					Value:  0.7,
+				},
 
 				// JWT config
 				cli.StringFlag{
 					Name:   "jwt-algo",
 					EnvVar: "JWT_ALGO",
-					Usage:  "The jwt algorithm to use for verification and signing [ hs256 | rsa256 ]",
+					Usage:  "The jwt algorithm to use for verification and signing [ hs256 | rsa256 | es256 | eddsa ]",
 					Value:  "hs256",
 				},
+				cli.StringFlag{
+					Name:   "jwt-key-url",
+					EnvVar: "JWT_KEY_URL",
+					Usage:  "The url to fetch the public keys of the galaxy server from. It can serve a pem encoded key or a json web key set",
+					Value:  "https://api.spaceuptech.com/v1/galaxy/galaxy/public-key",
+				},
+				cli.StringFlag{
+					Name:   "jwt-key-file",
+					EnvVar: "JWT_KEY_FILE",
+					Usage:  "The file to load the public keys of the galaxy server from instead of fetching them. It can contain pem encoded keys or a json web key set",
+				},
+				cli.DurationFlag{
+					Name:   "jwt-key-refresh-interval",
+					EnvVar: "JWT_KEY_REFRESH_INTERVAL",
+					Usage:  "The interval at which the public keys of the galaxy server are refreshed",
+					Value:  24 * time.Hour,
+				},
 				cli.StringFlag{
 					Name:   "jwt-secret",
 					EnvVar: "JWT_SECRET",
@@ -65,6 +243,22 @@ func main() {
 					Usage:  "The jwt secret to use for authenticating the proxy",
 					Value:  "some-proxy-secret",
 				},
+				cli.StringFlag{
+					Name:   "jwt-proxy-previous-secret",
+					EnvVar: "JWT_PROXY_PREVIOUS_SECRET",
+					Usage:  "The proxy secret used before the last rotation. It is accepted for the grace period",
+				},
+				cli.DurationFlag{
+					Name:   "jwt-proxy-secret-grace-period",
+					EnvVar: "JWT_PROXY_SECRET_GRACE_PERIOD",
+					Usage:  "The duration the previous proxy secret is accepted for. Defaults to the ttl of the proxy tokens",
+				},
+				cli.DurationFlag{
+					Name:   "jwt-proxy-token-ttl",
+					EnvVar: "JWT_PROXY_TOKEN_TTL",
+					Usage:  "The duration the tokens of the metrics proxies are valid for",
+					Value:  24 * time.Hour,
+				},
 
 				// Driver config
 				cli.StringFlag{
@@ -120,6 +314,69 @@ func main() {
 					Usage:  "The token to be used for authentication",
 					EnvVar: "TOKEN",
 				},
+				cli.BoolFlag{
+					Name:   "tls",
+					Usage:  "Connect to the runner over tls",
+					EnvVar: "TLS",
+				},
+				cli.StringFlag{
+					Name:   "tls-cert-file",
+					EnvVar: "TLS_CERT_FILE",
+					Usage:  "The path of the client certificate to authenticate with instead of the token",
+				},
+				cli.StringFlag{
+					Name:   "tls-key-file",
+					EnvVar: "TLS_KEY_FILE",
+					Usage:  "The path of the private key of the tls certificate",
+				},
+				cli.StringFlag{
+					Name:   "tls-ca-file",
+					EnvVar: "TLS_CA_FILE",
+					Usage:  "The path of the authorities used to verify the certificate of the runner. The system roots are used if not provided",
+				},
+				cli.DurationFlag{
+					Name:   "tls-reload-interval",
+					EnvVar: "TLS_RELOAD_INTERVAL",
+					Usage:  "The interval at which the tls files are checked for changes",
+					Value:  time.Minute,
+				},
+				cli.StringFlag{
+					Name:   "source",
+					Usage:  "The source to scrape metrics from [envoy | prometheus | file]",
+					EnvVar: "SOURCE",
+					Value:  string(proxy.SourceEnvoy),
+				},
+				cli.StringFlag{
+					Name:   "source-addr",
+					Usage:  "The url of the envoy admin api or the prometheus endpoint, or the path of the metrics file. Node agents default to the prometheus endpoint of the istio sidecar for envoy",
+					EnvVar: "SOURCE_ADDR",
+				},
+				cli.StringFlag{
+					Name:   "filter",
+					Usage:  "A regular expression to select the metrics to be scraped",
+					EnvVar: "FILTER",
+				},
+				cli.DurationFlag{
+					Name:   "interval",
+					Usage:  "The interval at which metrics are scraped",
+					EnvVar: "INTERVAL",
+					Value:  time.Second,
+				},
+				cli.BoolFlag{
+					Name:   "node-agent",
+					Usage:  "Run as a node agent which scrapes the metrics of all the galaxy pods on the node",
+					EnvVar: "NODE_AGENT",
+				},
+				cli.StringFlag{
+					Name:   "node-name",
+					Usage:  "The name of the node the agent is running on",
+					EnvVar: "NODE_NAME",
+				},
+				cli.StringFlag{
+					Name:   "kube-config",
+					Usage:  "The path of the kube config file used by the node agent. The in-cluster config is used if not provided",
+					EnvVar: "KUBE_CONFIG",
+				},
 				cli.StringFlag{
 					Name:   "log-level",
 					EnvVar: "LOG_LEVEL",
@@ -139,6 +396,147 @@ func main() {
 					EnvVar: "PORT",
 					Value:  "4050",
 				},
+				cli.DurationFlag{
+					Name:   "shutdown-timeout",
+					EnvVar: "SHUTDOWN_TIMEOUT",
+					Usage:  "The time given to in-flight requests to complete on shutdown",
+					Value:  30 * time.Second,
+				},
+				cli.StringFlag{
+					Name:   "tls-cert-file",
+					EnvVar: "TLS_CERT_FILE",
+					Usage:  "The path of the certificate to serve over tls",
+				},
+				cli.StringFlag{
+					Name:   "tls-key-file",
+					EnvVar: "TLS_KEY_FILE",
+					Usage:  "The path of the private key of the tls certificate",
+				},
+				cli.StringFlag{
+					Name:   "tls-ca-file",
+					EnvVar: "TLS_CA_FILE",
+					Usage:  "The path of the authorities used to verify client certificates",
+				},
+				cli.DurationFlag{
+					Name:   "tls-reload-interval",
+					EnvVar: "TLS_RELOAD_INTERVAL",
+					Usage:  "The interval at which the tls files are checked for changes",
+					Value:  time.Minute,
+				},
+
+				// CORS config
+				cli.StringSliceFlag{
+					Name:   "cors-allowed-origins",
+					EnvVar: "CORS_ALLOWED_ORIGINS",
+					Usage:  "The origins allowed to make cross origin requests. Use * to allow all origins without credentials",
+				},
+				cli.StringSliceFlag{
+					Name:   "cors-allowed-methods",
+					EnvVar: "CORS_ALLOWED_METHODS",
+					Usage:  "The methods allowed in cross origin requests (default: GET, PUT, POST, DELETE)",
+				},
+				cli.StringSliceFlag{
+					Name:   "cors-allowed-headers",
+					EnvVar: "CORS_ALLOWED_HEADERS",
+					Usage:  "The headers allowed in cross origin requests (default: Authorization, Content-Type)",
+				},
+				cli.DurationFlag{
+					Name:   "cors-max-age",
+					EnvVar: "CORS_MAX_AGE",
+					Usage:  "The duration the results of a preflight request can be cached for",
+					Value:  10 * time.Minute,
+				},
+
+				// Store config
+				cli.StringFlag{
+					Name:   "data-dir",
+					EnvVar: "DATA_DIR",
+					Usage:  "The directory in which the server persists its state",
+					Value:  "/var/lib/galaxy",
+				},
+				cli.StringFlag{
+					Name:   "store",
+					EnvVar: "STORE",
+					Usage:  "The store to use for the accounts, projects, environments and clusters [ badger ]",
+					Value:  "badger",
+				},
+				cli.DurationFlag{
+					Name:   "audit-retention",
+					EnvVar: "AUDIT_RETENTION",
+					Usage:  "The duration the audit log entries are retained for",
+					Value:  90 * 24 * time.Hour,
+				},
+
+				// JWT config
+				cli.StringFlag{
+					Name:   "jwt-secret",
+					EnvVar: "JWT_SECRET",
+					Usage:  "The jwt secret used to sign the tokens issued on login with HS256. The server signs the tokens with its own RSA keys if not provided",
+				},
+				cli.DurationFlag{
+					Name:   "jwt-token-ttl",
+					EnvVar: "JWT_TOKEN_TTL",
+					Usage:  "The duration the tokens issued on login are valid for",
+					Value:  24 * time.Hour,
+				},
+				cli.DurationFlag{
+					Name:   "jwt-key-rotation-interval",
+					EnvVar: "JWT_KEY_ROTATION_INTERVAL",
+					Usage:  "The duration after which the RSA key used to sign tokens gets replaced",
+					Value:  30 * 24 * time.Hour,
+				},
+				cli.DurationFlag{
+					Name:   "jwt-key-grace-period",
+					EnvVar: "JWT_KEY_GRACE_PERIOD",
+					Usage:  "The duration a replaced RSA key continues to be published for. Defaults to the token ttl",
+				},
+
+				// Deployments
+				cli.IntFlag{
+					Name:   "deploy-attempts",
+					EnvVar: "DEPLOY_ATTEMPTS",
+					Usage:  "The number of times a service is applied to the runner of a cluster before giving up",
+					Value:  3,
+				},
+				cli.DurationFlag{
+					Name:   "deploy-retry-backoff",
+					EnvVar: "DEPLOY_RETRY_BACKOFF",
+					Usage:  "The duration to wait before retrying to apply a service. It doubles with every attempt",
+					Value:  2 * time.Second,
+				},
+				cli.DurationFlag{
+					Name:   "deploy-timeout",
+					EnvVar: "DEPLOY_TIMEOUT",
+					Usage:  "The duration after which a deployment to the clusters of an environment is abandoned",
+					Value:  5 * time.Minute,
+				},
+
+				// Logins
+				cli.IntFlag{
+					Name:   "login-attempts",
+					EnvVar: "LOGIN_ATTEMPTS",
+					Usage:  "The number of failed logins from a client ip after which further logins are rejected. Logins of a username are slowed down instead.",
+					Value:  5,
+				},
+				cli.DurationFlag{
+					Name:   "login-lockout",
+					EnvVar: "LOGIN_LOCKOUT",
+					Usage:  "The duration logins from a client ip are rejected for once the attempts have failed",
+					Value:  15 * time.Minute,
+				},
+
+				// Admin account
+				cli.StringFlag{
+					Name:   "admin-user",
+					EnvVar: "ADMIN_USER",
+					Usage:  "The username of the admin account created if the server doesn't have any accounts yet",
+					Value:  "admin",
+				},
+				cli.StringFlag{
+					Name:   "admin-key",
+					EnvVar: "ADMIN_KEY",
+					Usage:  "The access key of the admin account created if the server doesn't have any accounts yet",
+				},
 				cli.StringFlag{
 					Name:   "log-level",
 					EnvVar: "LOG_LEVEL",
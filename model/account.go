@@ -0,0 +1,43 @@
+package model
+
+// UserAccount describes an account of the galaxy server. Only the hash of its access key is stored.
+type UserAccount struct {
+	ID           string   `json:"id" yaml:"id"`
+	UserName     string   `json:"username" yaml:"username"`
+	Role         string   `json:"role" yaml:"role"`
+	Projects     []string `json:"projects,omitempty" yaml:"projects,omitempty"`
+	Environments []string `json:"envs,omitempty" yaml:"envs,omitempty"`
+
+	// Unix timestamp
+	CreatedAt int64 `json:"createdAt" yaml:"createdAt"`
+
+	Hash string `json:"hash,omitempty" yaml:"hash,omitempty"`
+}
+
+// UserAccountRequest is the request to create or update an account
+type UserAccountRequest struct {
+	UserName     string   `json:"username"`
+	Role         string   `json:"role"`
+	Projects     []string `json:"projects"`
+	Environments []string `json:"envs"`
+}
+
+// UserAccountResponse holds the access key of an account. The key itself is only returned once.
+type UserAccountResponse struct {
+	Key     string       `json:"key"`
+	Account *UserAccount `json:"account"`
+}
+
+// LoginRequest is the request to log in to the galaxy server
+type LoginRequest struct {
+	UserName string `json:"username"`
+	Key      string `json:"key"`
+}
+
+// EnvironmentConfig describes an environment of a project and the clusters it is deployed to
+type EnvironmentConfig struct {
+	ID        string   `json:"id" yaml:"id"`
+	Name      string   `json:"name" yaml:"name"`
+	ProjectID string   `json:"projectId" yaml:"projectId"`
+	Clusters  []string `json:"clusters" yaml:"clusters"`
+}
@@ -0,0 +1,34 @@
+package model
+
+// APIKey describes a key used by pipelines to access a single project. Only the hash of the secret part of the key
+// is stored.
+type APIKey struct {
+	ID           string   `json:"id" yaml:"id"`
+	Name         string   `json:"name" yaml:"name"`
+	Project      string   `json:"project" yaml:"project"`
+	Environments []string `json:"envs,omitempty" yaml:"envs,omitempty"`
+	Role         string   `json:"role" yaml:"role"`
+
+	// Unix timestamps. Keys without an expiry are valid till they are revoked.
+	CreatedAt int64 `json:"createdAt" yaml:"createdAt"`
+	ExpiresAt int64 `json:"expiresAt,omitempty" yaml:"expiresAt,omitempty"`
+
+	Hash string `json:"hash,omitempty" yaml:"hash,omitempty"`
+}
+
+// APIKeyRequest is the request to create an api key
+type APIKeyRequest struct {
+	Name         string   `json:"name"`
+	Project      string   `json:"project"`
+	Environments []string `json:"envs"`
+	Role         string   `json:"role"`
+
+	// The duration the key is valid for, e.g. 720h. The key never expires if not provided.
+	ExpiresIn string `json:"expiresIn"`
+}
+
+// APIKeyResponse holds the created key. The key itself is only returned once.
+type APIKeyResponse struct {
+	Key    string  `json:"key"`
+	APIKey *APIKey `json:"apiKey"`
+}
@@ -0,0 +1,39 @@
+package model
+
+// AuditEntry records a single mutating operation
+type AuditEntry struct {
+	ID string `json:"id"`
+
+	// Unix timestamp in milliseconds
+	Ts int64 `json:"ts"`
+
+	// The user or api key which performed the operation. It is empty if the request could not be authenticated.
+	Actor string `json:"actor"`
+	Role  string `json:"role,omitempty"`
+
+	// The operation and the resource it was performed on
+	Action      string `json:"action"`
+	Project     string `json:"project,omitempty"`
+	Environment string `json:"env,omitempty"`
+	Target      string `json:"target,omitempty"`
+
+	// The request and its outcome. The digest is the sha256 hash of the request body.
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	RemoteAddr string `json:"remoteAddr"`
+	Digest     string `json:"digest,omitempty"`
+	Status     int    `json:"status"`
+	Result     string `json:"result"`
+	Error      string `json:"error,omitempty"`
+}
+
+// AuditQuery filters the audit entries
+type AuditQuery struct {
+	// Unix timestamps in milliseconds
+	From, To int64
+
+	Actor, Action, Project string
+
+	// The maximum number of entries to return. All the matching entries are returned if zero.
+	Limit int
+}
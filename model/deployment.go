@@ -0,0 +1,49 @@
+package model
+
+// DeploymentStatus describes the progress of a deployment
+type DeploymentStatus string
+
+const (
+	// DeploymentPending is used while the service is being applied
+	DeploymentPending DeploymentStatus = "pending"
+
+	// DeploymentSucceeded is used once the service has been applied
+	DeploymentSucceeded DeploymentStatus = "succeeded"
+
+	// DeploymentFailed is used if the service could not be applied
+	DeploymentFailed DeploymentStatus = "failed"
+
+	// DeploymentPartial is used if the service was applied to some of the clusters only
+	DeploymentPartial DeploymentStatus = "partial"
+)
+
+// Deployment describes the rollout of a service to the clusters of an environment
+type Deployment struct {
+	ID          string               `json:"id"`
+	ProjectID   string               `json:"projectId"`
+	Environment string               `json:"env"`
+	ServiceID   string               `json:"serviceId"`
+	Version     string               `json:"version"`
+	Actor       string               `json:"actor"`
+	Status      DeploymentStatus     `json:"status"`
+	Clusters    []*ClusterDeployment `json:"clusters"`
+
+	// The service applied to the clusters. It is kept for retrying the deployment and isn't handed out.
+	Service *Service `json:"service,omitempty"`
+
+	// Unix timestamps in milliseconds
+	CreatedAt   int64 `json:"createdAt"`
+	CompletedAt int64 `json:"completedAt,omitempty"`
+}
+
+// ClusterDeployment describes the rollout of a service to the runner of a single cluster
+type ClusterDeployment struct {
+	ClusterID string           `json:"clusterId"`
+	URL       string           `json:"url"`
+	Status    DeploymentStatus `json:"status"`
+	Attempts  int              `json:"attempts"`
+
+	// The status code of the last response of the runner and the error of the last attempt
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
@@ -0,0 +1,397 @@
+package model
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// ProtocolBinary is the websocket sub protocol used by proxies to send batches of messages encoded as protobuf frames.
+// Proxies which don't negotiate it send a json encoded ProxyMessage per websocket message instead.
+const ProtocolBinary = "galaxy.v2"
+
+// ProtocolVersion is the version of the frames sent over the binary protocol
+const ProtocolVersion = 2
+
+const (
+	// MaxBatchSize is the maximum number of messages sent in a single frame
+	MaxBatchSize = 500
+
+	// MaxMessageSize is the maximum size of an encoded message. The meta data and the status codes of a message take
+	// up a few hundred bytes at most.
+	MaxMessageSize = 4 << 10
+
+	// MaxFrameSize is the maximum size of a frame carrying a full batch
+	MaxFrameSize = MaxBatchSize * MaxMessageSize
+)
+
+// Frame is a single message of the binary protocol. Proxies send batches of messages identified by a sequence number.
+// The runner acknowledges each batch once it has been stored by replying with a frame with the ack flag set.
+//
+// Frames are encoded in the protobuf wire format as described by the following schema:
+//
+//	message Frame {
+//	  uint32 version = 1;
+//	  uint64 seq = 2;
+//	  bool ack = 3;
+//	  repeated ProxyMessage messages = 4;
+//	}
+//	message ProxyMessage {
+//	  int32 active = 1;
+//	  string project = 2;
+//	  string service = 3;
+//	  string env = 4;
+//	  string id = 5;
+//	  string version = 6;
+//	  ProxyMetrics metrics = 7;
+//	}
+//	message ProxyMetrics {
+//	  uint64 requests = 1;
+//	  map<string, uint64> status_codes = 2;
+//	  LatencySummary latency = 3;
+//	  uint64 active_connections = 4;
+//	  uint64 connections = 5;
+//	  uint64 interval = 6;
+//	}
+//	message LatencySummary {
+//	  double p50 = 1;
+//	  double p95 = 2;
+//	  double p99 = 3;
+//	}
+type Frame struct {
+	Version  uint32
+	Seq      uint64
+	Ack      bool
+	Messages []*ProxyMessage
+}
+
+// The protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errInvalidFrame = errors.New("invalid frame")
+
+// Marshal encodes the frame in the protobuf wire format
+func (f *Frame) Marshal() []byte {
+	e := new(encoder)
+	e.varint(1, uint64(f.Version))
+	e.varint(2, f.Seq)
+	if f.Ack {
+		e.varint(3, 1)
+	}
+	for _, m := range f.Messages {
+		e.bytes(4, marshalProxyMessage(m))
+	}
+	return e.buf
+}
+
+// Unmarshal decodes a frame encoded in the protobuf wire format
+func (f *Frame) Unmarshal(data []byte) error {
+	return decode(data, func(field int, d *decoder) error {
+		switch field {
+		case 1:
+			v, err := d.varint()
+			f.Version = uint32(v)
+			return err
+		case 2:
+			v, err := d.varint()
+			f.Seq = v
+			return err
+		case 3:
+			v, err := d.varint()
+			f.Ack = v != 0
+			return err
+		case 4:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			m := new(ProxyMessage)
+			if err := unmarshalProxyMessage(b, m); err != nil {
+				return err
+			}
+			f.Messages = append(f.Messages, m)
+			return nil
+		}
+		return d.skip()
+	})
+}
+
+func marshalProxyMessage(m *ProxyMessage) []byte {
+	e := new(encoder)
+	e.varint(1, uint64(int64(m.ActiveRequests)))
+	e.string(2, m.Project)
+	e.string(3, m.Service)
+	e.string(4, m.Environment)
+	e.string(5, m.NodeID)
+	e.string(6, m.Version)
+	if m.Metrics != nil {
+		e.bytes(7, marshalProxyMetrics(m.Metrics))
+	}
+	return e.buf
+}
+
+func unmarshalProxyMessage(data []byte, m *ProxyMessage) error {
+	return decode(data, func(field int, d *decoder) error {
+		var err error
+		switch field {
+		case 1:
+			var v uint64
+			v, err = d.varint()
+			m.ActiveRequests = int32(int64(v))
+		case 2:
+			m.Project, err = d.string()
+		case 3:
+			m.Service, err = d.string()
+		case 4:
+			m.Environment, err = d.string()
+		case 5:
+			m.NodeID, err = d.string()
+		case 6:
+			m.Version, err = d.string()
+		case 7:
+			var b []byte
+			if b, err = d.bytes(); err == nil {
+				m.Metrics = new(ProxyMetrics)
+				err = unmarshalProxyMetrics(b, m.Metrics)
+			}
+		default:
+			err = d.skip()
+		}
+		return err
+	})
+}
+
+func marshalProxyMetrics(m *ProxyMetrics) []byte {
+	e := new(encoder)
+	e.varint(1, m.Requests)
+
+	// Encode the map in a stable order
+	codes := make([]string, 0, len(m.StatusCodes))
+	for code := range m.StatusCodes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		entry := new(encoder)
+		entry.string(1, code)
+		entry.varint(2, m.StatusCodes[code])
+		e.bytes(2, entry.buf)
+	}
+
+	if m.Latency != nil {
+		latency := new(encoder)
+		latency.double(1, m.Latency.P50)
+		latency.double(2, m.Latency.P95)
+		latency.double(3, m.Latency.P99)
+		e.bytes(3, latency.buf)
+	}
+	e.varint(4, m.ActiveConnections)
+	e.varint(5, m.Connections)
+	if m.Interval != 0 {
+		e.varint(6, m.Interval)
+	}
+	return e.buf
+}
+
+func unmarshalProxyMetrics(data []byte, m *ProxyMetrics) error {
+	return decode(data, func(field int, d *decoder) error {
+		var err error
+		switch field {
+		case 1:
+			m.Requests, err = d.varint()
+		case 2:
+			var b []byte
+			if b, err = d.bytes(); err != nil {
+				return err
+			}
+			var code string
+			var count uint64
+			err = decode(b, func(field int, d *decoder) error {
+				var err error
+				switch field {
+				case 1:
+					code, err = d.string()
+				case 2:
+					count, err = d.varint()
+				default:
+					err = d.skip()
+				}
+				return err
+			})
+			if m.StatusCodes == nil {
+				m.StatusCodes = map[string]uint64{}
+			}
+			m.StatusCodes[code] = count
+		case 3:
+			var b []byte
+			if b, err = d.bytes(); err != nil {
+				return err
+			}
+			m.Latency = new(LatencySummary)
+			err = decode(b, func(field int, d *decoder) error {
+				var err error
+				switch field {
+				case 1:
+					m.Latency.P50, err = d.double()
+				case 2:
+					m.Latency.P95, err = d.double()
+				case 3:
+					m.Latency.P99, err = d.double()
+				default:
+					err = d.skip()
+				}
+				return err
+			})
+		case 4:
+			m.ActiveConnections, err = d.varint()
+		case 5:
+			m.Connections, err = d.varint()
+		case 6:
+			m.Interval, err = d.varint()
+		default:
+			err = d.skip()
+		}
+		return err
+	})
+}
+
+// encoder writes fields in the protobuf wire format. Fields with default values are omitted like protobuf does.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	e.buf = append(e.buf, b[:n]...)
+}
+
+func (e *encoder) tag(field, wireType int) {
+	e.uvarint(uint64(field<<3 | wireType))
+}
+
+func (e *encoder) varint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.uvarint(v)
+}
+
+func (e *encoder) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireFixed64)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) bytes(field int, b []byte) {
+	e.tag(field, wireBytes)
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	e.bytes(field, []byte(s))
+}
+
+// decoder reads fields in the protobuf wire format
+type decoder struct {
+	buf      []byte
+	wireType int
+}
+
+// decode invokes the callback for every field in the data. The callback must consume the value of the field.
+func decode(data []byte, cb func(field int, d *decoder) error) error {
+	d := &decoder{buf: data}
+	for len(d.buf) > 0 {
+		tag, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		d.wireType = int(tag & 7)
+		if err := cb(int(tag>>3), d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *decoder) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		return 0, errInvalidFrame
+	}
+	d.buf = d.buf[n:]
+	return v, nil
+}
+
+func (d *decoder) varint() (uint64, error) {
+	if d.wireType != wireVarint {
+		return 0, errInvalidFrame
+	}
+	return d.uvarint()
+}
+
+func (d *decoder) double() (float64, error) {
+	if d.wireType != wireFixed64 || len(d.buf) < 8 {
+		return 0, errInvalidFrame
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(d.buf))
+	d.buf = d.buf[8:]
+	return v, nil
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	if d.wireType != wireBytes {
+		return nil, errInvalidFrame
+	}
+	n, err := d.uvarint()
+	if err != nil || uint64(len(d.buf)) < n {
+		return nil, errInvalidFrame
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b, nil
+}
+
+func (d *decoder) string() (string, error) {
+	b, err := d.bytes()
+	return string(b), err
+}
+
+// skip discards the value of an unknown field so that newer frames can be read by older runners
+func (d *decoder) skip() error {
+	switch d.wireType {
+	case wireVarint:
+		_, err := d.uvarint()
+		return err
+	case wireFixed64, wireFixed32:
+		n := 8
+		if d.wireType == wireFixed32 {
+			n = 4
+		}
+		if len(d.buf) < n {
+			return errInvalidFrame
+		}
+		d.buf = d.buf[n:]
+		return nil
+	case wireBytes:
+		_, err := d.bytes()
+		return err
+	default:
+		return errInvalidFrame
+	}
+}
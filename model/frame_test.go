@@ -0,0 +1,62 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFrame_Marshal(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame *Frame
+	}{
+		{name: "ack", frame: &Frame{Version: ProtocolVersion, Seq: 42, Ack: true}},
+		{
+			name: "batch",
+			frame: &Frame{Version: ProtocolVersion, Seq: 7, Messages: []*ProxyMessage{
+				{ActiveRequests: 3, Project: "p1", Service: "s1", Environment: "production", NodeID: "n1", Version: "v1"},
+				{ActiveRequests: -1, Metrics: &ProxyMetrics{
+					Requests:          100,
+					StatusCodes:       map[string]uint64{"2xx": 90, "5xx": 10},
+					Latency:           &LatencySummary{P50: 1.5, P95: 20, P99: 45.25},
+					ActiveConnections: 4,
+					Connections:       2,
+					Interval:          5000,
+				}},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := new(Frame)
+			if err := got.Unmarshal(tt.frame.Marshal()); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.frame) {
+				t.Errorf("Unmarshal() = %+v, want %+v", got, tt.frame)
+			}
+		})
+	}
+}
+
+func TestFrame_Unmarshal(t *testing.T) {
+	// Frames of newer versions may carry fields unknown to this version
+	e := new(encoder)
+	e.varint(1, ProtocolVersion+1)
+	e.varint(2, 5)
+	e.string(15, "unknown")
+	e.double(16, 1)
+	e.varint(17, 1)
+
+	f := new(Frame)
+	if err := f.Unmarshal(e.buf); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if f.Seq != 5 {
+		t.Errorf("Unmarshal() seq = %d, want 5", f.Seq)
+	}
+
+	if err := f.Unmarshal(e.buf[:len(e.buf)-5]); err == nil {
+		t.Error("Unmarshal() did not return an error for a truncated frame")
+	}
+}
@@ -4,3 +4,42 @@ package model
 type PublicKeyPayload struct {
 	PemData string `json:"pem"`
 }
+
+// JWKS is a json web key set as described by RFC 7517
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is a single public key in a json web key set
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+
+	// For rsa keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// For elliptic curve and edwards curve keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// PublicKeySet holds the public keys of the galaxy server both as pem blocks and as a json web key set
+type PublicKeySet struct {
+	JWKS
+	PublicKeyPayload
+}
+
+// SigningKey is a key pair the galaxy server signs tokens with
+type SigningKey struct {
+	ID         string `json:"id"`
+	PrivateKey string `json:"privateKey"` // pem encoded
+	CreatedAt  int64  `json:"createdAt"`
+
+	// The time the key stopped signing new tokens. Retired keys continue to be published till the tokens signed
+	// with them have expired.
+	RetiredAt int64 `json:"retiredAt,omitempty"`
+}
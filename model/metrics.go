@@ -0,0 +1,19 @@
+package model
+
+// MetricsQueryResponse is the response of the metrics query api
+type MetricsQueryResponse struct {
+	Project     string        `json:"project"`
+	Service     string        `json:"service"`
+	Environment string        `json:"env"`
+	Version     string        `json:"version"`
+	Resolution  string        `json:"resolution"`
+	Step        int64         `json:"step"`
+	Points      []MetricPoint `json:"points"`
+}
+
+// MetricPoint is a single downsampled data point of the active requests of a service
+type MetricPoint struct {
+	Ts  int64   `json:"ts"`
+	Avg float64 `json:"avg"`
+	Max int32   `json:"max"`
+}
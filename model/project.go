@@ -2,5 +2,6 @@ package model
 
 // Project describes the configuration of a project
 type Project struct {
-	ID string `json:"id" yaml:"id"`
+	ID   string `json:"id" yaml:"id"`
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
 }
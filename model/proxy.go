@@ -1,13 +1,50 @@
 package model
 
+// The annotations set on the pods of a service to let the node agents identify the service they belong to. The id
+// and version of the service are present in the `app` and `version` labels.
+const (
+	AnnotationProject     = "galaxy.spaceuptech.com/project"
+	AnnotationEnvironment = "galaxy.spaceuptech.com/env"
+)
+
 // ProxyMessage is the payload send by the proxy
 type ProxyMessage struct {
-	ActiveRequests int32  `json:"active,omitempty"`
-	Project        string `json:"project,omitempty"`
-	Service        string `json:"service,omitempty"`
-	Environment    string `json:"env,omitempty"`
-	NodeID         string `json:"id,omitempty"`
-	Version        string `json:"version,omitempty"`
+	ActiveRequests int32         `json:"active,omitempty"`
+	Project        string        `json:"project,omitempty"`
+	Service        string        `json:"service,omitempty"`
+	Environment    string        `json:"env,omitempty"`
+	NodeID         string        `json:"id,omitempty"`
+	Version        string        `json:"version,omitempty"`
+	Metrics        *ProxyMetrics `json:"metrics,omitempty"`
+}
+
+// ProxyMetrics describes the detailed metrics collected by the proxy over a single collection interval. Counts are
+// the number of events which occurred in the interval. The interval is in milliseconds. Proxies which don't report it
+// collect metrics every second.
+type ProxyMetrics struct {
+	Requests          uint64            `json:"requests"`
+	StatusCodes       map[string]uint64 `json:"statusCodes,omitempty"`
+	Latency           *LatencySummary   `json:"latency,omitempty"`
+	ActiveConnections uint64            `json:"activeConnections"`
+	Connections       uint64            `json:"connections"`
+	Interval          uint64            `json:"interval,omitempty"`
+}
+
+// LatencySummary describes the request latency quantiles in milliseconds
+type LatencySummary struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+// ServiceStats describes the aggregated metrics of all the instances of a service
+type ServiceStats struct {
+	RequestsPerSecond    float64            `json:"rps"`
+	StatusCodes          map[string]float64 `json:"statusCodes,omitempty"`
+	Latency              *LatencySummary    `json:"latency,omitempty"`
+	ActiveConnections    float64            `json:"activeConnections"`
+	ConnectionsPerSecond float64            `json:"cps"`
+	Ts                   int64              `json:"ts"`
 }
 
 // EnvoyMetrics is the metrics collected from envoy
@@ -15,8 +52,38 @@ type EnvoyMetrics struct {
 	Stats []EnvoyStat `json:"stats"`
 }
 
-// EnvoyStat describes the stats received from envoy
+// EnvoyStat describes the stats received from envoy. The histograms are sent as a separate entry in the stats.
 type EnvoyStat struct {
-	Name  string `json:"name"`
-	Value uint64 `json:"value"`
+	Name       string           `json:"name"`
+	Value      uint64           `json:"value"`
+	Histograms *EnvoyHistograms `json:"histograms,omitempty"`
+}
+
+// EnvoyHistograms describes the quantiles computed by envoy for each histogram
+type EnvoyHistograms struct {
+	SupportedQuantiles []float64                `json:"supported_quantiles"`
+	ComputedQuantiles  []EnvoyComputedQuantiles `json:"computed_quantiles"`
+}
+
+// EnvoyComputedQuantiles describes the values of the supported quantiles of a histogram
+type EnvoyComputedQuantiles struct {
+	Name   string                `json:"name"`
+	Values []EnvoyQuantileValues `json:"values"`
+}
+
+// EnvoyQuantileValues describes the value of a quantile in the last interval and since envoy started. The values are
+// null when no samples have been recorded.
+type EnvoyQuantileValues struct {
+	Interval   *float64 `json:"interval"`
+	Cumulative *float64 `json:"cumulative"`
+}
+
+// ProxyToken is the token issued to a metrics proxy
+type ProxyToken struct {
+	Token string `json:"token"`
+}
+
+// ProxyRevocation identifies the proxy whose tokens need to be revoked
+type ProxyRevocation struct {
+	ID string `json:"id"`
 }
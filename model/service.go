@@ -15,6 +15,10 @@ type Service struct {
 	Upstreams   []Upstream        `json:"upstreams" yaml:"upstreams"`
 	Runtime     Runtime           `json:"runtime" yaml:"runtime"`
 	Expose      *Expose           `json:"expose" yaml:"expose"`
+
+	// Traffic splits the traffic between the versions of the service in percent. The weights need to add up to 100.
+	// The existing routing is left untouched if no split is provided.
+	Traffic map[string]int32 `json:"traffic,omitempty" yaml:"traffic,omitempty"`
 }
 
 // ScaleConfig describes the config used to scale a service
@@ -131,3 +135,25 @@ type ActionCode struct {
 	Service  *Service `json:"service" yaml:"service"`
 	IsDeploy bool     `json:"isdeploy" yaml:"isdeploy"`
 }
+
+// ScaleDecision describes the last scale decision made by the autoscaler for a service
+type ScaleDecision struct {
+	ActiveRequests int32 `json:"activeRequests" yaml:"activeRequests"`
+	Ts             int64 `json:"ts" yaml:"ts"`
+}
+
+// ServiceStatus describes the current status of a service on the deployment target
+type ServiceStatus struct {
+	Replicas          int32 `json:"replicas"`
+	ReadyReplicas     int32 `json:"readyReplicas"`
+	AvailableReplicas int32 `json:"availableReplicas"`
+	Traffic           int32 `json:"traffic"`
+}
+
+// ServiceState describes the persisted state of a service applied through a runner
+type ServiceState struct {
+	Service *Service       `json:"service" yaml:"service"`
+	Scale   *ScaleDecision `json:"scale,omitempty" yaml:"scale,omitempty"`
+	Status  *ServiceStatus `json:"status,omitempty" yaml:"status,omitempty"`
+	Stats   *ServiceStats  `json:"stats,omitempty" yaml:"stats,omitempty"`
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	coreListers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// The placeholder in the source address which gets replaced with the ip of each pod in the node agent mode
+const podIPPlaceholder = "{pod_ip}"
+
+// agent discovers the pods of galaxy services running on a node and scrapes the metrics of each of them. It lets a
+// single proxy per node collect the metrics of all the services instead of running one alongside every pod.
+type agent struct {
+	config *Config
+
+	factory informers.SharedInformerFactory
+	pods    coreListers.PodLister
+
+	// The sources of the pods discovered so far
+	sources map[types.UID]*podSource
+}
+
+// podSource is the source of the metrics of a single pod
+type podSource struct {
+	meta   model.ProxyMessage
+	source source
+}
+
+func newKubeClient(kubeConfigPath string) (kubernetes.Interface, error) {
+	var restConfig *rest.Config
+	var err error
+
+	if kubeConfigPath == "" {
+		restConfig, err = rest.InClusterConfig()
+	} else {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", kubeConfigPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(restConfig)
+}
+
+func newAgent(c *Config, kube kubernetes.Interface) *agent {
+	// Only the pods of galaxy services running on this node are of interest
+	factory := informers.NewSharedInformerFactoryWithOptions(kube, 5*time.Minute, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.FieldSelector = "spec.nodeName=" + c.NodeName
+		options.LabelSelector = "app,version"
+	}))
+
+	return &agent{
+		config:  c,
+		factory: factory,
+		pods:    factory.Core().V1().Pods().Lister(),
+		sources: map[types.UID]*podSource{},
+	}
+}
+
+// start starts watching the pods and blocks till the initial list of pods has been received
+func (a *agent) start(stopCh <-chan struct{}) error {
+	a.factory.Start(stopCh)
+	for t, synced := range a.factory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return fmt.Errorf("could not sync cache of %v", t)
+		}
+	}
+	return nil
+}
+
+// scrape collects the metrics of all the pods on the node in parallel. The messages are tagged with the service and
+// the pod they belong to.
+func (a *agent) scrape() []*model.ProxyMessage {
+	a.syncSources()
+
+	var wg sync.WaitGroup
+	messages := make([]*model.ProxyMessage, 0, len(a.sources))
+	var lock sync.Mutex
+	for _, s := range a.sources {
+		wg.Add(1)
+		go func(s *podSource) {
+			defer wg.Done()
+
+			msg, err := s.source.scrape()
+			if err != nil {
+				logrus.Errorf("Could not scrape metrics of pod (%s) - %s", s.meta.NodeID, err.Error())
+				return
+			}
+			msg.NodeID, msg.Project, msg.Service, msg.Environment, msg.Version = s.meta.NodeID, s.meta.Project, s.meta.Service, s.meta.Environment, s.meta.Version
+
+			lock.Lock()
+			messages = append(messages, msg)
+			lock.Unlock()
+		}(s)
+	}
+	wg.Wait()
+
+	return messages
+}
+
+// syncSources creates a source for every new pod and removes the sources of the pods which are gone. The sources
+// are stateful, so they are retained for as long as the pod lives.
+func (a *agent) syncSources() {
+	pods, err := a.pods.List(labels.Everything())
+	if err != nil {
+		logrus.Errorln("Could not list pods:", err)
+		return
+	}
+
+	seen := make(map[types.UID]struct{}, len(pods))
+	for _, pod := range pods {
+		project, env := pod.Annotations[model.AnnotationProject], pod.Annotations[model.AnnotationEnvironment]
+		if pod.Status.Phase != v1.PodRunning || pod.Status.PodIP == "" || project == "" || env == "" {
+			continue
+		}
+		seen[pod.UID] = struct{}{}
+		if _, p := a.sources[pod.UID]; p {
+			continue
+		}
+
+		c := *a.config
+		c.SourceAddr = strings.Replace(c.SourceAddr, podIPPlaceholder, pod.Status.PodIP, -1)
+		s, err := newSource(&c)
+		if err != nil {
+			logrus.Errorf("Could not create metrics source for pod (%s) - %s", pod.Name, err.Error())
+			continue
+		}
+
+		logrus.Debugf("Discovered pod (%s) of service (%s:%s)", pod.Name, project, pod.Labels["app"])
+		a.sources[pod.UID] = &podSource{
+			meta:   model.ProxyMessage{NodeID: pod.Name, Project: project, Service: pod.Labels["app"], Environment: env, Version: pod.Labels["version"]},
+			source: s,
+		}
+	}
+
+	for uid := range a.sources {
+		if _, p := seen[uid]; !p {
+			delete(a.sources, uid)
+		}
+	}
+}
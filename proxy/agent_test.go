@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubeFake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+func newTestPod(name, node, service string, annotated bool) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "p1-production",
+			UID:       types.UID("uid-" + name),
+			Labels:    map[string]string{"app": service, "version": "v1"},
+		},
+		Spec:   v1.PodSpec{NodeName: node},
+		Status: v1.PodStatus{Phase: v1.PodRunning, PodIP: "127.0.0.1"},
+	}
+	if annotated {
+		pod.Annotations = map[string]string{model.AnnotationProject: "p1", model.AnnotationEnvironment: "production"}
+	}
+	return pod
+}
+
+func TestAgent_scrape(t *testing.T) {
+	envoy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`envoy_http_downstream_rq_active{http_conn_manager_prefix="inbound_0.0.0.0_8080"} 2`))
+	}))
+	defer envoy.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(envoy.URL, "http://"))
+
+	c := &Config{NodeAgent: true, NodeName: "node-1", SourceAddr: "http://" + podIPPlaceholder + ":" + port}
+	if err := c.setDefaults(); err != nil {
+		t.Fatalf("setDefaults() error = %v", err)
+	}
+
+	// Pods without the galaxy annotations are ignored
+	kube := kubeFake.NewSimpleClientset(
+		newTestPod("s1-abc", "node-1", "s1", true),
+		newTestPod("s2-def", "node-1", "s2", true),
+		newTestPod("other", "node-1", "s3", false),
+	)
+	a := newAgent(c, kube)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := a.start(stopCh); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+
+	messages := a.scrape()
+	if len(messages) != 2 {
+		t.Fatalf("scrape() returned %d messages, want 2", len(messages))
+	}
+	for _, msg := range messages {
+		if msg.Project != "p1" || msg.Environment != "production" || msg.Version != "v1" || msg.ActiveRequests != 2 {
+			t.Errorf("scrape() = %+v, want a tagged message of project p1", msg)
+		}
+		if !strings.HasPrefix(msg.NodeID, msg.Service) {
+			t.Errorf("scrape() node id = %s for service %s", msg.NodeID, msg.Service)
+		}
+	}
+
+	// The sources of the pods which are gone get removed
+	if err := kube.CoreV1().Pods("p1-production").Delete("s2-def", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && len(a.sources) != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+		a.syncSources()
+	}
+	if len(a.sources) != 1 {
+		t.Errorf("agent has %d sources after a pod was deleted, want 1", len(a.sources))
+	}
+}
+
+func TestConfig_nodeAgent(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *Config
+		want    string
+		wantErr bool
+	}{
+		{name: "envoy", config: &Config{NodeAgent: true, NodeName: "n1"}, want: "http://{pod_ip}:15090/stats/prometheus"},
+		{name: "prometheus", config: &Config{NodeAgent: true, NodeName: "n1", Source: SourcePrometheus}, want: "http://{pod_ip}:9090/metrics"},
+		{name: "missing node name", config: &Config{NodeAgent: true}, wantErr: true},
+		{name: "file source", config: &Config{NodeAgent: true, NodeName: "n1", Source: SourceFile, SourceAddr: "metrics"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.setDefaults()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setDefaults() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && tt.config.SourceAddr != tt.want {
+				t.Errorf("setDefaults() source address = %s, want %s", tt.config.SourceAddr, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"math"
+	"sync"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// buffer holds the messages which are yet to be sent to the runner. It is bounded in size. Once full, the oldest
+// samples are coalesced so that an outage of the runner doesn't make the proxy run out of memory.
+type buffer struct {
+	lock     sync.Mutex
+	size     int
+	messages []*model.ProxyMessage
+
+	// Signals the writer that messages are available
+	notify chan struct{}
+}
+
+func newBuffer(size int) *buffer {
+	return &buffer{size: size, notify: make(chan struct{}, 1)}
+}
+
+// add appends a message to the buffer and wakes up the writer
+func (b *buffer) add(msg *model.ProxyMessage) {
+	b.lock.Lock()
+	b.messages = append(b.messages, msg)
+	b.coalesce()
+	b.lock.Unlock()
+
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// requeue puts back the messages which could not be sent ahead of the ones received since
+func (b *buffer) requeue(messages []*model.ProxyMessage) {
+	if len(messages) == 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.messages = append(messages, b.messages...)
+	b.coalesce()
+}
+
+// drain removes and returns all the messages in the buffer
+func (b *buffer) drain() []*model.ProxyMessage {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	messages := b.messages
+	b.messages = nil
+	return messages
+}
+
+// coalesce merges the oldest samples till the buffer fits in its size. A sample is merged into the next sample of the
+// same series. The counters get added up while the larger gauges are retained so that the autoscaler never under
+// estimates the load on the service. The lock must be held by the caller.
+func (b *buffer) coalesce() {
+	for len(b.messages) > b.size && len(b.messages) > 1 {
+		first := b.messages[0]
+		b.messages = b.messages[1:]
+		for _, next := range b.messages {
+			if sameSeries(first, next) {
+				if first.ActiveRequests > next.ActiveRequests {
+					next.ActiveRequests = first.ActiveRequests
+				}
+				next.Metrics = mergeMetrics(first.Metrics, next.Metrics)
+				break
+			}
+		}
+	}
+}
+
+// mergeMetrics merges the metrics of an older sample into the ones of the next sample
+func mergeMetrics(prev, next *model.ProxyMetrics) *model.ProxyMetrics {
+	if prev == nil {
+		return next
+	}
+	if next == nil {
+		return prev
+	}
+
+	next.Requests += prev.Requests
+	next.Connections += prev.Connections
+	next.Interval += prev.Interval
+	if prev.ActiveConnections > next.ActiveConnections {
+		next.ActiveConnections = prev.ActiveConnections
+	}
+	for code, count := range prev.StatusCodes {
+		if next.StatusCodes == nil {
+			next.StatusCodes = map[string]uint64{}
+		}
+		next.StatusCodes[code] += count
+	}
+
+	// The quantiles of both the samples can't be combined, so the slower ones are retained
+	if prev.Latency != nil {
+		if next.Latency == nil {
+			next.Latency = &model.LatencySummary{}
+		}
+		next.Latency.P50 = math.Max(next.Latency.P50, prev.Latency.P50)
+		next.Latency.P95 = math.Max(next.Latency.P95, prev.Latency.P95)
+		next.Latency.P99 = math.Max(next.Latency.P99, prev.Latency.P99)
+	}
+	return next
+}
+
+// sameSeries returns true if both the messages belong to the same node of a service
+func sameSeries(a, b *model.ProxyMessage) bool {
+	return a.NodeID == b.NodeID && a.Project == b.Project && a.Service == b.Service && a.Environment == b.Environment && a.Version == b.Version
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spaceuptech/galaxy/utils/certs"
+)
+
+// SourceType is the type of source the proxy scrapes metrics from
+type SourceType string
+
+const (
+	// SourceEnvoy scrapes the admin api of the envoy sidecar
+	SourceEnvoy SourceType = "envoy"
+
+	// SourcePrometheus scrapes a prometheus text endpoint exposed by the service itself
+	SourcePrometheus SourceType = "prometheus"
+
+	// SourceFile reads the metrics from a file. The file may either contain the json stats of envoy or metrics in the
+	// prometheus text format. It is mainly useful for testing.
+	SourceFile SourceType = "file"
+)
+
+// Config describes the configuration of the proxy
+type Config struct {
+	// The address of the galaxy runner and the token to authenticate with it
+	Addr, Token string
+
+	// Connect to the runner over tls. The certificate of the runner is verified with the authorities of the ca file or
+	// the system roots if none is provided. The client certificate, if provided, is presented to the runner which
+	// accepts it in place of the token.
+	TLS   bool
+	Certs *certs.Config
+
+	// The source to scrape metrics from. The address is a url for the envoy and prometheus sources and a path for
+	// the file source.
+	Source     SourceType
+	SourceAddr string
+
+	// A regular expression to select the metrics of interest. It is passed on to the admin api for envoy and
+	// matched against the metric names for prometheus.
+	Filter string
+
+	// The interval at which metrics are scraped
+	Interval time.Duration
+
+	// In the node agent mode, the proxy scrapes all the galaxy pods on the node it is running on. The source
+	// address may contain a `{pod_ip}` placeholder which gets replaced with the ip of each pod. The admin api of
+	// envoy only listens on localhost, so envoy is scraped through the prometheus endpoint of the istio sidecar
+	// (port 15090) in this mode. The filter doesn't apply to it.
+	NodeAgent      bool
+	NodeName       string
+	KubeConfigPath string
+}
+
+func (c *Config) setDefaults() error {
+	if c.Source == "" {
+		c.Source = SourceEnvoy
+	}
+	if c.Interval == 0 {
+		c.Interval = time.Second
+	}
+
+	host := "localhost"
+	if c.NodeAgent {
+		if c.NodeName == "" {
+			return errors.New("name of the node needs to be provided in the node agent mode")
+		}
+		if c.Source == SourceFile {
+			return fmt.Errorf("the %s source cannot be used in the node agent mode", c.Source)
+		}
+		host = podIPPlaceholder
+	}
+
+	switch c.Source {
+	case SourceEnvoy:
+		if c.SourceAddr == "" && c.NodeAgent {
+			c.SourceAddr = "http://" + host + ":15090/stats/prometheus"
+		}
+		if c.SourceAddr == "" {
+			c.SourceAddr = "http://" + host + ":15000"
+		}
+		if c.Filter == "" {
+			c.Filter = envoyStatsFilter
+		}
+	case SourcePrometheus:
+		if c.SourceAddr == "" {
+			c.SourceAddr = "http://" + host + ":9090/metrics"
+		}
+	case SourceFile:
+		if c.SourceAddr == "" {
+			return fmt.Errorf("path of the metrics file needs to be provided for the %s source", c.Source)
+		}
+	default:
+		return fmt.Errorf("invalid metrics source (%s) provided", c.Source)
+	}
+	return nil
+}
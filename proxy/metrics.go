@@ -1,58 +1,53 @@
 package proxy
 
 import (
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"net/http"
+	"context"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/spaceuptech/galaxy/model"
-	"github.com/spaceuptech/galaxy/utils"
 )
 
-func (p *Proxy) collectMetrics() (*model.EnvoyMetrics, error) {
-	logrus.Debugln("Pulling metrics from envoy...")
-	res, err := http.Get("http://localhost:15000/stats?filter=(?=.*downstream_rq_total)(?=.*http.inbound)&format=json")
-	if err != nil {
-		return nil, err
-	}
-	defer utils.CloseReaderCloser(res.Body)
-
-	data, _ := ioutil.ReadAll(res.Body)
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("invalid response (status code: %d; body: %s) received from envoy", res.StatusCode, string(data))
-	}
+func (p *Proxy) routineCollectMetrics(ctx context.Context, duration time.Duration) {
+	ticker := time.NewTicker(duration)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
 
-	metrics := new(model.EnvoyMetrics)
-	if err := json.Unmarshal(data, metrics); err != nil {
-		return nil, err
-	}
+		// The runner calculates rates from the time covered by each sample. Ticks get dropped when scraping is slow.
+		interval := uint64(now.Sub(last) / time.Millisecond)
+		last = now
 
-	logrus.Debugln("Received metrics from envoy:", metrics)
-	return metrics, nil
-}
-
-func (p *Proxy) routineCollectMetrics(duration time.Duration) {
-	// This variable tracks the last req count
-	prevValue := uint64(0)
+		// The agent scrapes all the pods on the node
+		if p.agent != nil {
+			for _, msg := range p.agent.scrape() {
+				p.send(withInterval(msg, interval))
+			}
+			continue
+		}
 
-	ticker := time.NewTicker(duration)
-	for range ticker.C {
-		metrics, err := p.collectMetrics()
+		msg, err := p.source.scrape()
 		if err != nil {
-			logrus.Errorln("Could not pull metrics from envoy:", err)
+			logrus.Errorln("Could not scrape metrics:", err)
 			continue
 		}
 
-		// Calculate the number of requests which occurred between subsequent requests
-		count := metrics.Stats[0].Value - prevValue
-		prevValue = metrics.Stats[0].Value
+		// Send the proxy message
+		p.send(withInterval(msg, interval))
+	}
+}
 
-		// Prepare and send proxy message
-		message := &model.ProxyMessage{ActiveRequests: int32(count)}
-		p.ch <- message
+// withInterval sets the milliseconds covered by the metrics of the message
+func withInterval(msg *model.ProxyMessage, interval uint64) *model.ProxyMessage {
+	if msg.Metrics != nil {
+		msg.Metrics.Interval = interval
 	}
+	return msg
 }
@@ -1,74 +1,369 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 
 	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils/certs"
+)
+
+const (
+	// The time allowed to write a message to the runner
+	writeWait = 10 * time.Second
+
+	// The time allowed to read the next pong message from the runner
+	pongWait = 60 * time.Second
+
+	// The interval at which pings are sent to the runner. Must be less than pongWait.
+	pingPeriod = 30 * time.Second
+
+	// The number of samples buffered while the runner is unreachable
+	bufferSize = 300
+
+	// The number of samples buffered by a node agent while the runner is unreachable
+	agentBufferSize = 30000
+
+	// The time allowed for the runner to acknowledge a batch
+	ackTimeout = 30 * time.Second
 )
 
 // Proxy is the module which collects metrics from envoy and pushes it to the autoscaler
 type Proxy struct {
-	addr, token string
+	addr     string
+	interval time.Duration
 
-	// For communication
-	c  *websocket.Conn
-	ch chan *model.ProxyMessage
+	// The token gets renewed with the runner before it expires
+	tokenLock sync.RWMutex
+	token     string
+
+	// The source metrics are scraped from. The agent is used instead in the node agent mode.
+	source source
+	agent  *agent
+
+	// For reconnecting to the runner
+	minBackoff, maxBackoff time.Duration
+
+	// For communicating with the runner
+	dialer *websocket.Dialer
+	client *http.Client
+	seq    uint64
+
+	// The certificates used to connect over tls. It is nil if tls isn't used.
+	certs *certs.Reloader
+
+	// Messages waiting to be sent to the runner
+	buffer *buffer
 }
 
 // New creates a new proxy instance
-func New(addr, token string) *Proxy {
-	return &Proxy{addr: addr, token: token, ch: make(chan *model.ProxyMessage, 1)}
+func New(c *Config) (*Proxy, error) {
+	if err := c.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		addr:       c.Addr,
+		token:      c.Token,
+		interval:   c.Interval,
+		minBackoff: time.Second,
+		maxBackoff: 30 * time.Second,
+		buffer:     newBuffer(bufferSize),
+		dialer:     newDialer(),
+		client:     http.DefaultClient,
+	}
+
+	if c.TLS {
+		config := c.Certs
+		if config == nil {
+			config = new(certs.Config)
+		}
+		reloader, err := certs.NewReloader(config)
+		if err != nil {
+			return nil, err
+		}
+		p.certs = reloader
+		p.dialer.TLSClientConfig = reloader.ClientConfig()
+		p.client = &http.Client{Transport: reloader.Transport()}
+	}
+
+	if c.NodeAgent {
+		kube, err := newKubeClient(c.KubeConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		p.agent = newAgent(c, kube)
+
+		// The samples of all the pods on the node share the buffer
+		p.buffer = newBuffer(agentBufferSize)
+		return p, nil
+	}
+
+	s, err := newSource(c)
+	if err != nil {
+		return nil, err
+	}
+	p.source = s
+	return p, nil
 }
 
-// Start begins the metric collection operation
-func (p *Proxy) Start() error {
+// newDialer returns a dialer which asks the runner for the binary protocol. Runners which don't support it fall
+// back to json.
+func newDialer() *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{model.ProtocolBinary}
+	return &dialer
+}
 
-	if err := p.connect(); err != nil {
-		return err
+// Start begins the metric collection operation. It runs till the context is cancelled.
+func (p *Proxy) Start(ctx context.Context) error {
+	// Wait till the pods on the node have been discovered
+	if p.agent != nil {
+		logrus.Infoln("Discovering pods on the node")
+		if err := p.agent.start(ctx.Done()); err != nil {
+			return err
+		}
 	}
 
-	// Start a ticker to push ping messages to server
+	// Start the metric collection routine
+	logrus.Infoln("Starting metric collection operation")
+	go p.routineCollectMetrics(ctx, p.interval)
+	go p.routineRenewToken(ctx)
+	if p.certs != nil {
+		go p.certs.Run(ctx.Done())
+	}
+
+	err := p.run(ctx)
+	logrus.Infoln("Stopping metric collection operation")
+	return err
+}
+
+// run keeps a connection to the runner open and pushes the buffered messages over it till the context is cancelled.
+// The connection is re-established with an exponential backoff whenever it breaks. It only returns an error if the
+// runner doesn't accept the token anymore.
+func (p *Proxy) run(ctx context.Context) error {
+	backoff := p.minBackoff
+	for {
+		c, err := p.connect(ctx)
+		if err == nil {
+			// Reset the backoff once we are connected
+			backoff = p.minBackoff
+			err = p.session(ctx, c)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == errUnauthorized {
+			return err
+		}
+		logrus.Errorf("Connection with runner (%s) broke, reconnecting in %s - %s", p.addr, backoff, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > p.maxBackoff {
+			backoff = p.maxBackoff
+		}
+	}
+}
+
+var (
+	errConnectionClosed = errors.New("connection closed by runner")
+	errAckTimeout       = errors.New("runner did not acknowledge batch in time")
+)
+
+// batch is a set of messages sent over the binary protocol which hasn't been acknowledged by the runner yet
+type batch struct {
+	seq      uint64
+	messages []*model.ProxyMessage
+	sentAt   time.Time
+}
+
+// session pushes messages over a single connection till it breaks or the context is cancelled. This is the only
+// goroutine which writes to the connection.
+func (p *Proxy) session(ctx context.Context, c *websocket.Conn) error {
+	binary := c.Subprotocol() == model.ProtocolBinary
+	if binary {
+		logrus.Debugf("Using binary protocol with runner (%s)", p.addr)
+	}
+
+	// The batches which haven't been acknowledged get sent again over the next connection
+	var inflight []*batch
+	defer func() {
+		_ = c.Close()
+
+		var messages []*model.ProxyMessage
+		for _, b := range inflight {
+			messages = append(messages, b.messages...)
+		}
+		p.buffer.requeue(messages)
+	}()
+
+	// The read side only processes control messages (pongs and close frames) and the acks of the binary protocol
+	readErr := make(chan error, 1)
+	acks := make(chan uint64, 16)
 	go func() {
-		ticker := time.NewTicker(30 * time.Second)
-		for range ticker.C {
-			if err := p.c.WriteMessage(websocket.PingMessage, nil); err != nil {
-				logrus.Errorf("Could not write ping message to server - %s", err.Error())
-				_ = p.connect()
+		_ = c.SetReadDeadline(time.Now().Add(pongWait))
+		c.SetPongHandler(func(string) error {
+			return c.SetReadDeadline(time.Now().Add(pongWait))
+		})
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if !binary {
+				continue
+			}
+
+			frame := new(model.Frame)
+			if err := frame.Unmarshal(data); err != nil {
+				readErr <- err
+				return
+			}
+			if frame.Ack {
+				acks <- frame.Seq
 			}
 		}
 	}()
 
-	// Start the metric collection routine
-	logrus.Infoln("Starting metric collection operation")
-	go p.routineCollectMetrics(1 * time.Second)
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
 
-	// Start infinite loop to push messages to autoscaler
-	for msg := range p.ch {
+	flush := func() error {
+		if !binary {
+			return p.flushJSON(c)
+		}
+		batches, err := p.flushBinary(c)
+		inflight = append(inflight, batches...)
+		return err
+	}
+
+	// Flush whatever got buffered while we were disconnected
+	if err := flush(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Let the runner know we are going away
+			_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+			return nil
+
+		case err := <-readErr:
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return errConnectionClosed
+			}
+			return err
+
+		case seq := <-acks:
+			// The runner acknowledges the batches in order
+			for len(inflight) > 0 && inflight[0].seq <= seq {
+				inflight = inflight[1:]
+			}
+
+		case <-ticker.C:
+			if len(inflight) > 0 && time.Since(inflight[0].sentAt) > ackTimeout {
+				return errAckTimeout
+			}
+			if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return err
+			}
+
+		case <-p.buffer.notify:
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// flushJSON writes all the buffered messages to the connection as individual json messages. The messages which could
+// not be written are put back in the buffer.
+func (p *Proxy) flushJSON(c *websocket.Conn) error {
+	messages := p.buffer.drain()
+	for i, msg := range messages {
 		logrus.Debugln("Sending metrics to runner:", msg)
-		if err := p.c.WriteJSON(msg); err != nil {
-			logrus.Errorf("Could not write message to server - %s", err.Error())
-			_ = p.connect()
+		_ = c.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := c.WriteJSON(msg); err != nil {
+			p.buffer.requeue(messages[i:])
+			return err
 		}
 	}
+	return nil
+}
+
+// flushBinary writes all the buffered messages to the connection in batches. It returns the batches which have been
+// sent. They need to be retained till the runner acknowledges them.
+func (p *Proxy) flushBinary(c *websocket.Conn) ([]*batch, error) {
+	messages := p.buffer.drain()
+
+	var batches []*batch
+	for len(messages) > 0 {
+		n := len(messages)
+		if n > model.MaxBatchSize {
+			n = model.MaxBatchSize
+		}
+
+		p.seq++
+		b := &batch{seq: p.seq, messages: messages[:n], sentAt: time.Now()}
+		frame := &model.Frame{Version: model.ProtocolVersion, Seq: b.seq, Messages: b.messages}
+		logrus.Debugf("Sending batch (%d) of %d messages to runner", b.seq, n)
 
-	return errors.New("loop prematurely exited")
+		_ = c.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := c.WriteMessage(websocket.BinaryMessage, frame.Marshal()); err != nil {
+			p.buffer.requeue(messages)
+			return batches, err
+		}
+		batches = append(batches, b)
+		messages = messages[n:]
+	}
+	return batches, nil
 }
 
-func (p *Proxy) connect() error {
+func (p *Proxy) connect(ctx context.Context) (*websocket.Conn, error) {
 	logrus.Debugf("Attempting websocket connection with %s", p.addr)
-	u := url.URL{Scheme: "ws", Host: p.addr, Path: "/v1/galaxy/socket"}
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{"Authorization": []string{"Bearer " + p.token}})
+	u := url.URL{Scheme: p.scheme("ws"), Host: p.addr, Path: "/v1/galaxy/socket"}
+
+	// Proxies authenticating with a client certificate don't have a token
+	header := http.Header{}
+	if token := p.getToken(); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	c, res, err := p.dialer.DialContext(ctx, u.String(), header)
 	if err != nil {
-		return err
+		if res != nil && res.StatusCode == http.StatusUnauthorized {
+			return nil, errUnauthorized
+		}
+		return nil, err
 	}
 
-	p.c = c
 	logrus.Debugf("Established websocket connection with %s", p.addr)
-	return nil
+	return c, nil
+}
+
+// scheme returns the secure variant of the scheme if the proxy connects to the runner over tls
+func (p *Proxy) scheme(scheme string) string {
+	if p.certs != nil {
+		return scheme + "s"
+	}
+	return scheme
+}
+
+// send queues a message to be sent to the runner
+func (p *Proxy) send(msg *model.ProxyMessage) {
+	p.buffer.add(msg)
 }
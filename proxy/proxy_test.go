@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils/certs"
+)
+
+func TestBuffer_coalesce(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		values   []int32
+		want     []int32
+		requests []uint64
+	}{
+		{name: "within size", size: 3, values: []int32{1, 2, 3}, want: []int32{1, 2, 3}, requests: []uint64{1, 2, 3}},
+		{name: "oldest samples coalesced", size: 3, values: []int32{5, 1, 2, 3, 4}, want: []int32{5, 3, 4}, requests: []uint64{8, 3, 4}},
+		{name: "single slot", size: 1, values: []int32{2, 7, 1}, want: []int32{7}, requests: []uint64{10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBuffer(tt.size)
+			for _, v := range tt.values {
+				b.add(&model.ProxyMessage{ActiveRequests: v, Metrics: &model.ProxyMetrics{Requests: uint64(v), StatusCodes: map[string]uint64{"2xx": uint64(v)}}})
+			}
+
+			messages := b.drain()
+			if len(messages) != len(tt.want) {
+				t.Fatalf("drain() returned %d messages, want %d", len(messages), len(tt.want))
+			}
+			for i, msg := range messages {
+				if msg.ActiveRequests != tt.want[i] {
+					t.Errorf("drain()[%d] = %d, want %d", i, msg.ActiveRequests, tt.want[i])
+				}
+				// The requests of the coalesced samples must not get lost
+				if msg.Metrics.Requests != tt.requests[i] || msg.Metrics.StatusCodes["2xx"] != tt.requests[i] {
+					t.Errorf("drain()[%d] has %d requests and status codes %v, want %d", i, msg.Metrics.Requests, msg.Metrics.StatusCodes, tt.requests[i])
+				}
+			}
+		})
+	}
+}
+
+func newTestProxy(t *testing.T, addr string) *Proxy {
+	p, err := New(&Config{Addr: addr, Token: "token", Source: SourceFile, SourceAddr: "metrics.json"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return p
+}
+
+// runnerServer is a websocket server which behaves like the runner. It drops the first few connections right
+// after receiving a message.
+type runnerServer struct {
+	drops       int32
+	connections int32
+
+	lock     sync.Mutex
+	received []int32
+}
+
+func (s *runnerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer func() { _ = c.Close() }()
+
+	drop := atomic.AddInt32(&s.connections, 1) <= s.drops
+	for {
+		msg := new(model.ProxyMessage)
+		if err := c.ReadJSON(msg); err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.received = append(s.received, msg.ActiveRequests)
+		s.lock.Unlock()
+
+		if drop {
+			return
+		}
+	}
+}
+
+func (s *runnerServer) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.received)
+}
+
+func TestProxy_reconnect(t *testing.T) {
+	s := &runnerServer{drops: 2}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	p := newTestProxy(t, strings.TrimPrefix(server.URL, "http://"))
+	p.minBackoff, p.maxBackoff = 10*time.Millisecond, 20*time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx)
+		close(done)
+	}()
+
+	// Messages sent while the connection keeps breaking are delivered once it gets re-established
+	for i := int32(1); i <= 5; i++ {
+		p.send(&model.ProxyMessage{ActiveRequests: i})
+		time.Sleep(20 * time.Millisecond)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.count() < 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("run() did not return after the context was cancelled")
+	}
+
+	if n := atomic.LoadInt32(&s.connections); n < 3 {
+		t.Errorf("proxy made %d connections, want at least 3", n)
+	}
+	if n := s.count(); n < 5 {
+		t.Errorf("runner received %d messages, want at least 5", n)
+	}
+}
+
+func TestProxy_backoff(t *testing.T) {
+	// Nothing listens on this address, so every attempt to connect fails
+	server := httptest.NewServer(http.NotFoundHandler())
+	addr := strings.TrimPrefix(server.URL, "http://")
+	server.Close()
+
+	p := newTestProxy(t, addr)
+	p.minBackoff, p.maxBackoff = 10*time.Millisecond, 40*time.Millisecond
+
+	// Messages are retained while the runner is unreachable
+	for i := 0; i < bufferSize+10; i++ {
+		p.send(&model.ProxyMessage{ActiveRequests: 1})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	p.run(ctx)
+	if time.Since(start) > time.Second {
+		t.Errorf("run() took %s to return after the context was done", time.Since(start))
+	}
+
+	if n := len(p.buffer.drain()); n != bufferSize {
+		t.Errorf("buffer holds %d messages, want %d", n, bufferSize)
+	}
+}
+
+func TestProxy_binaryProtocol(t *testing.T) {
+	// The runner drops the first connection without acknowledging the batch it received
+	var connections int32
+	batches := make(chan *model.Frame, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{Subprotocols: []string{model.ProtocolBinary}}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = c.Close() }()
+		if c.Subprotocol() != model.ProtocolBinary {
+			t.Errorf("proxy negotiated protocol %q, want %q", c.Subprotocol(), model.ProtocolBinary)
+		}
+
+		ack := atomic.AddInt32(&connections, 1) > 1
+		for {
+			msgType, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			frame := new(model.Frame)
+			if msgType != websocket.BinaryMessage || frame.Unmarshal(data) != nil {
+				t.Errorf("proxy sent an invalid frame")
+				return
+			}
+			batches <- frame
+			if !ack {
+				return
+			}
+
+			reply := &model.Frame{Version: model.ProtocolVersion, Seq: frame.Seq, Ack: true}
+			if err := c.WriteMessage(websocket.BinaryMessage, reply.Marshal()); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	p := newTestProxy(t, strings.TrimPrefix(server.URL, "http://"))
+	p.minBackoff, p.maxBackoff = 10*time.Millisecond, 20*time.Millisecond
+
+	// Queue the messages before connecting so that they go out in a single batch
+	for i := int32(1); i <= 3; i++ {
+		p.send(&model.ProxyMessage{ActiveRequests: i})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The unacknowledged batch is sent again over the next connection
+	for i, wantSeq := range []uint64{1, 2} {
+		select {
+		case frame := <-batches:
+			if frame.Seq != wantSeq || len(frame.Messages) != 3 {
+				t.Fatalf("batch %d: seq = %d with %d messages, want seq %d with 3 messages", i, frame.Seq, len(frame.Messages), wantSeq)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("batch %d was not received", i)
+		}
+	}
+}
+
+func TestProxy_tls(t *testing.T) {
+	s := &runnerServer{}
+	server := httptest.NewTLSServer(s)
+	defer server.Close()
+
+	// Trust the certificate of the test server
+	dir, err := ioutil.TempDir("", "galaxy-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := New(&Config{Addr: strings.TrimPrefix(server.URL, "https://"), Token: "token", Source: SourceFile, SourceAddr: "metrics.json", TLS: true, Certs: &certs.Config{CAFile: caFile}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	p.minBackoff, p.maxBackoff = 10*time.Millisecond, 20*time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	p.send(&model.ProxyMessage{ActiveRequests: 1})
+	deadline := time.Now().Add(5 * time.Second)
+	for s.count() < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.count() != 1 {
+		t.Errorf("runner received %d messages over wss, want 1", s.count())
+	}
+}
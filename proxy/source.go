@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils"
+)
+
+// source is the interface of the modules the proxy scrapes metrics from. The sources are stateful since they need
+// to convert cumulative counters into the events which occurred in each interval.
+type source interface {
+	scrape() (*model.ProxyMessage, error)
+}
+
+func newSource(c *Config) (source, error) {
+	var filter *regexp.Regexp
+	if c.Filter != "" && c.Source != SourceEnvoy {
+		f, err := regexp.Compile(c.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metrics filter provided - %s", err.Error())
+		}
+		filter = f
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	switch c.Source {
+	case SourceEnvoy:
+		if c.NodeAgent {
+			return &envoyPrometheusSource{client: client, addr: c.SourceAddr, collector: newPrometheusCollector()}, nil
+		}
+		return &envoySource{client: client, addr: c.SourceAddr, filter: c.Filter, collector: newCollector()}, nil
+	case SourcePrometheus:
+		return &prometheusSource{client: client, addr: c.SourceAddr, filter: filter, collector: newPrometheusCollector()}, nil
+	case SourceFile:
+		return &fileSource{path: c.SourceAddr, filter: filter, envoy: newCollector(), prometheus: newPrometheusCollector()}, nil
+	default:
+		return nil, fmt.Errorf("invalid metrics source (%s) provided", c.Source)
+	}
+}
+
+// fetch makes a get request and returns the body of the response
+func fetch(client *http.Client, u string) ([]byte, error) {
+	res, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.CloseReaderCloser(res.Body)
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid response (status code: %d; body: %s) received from %s", res.StatusCode, string(data), u)
+	}
+	return data, nil
+}
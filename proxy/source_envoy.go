@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// The stats of the inbound listeners of envoy which are of interest to us
+const envoyStatsFilter = `inbound.*(downstream_rq_(total|active|[1-5]xx|time)|downstream_cx_(total|active))$`
+
+// envoySource scrapes the stats of the inbound listeners from the admin api of the envoy sidecar
+type envoySource struct {
+	client    *http.Client
+	addr      string
+	filter    string
+	collector *collector
+}
+
+func (s *envoySource) scrape() (*model.ProxyMessage, error) {
+	logrus.Debugln("Pulling metrics from envoy...")
+	data, err := fetch(s.client, s.addr+"/stats?format=json&filter="+url.QueryEscape(s.filter))
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := new(model.EnvoyMetrics)
+	if err := json.Unmarshal(data, metrics); err != nil {
+		return nil, err
+	}
+
+	logrus.Debugln("Received metrics from envoy:", metrics)
+	return s.collector.process(metrics), nil
+}
+
+// envoyPrometheusSource scrapes the stats of the inbound listeners of envoy in the prometheus text format. The admin
+// api of the istio sidecar only listens on localhost, so the node agents scrape the prometheus endpoint the sidecar
+// exposes on the ip of the pod instead.
+type envoyPrometheusSource struct {
+	client    *http.Client
+	addr      string
+	collector *prometheusCollector
+}
+
+func (s *envoyPrometheusSource) scrape() (*model.ProxyMessage, error) {
+	logrus.Debugln("Pulling metrics from", s.addr)
+	data, err := fetch(s.client, s.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	samples, err := parsePrometheus(data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	translated := make([]*sample, 0, len(samples))
+	for _, raw := range samples {
+		if t := translateEnvoySample(raw); t != nil {
+			translated = append(translated, t)
+		}
+	}
+	return s.collector.process(translated), nil
+}
+
+// translateEnvoySample renames the stats of the inbound listeners of envoy to the names understood by the prometheus
+// collector. It returns nil for the other stats. Istio moves the listener and the status code class of a stat into
+// labels (e.g. `envoy_http_downstream_rq_xx{envoy_response_code_class="2",http_conn_manager_prefix="inbound_..."}`)
+// while envoy keeps them in the name otherwise. The prefix of the name is retained so that the series stay unique.
+func translateEnvoySample(s *sample) *sample {
+	inbound := strings.Contains(s.name, "inbound")
+	for _, v := range s.labels {
+		inbound = inbound || strings.Contains(v, "inbound")
+	}
+	if !inbound {
+		return nil
+	}
+
+	rename := func(suffix, name string) *sample {
+		labels := make(map[string]string, len(s.labels)+1)
+		for k, v := range s.labels {
+			labels[k] = v
+		}
+		return &sample{name: strings.TrimSuffix(s.name, suffix) + name, labels: labels, value: s.value}
+	}
+
+	switch {
+	case strings.HasSuffix(s.name, "_downstream_rq_xx"):
+		class := s.labels["envoy_response_code_class"]
+		if len(class) != 1 {
+			return nil
+		}
+		t := rename("_downstream_rq_xx", "_requests_total")
+		t.labels["code"] = class + "xx"
+		return t
+	case strings.HasSuffix(s.name, "xx") && strings.HasSuffix(s.name[:len(s.name)-3], "_downstream_rq_"):
+		class := s.name[len(s.name)-3:]
+		t := rename("_downstream_rq_"+class, "_requests_total")
+		t.labels["code"] = class
+		return t
+	case strings.HasSuffix(s.name, "_downstream_rq_active"):
+		return rename("_downstream_rq_active", "_requests_active")
+	case strings.HasSuffix(s.name, "_downstream_rq_time_bucket"):
+		return rename("_downstream_rq_time_bucket", "_request_duration_milliseconds_bucket")
+	case strings.HasSuffix(s.name, "_downstream_cx_active"):
+		return rename("_downstream_cx_active", "_connections_active")
+	case strings.HasSuffix(s.name, "_downstream_cx_total"):
+		return rename("_downstream_cx_total", "_connections_total")
+	}
+	return nil
+}
+
+// collector converts the stats of envoy into proxy messages. Envoy reports cumulative counters, so the collector
+// remembers their previous values to calculate the events which occurred in each interval.
+type collector struct {
+	prev map[string]uint64
+}
+
+func newCollector() *collector {
+	return &collector{prev: map[string]uint64{}}
+}
+
+func (c *collector) delta(name string, value uint64) uint64 {
+	prev, p := c.prev[name]
+	c.prev[name] = value
+
+	// The first value only sets the baseline. Counters get reset when envoy restarts.
+	if !p {
+		return 0
+	}
+	if value < prev {
+		return value
+	}
+	return value - prev
+}
+
+func (c *collector) process(metrics *model.EnvoyMetrics) *model.ProxyMessage {
+	msg := &model.ProxyMessage{Metrics: &model.ProxyMetrics{}}
+	for _, stat := range metrics.Stats {
+		if stat.Histograms != nil {
+			msg.Metrics.Latency = getLatencySummary(stat.Histograms)
+			continue
+		}
+
+		i := strings.LastIndex(stat.Name, ".")
+		if i == -1 {
+			continue
+		}
+		switch suffix := stat.Name[i+1:]; suffix {
+		case "downstream_rq_active":
+			msg.ActiveRequests += int32(stat.Value)
+		case "downstream_rq_total":
+			msg.Metrics.Requests += c.delta(stat.Name, stat.Value)
+		case "downstream_rq_1xx", "downstream_rq_2xx", "downstream_rq_3xx", "downstream_rq_4xx", "downstream_rq_5xx":
+			if msg.Metrics.StatusCodes == nil {
+				msg.Metrics.StatusCodes = map[string]uint64{}
+			}
+			msg.Metrics.StatusCodes[strings.TrimPrefix(suffix, "downstream_rq_")] += c.delta(stat.Name, stat.Value)
+		case "downstream_cx_active":
+			msg.Metrics.ActiveConnections += stat.Value
+		case "downstream_cx_total":
+			msg.Metrics.Connections += c.delta(stat.Name, stat.Value)
+		}
+	}
+	return msg
+}
+
+// getLatencySummary returns the request latency quantiles of the last interval. The slowest listener is reported
+// when envoy has multiple inbound listeners.
+func getLatencySummary(h *model.EnvoyHistograms) *model.LatencySummary {
+	index := map[float64]int{}
+	for i, q := range h.SupportedQuantiles {
+		index[q] = i
+	}
+	get := func(values []model.EnvoyQuantileValues, q float64) float64 {
+		i, p := index[q]
+		if !p || i >= len(values) || values[i].Interval == nil {
+			return 0
+		}
+		return *values[i].Interval
+	}
+
+	var summary *model.LatencySummary
+	for _, hist := range h.ComputedQuantiles {
+		if !strings.HasSuffix(hist.Name, ".downstream_rq_time") {
+			continue
+		}
+		// Skip the histograms which haven't recorded any request in the last interval
+		p50 := get(hist.Values, 50)
+		if p50 == 0 {
+			continue
+		}
+		if summary == nil {
+			summary = &model.LatencySummary{}
+		}
+		if p50 > summary.P50 {
+			summary.P50 = p50
+		}
+		if p95 := get(hist.Values, 95); p95 > summary.P95 {
+			summary.P95 = p95
+		}
+		if p99 := get(hist.Values, 99); p99 > summary.P99 {
+			summary.P99 = p99
+		}
+	}
+	return summary
+}
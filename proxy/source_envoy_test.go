@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+func envoyStats(t *testing.T, data string) *model.EnvoyMetrics {
+	metrics := new(model.EnvoyMetrics)
+	if err := json.Unmarshal([]byte(data), metrics); err != nil {
+		t.Fatal(err)
+	}
+	return metrics
+}
+
+func TestCollector_process(t *testing.T) {
+	c := newCollector()
+
+	// The first scrape only sets the baseline of the counters
+	first := c.process(envoyStats(t, `{"stats":[
+		{"name":"http.inbound_0.0.0.0_8080.downstream_rq_total","value":100},
+		{"name":"http.inbound_0.0.0.0_8080.downstream_rq_2xx","value":90},
+		{"name":"http.inbound_0.0.0.0_8080.downstream_rq_5xx","value":10},
+		{"name":"http.inbound_0.0.0.0_8080.downstream_rq_active","value":3},
+		{"name":"tcp.inbound|9000||s1.downstream_cx_total","value":5},
+		{"name":"tcp.inbound|9000||s1.downstream_cx_active","value":2}
+	]}`))
+	if first.ActiveRequests != 3 || first.Metrics.Requests != 0 || first.Metrics.ActiveConnections != 2 {
+		t.Errorf("process() = %+v, want only the gauges on the first scrape", first.Metrics)
+	}
+
+	second := c.process(envoyStats(t, `{"stats":[
+		{"name":"http.inbound_0.0.0.0_8080.downstream_rq_total","value":150},
+		{"name":"http.inbound_0.0.0.0_8080.downstream_rq_2xx","value":130},
+		{"name":"http.inbound_0.0.0.0_8080.downstream_rq_5xx","value":20},
+		{"name":"http.inbound_0.0.0.0_8080.downstream_rq_active","value":7},
+		{"name":"tcp.inbound|9000||s1.downstream_cx_total","value":2},
+		{"name":"tcp.inbound|9000||s1.downstream_cx_active","value":1},
+		{"histograms":{
+			"supported_quantiles":[0,25,50,75,90,95,99,99.5,99.9,100],
+			"computed_quantiles":[
+				{"name":"http.inbound_0.0.0.0_8080.downstream_rq_time","values":[
+					{"interval":1,"cumulative":1},{"interval":2,"cumulative":2},{"interval":5,"cumulative":5},
+					{"interval":8,"cumulative":8},{"interval":10,"cumulative":10},{"interval":20,"cumulative":20},
+					{"interval":40,"cumulative":40},{"interval":50,"cumulative":50},{"interval":60,"cumulative":60},
+					{"interval":70,"cumulative":70}
+				]},
+				{"name":"http.inbound_0.0.0.0_9090.downstream_rq_time","values":[
+					{"interval":null,"cumulative":null},{"interval":null,"cumulative":null},{"interval":null,"cumulative":null},
+					{"interval":null,"cumulative":null},{"interval":null,"cumulative":null},{"interval":null,"cumulative":null},
+					{"interval":null,"cumulative":null},{"interval":null,"cumulative":null},{"interval":null,"cumulative":null},
+					{"interval":null,"cumulative":null}
+				]}
+			]
+		}}
+	]}`))
+
+	want := &model.ProxyMetrics{
+		Requests:          50,
+		StatusCodes:       map[string]uint64{"2xx": 40, "5xx": 10},
+		Latency:           &model.LatencySummary{P50: 5, P95: 20, P99: 40},
+		ActiveConnections: 1,
+		// The counter got reset, so all the connections are new
+		Connections: 2,
+	}
+	if second.ActiveRequests != 7 {
+		t.Errorf("process() active requests = %d, want 7", second.ActiveRequests)
+	}
+	if !reflect.DeepEqual(second.Metrics, want) {
+		t.Errorf("process() = %+v, want %+v", second.Metrics, want)
+	}
+}
+
+func TestEnvoyPrometheusSource_scrape(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	c := &Config{NodeAgent: true, NodeName: "n1", SourceAddr: server.URL}
+	if err := c.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSource(c)
+	if err != nil {
+		t.Fatalf("newSource() error = %v", err)
+	}
+	scrape := func(data string) *model.ProxyMessage {
+		body = data
+		msg, err := s.scrape()
+		if err != nil {
+			t.Fatalf("scrape() error = %v", err)
+		}
+		return msg
+	}
+
+	// Istio moves the listener and the status code class into labels while plain envoy keeps them in the name. The
+	// stats of the outbound listeners are ignored.
+	first := scrape(`
+envoy_http_downstream_rq_xx{envoy_response_code_class="2",http_conn_manager_prefix="inbound_0.0.0.0_8080"} 90
+envoy_http_downstream_rq_xx{envoy_response_code_class="5",http_conn_manager_prefix="inbound_0.0.0.0_8080"} 10
+envoy_http_downstream_rq_xx{envoy_response_code_class="2",http_conn_manager_prefix="outbound_0.0.0.0_80"} 500
+envoy_http_inbound_0_0_0_0_9090_downstream_rq_2xx 20
+envoy_http_downstream_rq_active{http_conn_manager_prefix="inbound_0.0.0.0_8080"} 3
+envoy_http_downstream_rq_active{http_conn_manager_prefix="outbound_0.0.0.0_80"} 50
+envoy_tcp_downstream_cx_active{envoy_tcp_prefix="inbound|9000||s1"} 2
+`)
+	if first.ActiveRequests != 3 || first.Metrics.Requests != 0 || first.Metrics.ActiveConnections != 2 {
+		t.Errorf("scrape() = %+v with %d active requests, want only the inbound gauges on the first scrape", first.Metrics, first.ActiveRequests)
+	}
+
+	second := scrape(`
+envoy_http_downstream_rq_xx{envoy_response_code_class="2",http_conn_manager_prefix="inbound_0.0.0.0_8080"} 130
+envoy_http_downstream_rq_xx{envoy_response_code_class="5",http_conn_manager_prefix="inbound_0.0.0.0_8080"} 20
+envoy_http_downstream_rq_xx{envoy_response_code_class="2",http_conn_manager_prefix="outbound_0.0.0.0_80"} 900
+envoy_http_inbound_0_0_0_0_9090_downstream_rq_2xx 30
+envoy_http_downstream_rq_active{http_conn_manager_prefix="inbound_0.0.0.0_8080"} 7
+envoy_http_downstream_rq_time_bucket{http_conn_manager_prefix="inbound_0.0.0.0_8080",le="10"} 0
+envoy_http_downstream_rq_time_bucket{http_conn_manager_prefix="inbound_0.0.0.0_8080",le="+Inf"} 0
+envoy_tcp_downstream_cx_active{envoy_tcp_prefix="inbound|9000||s1"} 1
+`)
+	want := &model.ProxyMetrics{Requests: 60, StatusCodes: map[string]uint64{"2xx": 50, "5xx": 10}, ActiveConnections: 1}
+	if second.ActiveRequests != 7 {
+		t.Errorf("scrape() active requests = %d, want 7", second.ActiveRequests)
+	}
+	if !reflect.DeepEqual(second.Metrics, want) {
+		t.Errorf("scrape() = %+v, want %+v", second.Metrics, want)
+	}
+}
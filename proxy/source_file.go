@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// fileSource reads the metrics from a file on every scrape. The file either contains the json stats of envoy or
+// metrics in the prometheus text format.
+type fileSource struct {
+	path   string
+	filter *regexp.Regexp
+
+	envoy      *collector
+	prometheus *prometheusCollector
+}
+
+func (s *fileSource) scrape() (*model.ProxyMessage, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The json stats of envoy are always an object
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		metrics := new(model.EnvoyMetrics)
+		if err := json.Unmarshal(data, metrics); err != nil {
+			return nil, err
+		}
+		return s.envoy.process(metrics), nil
+	}
+
+	samples, err := parsePrometheus(data, s.filter)
+	if err != nil {
+		return nil, err
+	}
+	return s.prometheus.process(samples), nil
+}
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// prometheusSource scrapes a prometheus text endpoint exposed by the service. The metrics are recognised by the
+// suffix of their names:
+//   - `_requests_total` counters are the requests served. The `code` or `status` label gives the status code.
+//   - `_requests_in_flight` and `_requests_active` gauges are the active requests.
+//   - `_request_duration_seconds` and `_request_duration_milliseconds` histograms are the request latencies.
+//   - `_connections_total` counters and `_connections_active` gauges are the tcp connections.
+type prometheusSource struct {
+	client    *http.Client
+	addr      string
+	filter    *regexp.Regexp
+	collector *prometheusCollector
+}
+
+func (s *prometheusSource) scrape() (*model.ProxyMessage, error) {
+	logrus.Debugln("Pulling metrics from", s.addr)
+	data, err := fetch(s.client, s.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	samples, err := parsePrometheus(data, s.filter)
+	if err != nil {
+		return nil, err
+	}
+	return s.collector.process(samples), nil
+}
+
+// sample is a single sample in the prometheus text format
+type sample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// key uniquely identifies the series of the sample
+func (s *sample) key() string {
+	keys := make([]string, 0, len(s.labels))
+	for k, v := range s.labels {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+	return s.name + "{" + strings.Join(keys, ",") + "}"
+}
+
+// parsePrometheus parses metrics in the prometheus text format. Only the samples whose name matches the filter are
+// returned.
+func parsePrometheus(data []byte, filter *regexp.Regexp) ([]*sample, error) {
+	var samples []*sample
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		s := &sample{labels: map[string]string{}}
+		rest := line
+		if i := strings.IndexAny(line, "{ "); i == -1 {
+			return nil, fmt.Errorf("invalid sample on line %d", n)
+		} else if line[i] == '{' {
+			end := strings.LastIndex(line, "}")
+			if end < i {
+				return nil, fmt.Errorf("invalid labels on line %d", n)
+			}
+			s.name = line[:i]
+			if err := parseLabels(line[i+1:end], s.labels); err != nil {
+				return nil, fmt.Errorf("invalid labels on line %d - %s", n, err.Error())
+			}
+			rest = line[end+1:]
+		} else {
+			s.name = line[:i]
+			rest = line[i:]
+		}
+
+		// The value may be followed by a timestamp
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("missing value on line %d", n)
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value on line %d - %s", n, err.Error())
+		}
+		s.value = value
+
+		if filter == nil || filter.MatchString(s.name) {
+			samples = append(samples, s)
+		}
+	}
+	return samples, scanner.Err()
+}
+
+func parseLabels(text string, labels map[string]string) error {
+	for text = strings.TrimSpace(text); text != ""; {
+		eq := strings.Index(text, "=")
+		if eq == -1 || len(text) < eq+2 || text[eq+1] != '"' {
+			return fmt.Errorf("malformed label (%s)", text)
+		}
+		name := strings.TrimSpace(text[:eq])
+
+		// Read the quoted value while handling escape sequences
+		var value strings.Builder
+		i := eq + 2
+		for ; i < len(text) && text[i] != '"'; i++ {
+			if text[i] == '\\' && i+1 < len(text) {
+				i++
+				if text[i] == 'n' {
+					value.WriteByte('\n')
+					continue
+				}
+			}
+			value.WriteByte(text[i])
+		}
+		if i == len(text) {
+			return fmt.Errorf("unterminated value of label (%s)", name)
+		}
+		labels[name] = value.String()
+
+		text = strings.TrimPrefix(strings.TrimSpace(text[i+1:]), ",")
+		text = strings.TrimSpace(text)
+	}
+	return nil
+}
+
+// prometheusCollector converts prometheus samples into proxy messages. It remembers the previous values of the
+// counters to calculate the events which occurred in each interval.
+type prometheusCollector struct {
+	prev map[string]float64
+}
+
+func newPrometheusCollector() *prometheusCollector {
+	return &prometheusCollector{prev: map[string]float64{}}
+}
+
+func (c *prometheusCollector) delta(s *sample) float64 {
+	key := s.key()
+	prev, p := c.prev[key]
+	c.prev[key] = s.value
+
+	// The first value only sets the baseline. Counters get reset when the service restarts.
+	if !p {
+		return 0
+	}
+	if s.value < prev {
+		return s.value
+	}
+	return s.value - prev
+}
+
+func (c *prometheusCollector) process(samples []*sample) *model.ProxyMessage {
+	msg := &model.ProxyMessage{Metrics: &model.ProxyMetrics{}}
+
+	// The buckets of the latency histograms in the last interval keyed by their upper bound
+	buckets := map[float64]float64{}
+	scale := 1.0
+
+	for _, s := range samples {
+		switch {
+		case strings.HasSuffix(s.name, "_requests_total"):
+			count := c.delta(s)
+			msg.Metrics.Requests += uint64(count)
+			if code := getStatusClass(s.labels); code != "" {
+				if msg.Metrics.StatusCodes == nil {
+					msg.Metrics.StatusCodes = map[string]uint64{}
+				}
+				msg.Metrics.StatusCodes[code] += uint64(count)
+			}
+		case strings.HasSuffix(s.name, "_requests_in_flight"), strings.HasSuffix(s.name, "_requests_active"):
+			msg.ActiveRequests += int32(s.value)
+		case strings.HasSuffix(s.name, "_request_duration_seconds_bucket"), strings.HasSuffix(s.name, "_request_duration_milliseconds_bucket"):
+			if strings.HasSuffix(s.name, "_seconds_bucket") {
+				scale = 1000
+			}
+			le, err := strconv.ParseFloat(s.labels["le"], 64)
+			if err != nil {
+				continue
+			}
+			buckets[le] += c.delta(s)
+		case strings.HasSuffix(s.name, "_connections_active"):
+			msg.Metrics.ActiveConnections += uint64(s.value)
+		case strings.HasSuffix(s.name, "_connections_total"):
+			msg.Metrics.Connections += uint64(c.delta(s))
+		}
+	}
+
+	if len(buckets) > 0 {
+		msg.Metrics.Latency = getHistogramSummary(buckets, scale)
+	}
+	return msg
+}
+
+// getStatusClass returns the class (e.g. 2xx) of the status code present in the labels
+func getStatusClass(labels map[string]string) string {
+	code, p := labels["code"]
+	if !p {
+		code = labels["status"]
+	}
+	if len(code) != 3 || code[0] < '1' || code[0] > '5' {
+		return ""
+	}
+	return code[:1] + "xx"
+}
+
+// getHistogramSummary estimates the latency quantiles from the cumulative buckets of a histogram by interpolating
+// linearly within the bucket the quantile falls in. It returns nil if no requests were recorded.
+func getHistogramSummary(buckets map[float64]float64, scale float64) *model.LatencySummary {
+	bounds := make([]float64, 0, len(buckets))
+	for le := range buckets {
+		bounds = append(bounds, le)
+	}
+	sort.Float64s(bounds)
+
+	total := buckets[bounds[len(bounds)-1]]
+	if total == 0 {
+		return nil
+	}
+
+	quantile := func(q float64) float64 {
+		rank := q * total
+		var lower, prevCount float64
+		for _, le := range bounds {
+			count := buckets[le]
+			if count >= rank {
+				// The upper bound of the last bucket is infinite, so the best we can do is its lower bound
+				if math.IsInf(le, 1) || count == prevCount {
+					return lower * scale
+				}
+				return (lower + (le-lower)*(rank-prevCount)/(count-prevCount)) * scale
+			}
+			lower, prevCount = le, count
+		}
+		return lower * scale
+	}
+
+	return &model.LatencySummary{P50: quantile(0.5), P95: quantile(0.95), P99: quantile(0.99)}
+}
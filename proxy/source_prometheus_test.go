@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+func TestParsePrometheus(t *testing.T) {
+	data := []byte(`# HELP http_requests_total The total requests
+# TYPE http_requests_total counter
+http_requests_total{code="200",path="/a \"quoted\""} 10 1574000000000
+http_requests_total{code="500"} 2
+process_open_fds 12
+`)
+
+	tests := []struct {
+		name   string
+		filter *regexp.Regexp
+		want   []*sample
+	}{
+		{
+			name: "all samples",
+			want: []*sample{
+				{name: "http_requests_total", labels: map[string]string{"code": "200", "path": `/a "quoted"`}, value: 10},
+				{name: "http_requests_total", labels: map[string]string{"code": "500"}, value: 2},
+				{name: "process_open_fds", labels: map[string]string{}, value: 12},
+			},
+		},
+		{
+			name:   "filtered samples",
+			filter: regexp.MustCompile("^process_"),
+			want:   []*sample{{name: "process_open_fds", labels: map[string]string{}, value: 12}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePrometheus(data, tt.filter)
+			if err != nil {
+				t.Fatalf("parsePrometheus() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePrometheus() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parsePrometheus([]byte(`broken{code="200" 1`), nil); err == nil {
+		t.Error("parsePrometheus() did not return an error for malformed labels")
+	}
+}
+
+func TestFileSource_scrape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "metrics")
+
+	s, err := newSource(&Config{Source: SourceFile, SourceAddr: path})
+	if err != nil {
+		t.Fatalf("newSource() error = %v", err)
+	}
+
+	scrape := func(data string) *model.ProxyMessage {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := s.scrape()
+		if err != nil {
+			t.Fatalf("scrape() error = %v", err)
+		}
+		return msg
+	}
+
+	// The first scrape only sets the baseline of the counters
+	scrape(`
+http_requests_total{code="200"} 100
+http_requests_total{code="503"} 5
+http_request_duration_seconds_bucket{le="0.1"} 50
+http_request_duration_seconds_bucket{le="1"} 100
+http_request_duration_seconds_bucket{le="+Inf"} 105
+`)
+	msg := scrape(`
+http_requests_in_flight 4
+http_requests_total{code="200"} 190
+http_requests_total{code="503"} 15
+http_request_duration_seconds_bucket{le="0.1"} 130
+http_request_duration_seconds_bucket{le="1"} 200
+http_request_duration_seconds_bucket{le="+Inf"} 205
+tcp_connections_active 3
+`)
+
+	if msg.ActiveRequests != 4 {
+		t.Errorf("scrape() active requests = %d, want 4", msg.ActiveRequests)
+	}
+	want := &model.ProxyMetrics{
+		Requests:          100,
+		StatusCodes:       map[string]uint64{"2xx": 90, "5xx": 10},
+		ActiveConnections: 3,
+	}
+	latency := msg.Metrics.Latency
+	msg.Metrics.Latency = nil
+	if !reflect.DeepEqual(msg.Metrics, want) {
+		t.Errorf("scrape() = %+v, want %+v", msg.Metrics, want)
+	}
+
+	// The quantiles get interpolated within the buckets of the last interval and converted to milliseconds
+	wantLatency := model.LatencySummary{P50: 62.5, P95: 775, P99: 955}
+	if latency == nil || math.Abs(latency.P50-wantLatency.P50) > 1e-6 || math.Abs(latency.P95-wantLatency.P95) > 1e-6 || math.Abs(latency.P99-wantLatency.P99) > 1e-6 {
+		t.Errorf("scrape() latency = %+v, want %+v", latency, wantLatency)
+	}
+
+	// The envoy format is detected from the content of the file
+	msg = scrape(`{"stats":[{"name":"http.inbound_0.0.0.0_8080.downstream_rq_active","value":9}]}`)
+	if msg.ActiveRequests != 9 {
+		t.Errorf("scrape() active requests = %d, want 9 from envoy stats", msg.ActiveRequests)
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// The interval at which a failed renewal of the token is retried
+const renewRetryInterval = 30 * time.Second
+
+// errUnauthorized is returned when the runner doesn't accept the token anymore. The proxy exits in this case so that
+// it gets restarted with the latest token stored by the runner.
+var errUnauthorized = errors.New("token rejected by runner")
+
+func (p *Proxy) getToken() string {
+	p.tokenLock.RLock()
+	defer p.tokenLock.RUnlock()
+	return p.token
+}
+
+func (p *Proxy) setToken(token string) {
+	p.tokenLock.Lock()
+	p.token = token
+	p.tokenLock.Unlock()
+}
+
+// getRenewalTime returns the time the token needs to be renewed at. Tokens get renewed once two thirds of their
+// lifetime is over. It returns false for tokens which don't expire.
+func getRenewalTime(token string) (time.Time, bool) {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return time.Time{}, false
+	}
+
+	exp, ok1 := claims["exp"].(float64)
+	iat, ok2 := claims["iat"].(float64)
+	if !ok1 || !ok2 || exp <= iat {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(iat+(exp-iat)*2/3), 0), true
+}
+
+// routineRenewToken renews the token with the runner before it expires till the context is cancelled
+func (p *Proxy) routineRenewToken(ctx context.Context) {
+	for {
+		renewAt, ok := getRenewalTime(p.getToken())
+		if !ok {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(renewAt)):
+		}
+
+		for {
+			err := p.renewToken(ctx)
+			if err == nil {
+				logrus.Debugln("Renewed token with runner")
+				break
+			}
+			logrus.Errorf("Could not renew token with runner (%s) - %s", p.addr, err.Error())
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(renewRetryInterval):
+			}
+		}
+	}
+}
+
+// renewToken fetches a fresh token from the runner
+func (p *Proxy) renewToken(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	u := url.URL{Scheme: p.scheme("http"), Host: p.addr, Path: "/v1/galaxy/proxy/token"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.getToken())
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return errUnauthorized
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("runner responded with status code %d", res.StatusCode)
+	}
+
+	token := new(model.ProxyToken)
+	if err := json.NewDecoder(res.Body).Decode(token); err != nil {
+		return err
+	}
+	p.setToken(token.Token)
+	return nil
+}
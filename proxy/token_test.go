@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+func TestProxy_renewToken(t *testing.T) {
+	sign := func(claims jwt.MapClaims) string {
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("some-secret"))
+		return token
+	}
+	now := time.Now().Unix()
+	current := sign(jwt.MapClaims{"id": "node", "iat": now - 60, "exp": now + 30})
+	renewed := sign(jwt.MapClaims{"id": "node", "iat": now, "exp": now + 90})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/galaxy/proxy/token" || r.Header.Get("Authorization") != "Bearer "+current {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(&model.ProxyToken{Token: renewed})
+	}))
+	defer server.Close()
+
+	p := newTestProxy(t, strings.TrimPrefix(server.URL, "http://"))
+	p.setToken(current)
+
+	// Two thirds of the lifetime of the current token are over, so it gets renewed right away
+	renewAt, ok := getRenewalTime(current)
+	if !ok || renewAt.Unix() != now {
+		t.Fatalf("getRenewalTime() = (%v, %v), want (%v, true)", renewAt.Unix(), ok, now)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.routineRenewToken(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.getToken() != renewed && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.getToken() != renewed {
+		t.Fatalf("Token was not renewed")
+	}
+
+	// The runner rejects the renewed token from now on
+	if err := p.renewToken(ctx); err != errUnauthorized {
+		t.Errorf("renewToken() error = %v, want %v", err, errUnauthorized)
+	}
+
+	// Tokens which don't expire never get renewed
+	if _, ok := getRenewalTime(sign(jwt.MapClaims{"id": "node"})); ok {
+		t.Errorf("getRenewalTime() returned a renewal time for a token without expiry")
+	}
+}
+
+func TestProxy_rejectedToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	p := newTestProxy(t, strings.TrimPrefix(server.URL, "http://"))
+	p.minBackoff, p.maxBackoff = 10*time.Millisecond, 20*time.Millisecond
+
+	// The proxy stops once the runner rejects its token so that it gets restarted with a fresh one
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.run(ctx); err != errUnauthorized {
+		t.Errorf("run() error = %v, want %v", err, errUnauthorized)
+	}
+}
@@ -0,0 +1,263 @@
+package activator
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils"
+)
+
+// The headers set by the scale zero routing rules to describe the original destination of the request
+const (
+	headerProject = "x-og-project"
+	headerService = "x-og-service"
+	headerHost    = "x-og-host"
+	headerPort    = "x-og-port"
+	headerEnv     = "x-og-env"
+	headerVersion = "x-og-version"
+	headerSubset  = "x-og-subset"
+)
+
+// Scaler is the interface of the modules which can scale a service up from zero
+type Scaler interface {
+	WaitForService(service *model.Service) error
+}
+
+// Activator receives the requests sent to services which have been scaled down to zero. It buffers the requests and
+// queues them per service till the service scales back up. The requests are then forwarded to the service.
+type Activator struct {
+	config *Config
+
+	// For scaling up services
+	scaler    Scaler
+	onRequest func(service *model.Service)
+	queues    sync.Map
+	pending   int64 // The number of requests admitted across all queues. Accessed atomically.
+
+	// For forwarding requests
+	proxy *httputil.ReverseProxy
+}
+
+// New creates a new activator. The onRequest callback gets invoked for every request received for a service.
+func New(config *Config, scaler Scaler, onRequest func(service *model.Service)) *Activator {
+	if config == nil {
+		config = &Config{}
+	}
+	config.setDefaults()
+
+	a := &Activator{config: config, scaler: scaler, onRequest: onRequest}
+
+	// A single set of transports is shared by all the requests to reuse connections to the services
+	transport := &protocolTransport{
+		http1: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			MaxIdleConns:          1000,
+			MaxIdleConnsPerHost:   100,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+		h2c: &http2.Transport{
+			// Services speak cleartext http2 (h2c) inside the mesh
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.DialTimeout(network, addr, 30*time.Second)
+			},
+		},
+	}
+
+	a.proxy = &httputil.ReverseProxy{
+		// The destination has already been set on the request
+		Director:  func(*http.Request) {},
+		Transport: &retryTransport{base: transport, attempts: config.RetryAttempts, backoff: config.RetryBackoff},
+
+		// Flush immediately to support streaming responses like server sent events
+		FlushInterval: -1,
+		ErrorHandler:  a.handleError,
+	}
+	return a
+}
+
+// ServeHTTP handles a request sent to a service which has been scaled down to zero
+func (a *Activator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Get the meta data from headers
+	service := &model.Service{
+		ProjectID:   r.Header.Get(headerProject),
+		ID:          r.Header.Get(headerService),
+		Environment: r.Header.Get(headerEnv),
+		Version:     r.Header.Get(headerVersion),
+	}
+	ogHost := r.Header.Get(headerHost)
+	ogPort := r.Header.Get(headerPort)
+	if service.ProjectID == "" || service.ID == "" || ogHost == "" || ogPort == "" {
+		utils.SendErrorResponse(w, r, http.StatusBadRequest, errors.New("request does not contain the original destination"))
+		return
+	}
+
+	// Delete the headers
+	for _, h := range []string{headerProject, headerService, headerHost, headerPort, headerEnv, headerVersion, headerSubset} {
+		r.Header.Del(h)
+	}
+
+	// Shed load before buffering anything once too many requests are waiting for services to scale up
+	release, err := a.admit(service)
+	if err != nil {
+		logrus.Warnf("Rejecting request for service (%s:%s:%s) - %s", service.ProjectID, service.ID, service.Version, err.Error())
+		status := http.StatusServiceUnavailable
+		if err == errServiceQueueFull {
+			status = http.StatusTooManyRequests
+		}
+		w.Header().Set("Retry-After", retryAfterSeconds(a.config.RetryAfter))
+		utils.SendErrorResponse(w, r, status, err)
+		return
+	}
+	defer func() {
+		// The place in the queue may have been released already once the service scaled up
+		if release != nil {
+			release()
+		}
+	}()
+
+	// Buffer the body so that the request can be retried while the routes of the service settle. Bodies of unknown
+	// length are streamed to the service as is since they are usually long lived streams (e.g. grpc).
+	if err := bufferBody(r, a.config.MaxBodyBytes); err != nil {
+		logrus.Errorf("Could not buffer request for service (%s:%s) - %s", service.ProjectID, service.ID, err.Error())
+		status := http.StatusBadRequest
+		if err == errBodyTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		utils.SendErrorResponse(w, r, status, err)
+		return
+	}
+
+	// Add to active request count
+	if a.onRequest != nil {
+		a.onRequest(service)
+	}
+
+	// Wait in the queue of the service till it scales up
+	ctx, cancel := context.WithTimeout(r.Context(), a.config.WaitTimeout)
+	defer cancel()
+	if err := a.wait(ctx, service); err != nil {
+		// There is nobody to respond to if the client has gone away
+		if r.Context().Err() != nil {
+			logrus.Debugf("Client cancelled request for service (%s:%s) while it was scaling up", service.ProjectID, service.ID)
+			return
+		}
+
+		logrus.Errorf("Service (%s:%s) could not be scaled up in time - %s", service.ProjectID, service.ID, err.Error())
+		status := http.StatusServiceUnavailable
+		if err == context.DeadlineExceeded {
+			status = http.StatusGatewayTimeout
+		}
+		utils.SendErrorResponse(w, r, status, err)
+		return
+	}
+
+	// The request no longer occupies a place in the queue
+	release()
+	release = nil
+
+	// Change the destination with the original host and port
+	r.Host = ogHost
+	r.URL.Host = fmt.Sprintf("%s:%s", ogHost, ogPort)
+	r.URL.Scheme = "http"
+
+	a.proxy.ServeHTTP(w, r)
+}
+
+func (a *Activator) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	logrus.Errorf("Could not forward request to %s - %s", r.URL.Host, err.Error())
+	utils.SendErrorResponse(w, r, http.StatusBadGateway, err)
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// bufferBody reads the entire body of the request in memory and makes it replayable. Bodies of unknown length and
+// those of connection upgrades are left untouched.
+func bufferBody(r *http.Request, limit int64) error {
+	if r.Body == nil || r.Body == http.NoBody || isUpgrade(r) {
+		return nil
+	}
+	if r.ContentLength > limit {
+		return errBodyTooLarge
+	}
+	if r.ContentLength < 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	utils.CloseReaderCloser(r.Body)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > limit {
+		return errBodyTooLarge
+	}
+
+	r.ContentLength = int64(len(data))
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	return nil
+}
+
+// isUpgrade returns true if the request asks for a connection upgrade (e.g. websockets)
+func isUpgrade(r *http.Request) bool {
+	for _, v := range r.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WithH2C makes the handler of the proxy server accept cleartext http2 (h2c) requests as well, which are required
+// for grpc
+func WithH2C(h http.Handler) http.Handler {
+	return h2c.NewHandler(h, &http2.Server{})
+}
+
+// protocolTransport forwards http2 requests over h2c and all the others over http1
+type protocolTransport struct {
+	http1 http.RoundTripper
+	h2c   http.RoundTripper
+}
+
+func (t *protocolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.ProtoMajor == 2 {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.http1.RoundTrip(req)
+}
+
+// retryAfterSeconds returns the value of the Retry-After header for the duration. The header only carries whole
+// seconds, so the duration is rounded up to make sure clients don't retry right away.
+func retryAfterSeconds(d time.Duration) string {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
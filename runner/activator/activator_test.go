@@ -0,0 +1,257 @@
+package activator
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+type mockScaler struct {
+	calls int32
+	delay time.Duration
+	block chan struct{}
+	err   error
+}
+
+func (m *mockScaler) WaitForService(service *model.Service) error {
+	atomic.AddInt32(&m.calls, 1)
+	time.Sleep(m.delay)
+	if m.block != nil {
+		<-m.block
+	}
+	return m.err
+}
+
+// newProxyRequest prepares a request the way the scale zero routing rules send it to the activator
+func newProxyRequest(t *testing.T, backendURL, method, body string) *http.Request {
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(backendURL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(method, "/some/path?a=b", strings.NewReader(body))
+	r.Header.Set(headerProject, "p1")
+	r.Header.Set(headerService, "s1")
+	r.Header.Set(headerEnv, "production")
+	r.Header.Set(headerVersion, "v1")
+	r.Header.Set(headerHost, host)
+	r.Header.Set(headerPort, port)
+	return r
+}
+
+func TestActivator_ServeHTTP(t *testing.T) {
+	// The backend rejects the first attempt like the mesh does while the routes settle
+	var attempts int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get(headerService) != "" {
+			t.Errorf("activator forwarded the %s header", headerService)
+		}
+		if r.URL.RequestURI() != "/some/path?a=b" {
+			t.Errorf("activator forwarded request to %s", r.URL.RequestURI())
+		}
+
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(body)
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer backend.Close()
+
+	scaler := &mockScaler{}
+	var reported int32
+	a := New(&Config{RetryBackoff: time.Millisecond}, scaler, func(*model.Service) { atomic.AddInt32(&reported, 1) })
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, newProxyRequest(t, backend.URL, http.MethodPost, "hello"))
+
+	res := w.Result()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("ServeHTTP() status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "hello" {
+		t.Errorf("ServeHTTP() body = %q, want the request body to be replayed on retry", string(body))
+	}
+	if cookies := res.Header["Set-Cookie"]; len(cookies) != 2 {
+		t.Errorf("ServeHTTP() Set-Cookie = %v, want all values", cookies)
+	}
+	if trailer := res.Trailer.Get("X-Checksum"); trailer != "abc" {
+		t.Errorf("ServeHTTP() trailer = %q, want abc", trailer)
+	}
+	if scaler.calls != 1 || reported != 1 {
+		t.Errorf("ServeHTTP() scaler calls = %d, reported = %d, want 1 each", scaler.calls, reported)
+	}
+}
+
+func TestActivator_queue(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	// All the requests received while the service scales up wait for the same scale up
+	scaler := &mockScaler{delay: 50 * time.Millisecond}
+	a := New(&Config{}, scaler, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, newProxyRequest(t, backend.URL, http.MethodGet, ""))
+			if w.Code != http.StatusOK {
+				t.Errorf("ServeHTTP() status = %d, want %d", w.Code, http.StatusOK)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if scaler.calls != 1 {
+		t.Errorf("WaitForService() called %d times, want 1", scaler.calls)
+	}
+}
+
+func TestActivator_errors(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	tests := []struct {
+		name   string
+		config *Config
+		scaler *mockScaler
+		body   string
+		want   int
+	}{
+		{name: "body too large", config: &Config{MaxBodyBytes: 4}, scaler: &mockScaler{}, body: "hello", want: http.StatusRequestEntityTooLarge},
+		{name: "wait timeout", config: &Config{WaitTimeout: 10 * time.Millisecond}, scaler: &mockScaler{delay: 100 * time.Millisecond}, want: http.StatusGatewayTimeout},
+		{name: "scale up failed", config: &Config{}, scaler: &mockScaler{err: errors.New("deployment not ready")}, want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			New(tt.config, tt.scaler, nil).ServeHTTP(w, newProxyRequest(t, backend.URL, http.MethodPost, tt.body))
+			if w.Code != tt.want {
+				t.Errorf("ServeHTTP() status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestActivator_loadShedding(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	scaler := &mockScaler{block: make(chan struct{})}
+	a := New(&Config{MaxQueuedPerService: 2, MaxQueued: 3, RetryAfter: 5 * time.Second}, scaler, nil)
+
+	serve := func(service string) *httptest.ResponseRecorder {
+		r := newProxyRequest(t, backend.URL, http.MethodGet, "")
+		r.Header.Set(headerService, service)
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		return w
+	}
+
+	// Fill up the queues while the services are scaling up
+	var wg sync.WaitGroup
+	for _, service := range []string{"s1", "s1", "s2"} {
+		wg.Add(1)
+		go func(service string) {
+			defer wg.Done()
+			if w := serve(service); w.Code != http.StatusOK {
+				t.Errorf("ServeHTTP() status = %d for queued request, want %d", w.Code, http.StatusOK)
+			}
+		}(service)
+	}
+	for atomic.LoadInt64(&a.pending) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	tests := []struct {
+		name    string
+		service string
+		want    int
+	}{
+		{name: "service queue full", service: "s1", want: http.StatusTooManyRequests},
+		{name: "global queue full", service: "s3", want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(tt.service)
+			if w.Code != tt.want {
+				t.Errorf("ServeHTTP() status = %d, want %d", w.Code, tt.want)
+			}
+			if retryAfter := w.Header().Get("Retry-After"); retryAfter != "5" {
+				t.Errorf("ServeHTTP() Retry-After = %q, want 5", retryAfter)
+			}
+		})
+	}
+
+	// The places in the queues are released once the services scale up
+	close(scaler.block)
+	wg.Wait()
+	if pending := atomic.LoadInt64(&a.pending); pending != 0 {
+		t.Errorf("pending requests = %d after scale up, want 0", pending)
+	}
+}
+
+func TestActivator_clientCancelled(t *testing.T) {
+	scaler := &mockScaler{block: make(chan struct{})}
+	defer close(scaler.block)
+	a := New(&Config{}, scaler, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newProxyRequest(t, "http://localhost:8080", http.MethodGet, "").WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		a.ServeHTTP(w, r)
+		close(done)
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServeHTTP() kept waiting after the client went away")
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("ServeHTTP() responded with %q to a cancelled request", w.Body.String())
+	}
+	if pending := atomic.LoadInt64(&a.pending); pending != 0 {
+		t.Errorf("pending requests = %d after cancellation, want 0", pending)
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{d: 0, want: "1"},
+		{d: 500 * time.Millisecond, want: "1"},
+		{d: 5 * time.Second, want: "5"},
+		{d: 5500 * time.Millisecond, want: "6"},
+	}
+	for _, tt := range tests {
+		if got := retryAfterSeconds(tt.d); got != tt.want {
+			t.Errorf("retryAfterSeconds(%s) = %s, want %s", tt.d, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package activator
+
+import "time"
+
+// Config describes the configuration of the activator
+type Config struct {
+	// The maximum size of a request body which gets buffered. Larger requests are rejected.
+	MaxBodyBytes int64
+
+	// The maximum time a request waits for the service to scale up
+	WaitTimeout time.Duration
+
+	// The number of attempts made to forward a request while the routes of the service settle after scaling up
+	RetryAttempts int
+
+	// The delay before the first retry. It doubles with every attempt.
+	RetryBackoff time.Duration
+
+	// The maximum number of requests waiting for a single service to scale up. Requests beyond this limit are
+	// rejected with a 429.
+	MaxQueuedPerService int
+
+	// The maximum number of requests waiting across all services. Requests beyond this limit are rejected with a 503.
+	MaxQueued int
+
+	// The duration clients are asked to wait before retrying a rejected request
+	RetryAfter time.Duration
+}
+
+func (c *Config) setDefaults() {
+	if c.MaxBodyBytes == 0 {
+		c.MaxBodyBytes = 10 << 20
+	}
+	if c.WaitTimeout == 0 {
+		c.WaitTimeout = 3 * time.Minute
+	}
+	if c.RetryAttempts == 0 {
+		c.RetryAttempts = 5
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = 100 * time.Millisecond
+	}
+	if c.MaxQueuedPerService == 0 {
+		c.MaxQueuedPerService = 250
+	}
+	if c.MaxQueued == 0 {
+		c.MaxQueued = 1000
+	}
+	if c.RetryAfter == 0 {
+		c.RetryAfter = 10 * time.Second
+	}
+}
@@ -0,0 +1,168 @@
+package activator
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// proxyHeaders returns the headers set by the scale zero routing rules for the backend
+func proxyHeaders(t *testing.T, backendURL string) http.Header {
+	r := newProxyRequest(t, backendURL, http.MethodGet, "")
+	h := http.Header{}
+	for _, key := range []string{headerProject, headerService, headerEnv, headerVersion, headerHost, headerPort} {
+		h.Set(key, r.Header.Get(key))
+	}
+	return h
+}
+
+func TestActivator_websocket(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("backend could not upgrade connection - %v", err)
+			return
+		}
+		defer func() { _ = c.Close() }()
+
+		// Echo all messages back
+		for {
+			msgType, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(msgType, data); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+
+	a := New(&Config{}, &mockScaler{}, nil)
+	proxy := httptest.NewServer(WithH2C(a))
+	defer proxy.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http")+"/socket", proxyHeaders(t, backend.URL))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer func() { _ = c.Close() }()
+
+	for _, msg := range []string{"ping", "pong"} {
+		if err := c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("WriteMessage() error = %v", err)
+		}
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage() error = %v", err)
+		}
+		if string(data) != msg {
+			t.Errorf("ReadMessage() = %s, want %s", string(data), msg)
+		}
+	}
+}
+
+func TestActivator_serverSentEvents(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+
+		// Hold the stream open till the client has received the first event
+		<-release
+		_, _ = io.WriteString(w, "data: second\n\n")
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	a := New(&Config{}, &mockScaler{}, nil)
+	proxy := httptest.NewServer(WithH2C(a))
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/events", nil)
+	req.Header = proxyHeaders(t, backend.URL)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	line := make(chan string, 1)
+	go func() {
+		l, _ := bufio.NewReader(res.Body).ReadString('\n')
+		line <- l
+	}()
+
+	select {
+	case l := <-line:
+		if l != "data: first\n" {
+			t.Errorf("received %q, want the first event", l)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first event was not flushed to the client")
+	}
+}
+
+func TestActivator_h2c(t *testing.T) {
+	// The backend behaves like a grpc server which streams the request body back and sets the status in a trailer
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("backend received request over %s, want HTTP/2", r.Proto)
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		data, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(data)
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer backend.Close()
+
+	a := New(&Config{}, &mockScaler{}, nil)
+	proxy := httptest.NewServer(WithH2C(a))
+	defer proxy.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	// Stream a body of unknown length
+	reader, writer := io.Pipe()
+	go func() {
+		_, _ = io.WriteString(writer, "hello ")
+		_, _ = io.WriteString(writer, "world")
+		_ = writer.Close()
+	}()
+
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/pkg.Service/Method", reader)
+	req.Header = proxyHeaders(t, backend.URL)
+	req.Header.Set("Content-Type", "application/grpc")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "hello world" {
+		t.Errorf("response body = %q, want hello world", string(body))
+	}
+	if status := res.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("Grpc-Status trailer = %q, want 0", status)
+	}
+}
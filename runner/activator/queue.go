@@ -0,0 +1,107 @@
+package activator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// The time for which a service is considered to be ready after it has scaled up. Requests received in this period
+// are forwarded right away, since the routing rules of the service take a while to get reverted.
+const readyPeriod = 10 * time.Second
+
+var (
+	errServiceQueueFull = errors.New("too many requests waiting for the service to scale up")
+	errQueueFull        = errors.New("too many requests waiting for services to scale up")
+)
+
+// queue holds the requests waiting for a service to scale up
+type queue struct {
+	lock    sync.Mutex
+	waiters []chan error
+	readyAt time.Time
+
+	// The number of requests admitted to the queue
+	pending int
+}
+
+func makeQueueKey(service *model.Service) string {
+	return fmt.Sprintf("%s:%s:%s:%s", service.ProjectID, service.Environment, service.ID, service.Version)
+}
+
+func (a *Activator) getQueue(service *model.Service) *queue {
+	v, _ := a.queues.LoadOrStore(makeQueueKey(service), &queue{})
+	return v.(*queue)
+}
+
+// admit reserves a place for the request in the queue of the service. It fails if either the queue of the service
+// or the activator as a whole is full. The returned function must be called to release the place.
+func (a *Activator) admit(service *model.Service) (func(), error) {
+	q := a.getQueue(service)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.pending >= a.config.MaxQueuedPerService {
+		return nil, errServiceQueueFull
+	}
+	if atomic.AddInt64(&a.pending, 1) > int64(a.config.MaxQueued) {
+		atomic.AddInt64(&a.pending, -1)
+		return nil, errQueueFull
+	}
+	q.pending++
+
+	return func() {
+		q.lock.Lock()
+		q.pending--
+		q.lock.Unlock()
+		atomic.AddInt64(&a.pending, -1)
+	}, nil
+}
+
+// wait blocks till the service has scaled up or the context is done. The first request in the queue triggers the
+// scale up. All the other requests wait for its result.
+func (a *Activator) wait(ctx context.Context, service *model.Service) error {
+	q := a.getQueue(service)
+
+	q.lock.Lock()
+	if time.Since(q.readyAt) < readyPeriod {
+		q.lock.Unlock()
+		return nil
+	}
+
+	ch := make(chan error, 1)
+	q.waiters = append(q.waiters, ch)
+	if len(q.waiters) == 1 {
+		go a.scaleUp(q, service)
+	}
+	q.lock.Unlock()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *Activator) scaleUp(q *queue, service *model.Service) {
+	err := a.scaler.WaitForService(service)
+
+	q.lock.Lock()
+	if err == nil {
+		q.readyAt = time.Now()
+	}
+	waiters := q.waiters
+	q.waiters = nil
+	q.lock.Unlock()
+
+	// Notify all the requests waiting in the queue. The channels are buffered, so requests which gave up waiting
+	// don't block us.
+	for _, ch := range waiters {
+		ch <- err
+	}
+}
@@ -0,0 +1,59 @@
+package activator
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/spaceuptech/galaxy/utils"
+)
+
+// retryTransport retries requests while the routing rules of a service settle after it has scaled up. The service may
+// refuse connections or the mesh may respond with a 404 or 503 during this period.
+type retryTransport struct {
+	base     http.RoundTripper
+	attempts int
+	backoff  time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := t.backoff
+	for i := 1; ; i++ {
+		// Requests with a body can only be retried if the body can be replayed
+		attempt := req
+		if i > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attempt = req.Clone(req.Context())
+			attempt.Body = body
+		}
+
+		res, err := t.base.RoundTrip(attempt)
+		if i == t.attempts || !shouldRetry(res, err) || (req.GetBody == nil && req.Body != nil && req.Body != http.NoBody) {
+			return res, err
+		}
+
+		// Discard the response before retrying
+		if res != nil {
+			_, _ = io.Copy(ioutil.Discard, res.Body)
+			utils.CloseReaderCloser(res.Body)
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func shouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusServiceUnavailable
+}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/spaceuptech/galaxy/model"
 )
 
 type aggregator struct {
@@ -24,7 +27,17 @@ func (a *aggregator) splitKey(key string) (project, service, env, version string
 	return array[0], array[1], array[2], array[3]
 }
 
-func (a *aggregator) add(project, service, env, version, nodeID string, value int32) {
+func (a *aggregator) add(project, service, env, version, nodeID string, value int32, metrics *model.ProxyMetrics) {
+	var s *stats
+	if metrics != nil {
+		s = new(stats)
+		s.add(metrics)
+	}
+	a.addCounter(project, service, env, version, nodeID, value, 1, s)
+}
+
+// addCounter adds a set of pre-aggregated samples of a node. The detailed stats are optional.
+func (a *aggregator) addCounter(project, service, env, version, nodeID string, value, nos int32, s *stats) {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
@@ -41,7 +54,13 @@ func (a *aggregator) add(project, service, env, version, nodeID string, value in
 	}
 
 	c.value += value
-	c.nos++
+	c.nos += nos
+	if s != nil {
+		if c.stats == nil {
+			c.stats = new(stats)
+		}
+		c.stats.merge(s)
+	}
 }
 
 func (a *aggregator) iterate(cb func(project, service, env, version string, value int32)) {
@@ -76,6 +95,19 @@ func (a *aggregator) get(project, service, env, version string) int32 {
 	return value
 }
 
+// stats returns the detailed stats of the service aggregated across all its nodes. It returns nil if none of the
+// nodes have reported detailed stats.
+func (a *aggregator) stats(project, service, env, version string, now time.Time) *model.ServiceStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	nodes, p := a.count[a.makeKey(project, service, env, version)]
+	if !p {
+		return nil
+	}
+	return serviceStats(nodes, now)
+}
+
 func (a *aggregator) delete(project, service, env, version string) {
 	a.lock.Lock()
 	defer a.lock.Unlock()
@@ -0,0 +1,190 @@
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils"
+	"github.com/spaceuptech/galaxy/utils/audit"
+	"github.com/spaceuptech/galaxy/utils/auth"
+)
+
+func (runner *Runner) syncAPIKeys() {
+	keys, err := runner.driver.GetAPIKeys()
+	if err != nil {
+		logrus.Errorf("Could not sync api keys - %s", err.Error())
+		return
+	}
+	runner.auth.SetAPIKeys(keys)
+}
+
+// withoutHash returns a copy of the api key which is safe to be sent in responses
+func withoutHash(key *model.APIKey) *model.APIKey {
+	k := *key
+	k.Hash = ""
+	return &k
+}
+
+// authorizeAPIKey checks if the claims allow managing the keys granting access to the environments of a project. Keys
+// without any environments grant access to all of them.
+func authorizeAPIKey(claims *auth.Claims, project string, envs []string) error {
+	if len(envs) == 0 {
+		return claims.AuthorizeProject(auth.ActionManageProject, project)
+	}
+	for _, env := range envs {
+		if err := claims.Authorize(auth.ActionManageProject, project, env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (runner *Runner) handleCreateAPIKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := runner.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to create api key - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+
+		// Parse request body
+		req := new(model.APIKeyRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			logrus.Errorf("Failed to create api key - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if project, ok := claims.DefaultProject(); ok && req.Project == "" {
+			req.Project = project
+		}
+
+		audit.SetTarget(r, req.Project, "", req.Name)
+
+		// Keys can't grant access to environments the user doesn't have access to
+		if len(req.Environments) == 0 && !claims.IsAdmin() {
+			req.Environments = claims.Environments
+		}
+		if err := authorizeAPIKey(claims, req.Project, req.Environments); err != nil {
+			logrus.Errorf("Failed to create api key for project (%s) - %s", req.Project, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		key, apiKey, err := auth.NewAPIKey(req)
+		if err != nil {
+			logrus.Errorf("Failed to create api key - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if err := runner.driver.SaveAPIKey(apiKey); err != nil {
+			logrus.Errorf("Failed to create api key - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		runner.syncAPIKeys()
+		audit.SetTarget(r, apiKey.Project, "", apiKey.ID)
+
+		logrus.Infof("Created api key (%s) for project (%s)", apiKey.ID, apiKey.Project)
+		utils.SendResponse(w, r, http.StatusOK, &model.APIKeyResponse{Key: key, APIKey: withoutHash(apiKey)})
+	}
+}
+
+func (runner *Runner) handleGetAPIKeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := runner.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to get api keys - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+
+		keys, err := runner.driver.GetAPIKeys()
+		if err != nil {
+			logrus.Errorf("Failed to get api keys - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		// Only return the keys of the projects and environments the user manages
+		project := r.URL.Query().Get("project")
+		result := make([]*model.APIKey, 0, len(keys))
+		for _, key := range keys {
+			if project != "" && key.Project != project {
+				continue
+			}
+			if authorizeAPIKey(claims, key.Project, key.Environments) == nil {
+				result = append(result, withoutHash(key))
+			}
+		}
+		utils.SendResponse(w, r, http.StatusOK, map[string]interface{}{"apiKeys": result})
+	}
+}
+
+func (runner *Runner) handleRevokeAPIKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := runner.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to revoke api key - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+
+		keys, err := runner.driver.GetAPIKeys()
+		if err != nil {
+			logrus.Errorf("Failed to revoke api key - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+		var key *model.APIKey
+		for _, k := range keys {
+			if k.ID == id {
+				key = k
+				break
+			}
+		}
+		if key == nil {
+			utils.SendErrorResponse(w, r, http.StatusNotFound, errors.New("api key not found"))
+			return
+		}
+
+		audit.SetTarget(r, key.Project, "", key.ID)
+
+		if err := authorizeAPIKey(claims, key.Project, key.Environments); err != nil {
+			logrus.Errorf("Failed to revoke api key (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		if err := runner.driver.DeleteAPIKey(id); err != nil {
+			logrus.Errorf("Failed to revoke api key (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		runner.syncAPIKeys()
+
+		logrus.Infof("Revoked api key (%s) of project (%s)", id, key.Project)
+		utils.SendEmptySuccessResponse(w, r)
+	}
+}
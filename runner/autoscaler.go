@@ -1,15 +1,8 @@
 package runner
 
 import (
-	"context"
-	"encoding/json"
-	"fmt"
-	"strings"
 	"time"
 
-	"github.com/dgraph-io/badger"
-	"github.com/dgraph-io/badger/pb"
-	"github.com/segmentio/ksuid"
 	"github.com/sirupsen/logrus"
 
 	"github.com/spaceuptech/galaxy/model"
@@ -17,47 +10,17 @@ import (
 
 type counter struct {
 	value, nos int32
-}
-
-type metric struct {
-	Value int32 `json:"val"`
-	Ts    int64 `json:"ts"`
+	stats      *stats
 }
 
 func (runner *Runner) aggregate() {
-	// Create a 60s aggregator and a 6s aggregator
-	a60 := newAggregator()
-	a6 := newAggregator()
-
 	// Take the current time snapshot
-	now := time.Now().Unix()
-
-	// Create stream
-	stream := runner.db.NewStream()
-	stream.NumGo = 16
-	stream.Prefix = []byte("metrics")
-	stream.Send = func(list *pb.KVList) error {
-		for _, kv := range list.Kv {
-			// Get the project id, service, version and node id
-			array := strings.Split(string(kv.Key), "/")
-			project, service, env, version, nodeID := array[1], array[2], array[3], array[4], array[5]
-
-			// Unmarshal the metrics from badger
-			m := new(metric)
-			_ = json.Unmarshal(kv.Value, m)
-
-			// Add the metric to the 60s aggregator. Add it to the 6s aggregator only if its less that 6s old.
-			a60.add(project, service, env, version, nodeID, m.Value)
-			if m.Ts+6 >= now {
-				a6.add(project, service, env, version, nodeID, m.Value)
-			}
-		}
-		return nil
-	}
+	t := time.Now()
 
-	// Orchestrate the stream
-	if err := stream.Orchestrate(context.Background()); err != nil {
-		logrus.Errorln("Could start stream from badger:", err)
+	// Get the 60s and 6s aggregations from the metric store
+	a60, a6, err := runner.store.aggregate(t)
+	if err != nil {
+		logrus.Errorln("Could not aggregate metrics:", err)
 		return
 	}
 
@@ -73,6 +36,17 @@ func (runner *Runner) aggregate() {
 			value = v6
 		}
 
+		// Store the aggregated value in the downsampled retention tiers
+		if err := runner.recordRollups(project, service, env, version, value, t); err != nil {
+			logrus.Errorf("Could not record metrics rollup of service (%s:%s): %s", project, service, err.Error())
+		}
+		if err := runner.state.setScaleDecision(project, service, env, version, value, t); err != nil {
+			logrus.Errorf("Could not persist scale decision of service (%s:%s): %s", project, service, err.Error())
+		}
+		if s := a60.stats(project, service, env, version, t); s != nil {
+			runner.state.setStats(project, service, env, version, s)
+		}
+
 		// Adjust the scale of the service
 		go func() {
 			if err := runner.driver.AdjustScale(&model.Service{ProjectID: project, ID: service, Environment: env, Version: version}, value); err != nil {
@@ -93,43 +67,78 @@ func (runner *Runner) aggregate() {
 }
 
 func (runner *Runner) routineAdjustScale() {
+	defer runner.wg.Done()
+
 	ticker := time.NewTicker(5 * time.Second)
-	for range ticker.C {
-		runner.aggregate()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-runner.done:
+			return
+		case <-ticker.C:
+			// Only the leader adjusts the scale of services. It picks up the state of the previous leader first.
+			if !runner.elector.IsLeader() {
+				runner.releaseSharedState()
+				continue
+			}
+			if err := runner.ensureSharedState(); err != nil {
+				logrus.Errorln("Could not restore shared state:", err)
+				continue
+			}
+			runner.aggregate()
+		}
 	}
 }
 
 func (runner *Runner) routineDumpDetails() {
+	defer runner.wg.Done()
+
 	messages := make([]*model.ProxyMessage, 0)
+	flush := func() {
+		if len(messages) > 0 {
+			if err := runner.storeMetrics(messages); err != nil {
+				logrus.Errorln("Could not store metrics:", err)
+			}
+			messages = []*model.ProxyMessage{}
+		}
+	}
+
 	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-ticker.C:
-			if len(messages) > 0 {
-				if err := runner.flushMetrics(messages); err != nil {
-					logrus.Errorln("Could not flush metrics to disk:", err)
+		case <-runner.done:
+			// Flush the pending messages before exiting
+			for {
+				select {
+				case msg := <-runner.chAppend:
+					messages = append(messages, msg)
+				default:
+					flush()
+					return
 				}
-				messages = []*model.ProxyMessage{}
 			}
+		case <-ticker.C:
+			flush()
 		case msg := <-runner.chAppend:
 			messages = append(messages, msg)
 		}
 	}
 }
 
-func (runner *Runner) flushMetrics(metrics []*model.ProxyMessage) error {
-	return runner.db.Update(func(txn *badger.Txn) error {
-		for _, m := range metrics {
-			// Prepare the key and values
-			key := fmt.Sprintf("metrics/%s/%s/%s/%s/%s/%s", m.Project, m.Service, m.Environment, m.Version, m.NodeID, ksuid.New().String())
-			data, _ := json.Marshal(&metric{Ts: time.Now().Unix(), Value: m.ActiveRequests})
-			// Set entry in badger
-			e := badger.NewEntry([]byte(key), data).WithTTL(time.Minute)
-			if err := txn.SetEntry(e); err != nil {
-				return err
+func (runner *Runner) routineSnapshotMetrics(s snapshotter) {
+	defer runner.wg.Done()
+
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-runner.done:
+			return
+		case <-ticker.C:
+			if err := s.snapshot(); err != nil {
+				logrus.Errorln("Could not snapshot metrics:", err)
 			}
 		}
-
-		return nil
-	})
+	}
 }
@@ -1,8 +1,14 @@
 package runner
 
 import (
+	"time"
+
+	"github.com/spaceuptech/galaxy/runner/activator"
 	"github.com/spaceuptech/galaxy/runner/driver"
+	"github.com/spaceuptech/galaxy/runner/services"
+	"github.com/spaceuptech/galaxy/utils"
 	"github.com/spaceuptech/galaxy/utils/auth"
+	"github.com/spaceuptech/galaxy/utils/certs"
 )
 
 // Config is the object required to configure the runner
@@ -10,9 +16,85 @@ type Config struct {
 	Port      string
 	ProxyPort string
 
+	// The time given to in-flight requests to complete when shutting down
+	ShutdownTimeout time.Duration
+
+	// The directory in which the runner persists its state
+	DataDir string
+
+	// Tuning options for the embedded database
+	DB *DBConfig
+
+	// The store used for the samples of the autoscaler
+	MetricStore MetricStoreType
+
+	// The duration the audit entries are retained for
+	AuditRetention time.Duration
+
+	// Certificates for serving the runner and its proxy over tls. The metrics proxies may authenticate with a client
+	// certificate signed by one of the authorities instead of a token. The authorities are also used to verify the
+	// certificates of the other runner replicas.
+	TLS *certs.Config
+
+	// The cross origin requests accepted by the runner api
+	Cors *utils.CorsConfig
+
+	// Configuration for the proxy which scales services up from zero
+	Proxy *activator.Config
+
+	// Configuration for electing the leader amongst the runner replicas
+	Election *ElectionConfig
+
 	// Configuration for the driver
 	Driver *driver.Config
 
 	// Configuration for the auth module
 	Auth *auth.Config
+
+	// Configuration for DO provider
+	Providers *services.Config
+}
+
+// DBConfig holds the tuning options of the embedded badger database
+type DBConfig struct {
+	// Sync all writes to disk before acknowledging them
+	SyncWrites bool
+
+	// Truncate the value log to recover from a crash instead of refusing to start
+	Truncate bool
+
+	// Sizes of the value log files and the tables in MB. The badger defaults are used if zero.
+	ValueLogFileSize int64
+	MaxTableSize     int64
+
+	// Interval and discard ratio of the value log garbage collection
+	GCInterval     time.Duration
+	GCDiscardRatio float64
+}
+
+// ElectionMode describes how the leader amongst the runner replicas gets elected
+type ElectionMode string
+
+const (
+	// ElectionNone is used when a single replica of the runner is running
+	ElectionNone ElectionMode = "none"
+
+	// ElectionDriver uses the mechanism provided by the driver (a lease for kubernetes)
+	ElectionDriver ElectionMode = "driver"
+
+	// ElectionFile uses a lock file shared by all the replicas
+	ElectionFile ElectionMode = "file"
+)
+
+// ElectionConfig describes how the leader amongst the runner replicas gets elected. Only the leader adjusts the scale
+// of services. The other replicas forward the metrics they receive to the leader along with the requests for the
+// services, the metrics and the audit log.
+type ElectionConfig struct {
+	Mode ElectionMode
+
+	// The address (host:port) at which the other replicas can reach this replica. It is used as its identity.
+	AdvertiseAddr string
+
+	// The path of the lock file for the file election mode
+	LockFile string
 }
@@ -0,0 +1,63 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/sirupsen/logrus"
+)
+
+func openDB(dataDir string, c *DBConfig) (*badger.DB, error) {
+	if c == nil {
+		c = &DBConfig{}
+	}
+
+	// Make sure the data directory exists
+	dir := filepath.Join(dataDir, "galaxy.db")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	opts := badger.DefaultOptions(dir).WithSyncWrites(c.SyncWrites).WithTruncate(c.Truncate)
+	opts.Logger = &logrus.Logger{Out: ioutil.Discard}
+	if c.ValueLogFileSize > 0 {
+		opts = opts.WithValueLogFileSize(c.ValueLogFileSize << 20)
+	}
+	if c.MaxTableSize > 0 {
+		opts = opts.WithMaxTableSize(c.MaxTableSize << 20)
+	}
+
+	logrus.Infof("Opening runner database at %s", dir)
+	return badger.Open(opts)
+}
+
+// routineGarbageCollect periodically runs the garbage collector of the value log till the runner is closed
+func (runner *Runner) routineGarbageCollect() {
+	interval, ratio := 5*time.Minute, 0.7
+	if c := runner.config.DB; c != nil {
+		if c.GCInterval > 0 {
+			interval = c.GCInterval
+		}
+		if c.GCDiscardRatio > 0 {
+			ratio = c.GCDiscardRatio
+		}
+	}
+
+	defer runner.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-runner.done:
+			return
+		case <-ticker.C:
+			// Keep collecting till there is nothing left to rewrite
+			for runner.db.RunValueLogGC(ratio) == nil {
+			}
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 
 	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/runner/driver/istio"
+	"github.com/spaceuptech/galaxy/runner/election"
 	"github.com/spaceuptech/galaxy/utils/auth"
 )
 
@@ -20,6 +22,7 @@ func New(auth *auth.Module, c *Config) (Driver, error) {
 			istioConfig = istio.GenerateOutsideClusterConfig(c.ConfigFilePath)
 		}
 		istioConfig.SetProxyPort(c.ProxyPort)
+		istioConfig.SetNodeAgent(c.NodeAgent)
 
 		return istio.NewIstioDriver(auth, istioConfig)
 	default:
@@ -33,6 +36,7 @@ type Config struct {
 	ConfigFilePath string
 	IsInCluster    bool
 	ProxyPort      uint32
+	NodeAgent      bool
 }
 
 // Driver is the interface of the modules which interact with the deployment targets
@@ -41,5 +45,17 @@ type Driver interface {
 	ApplyService(service *model.Service) error
 	AdjustScale(service *model.Service, activeReqs int32) error
 	WaitForService(service *model.Service) error
+	GetServiceStatus(service *model.Service) (*model.ServiceStatus, error)
+	NewElector(identity string) (election.Elector, error)
+	RefreshProxyTokens() error
+	RevokeProxy(id string) error
+	GetRevokedProxies() ([]string, error)
+	SaveAPIKey(key *model.APIKey) error
+	DeleteAPIKey(id string) error
+	GetAPIKeys() ([]*model.APIKey, error)
+	SaveState(kind, key string, data []byte) error
+	DeleteState(kind, key string) error
+	GetState(kind string) (map[string][]byte, error)
 	Type() model.DriverType
+	Close() error
 }
@@ -0,0 +1,58 @@
+package istio
+
+import (
+	"encoding/json"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// The api keys are stored in secrets in the galaxy namespace so that they are shared by all the runner replicas
+
+// SaveAPIKey stores an api key
+func (i *Istio) SaveAPIKey(key *model.APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: getAPIKeySecretName(key.ID), Namespace: galaxyNamespace, Labels: map[string]string{apiKeyLabel: "true", "project": key.Project}},
+		Data:       map[string][]byte{"key": data},
+	}
+	logrus.Debugf("Creating api key secret %s in %s", secret.Name, galaxyNamespace)
+	_, err = i.kube.CoreV1().Secrets(galaxyNamespace).Create(secret)
+	return err
+}
+
+// DeleteAPIKey deletes an api key. It is a no-op if the key doesn't exist.
+func (i *Istio) DeleteAPIKey(id string) error {
+	err := i.kube.CoreV1().Secrets(galaxyNamespace).Delete(getAPIKeySecretName(id), &metav1.DeleteOptions{})
+	if kubeErrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// GetAPIKeys returns all the api keys
+func (i *Istio) GetAPIKeys() ([]*model.APIKey, error) {
+	secrets, err := i.kube.CoreV1().Secrets(galaxyNamespace).List(metav1.ListOptions{LabelSelector: apiKeyLabel})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*model.APIKey, 0, len(secrets.Items))
+	for _, secret := range secrets.Items {
+		key := new(model.APIKey)
+		if err := json.Unmarshal(secret.Data["key"], key); err != nil {
+			logrus.Errorf("Could not parse api key secret (%s) - %s", secret.Name, err.Error())
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
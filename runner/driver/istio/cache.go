@@ -0,0 +1,158 @@
+package istio
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	networkingv1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	versionedclient "istio.io/client-go/pkg/clientset/versioned"
+	istioInformers "istio.io/client-go/pkg/informers/externalversions"
+	istioListers "istio.io/client-go/pkg/listers/networking/v1alpha3"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appsListers "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The interval after which the informers resync their entire cache
+const resyncPeriod = 5 * time.Minute
+
+// resourceCache keeps a local copy of the deployments and virtual services managed by galaxy. It is backed by a single
+// shared watch per resource type, so reads and readiness waits don't hit the api server. The copy may lag behind, so
+// updates need to be made on objects fetched from the api server.
+type resourceCache struct {
+	kubeFactory  informers.SharedInformerFactory
+	istioFactory istioInformers.SharedInformerFactory
+
+	deployments     appsListers.DeploymentLister
+	virtualServices istioListers.VirtualServiceLister
+
+	// Channels to notify the waiters of a deployment when it changes
+	lock    sync.Mutex
+	waiters map[string][]chan struct{}
+}
+
+func newResourceCache(kube kubernetes.Interface, istio versionedclient.Interface) *resourceCache {
+	// Only the deployments created by galaxy are of interest
+	kubeFactory := informers.NewSharedInformerFactoryWithOptions(kube, resyncPeriod, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.LabelSelector = "app,version"
+	}))
+	istioFactory := istioInformers.NewSharedInformerFactory(istio, resyncPeriod)
+
+	c := &resourceCache{
+		kubeFactory:     kubeFactory,
+		istioFactory:    istioFactory,
+		deployments:     kubeFactory.Apps().V1().Deployments().Lister(),
+		virtualServices: istioFactory.Networking().V1alpha3().VirtualServices().Lister(),
+		waiters:         map[string][]chan struct{}{},
+	}
+
+	kubeFactory.Apps().V1().Deployments().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.notify,
+		UpdateFunc: func(_, obj interface{}) { c.notify(obj) },
+	})
+	return c
+}
+
+// start starts the informers and blocks till the cache has synced
+func (c *resourceCache) start(stopCh <-chan struct{}) error {
+	c.kubeFactory.Start(stopCh)
+	c.istioFactory.Start(stopCh)
+
+	for t, synced := range c.kubeFactory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return fmt.Errorf("could not sync cache of %v", t)
+		}
+	}
+	for t, synced := range c.istioFactory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return fmt.Errorf("could not sync cache of %v", t)
+		}
+	}
+	return nil
+}
+
+func makeCacheKey(ns, name string) string {
+	return fmt.Sprintf("%s/%s", ns, name)
+}
+
+func (c *resourceCache) notify(obj interface{}) {
+	deployment, ok := obj.(*appsv1.Deployment)
+	if !ok {
+		return
+	}
+
+	key := makeCacheKey(deployment.Namespace, deployment.Name)
+	c.lock.Lock()
+	waiters := c.waiters[key]
+	delete(c.waiters, key)
+	c.lock.Unlock()
+
+	for _, ch := range waiters {
+		close(ch)
+	}
+}
+
+// getDeployment returns a copy of the deployment which is safe to modify
+func (c *resourceCache) getDeployment(ns, name string) (*appsv1.Deployment, error) {
+	deployment, err := c.deployments.Deployments(ns).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return deployment.DeepCopy(), nil
+}
+
+// getVirtualService returns the virtual service from the cache. It must not be modified.
+func (c *resourceCache) getVirtualService(ns, name string) (*networkingv1alpha3.VirtualService, error) {
+	return c.virtualServices.VirtualServices(ns).Get(name)
+}
+
+// waitForDeployment blocks till the deployment satisfies the condition or the context is done. All the waiters share
+// the same watch and get notified whenever the deployment changes.
+func (c *resourceCache) waitForDeployment(ctx context.Context, ns, name string, condition func(deployment *appsv1.Deployment) bool) error {
+	key := makeCacheKey(ns, name)
+	for {
+		// Register before checking the cache so that we don't miss an update in between
+		ch := make(chan struct{})
+		c.lock.Lock()
+		c.waiters[key] = append(c.waiters[key], ch)
+		c.lock.Unlock()
+
+		deployment, err := c.deployments.Deployments(ns).Get(name)
+		if err == nil && condition(deployment) {
+			c.removeWaiter(key, ch)
+			return nil
+		}
+		if err != nil {
+			logrus.Debugf("Deployment (%s) not found in cache yet - %s", key, err.Error())
+		}
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			c.removeWaiter(key, ch)
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *resourceCache) removeWaiter(key string, ch chan struct{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	waiters := c.waiters[key]
+	for i, w := range waiters {
+		if w == ch {
+			c.waiters[key] = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(c.waiters[key]) == 0 {
+		delete(c.waiters, key)
+	}
+}
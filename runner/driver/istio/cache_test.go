@@ -0,0 +1,57 @@
+package istio
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	istioFake "istio.io/client-go/pkg/clientset/versioned/fake"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeFake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestResourceCache_waitForDeployment(t *testing.T) {
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "s1-v1", Namespace: "p1-production", Labels: map[string]string{"app": "s1", "version": "v1"}}}
+	kube := kubeFake.NewSimpleClientset(deployment)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	c := newResourceCache(kube, istioFake.NewSimpleClientset())
+	if err := c.start(stopCh); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+
+	ready := func(d *appsv1.Deployment) bool { return d.Status.ReadyReplicas >= 1 }
+
+	// Multiple waiters share the same watch
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			errs <- c.waitForDeployment(ctx, "p1-production", "s1-v1", ready)
+		}()
+	}
+
+	updated := deployment.DeepCopy()
+	updated.Status.ReadyReplicas = 1
+	if _, err := kube.AppsV1().Deployments("p1-production").UpdateStatus(updated); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("waitForDeployment() error = %v", err)
+		}
+	}
+
+	// Waiters give up once the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.waitForDeployment(ctx, "p1-production", "s2-v1", ready); err != context.DeadlineExceeded {
+		t.Errorf("waitForDeployment() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := len(c.waiters); n != 0 {
+		t.Errorf("waiters = %d after all waits returned, want 0", n)
+	}
+}
@@ -5,6 +5,9 @@ type Config struct {
 	IsInsideCluster bool
 	KubeConfigPath  string
 	ProxyPort       uint32
+
+	// Metrics are collected by the node agents instead of a container injected in every pod
+	NodeAgent bool
 }
 
 // GenerateInClusterConfig returns a in-cluster config
@@ -21,3 +24,8 @@ func GenerateOutsideClusterConfig(kubeConfigPath string) *Config {
 func (c *Config) SetProxyPort(port uint32) {
 	c.ProxyPort = port
 }
+
+// SetNodeAgent enables or disables the collection of metrics by node agents
+func (c *Config) SetNodeAgent(enabled bool) {
+	c.NodeAgent = enabled
+}
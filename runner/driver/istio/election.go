@@ -0,0 +1,61 @@
+package istio
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/spaceuptech/galaxy/runner/election"
+)
+
+// leaseElector elects the leader amongst the runner replicas using a kubernetes lease
+type leaseElector struct {
+	elector *leaderelection.LeaderElector
+}
+
+// NewElector returns an elector which uses a kubernetes lease in the galaxy namespace to elect the leader
+func (i *Istio) NewElector(identity string) (election.Elector, error) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: "galaxy-runner", Namespace: galaxyNamespace},
+		Client:     i.kube.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Name:            "galaxy-runner",
+		Lock:            lock,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) { logrus.Infof("Acquired leadership (%s) of runner replicas", identity) },
+			OnStoppedLeading: func() { logrus.Infof("Lost leadership (%s) of runner replicas", identity) },
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &leaseElector{elector: elector}, nil
+}
+
+// Run campaigns for leadership till the context is cancelled. The client-go elector returns as soon as the leadership
+// is lost, so we keep campaigning again.
+func (l *leaseElector) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		l.elector.Run(ctx)
+	}
+}
+
+func (l *leaseElector) IsLeader() bool {
+	return l.elector.IsLeader()
+}
+
+func (l *leaseElector) Leader() string {
+	return l.elector.GetLeader()
+}
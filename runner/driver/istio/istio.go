@@ -1,12 +1,13 @@
 package istio
 
 import (
+	"context"
 	"fmt"
-	"math"
-	"strconv"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"istio.io/client-go/pkg/apis/networking/v1alpha3"
 	versionedclient "istio.io/client-go/pkg/clientset/versioned"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
@@ -15,6 +16,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
 
 	"github.com/spaceuptech/galaxy/model"
 	"github.com/spaceuptech/galaxy/utils/auth"
@@ -30,8 +32,15 @@ type Istio struct {
 	adjustScaleLock sync.Map
 
 	// Drivers to talk to k8s and istio
-	kube  *kubernetes.Clientset
-	istio *versionedclient.Clientset
+	kube  kubernetes.Interface
+	istio versionedclient.Interface
+
+	// Local copy of the resources to avoid hitting the api server
+	cache *resourceCache
+
+	// For tracking background routines
+	wg     sync.WaitGroup
+	stopCh chan struct{}
 }
 
 // NewIstioDriver creates a new instance of the istio driver
@@ -60,17 +69,45 @@ func NewIstioDriver(auth *auth.Module, c *Config) (*Istio, error) {
 		return nil, err
 	}
 
-	return &Istio{auth: auth, config: c, kube: kube, istio: istio}, nil
+	return newIstio(auth, c, kube, istio)
+}
+
+func newIstio(auth *auth.Module, c *Config, kube kubernetes.Interface, istio versionedclient.Interface) (*Istio, error) {
+	i := &Istio{auth: auth, config: c, kube: kube, istio: istio, cache: newResourceCache(kube, istio), stopCh: make(chan struct{})}
+	if err := i.cache.start(i.stopCh); err != nil {
+		close(i.stopCh)
+		return nil, err
+	}
+
+	if c.NodeAgent {
+		if err := i.applyAgentToken(); err != nil {
+			close(i.stopCh)
+			return nil, err
+		}
+	}
+	return i, nil
+}
+
+// Close stops the informers and waits for the background routines to finish
+func (i *Istio) Close() error {
+	close(i.stopCh)
+	i.wg.Wait()
+	return nil
 }
 
 // ApplyService deploys the service on istio
 func (i *Istio) ApplyService(service *model.Service) error {
 	// TODO: do we need to rollback on failure? rollback to previous version if it existed else remove
 	// TODO: Add support for custom runtime
-	// TODO: Add support for running multiple versions
-	// We are hard coding the version right now. But we need to create rules for running multiple versions of
-	// the same service. Also the traffic splitting between the versions needs to be configurable
-	service.Version = "v1"
+	// Multiple versions of the same service can run side by side. Each version gets its own deployment and subset
+	// while the rest of the resources are shared between the versions.
+	if service.Version == "" {
+		service.Version = "v1"
+	}
+
+	if err := validateTraffic(service); err != nil {
+		return err
+	}
 
 	ns := getNamespaceName(service.ProjectID, service.Environment)
 
@@ -92,9 +129,21 @@ func (i *Istio) ApplyService(service *model.Service) error {
 	istioAuthPolicy := generateAuthPolicy(service)
 	istioSidecar := generateSidecarConfig(service)
 
+	// The metrics proxies read their token from a secret which needs to exist before the pods get created
+	if i.needsMetricsProxy(service) {
+		if err := i.applyProxyToken(ns, service); err != nil {
+			return err
+		}
+	}
+
 	// Create a service account if it doesn't already exist. This is used as the identity of the service.
 	_, err := i.kube.CoreV1().ServiceAccounts(ns).Get(getServiceAccountName(service), metav1.GetOptions{})
 	if kubeErrors.IsNotFound(err) {
+		// There are no other versions the traffic could be split with
+		if istioVirtualService.Spec.Http, err = mergeVirtualServiceRoutes(service, nil, istioVirtualService.Spec.Http); err != nil {
+			return err
+		}
+
 		// Create the resources since they dont exist
 		logrus.Debugf("Creating service account for %s in %s", service.ID, ns)
 		if _, err := i.kube.CoreV1().ServiceAccounts(ns).Create(kubeServiceAccount); err != nil {
@@ -111,13 +160,14 @@ func (i *Istio) ApplyService(service *model.Service) error {
 			return err
 		}
 
-		logrus.Debugf("Creating virtual service for %s in %s", service.ID, ns)
-		if _, err := i.istio.NetworkingV1alpha3().VirtualServices(ns).Create(istioVirtualService); err != nil {
+		// The subsets need to exist before the virtual service routes to them
+		logrus.Debugf("Creating destination rule for %s in %s", service.ID, ns)
+		if _, err := i.istio.NetworkingV1alpha3().DestinationRules(ns).Create(istioDestRule); err != nil {
 			return err
 		}
 
-		logrus.Debugf("Creating destination rule for %s in %s", service.ID, ns)
-		if _, err := i.istio.NetworkingV1alpha3().DestinationRules(ns).Create(istioDestRule); err != nil {
+		logrus.Debugf("Creating virtual service for %s in %s", service.ID, ns)
+		if _, err := i.istio.NetworkingV1alpha3().VirtualServices(ns).Create(istioVirtualService); err != nil {
 			return err
 		}
 
@@ -136,9 +186,28 @@ func (i *Istio) ApplyService(service *model.Service) error {
 			return err
 		}
 	} else if err == nil {
-		// Update the resources
-		logrus.Debugf("Updating service for %s in %s", service.ID, ns)
-		if _, err := i.kube.AppsV1().Deployments(ns).Update(kubeDeployment); err != nil {
+		// Work out the routing first so that an invalid traffic split doesn't leave the service half updated
+		prevVirtualService, err := i.istio.NetworkingV1alpha3().VirtualServices(ns).Get(istioVirtualService.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if istioVirtualService.Spec.Http, err = mergeVirtualServiceRoutes(service, prevVirtualService.Spec.Http, istioVirtualService.Spec.Http); err != nil {
+			return err
+		}
+
+		// Update the resources. The deployment needs to be created if this is a new version of the service.
+		_, err = i.kube.AppsV1().Deployments(ns).Get(kubeDeployment.Name, metav1.GetOptions{})
+		if kubeErrors.IsNotFound(err) {
+			logrus.Debugf("Creating deployment for %s (%s) in %s", service.ID, service.Version, ns)
+			if _, err := i.kube.AppsV1().Deployments(ns).Create(kubeDeployment); err != nil {
+				return err
+			}
+		} else if err == nil {
+			logrus.Debugf("Updating deployment for %s (%s) in %s", service.ID, service.Version, ns)
+			if _, err := i.kube.AppsV1().Deployments(ns).Update(kubeDeployment); err != nil {
+				return err
+			}
+		} else {
 			return err
 		}
 
@@ -153,11 +222,20 @@ func (i *Istio) ApplyService(service *model.Service) error {
 			return err
 		}
 
-		logrus.Debugf("Updating virtual service for %s in %s", service.ID, ns)
-		prevVirtualService, err := i.istio.NetworkingV1alpha3().VirtualServices(ns).Get(istioVirtualService.Name, metav1.GetOptions{})
+		// The subsets need to exist before the virtual service routes to them
+		logrus.Debugf("Updating destination rule for %s in %s", service.ID, ns)
+		prevDestRule, err := i.istio.NetworkingV1alpha3().DestinationRules(ns).Get(istioDestRule.Name, metav1.GetOptions{})
 		if err != nil {
 			return err
 		}
+		mergeDestinationRuleSubsets(prevDestRule, istioDestRule)
+		prevDestRule.Spec = istioDestRule.Spec
+		prevDestRule.Labels = istioDestRule.Labels
+		if _, err := i.istio.NetworkingV1alpha3().DestinationRules(ns).Update(prevDestRule); err != nil {
+			return err
+		}
+
+		logrus.Debugf("Updating virtual service for %s in %s", service.ID, ns)
 		prevVirtualService.Spec = istioVirtualService.Spec
 		prevVirtualService.Labels = istioVirtualService.Labels
 		if _, err := i.istio.NetworkingV1alpha3().VirtualServices(ns).Update(prevVirtualService); err != nil {
@@ -213,116 +291,152 @@ func (i *Istio) AdjustScale(service *model.Service, activeReqs int32) error {
 	ns := getNamespaceName(service.ProjectID, service.Environment)
 	uniqueName := getServiceUniqueName(service.ProjectID, service.ID, service.Environment, service.Version)
 	if _, loaded := i.adjustScaleLock.LoadOrStore(uniqueName, struct{}{}); loaded {
-		logrus.Infof("Ignoring adjust scale request for service (%s:%s) since another request is already in progress", ns, service.ID)
+		logrus.Infof("Ignoring adjust scale request for service (%s:%s:%s) since another request is already in progress", ns, service.ID, service.Version)
 		return nil
 	}
 	// Remove the lock once processing is done
 	defer i.adjustScaleLock.Delete(uniqueName)
 
-	logrus.Debugf("Adjusting scale of service (%s:%s): Active reqs - %d", ns, service.ID, activeReqs)
-	deployment, err := i.kube.AppsV1().Deployments(ns).Get(getDeploymentName(service), metav1.GetOptions{})
+	logrus.Debugf("Adjusting scale of service (%s:%s:%s): Active reqs - %d", ns, service.ID, service.Version, activeReqs)
+	deployment, err := i.getDeployment(ns, getDeploymentName(service))
 	if err != nil {
 		return err
 	}
 
-	// Get the min and max replica numbers
-	minReplicasString := deployment.Annotations["minReplicas"]
-	maxReplicasString := deployment.Annotations["maxReplicas"]
-	minReplicas, _ := strconv.Atoi(minReplicasString)
-	maxReplicas, _ := strconv.Atoi(maxReplicasString)
-
-	// Calculate the desired replica count
-	concurrencyString := deployment.Annotations["concurrency"]
-	concurrency, _ := strconv.Atoi(concurrencyString)
-	replicaCount := int32(math.Ceil(float64(activeReqs) / float64(concurrency)))
-
-	// Make sure the desired replica count doesn't cross the min and max range
-	if replicaCount < int32(minReplicas) {
-		replicaCount = int32(minReplicas)
-	}
-	if replicaCount > int32(maxReplicas) {
-		replicaCount = int32(maxReplicas)
-	}
-
 	// Return if the existing replica count is the same
+	replicaCount := getDesiredReplicas(deployment, activeReqs)
 	if *deployment.Spec.Replicas == replicaCount {
 		logrus.Debugf("Desired scale of service (%s:%s) is same as current scale (%d). Making no changes", ns, service.ID, replicaCount)
 		return nil
 	}
 
 	// Update the virtual service if the new replica count is zero. This is required to redirect incoming http requests to
-	// the galaxy runner proxy. The proxy is responsible to scale the service back up from zero.
+	// the galaxy runner proxy. The proxy is responsible to scale the service back up from zero. Only the routes of this
+	// version are redirected so that the other versions keep serving traffic.
 	if replicaCount == 0 {
-		virtualService, err := i.istio.NetworkingV1alpha3().VirtualServices(ns).Get(service.ID, metav1.GetOptions{})
+		err := i.updateVirtualService(ns, service.ID, func(virtualService *v1alpha3.VirtualService) {
+			// Apply scale zero config to virtual service
+			makeScaleZeroVirtualService(service, virtualService, i.config.ProxyPort)
+		})
 		if err != nil {
-			logrus.Errorf("Could not fetch virtual service (%s:%s) to adjust scale: %s", ns, service.ID, err.Error())
+			logrus.Errorf("Could not update virtual service (%s:%s) to adjust scale: %s", ns, service.ID, err.Error())
 			return err
 		}
+	}
 
-		// Apply scale zero config to virtual service
-		makeScaleZeroVirtualService(service, virtualService, i.config.ProxyPort)
-		if _, err := i.istio.NetworkingV1alpha3().VirtualServices(ns).Update(virtualService); err != nil {
-			logrus.Errorf("Could not revert virtual service (%s:%s) back to original to adjust scale: %s", ns, service.ID, err.Error())
+	// Update the replica count. The deployment is fetched again since the cached copy may be stale.
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := i.kube.AppsV1().Deployments(ns).Get(getDeploymentName(service), metav1.GetOptions{})
+		if err != nil {
 			return err
 		}
-	}
-
-	// Update the replica count
-	deployment.Spec.Replicas = &replicaCount
-	if _, err := i.kube.AppsV1().Deployments(ns).Update(deployment); err != nil {
+		deployment.Spec.Replicas = &replicaCount
+		_, err = i.kube.AppsV1().Deployments(ns).Update(deployment)
+		return err
+	})
+	if err != nil {
 		logrus.Errorf("Could not adjust scale: %s", err.Error())
 		return err
 	}
 
-	logrus.Infof("Scale of of service (%s:%s) adjusted to %d successfully", ns, service.ID, replicaCount)
+	logrus.Infof("Scale of of service (%s:%s:%s) adjusted to %d successfully", ns, service.ID, service.Version, replicaCount)
 	return nil
 }
 
 // WaitForService adjusts scales, up the service to scale up the number of nodes from zero to one
-// TODO: Do one watch per service. Right now its possible to have multiple watches for the same service
 func (i *Istio) WaitForService(service *model.Service) error {
 	ns := getNamespaceName(service.ProjectID, service.Environment)
-	logrus.Debugf("Scaling up service (%s:%s) from zero", ns, service.ID)
+	logrus.Debugf("Scaling up service (%s:%s:%s) from zero", ns, service.ID, service.Version)
 
 	// Scale up the service
 	if err := i.AdjustScale(service, 1); err != nil {
 		return err
 	}
 
-	timeout := int64(3 * 60)
-	labels := fmt.Sprintf("app=%s,version=%s", service.ID, service.Version)
-	logrus.Debugf("Watching for service (%s:%s) to scale up and enter ready state", ns, service.ID)
-	watcher, err := i.kube.AppsV1().Deployments(ns).Watch(metav1.ListOptions{Watch: true, LabelSelector: labels, TimeoutSeconds: &timeout})
+	// All the requests waiting for this service share the same watch on the deployment
+	logrus.Debugf("Waiting for service (%s:%s) to scale up and enter ready state", ns, service.ID)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+	err := i.cache.waitForDeployment(ctx, ns, getDeploymentName(service), func(deployment *appsv1.Deployment) bool {
+		logrus.Debugf("Received update for service (%s:%s): available replicas - %d; ready replicas - %d", ns, service.ID, deployment.Status.AvailableReplicas, deployment.Status.ReadyReplicas)
+		return deployment.Status.AvailableReplicas >= 1 && deployment.Status.ReadyReplicas >= 1
+	})
 	if err != nil {
-		return err
+		return fmt.Errorf("service (%s:%s) could not be started - %s", ns, service.ID, err.Error())
 	}
-	defer watcher.Stop()
-
-	for ev := range watcher.ResultChan() {
-		deployment := ev.Object.(*appsv1.Deployment)
-		logrus.Debugf("Received watch event for service (%s:%s): available replicas - %d; ready replicas - %d", ns, service.ID, deployment.Status.AvailableReplicas, deployment.Status.ReadyReplicas)
-		if deployment.Status.AvailableReplicas >= 1 && deployment.Status.ReadyReplicas >= 1 {
-			go func() {
-				// Update the `virtual service` config of this service back to the original
-				virtualService, err := i.istio.NetworkingV1alpha3().VirtualServices(ns).Get(service.ID, metav1.GetOptions{})
-				if err != nil {
-					logrus.Errorf("Could not fetch virtual service (%s:%s): %s", ns, service.ID, err.Error())
-					return
-				}
-
-				// Revert back to the original configuration and apply that
-				logrus.Debugf("Reverting routing rules back to original for service (%s:%s)", ns, service.ID)
-				makeOriginalVirtualService(service, virtualService)
-				if _, err := i.istio.NetworkingV1alpha3().VirtualServices(ns).Update(virtualService); err != nil {
-					logrus.Errorf("Could not revert virtual service (%s:%s) back to original: %s", ns, service.ID, err.Error())
-				}
-				logrus.Infof("Routing rules reverted back to original for service (%s:%s) successfully", ns, service.ID)
-			}()
-			return nil
+
+	// Revert the routing rules in the background so that the waiting requests can be forwarded right away
+	i.wg.Add(1)
+	go func() {
+		defer i.wg.Done()
+		i.revertVirtualService(service)
+	}()
+	return nil
+}
+
+// revertVirtualService updates the `virtual service` config of this service back to the original
+func (i *Istio) revertVirtualService(service *model.Service) {
+	ns := getNamespaceName(service.ProjectID, service.Environment)
+
+	// Revert back to the original configuration and apply that
+	logrus.Debugf("Reverting routing rules of version %s back to original for service (%s:%s)", service.Version, ns, service.ID)
+	err := i.updateVirtualService(ns, service.ID, func(virtualService *v1alpha3.VirtualService) {
+		makeOriginalVirtualService(service, virtualService)
+	})
+	if err != nil {
+		logrus.Errorf("Could not revert virtual service (%s:%s) back to original: %s", ns, service.ID, err.Error())
+		return
+	}
+	logrus.Infof("Routing rules reverted back to original for service (%s:%s) successfully", ns, service.ID)
+}
+
+// updateVirtualService applies the changes to the latest version of the virtual service. The changes are applied again
+// if the virtual service got modified in the meantime.
+func (i *Istio) updateVirtualService(ns, name string, update func(virtualService *v1alpha3.VirtualService)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		virtualService, err := i.istio.NetworkingV1alpha3().VirtualServices(ns).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
 		}
+		update(virtualService)
+		_, err = i.istio.NetworkingV1alpha3().VirtualServices(ns).Update(virtualService)
+		return err
+	})
+}
+
+// getDeployment returns the deployment from the local cache. Deployments which were created recently may not have
+// made it to the cache yet, so they are fetched from the api server instead.
+func (i *Istio) getDeployment(ns, name string) (*appsv1.Deployment, error) {
+	deployment, err := i.cache.getDeployment(ns, name)
+	if kubeErrors.IsNotFound(err) {
+		return i.kube.AppsV1().Deployments(ns).Get(name, metav1.GetOptions{})
+	}
+	return deployment, err
+}
+
+// GetServiceStatus returns the current status of the service from the local cache
+func (i *Istio) GetServiceStatus(service *model.Service) (*model.ServiceStatus, error) {
+	ns := getNamespaceName(service.ProjectID, service.Environment)
+	deployment, err := i.getDeployment(ns, getDeploymentName(service))
+	if err != nil {
+		return nil, err
 	}
 
-	return fmt.Errorf("service (%s:%s) could not be started", ns, service.ID)
+	var replicas int32
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := &model.ServiceStatus{
+		Replicas:          replicas,
+		ReadyReplicas:     deployment.Status.ReadyReplicas,
+		AvailableReplicas: deployment.Status.AvailableReplicas,
+	}
+
+	// The virtual service may not have made it to the cache yet
+	if virtualService, err := i.cache.getVirtualService(ns, service.ID); err == nil {
+		status.Traffic = getVersionTraffic(virtualService, service.Version)
+	}
+	return status, nil
 }
 
 // CreateProject creates a new namespace for the client
@@ -2,11 +2,12 @@ package istio
 
 import (
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/gogo/protobuf/types"
-	"github.com/segmentio/ksuid"
 	networkingv1alpha3 "istio.io/api/networking/v1alpha3"
 	securityv1beta1 "istio.io/api/security/v1beta1"
 	v1beta12 "istio.io/api/type/v1beta1"
@@ -20,6 +21,23 @@ import (
 	"github.com/spaceuptech/galaxy/model"
 )
 
+// needsMetricsProxy returns true if a metrics proxy needs to run alongside the service. The proxy is only added if
+// the service is purely http based and the node agents aren't collecting the metrics of all the pods on their node.
+func (i *Istio) needsMetricsProxy(service *model.Service) bool {
+	if i.config.NodeAgent {
+		return false
+	}
+
+	for _, task := range service.Tasks {
+		for _, port := range task.Ports {
+			if port.Protocol == model.TCP {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func (i *Istio) prepareContainers(service *model.Service) []v1.Container {
 	// There will be n + 1 containers in the pod. Each task will have it's own container. Along with that,
 	// there will be a metric collection container as well which pushes metric data to the autoscaler.
@@ -61,21 +79,12 @@ func (i *Istio) prepareContainers(service *model.Service) []v1.Container {
 		}
 	}
 
-	// Add metric proxy container service is purely http based
-	var isTCP bool
-	for _, task := range tasks {
-		for _, port := range task.Ports {
-			if port.Protocol == model.TCP {
-				isTCP = true
-				break
-			}
-		}
-	}
-	if !isTCP {
-		token, _ := i.auth.SignProxyToken(ksuid.New().String(), service.ProjectID, service.ID, service.Environment, service.Version)
+	if i.needsMetricsProxy(service) {
 		containers = append(containers, v1.Container{
 			Name: "galaxy-metrics",
-			Env:  []v1.EnvVar{{Name: "TOKEN", Value: token}},
+			Env: []v1.EnvVar{{Name: "TOKEN", ValueFrom: &v1.EnvVarSource{
+				SecretKeyRef: &v1.SecretKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: getProxySecretName(service)}, Key: "token"},
+			}}},
 
 			// Resource Related
 			Resources: *generateResourceRequirements(&model.Resources{CPU: 20, Memory: 50}),
@@ -91,6 +100,27 @@ func (i *Istio) prepareContainers(service *model.Service) []v1.Container {
 	return containers
 }
 
+// getDesiredReplicas returns the number of replicas required to serve the active requests without exceeding the
+// concurrency of the service. The count is kept within the min and max replicas of the service.
+func getDesiredReplicas(deployment *appsv1.Deployment, activeReqs int32) int32 {
+	// Get the min and max replica numbers
+	minReplicas, _ := strconv.Atoi(deployment.Annotations["minReplicas"])
+	maxReplicas, _ := strconv.Atoi(deployment.Annotations["maxReplicas"])
+
+	// Calculate the desired replica count
+	concurrency, _ := strconv.Atoi(deployment.Annotations["concurrency"])
+	replicaCount := int32(math.Ceil(float64(activeReqs) / float64(concurrency)))
+
+	// Make sure the desired replica count doesn't cross the min and max range
+	if replicaCount < int32(minReplicas) {
+		replicaCount = int32(minReplicas)
+	}
+	if replicaCount > int32(maxReplicas) {
+		replicaCount = int32(maxReplicas)
+	}
+	return replicaCount
+}
+
 func prepareContainerPorts(taskPorts []model.Port) []v1.ContainerPort {
 	ports := make([]v1.ContainerPort, len(taskPorts))
 	for i, p := range taskPorts {
@@ -111,16 +141,87 @@ func prepareServicePorts(tasks []model.Task) []v1.ServicePort {
 	return ports
 }
 
-func makeOriginalVirtualService(service *model.Service, virtualService *v1alpha3.VirtualService) {
-	ogHost := fmt.Sprintf("%s.%s.svc.cluster.local", service.ID, getNamespaceName(service.ProjectID, service.Environment))
+// getScaleZeroHeaders returns the headers describing the original destination of a route destination which has been
+// redirected to the galaxy runner proxy. It returns nil if the destination hasn't been redirected.
+func getScaleZeroHeaders(route *networkingv1alpha3.HTTPRouteDestination) map[string]string {
+	if route.Headers == nil || route.Headers.Request == nil {
+		return nil
+	}
 
-	// Redo the http routes. The tcp routes are lost anyways so we don't really care about them.
+	// Older virtual services used to add the headers instead of setting them
+	if h := route.Headers.Request.Set; h["x-og-host"] != "" {
+		return h
+	}
+	if h := route.Headers.Request.Add; h["x-og-host"] != "" {
+		return h
+	}
+	return nil
+}
+
+// getVersionTraffic returns the percentage of the requests routed to the version. The first http route routing to the
+// version is considered since the routes of all the ports served by a version share the same split.
+func getVersionTraffic(virtualService *v1alpha3.VirtualService, version string) int32 {
+	for _, httpRoute := range virtualService.Spec.Http {
+		var traffic int32
+		var found bool
+		for _, route := range httpRoute.Route {
+			if v := getDestinationVersion(route); v != version && v != "" {
+				continue
+			}
+			// A single destination without a weight receives all the requests
+			if len(httpRoute.Route) == 1 && route.Weight == 0 {
+				return 100
+			}
+			traffic += route.Weight
+			found = true
+		}
+		if found {
+			return traffic
+		}
+	}
+	return 0
+}
+
+// getDestinationVersion returns the version of the service a route destination belongs to
+func getDestinationVersion(route *networkingv1alpha3.HTTPRouteDestination) string {
+	if headers := getScaleZeroHeaders(route); headers != nil {
+		return headers["x-og-version"]
+	}
+	return route.Destination.Subset
+}
+
+func prepareScaleZeroHeaders(service *model.Service, ogHost string, ogPort uint32, ogSubset string) *networkingv1alpha3.Headers {
+	return &networkingv1alpha3.Headers{
+		Request: &networkingv1alpha3.Headers_HeaderOperations{
+			Set: map[string]string{
+				"x-og-project": service.ProjectID,
+				"x-og-service": service.ID,
+				"x-og-host":    ogHost,
+				"x-og-port":    strconv.Itoa(int(ogPort)),
+				"x-og-env":     service.Environment,
+				"x-og-version": service.Version,
+				"x-og-subset":  ogSubset,
+			},
+		},
+	}
+}
+
+func makeOriginalVirtualService(service *model.Service, virtualService *v1alpha3.VirtualService) {
+	// Redo the http routes. The tcp routes are lost anyways so we don't really care about them. Only the destinations
+	// of this version are reverted. The other versions may still be scaled down to zero.
 	for _, httpRoute := range virtualService.Spec.Http {
 		for _, route := range httpRoute.Route {
-			// Revert the destination to original
-			port, _ := strconv.Atoi(strings.Split(httpRoute.Name, "-")[2])
-			route.Destination.Host = ogHost
+			headers := getScaleZeroHeaders(route)
+			if headers == nil || headers["x-og-version"] != service.Version {
+				continue
+			}
+
+			// Revert the destination to original. Destinations redirected by older versions of galaxy didn't use
+			// subsets, which their destination rules may not have either.
+			port, _ := strconv.Atoi(headers["x-og-port"])
+			route.Destination.Host = headers["x-og-host"]
 			route.Destination.Port.Number = uint32(port)
+			route.Destination.Subset = headers["x-og-subset"]
 
 			// Reset the headers
 			route.Headers = nil
@@ -129,29 +230,145 @@ func makeOriginalVirtualService(service *model.Service, virtualService *v1alpha3
 }
 
 func makeScaleZeroVirtualService(service *model.Service, virtualService *v1alpha3.VirtualService, proxyPort uint32) {
-	ogHost := fmt.Sprintf("%s.%s.svc.cluster.local", service.ID, getNamespaceName(service.ProjectID, service.Environment))
-
 	// Redirect traffic to galaxy runner when no of replicas is equal to zero. The galaxy proxy will scale up the service
-	// to service incoming requests.
+	// to service incoming requests. Only the destinations of this version are redirected.
 	for _, httpRoute := range virtualService.Spec.Http {
 		for _, route := range httpRoute.Route {
+			// Skip the destinations which are already redirected or belong to another version. Destinations without a
+			// subset were created before versions were tracked and belong to the only version of the service.
+			if getScaleZeroHeaders(route) != nil || (route.Destination.Subset != "" && route.Destination.Subset != service.Version) {
+				continue
+			}
+
+			// Set the headers
+			route.Headers = prepareScaleZeroHeaders(service, route.Destination.Host, route.Destination.Port.Number, route.Destination.Subset)
+
 			// Set the destination to galaxy runner proxy
-			route.Destination.Host = "runner.galaxy.svc.cluster.local"
+			route.Destination.Host = runnerProxyHost
 			route.Destination.Port.Number = proxyPort
+			route.Destination.Subset = ""
+		}
+	}
+}
 
-			// Set the headers
-			route.Headers = &networkingv1alpha3.Headers{
-				Request: &networkingv1alpha3.Headers_HeaderOperations{
-					Add: map[string]string{
-						"x-og-project": service.ProjectID,
-						"x-og-service": service.ID,
-						"x-og-host":    ogHost,
-						"x-og-port":    strings.Split(httpRoute.Name, "-")[2],
-						"x-og-env":     service.Environment,
-						"x-og-version": service.Version,
-					},
-				},
+// validateTraffic checks that the traffic split of the service adds up to 100
+func validateTraffic(service *model.Service) error {
+	if len(service.Traffic) == 0 {
+		return nil
+	}
+
+	var total int32
+	for version, weight := range service.Traffic {
+		if weight < 0 || weight > 100 {
+			return fmt.Errorf("traffic weight (%d) of version (%s) needs to be between 0 and 100", weight, version)
+		}
+		total += weight
+	}
+	if total != 100 {
+		return fmt.Errorf("traffic weights of service (%s) add up to %d instead of 100", service.ID, total)
+	}
+	return nil
+}
+
+// getRouteKey identifies the requests matched by an http route. The routes within the mesh match the port of the
+// service while the ones exposed through the gateway are told apart by their name.
+func getRouteKey(route *networkingv1alpha3.HTTPRoute) string {
+	if len(route.Match) > 0 && route.Match[0].Port != 0 {
+		return fmt.Sprintf("port-%d", route.Match[0].Port)
+	}
+	return route.Name
+}
+
+// mergeVirtualServiceRoutes carries the routing of the previous http routes over to the new ones, which only route to
+// the version being applied. The existing routing is kept as it is unless the service provides a traffic split, so a
+// new version doesn't receive any traffic till it is asked for. Versions with a weight of zero stop receiving traffic.
+// The previous routes of the ports the version doesn't serve are kept as they are since other versions serve them.
+// The previous routes are nil if the virtual service is being created.
+func mergeVirtualServiceRoutes(service *model.Service, prev, next []*networkingv1alpha3.HTTPRoute) ([]*networkingv1alpha3.HTTPRoute, error) {
+	prevRoutes := make(map[string]*networkingv1alpha3.HTTPRoute, len(prev))
+	for _, route := range prev {
+		prevRoutes[getRouteKey(route)] = route
+	}
+
+	// Sort the versions so that the destinations don't get reordered on every update
+	versions := make([]string, 0, len(service.Traffic))
+	for version := range service.Traffic {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+
+	for _, route := range next {
+		dest := route.Route[0]
+		var prevDests []*networkingv1alpha3.HTTPRouteDestination
+		if prevRoute, p := prevRoutes[getRouteKey(route)]; p {
+			prevDests = prevRoute.Route
+		}
+
+		if len(service.Traffic) == 0 {
+			// The version being applied only replaces its own destination if the route already existed
+			if len(prevDests) == 0 {
+				continue
 			}
+			route.Route = make([]*networkingv1alpha3.HTTPRouteDestination, len(prevDests))
+			for i, d := range prevDests {
+				route.Route[i] = d
+				if getDestinationVersion(d) == service.Version {
+					dest.Weight = d.Weight
+					route.Route[i] = dest
+				}
+			}
+			continue
+		}
+
+		var dests []*networkingv1alpha3.HTTPRouteDestination
+		for _, version := range versions {
+			weight := service.Traffic[version]
+			if weight == 0 {
+				continue
+			}
+
+			d := dest
+			if version != service.Version {
+				d = nil
+				for _, prevDest := range prevDests {
+					if getDestinationVersion(prevDest) == version {
+						d = prevDest
+						break
+					}
+				}
+			}
+			if d == nil {
+				return nil, fmt.Errorf("version (%s) of service (%s) is not receiving any traffic yet - apply it with a traffic split first", version, service.ID)
+			}
+			d.Weight = weight
+			dests = append(dests, d)
+		}
+		route.Route = dests
+	}
+
+	nextRoutes := make(map[string]bool, len(next))
+	for _, route := range next {
+		nextRoutes[getRouteKey(route)] = true
+	}
+	for _, route := range prev {
+		if !nextRoutes[getRouteKey(route)] {
+			next = append(next, route)
+		}
+	}
+	return next, nil
+}
+
+func mergeDestinationRuleSubsets(prev, next *v1alpha3.DestinationRule) {
+	for _, subset := range prev.Spec.Subsets {
+		var exists bool
+		for _, s := range next.Spec.Subsets {
+			if s.Name == subset.Name {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			next.Spec.Subsets = append(next.Spec.Subsets, subset)
 		}
 	}
 }
@@ -169,25 +386,16 @@ func prepareVirtualServiceRoutes(service *model.Service, proxyPort uint32) ([]*n
 				retries := &networkingv1alpha3.HTTPRetry{Attempts: 3, PerTryTimeout: &types.Duration{Seconds: 90}}
 				destHost := fmt.Sprintf("%s.%s.svc.cluster.local", service.ID, getNamespaceName(service.ProjectID, service.Environment))
 				destPort := uint32(port.Port)
+				subset := service.Version
 
 				// Redirect traffic to galaxy runner when no of replicas is equal to zero. The galaxy proxy will scale up the service
 				// to service incoming requests.
 				if service.Scale.Replicas == 0 {
-					headers = &networkingv1alpha3.Headers{
-						Request: &networkingv1alpha3.Headers_HeaderOperations{
-							Add: map[string]string{
-								"x-og-project": service.ProjectID,
-								"x-og-service": service.ID,
-								"x-og-host":    destHost,
-								"x-og-port":    strconv.Itoa(int(destPort)),
-								"x-og-env":     service.Environment,
-								"x-og-version": service.Version,
-							},
-						},
-					}
+					headers = prepareScaleZeroHeaders(service, destHost, destPort, subset)
 					retries = &networkingv1alpha3.HTTPRetry{Attempts: 1, PerTryTimeout: &types.Duration{Seconds: 180}}
-					destHost = "runner.galaxy.svc.cluster.local"
+					destHost = runnerProxyHost
 					destPort = proxyPort
+					subset = ""
 				}
 
 				httpRoutes = append(httpRoutes, &networkingv1alpha3.HTTPRoute{
@@ -198,8 +406,9 @@ func prepareVirtualServiceRoutes(service *model.Service, proxyPort uint32) ([]*n
 						{
 							Headers: headers,
 							Destination: &networkingv1alpha3.Destination{
-								Host: destHost,
-								Port: &networkingv1alpha3.PortSelector{Number: destPort},
+								Host:   destHost,
+								Subset: subset,
+								Port:   &networkingv1alpha3.PortSelector{Number: destPort},
 							},
 						},
 					},
@@ -216,8 +425,9 @@ func prepareVirtualServiceRoutes(service *model.Service, proxyPort uint32) ([]*n
 					Route: []*networkingv1alpha3.RouteDestination{
 						{
 							Destination: &networkingv1alpha3.Destination{
-								Host: fmt.Sprintf("%s.%s.svc.cluster.local", service.ID, getNamespaceName(service.ProjectID, service.Environment)),
-								Port: &networkingv1alpha3.PortSelector{Number: uint32(port.Port)},
+								Host:   fmt.Sprintf("%s.%s.svc.cluster.local", service.ID, getNamespaceName(service.ProjectID, service.Environment)),
+								Subset: service.Version,
+								Port:   &networkingv1alpha3.PortSelector{Number: uint32(port.Port)},
 							},
 						},
 					},
@@ -234,25 +444,16 @@ func prepareVirtualServiceRoutes(service *model.Service, proxyPort uint32) ([]*n
 			retries := &networkingv1alpha3.HTTPRetry{Attempts: 3, PerTryTimeout: &types.Duration{Seconds: 90}}
 			destHost := fmt.Sprintf("%s.%s.svc.cluster.local", service.ID, getNamespaceName(service.ProjectID, service.Environment))
 			destPort := uint32(rule.Port)
+			subset := service.Version
 
 			// Redirect traffic to galaxy runner when no of replicas is equal to zero. The galaxy proxy will scale up the service
 			// to service incoming requests.
 			if service.Scale.Replicas == 0 {
-				headers = &networkingv1alpha3.Headers{
-					Request: &networkingv1alpha3.Headers_HeaderOperations{
-						Set: map[string]string{
-							"x-og-project": service.ProjectID,
-							"x-og-service": service.ID,
-							"x-og-host":    destHost,
-							"x-og-port":    strconv.Itoa(int(destPort)),
-							"x-og-env":     service.Environment,
-							"x-og-version": service.Version,
-						},
-					},
-				}
+				headers = prepareScaleZeroHeaders(service, destHost, destPort, subset)
 				retries = &networkingv1alpha3.HTTPRetry{Attempts: 1, PerTryTimeout: &types.Duration{Seconds: 180}}
-				destHost = "runner.galaxy.svc.cluster.local"
+				destHost = runnerProxyHost
 				destPort = proxyPort
+				subset = ""
 			}
 
 			match := prepareHTTPMatch(&rule)
@@ -266,8 +467,9 @@ func prepareVirtualServiceRoutes(service *model.Service, proxyPort uint32) ([]*n
 					{
 						Headers: headers,
 						Destination: &networkingv1alpha3.Destination{
-							Host: destHost,
-							Port: &networkingv1alpha3.PortSelector{Number: destPort},
+							Host:   destHost,
+							Subset: subset,
+							Port:   &networkingv1alpha3.PortSelector{Number: destPort},
 						},
 					},
 				},
@@ -399,8 +601,14 @@ func (i *Istio) generateDeployment(service *model.Service) *appsv1.Deployment {
 			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": service.ID, "version": service.Version}},
 			Template: v1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Annotations: map[string]string{"sidecar.istio.io/statsInclusionPrefixes": "cluster.outbound,listener,http,cluster_manager,listener_manager,http_mixer_filter,tcp_mixer_filter,server,cluster.xds-grpc"},
-					Labels:      map[string]string{"app": service.ID, "version": service.Version},
+					Annotations: map[string]string{
+						"sidecar.istio.io/statsInclusionPrefixes": "cluster.outbound,listener,http,cluster_manager,listener_manager,http_mixer_filter,tcp_mixer_filter,server,cluster.xds-grpc",
+
+						// Used by the node agents to identify the service a pod belongs to
+						model.AnnotationProject:     service.ProjectID,
+						model.AnnotationEnvironment: service.Environment,
+					},
+					Labels: map[string]string{"app": service.ID, "version": service.Version},
 				},
 				Spec: v1.PodSpec{
 					ServiceAccountName: getServiceAccountName(service),
@@ -447,6 +655,8 @@ func generateDestinationRule(service *model.Service) *v1alpha3.DestinationRule {
 			TrafficPolicy: &networkingv1alpha3.TrafficPolicy{
 				Tls: &networkingv1alpha3.TLSSettings{Mode: networkingv1alpha3.TLSSettings_ISTIO_MUTUAL},
 			},
+			// Each version of the service is routed to using a subset
+			Subsets: []*networkingv1alpha3.Subset{{Name: service.Version, Labels: map[string]string{"version": service.Version}}},
 		},
 	}
 }
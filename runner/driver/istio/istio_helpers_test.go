@@ -0,0 +1,235 @@
+package istio
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	networkingv1alpha3 "istio.io/api/networking/v1alpha3"
+	"istio.io/client-go/pkg/apis/networking/v1alpha3"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+func newTestVirtualService(versions ...string) *v1alpha3.VirtualService {
+	var routes []*networkingv1alpha3.HTTPRouteDestination
+	for _, v := range versions {
+		routes = append(routes, &networkingv1alpha3.HTTPRouteDestination{
+			Destination: &networkingv1alpha3.Destination{
+				Host:   "s1.p1-production.svc.cluster.local",
+				Subset: v,
+				Port:   &networkingv1alpha3.PortSelector{Number: 8080},
+			},
+		})
+	}
+	return &v1alpha3.VirtualService{Spec: networkingv1alpha3.VirtualService{Http: []*networkingv1alpha3.HTTPRoute{{Name: "http", Route: routes}}}}
+}
+
+func TestScaleZeroVirtualService(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []string
+		version  string
+	}{
+		{name: "single version", versions: []string{"v1"}, version: "v1"},
+		{name: "only the idle version", versions: []string{"v1", "v2"}, version: "v2"},
+		{name: "legacy route without subset", versions: []string{""}, version: "v1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &model.Service{ProjectID: "p1", ID: "s1", Environment: "production", Version: tt.version}
+			vs := newTestVirtualService(tt.versions...)
+
+			makeScaleZeroVirtualService(service, vs, 4050)
+			for _, route := range vs.Spec.Http[0].Route {
+				redirected := route.Destination.Host == runnerProxyHost
+				if want := getDestinationVersion(route) == tt.version; redirected != want {
+					t.Errorf("makeScaleZeroVirtualService() redirected = %v for destination %v, want %v", redirected, route.Destination, want)
+				}
+				if headers := getScaleZeroHeaders(route); redirected && headers["x-og-port"] != "8080" {
+					t.Errorf("makeScaleZeroVirtualService() x-og-port = %s, want 8080", headers["x-og-port"])
+				}
+			}
+
+			// Applying it twice must not overwrite the original destination
+			makeScaleZeroVirtualService(service, vs, 4050)
+			makeOriginalVirtualService(service, vs)
+			for i, route := range vs.Spec.Http[0].Route {
+				if route.Destination.Host == runnerProxyHost || route.Destination.Port.Number != 8080 || route.Headers != nil {
+					t.Errorf("makeOriginalVirtualService() did not revert destination %v", route.Destination)
+				}
+
+				// The destination rule may not have a subset for destinations which didn't use one
+				if route.Destination.Subset != tt.versions[i] {
+					t.Errorf("makeOriginalVirtualService() subset = %q, want %q", route.Destination.Subset, tt.versions[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMergeVirtualServiceRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		prev    []string
+		version string
+		traffic map[string]int32
+		want    map[string]int32
+		wantErr bool
+	}{
+		{name: "new virtual service", version: "v1", want: map[string]int32{"v1": 0}},
+		{name: "existing routing kept for new version", prev: []string{"v1"}, version: "v2", want: map[string]int32{"v1": 0}},
+		{name: "destination of applied version replaced", prev: []string{"v1", "v2"}, version: "v2", want: map[string]int32{"v1": 0, "v2": 0}},
+		{name: "explicit split", prev: []string{"v1"}, version: "v2", traffic: map[string]int32{"v1": 90, "v2": 10}, want: map[string]int32{"v1": 90, "v2": 10}},
+		{name: "old version removed", prev: []string{"v1", "v2"}, version: "v2", traffic: map[string]int32{"v1": 0, "v2": 100}, want: map[string]int32{"v2": 100}},
+		{name: "split with version without traffic", prev: []string{"v1"}, version: "v1", traffic: map[string]int32{"v1": 50, "v2": 50}, wantErr: true},
+		{name: "split on new virtual service", version: "v2", traffic: map[string]int32{"v1": 50, "v2": 50}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &model.Service{ProjectID: "p1", ID: "s1", Environment: "production", Version: tt.version, Traffic: tt.traffic}
+			var prev []*networkingv1alpha3.HTTPRoute
+			if tt.prev != nil {
+				prev = newTestVirtualService(tt.prev...).Spec.Http
+				makeScaleZeroVirtualService(&model.Service{ProjectID: "p1", ID: "s1", Environment: "production", Version: tt.prev[0]}, &v1alpha3.VirtualService{Spec: networkingv1alpha3.VirtualService{Http: prev}}, 4050)
+			}
+			next := newTestVirtualService(tt.version).Spec.Http
+			next[0].Route[0].Destination.Port.Number = 9090
+
+			next, err := mergeVirtualServiceRoutes(service, prev, next)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mergeVirtualServiceRoutes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			got := map[string]int32{}
+			for _, route := range next[0].Route {
+				version := getDestinationVersion(route)
+				got[version] = route.Weight
+
+				// The applied version gets its new destination while the others keep theirs
+				if version == tt.version && route.Destination.Port.Number != 9090 {
+					t.Errorf("mergeVirtualServiceRoutes() kept old destination %v of version %s", route.Destination, version)
+				}
+				if len(tt.prev) > 0 && version == tt.prev[0] && version != tt.version && route.Destination.Host != runnerProxyHost {
+					t.Errorf("mergeVirtualServiceRoutes() did not keep redirected destination of version %s", version)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("mergeVirtualServiceRoutes() routes to %v, want %v", got, tt.want)
+			}
+			for version, weight := range tt.want {
+				if w, p := got[version]; !p || w != weight {
+					t.Errorf("mergeVirtualServiceRoutes() routes to %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestMergeVirtualServiceRoutes_ports(t *testing.T) {
+	// newRoute returns the route of a port within the mesh which routes to the versions
+	newRoute := func(port uint32, versions ...string) *networkingv1alpha3.HTTPRoute {
+		route := newTestVirtualService(versions...).Spec.Http[0]
+		route.Name = fmt.Sprintf("http-00-%d", port)
+		route.Match = []*networkingv1alpha3.HTTPMatchRequest{{Port: port, Gateways: []string{"mesh"}}}
+		for _, dest := range route.Route {
+			dest.Destination.Port.Number = port
+		}
+		return route
+	}
+
+	tests := []struct {
+		name    string
+		traffic map[string]int32
+		want    map[uint32]map[string]int32
+	}{
+		{name: "existing routing", want: map[uint32]map[string]int32{8080: {"v1": 0}, 9090: {"v1": 0}}},
+		{name: "split", traffic: map[string]int32{"v1": 50, "v2": 50}, want: map[uint32]map[string]int32{8080: {"v1": 50, "v2": 50}, 9090: {"v1": 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Version v1 serves both the ports while version v2 only serves one of them
+			prev := []*networkingv1alpha3.HTTPRoute{newRoute(8080, "v1"), newRoute(9090, "v1")}
+			next := []*networkingv1alpha3.HTTPRoute{newRoute(8080, "v2")}
+			service := &model.Service{ProjectID: "p1", ID: "s1", Environment: "production", Version: "v2", Traffic: tt.traffic}
+
+			next, err := mergeVirtualServiceRoutes(service, prev, next)
+			if err != nil {
+				t.Fatalf("mergeVirtualServiceRoutes() error = %v", err)
+			}
+
+			got := map[uint32]map[string]int32{}
+			for _, route := range next {
+				weights := map[string]int32{}
+				for _, dest := range route.Route {
+					weights[getDestinationVersion(dest)] = dest.Weight
+				}
+				got[route.Match[0].Port] = weights
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeVirtualServiceRoutes() routes to %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTraffic(t *testing.T) {
+	tests := []struct {
+		name    string
+		traffic map[string]int32
+		wantErr bool
+	}{
+		{name: "no split"},
+		{name: "valid split", traffic: map[string]int32{"v1": 75, "v2": 25}},
+		{name: "weights below 100", traffic: map[string]int32{"v1": 50, "v2": 25}, wantErr: true},
+		{name: "negative weight", traffic: map[string]int32{"v1": 110, "v2": -10}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateTraffic(&model.Service{ID: "s1", Traffic: tt.traffic}); (err != nil) != tt.wantErr {
+				t.Errorf("validateTraffic() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetVersionTraffic(t *testing.T) {
+	split := newTestVirtualService("v1", "v2")
+	split.Spec.Http[0].Route[0].Weight = 75
+	split.Spec.Http[0].Route[1].Weight = 25
+
+	scaledDown := newTestVirtualService("v1")
+	scaledDown.Spec.Http[0].Route[0].Destination.Subset = ""
+	scaledDown.Spec.Http[0].Route[0].Headers = &networkingv1alpha3.Headers{Request: &networkingv1alpha3.Headers_HeaderOperations{
+		Set: map[string]string{"x-og-host": "s1.p1-production.svc.cluster.local", "x-og-version": "v1"},
+	}}
+
+	ports := newTestVirtualService("v1")
+	ports.Spec.Http = append(ports.Spec.Http, newTestVirtualService("v2").Spec.Http...)
+
+	tests := []struct {
+		name           string
+		virtualService *v1alpha3.VirtualService
+		version        string
+		want           int32
+	}{
+		{name: "no routes", virtualService: &v1alpha3.VirtualService{}, version: "v1", want: 0},
+		{name: "single version", virtualService: newTestVirtualService("v1"), version: "v1", want: 100},
+		{name: "legacy destination without subset", virtualService: newTestVirtualService(""), version: "v1", want: 100},
+		{name: "split", virtualService: split, version: "v2", want: 25},
+		{name: "version not routed", virtualService: newTestVirtualService("v1"), version: "v2", want: 0},
+		{name: "scaled down to zero", virtualService: scaledDown, version: "v1", want: 100},
+		{name: "version serving other port", virtualService: ports, version: "v2", want: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getVersionTraffic(tt.virtualService, tt.version); got != tt.want {
+				t.Errorf("getVersionTraffic() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package istio
+
+import (
+	"testing"
+
+	istioFake "istio.io/client-go/pkg/clientset/versioned/fake"
+	appsv1 "k8s.io/api/apps/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kubeFake "k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+func TestIstio_AdjustScale(t *testing.T) {
+	service := &model.Service{ID: "s1", ProjectID: "todo", Environment: "production", Version: "v1"}
+	ns := getNamespaceName(service.ProjectID, service.Environment)
+	replicas := int32(1)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        getDeploymentName(service),
+			Namespace:   ns,
+			Labels:      map[string]string{"app": "s1", "version": "v1"},
+			Annotations: map[string]string{"minReplicas": "0", "maxReplicas": "10", "concurrency": "10"},
+		},
+		Spec: appsv1.DeploymentSpec{Replicas: &replicas},
+	}
+
+	tests := []struct {
+		name      string
+		conflicts int
+	}{
+		{name: "deployment missing from cache"},
+		{name: "conflicting updates retried", conflicts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kube := kubeFake.NewSimpleClientset(deployment.DeepCopy())
+			conflicts := tt.conflicts
+			kube.PrependReactor("update", "deployments", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+				if conflicts == 0 {
+					return false, nil, nil
+				}
+				conflicts--
+				return true, nil, kubeErrors.NewConflict(schema.GroupResource{Group: "apps", Resource: "deployments"}, deployment.Name, nil)
+			})
+
+			// The informers aren't started, so the cache behaves like one which hasn't caught up yet
+			istio := istioFake.NewSimpleClientset()
+			i := &Istio{config: &Config{}, kube: kube, istio: istio, cache: newResourceCache(kube, istio)}
+			if err := i.AdjustScale(service, 35); err != nil {
+				t.Fatalf("AdjustScale() error = %v", err)
+			}
+
+			updated, err := kube.AppsV1().Deployments(ns).Get(deployment.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *updated.Spec.Replicas != 4 {
+				t.Errorf("AdjustScale() set replicas to %d, want 4", *updated.Spec.Replicas)
+			}
+		})
+	}
+}
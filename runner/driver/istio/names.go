@@ -1,11 +1,37 @@
 package istio
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 
 	"github.com/spaceuptech/galaxy/model"
 )
 
+const (
+	// The namespace galaxy itself runs in
+	galaxyNamespace = "galaxy"
+
+	// The host of the galaxy runner proxy which scales services up from zero
+	runnerProxyHost = "runner.galaxy.svc.cluster.local"
+
+	// The secret holding the token of the node agents
+	agentSecretName = "galaxy-agent"
+
+	// The secret holding the node ids of the revoked proxies
+	revocationsSecretName = "galaxy-proxy-revocations"
+
+	// The label identifying the secrets which hold the tokens of the metrics proxies
+	proxyTokenLabel = "galaxy.spaceuptech.com/proxy-token"
+
+	// The label identifying the secrets which hold the api keys
+	apiKeyLabel = "galaxy.spaceuptech.com/api-key"
+
+	// The label identifying the secrets which hold the state shared by the runner replicas. Its value is the kind of
+	// the state.
+	stateLabel = "galaxy.spaceuptech.com/state"
+)
+
 func getNamespaceName(project, env string) string {
 	return fmt.Sprintf("%s-%s", project, env)
 }
@@ -29,3 +55,18 @@ func getAuthorizationPolicyName(service *model.Service) string {
 func getGatewayName(service *model.Service) string {
 	return fmt.Sprintf("gateway-%s", service.ID)
 }
+
+func getProxySecretName(service *model.Service) string {
+	return fmt.Sprintf("%s-%s-proxy-token", service.ID, service.Version)
+}
+
+func getAPIKeySecretName(id string) string {
+	return fmt.Sprintf("galaxy-api-key-%s", id)
+}
+
+// getStateSecretName returns the name of the secret holding an entry of the shared state. The key is hashed since it
+// may contain characters which aren't allowed in names.
+func getStateSecretName(kind, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("galaxy-state-%s-%s", kind, hex.EncodeToString(sum[:10]))
+}
@@ -0,0 +1,59 @@
+package istio
+
+import (
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// The state shared by the runner replicas is stored in secrets in the galaxy namespace. Each entry gets a secret of its
+// own so that the size limit of secrets only applies to a single entry.
+
+// SaveState creates or replaces an entry of the shared state
+func (i *Istio) SaveState(kind, key string, data []byte) error {
+	name := getStateSecretName(kind, key)
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: galaxyNamespace, Labels: map[string]string{stateLabel: kind}},
+		Data:       map[string][]byte{"key": []byte(key), "data": data},
+	}
+	logrus.Debugf("Saving state secret %s in %s", name, galaxyNamespace)
+	_, err := i.kube.CoreV1().Secrets(galaxyNamespace).Create(secret)
+	if !kubeErrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		existing, err := i.kube.CoreV1().Secrets(galaxyNamespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		existing.Labels, existing.Data = secret.Labels, secret.Data
+		_, err = i.kube.CoreV1().Secrets(galaxyNamespace).Update(existing)
+		return err
+	})
+}
+
+// DeleteState deletes an entry of the shared state. It is a no-op if the entry doesn't exist.
+func (i *Istio) DeleteState(kind, key string) error {
+	err := i.kube.CoreV1().Secrets(galaxyNamespace).Delete(getStateSecretName(kind, key), &metav1.DeleteOptions{})
+	if kubeErrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// GetState returns all the entries of a kind of the shared state keyed by their keys
+func (i *Istio) GetState(kind string) (map[string][]byte, error) {
+	secrets, err := i.kube.CoreV1().Secrets(galaxyNamespace).List(metav1.ListOptions{LabelSelector: stateLabel + "=" + kind})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string][]byte, len(secrets.Items))
+	for _, secret := range secrets.Items {
+		entries[string(secret.Data["key"])] = secret.Data["data"]
+	}
+	return entries, nil
+}
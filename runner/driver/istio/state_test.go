@@ -0,0 +1,37 @@
+package istio
+
+import (
+	"testing"
+
+	kubeFake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestIstio_state(t *testing.T) {
+	i := &Istio{config: &Config{}, kube: kubeFake.NewSimpleClientset()}
+
+	for _, entry := range []struct{ kind, key, data string }{
+		{kind: "services", key: "todo/production/app/v1", data: "v1"},
+		{kind: "services", key: "todo/production/app/v2", data: "v2"},
+		{kind: "audit", key: "todo/production/app/v1", data: "entry"},
+		{kind: "services", key: "todo/production/app/v1", data: "v1-updated"},
+	} {
+		if err := i.SaveState(entry.kind, entry.key, []byte(entry.data)); err != nil {
+			t.Fatalf("SaveState(%s, %s) error = %v", entry.kind, entry.key, err)
+		}
+	}
+	if err := i.DeleteState("services", "todo/production/app/v2"); err != nil {
+		t.Fatalf("DeleteState() error = %v", err)
+	}
+	if err := i.DeleteState("services", "unknown"); err != nil {
+		t.Errorf("DeleteState() of unknown entry error = %v", err)
+	}
+
+	// The entries of other kinds are left out
+	entries, err := i.GetState("services")
+	if err != nil {
+		t.Fatalf("GetState() error = %v", err)
+	}
+	if len(entries) != 1 || string(entries["todo/production/app/v1"]) != "v1-updated" {
+		t.Errorf("GetState() = %v, want the updated entry only", entries)
+	}
+}
@@ -0,0 +1,149 @@
+package istio
+
+import (
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// The tokens of the metrics proxies are stored in secrets instead of the pod spec. The secrets are re-signed before
+// the tokens expire so that new pods always start with a valid token. Running proxies renew their tokens with the
+// runner themselves.
+
+// applyProxyToken stores the token of the metrics proxies of a service in a secret
+func (i *Istio) applyProxyToken(ns string, service *model.Service) error {
+	labels := map[string]string{"app": service.ID, "version": service.Version, proxyTokenLabel: "true"}
+	return i.applyTokenSecret(ns, getProxySecretName(service), labels, func(id string) (map[string]string, error) {
+		token, err := i.auth.SignProxyToken(id, service.ProjectID, service.ID, service.Environment, service.Version)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"id": id, "token": token, "project": service.ProjectID, "service": service.ID, "env": service.Environment, "version": service.Version}, nil
+	})
+}
+
+// applyAgentToken stores the token used by the node agents to authenticate with the runner in a secret. The
+// daemon set of the node agents is expected to mount it.
+func (i *Istio) applyAgentToken() error {
+	return i.applyTokenSecret(galaxyNamespace, agentSecretName, nil, func(id string) (map[string]string, error) {
+		token, err := i.auth.SignAgentToken(id)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"id": id, "token": token}, nil
+	})
+}
+
+// applyTokenSecret creates or updates a secret holding a token. The node id of the existing token is retained
+// unless it has been revoked.
+func (i *Istio) applyTokenSecret(ns, name string, labels map[string]string, sign func(id string) (map[string]string, error)) error {
+	existing, err := i.kube.CoreV1().Secrets(ns).Get(name, metav1.GetOptions{})
+	if err != nil && !kubeErrors.IsNotFound(err) {
+		return err
+	}
+	found := err == nil
+
+	id := ""
+	if found {
+		id = string(existing.Data["id"])
+	}
+	if id == "" || i.auth.IsRevoked(id) {
+		id = ksuid.New().String()
+	}
+
+	values, err := sign(id)
+	if err != nil {
+		return err
+	}
+	data := make(map[string][]byte, len(values))
+	for k, v := range values {
+		data[k] = []byte(v)
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns, Labels: labels},
+		Data:       data,
+	}
+
+	if !found {
+		logrus.Debugf("Creating token secret %s in %s", name, ns)
+		_, err = i.kube.CoreV1().Secrets(ns).Create(secret)
+		return err
+	}
+
+	logrus.Debugf("Updating token secret %s in %s", name, ns)
+	secret.ResourceVersion = existing.ResourceVersion
+	_, err = i.kube.CoreV1().Secrets(ns).Update(secret)
+	return err
+}
+
+// RefreshProxyTokens re-signs the tokens stored in the secrets of all the services and the node agents
+func (i *Istio) RefreshProxyTokens() error {
+	secrets, err := i.kube.CoreV1().Secrets(v1.NamespaceAll).List(metav1.ListOptions{LabelSelector: proxyTokenLabel})
+	if err != nil {
+		return err
+	}
+
+	for _, secret := range secrets.Items {
+		service := &model.Service{
+			ID:          string(secret.Data["service"]),
+			ProjectID:   string(secret.Data["project"]),
+			Environment: string(secret.Data["env"]),
+			Version:     string(secret.Data["version"]),
+		}
+		if err := i.applyProxyToken(secret.Namespace, service); err != nil {
+			logrus.Errorf("Could not refresh proxy token of service (%s:%s) - %s", service.ProjectID, service.ID, err.Error())
+		}
+	}
+
+	if i.config.NodeAgent {
+		return i.applyAgentToken()
+	}
+	return nil
+}
+
+// RevokeProxy stores the node id in the secret holding the revoked proxies
+func (i *Istio) RevokeProxy(id string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := i.kube.CoreV1().Secrets(galaxyNamespace).Get(revocationsSecretName, metav1.GetOptions{})
+		if kubeErrors.IsNotFound(err) {
+			secret = &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: revocationsSecretName, Namespace: galaxyNamespace},
+				Data:       map[string][]byte{id: []byte(time.Now().UTC().Format(time.RFC3339))},
+			}
+			_, err = i.kube.CoreV1().Secrets(galaxyNamespace).Create(secret)
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		secret.Data[id] = []byte(time.Now().UTC().Format(time.RFC3339))
+		_, err = i.kube.CoreV1().Secrets(galaxyNamespace).Update(secret)
+		return err
+	})
+}
+
+// GetRevokedProxies returns the node ids of the revoked proxies
+func (i *Istio) GetRevokedProxies() ([]string, error) {
+	secret, err := i.kube.CoreV1().Secrets(galaxyNamespace).Get(revocationsSecretName, metav1.GetOptions{})
+	if kubeErrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(secret.Data))
+	for id := range secret.Data {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
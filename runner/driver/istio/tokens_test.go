@@ -0,0 +1,105 @@
+package istio
+
+import (
+	"testing"
+	"time"
+
+	istioFake "istio.io/client-go/pkg/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeFake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils/auth"
+)
+
+func TestIstio_proxyTokens(t *testing.T) {
+	a, err := auth.New(&auth.Config{Mode: auth.Runner, JWTAlgorithm: auth.HS256, ProxySecret: "some-secret", ProxyTokenTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("auth.New() error = %v", err)
+	}
+	kube := kubeFake.NewSimpleClientset()
+	i, err := newIstio(a, &Config{}, kube, istioFake.NewSimpleClientset())
+	if err != nil {
+		t.Fatalf("newIstio() error = %v", err)
+	}
+	defer func() { _ = i.Close() }()
+
+	service := &model.Service{ID: "s1", ProjectID: "todo", Environment: "production", Version: "v1"}
+	ns := getNamespaceName(service.ProjectID, service.Environment)
+	getSecret := func() (id string, claims map[string]interface{}) {
+		secret, err := kube.CoreV1().Secrets(ns).Get(getProxySecretName(service), metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Could not get proxy token secret - %s", err)
+		}
+		claims, err = a.VerifyProxyToken(string(secret.Data["token"]))
+		if err != nil {
+			t.Fatalf("VerifyProxyToken() error = %v", err)
+		}
+		if claims["id"] != string(secret.Data["id"]) || claims["service"] != "s1" || claims["version"] != "v1" {
+			t.Errorf("Secret holds token with claims %v", claims)
+		}
+		return string(secret.Data["id"]), claims
+	}
+
+	if err := i.applyProxyToken(ns, service); err != nil {
+		t.Fatalf("applyProxyToken() error = %v", err)
+	}
+	id, _ := getSecret()
+	if id == "" {
+		t.Fatalf("Secret does not hold the node id")
+	}
+
+	// The node id is retained when the tokens are refreshed
+	if err := i.RefreshProxyTokens(); err != nil {
+		t.Fatalf("RefreshProxyTokens() error = %v", err)
+	}
+	if got, _ := getSecret(); got != id {
+		t.Errorf("Refreshed secret holds node id %s, want %s", got, id)
+	}
+
+	// Revoked node ids get replaced when the tokens are refreshed
+	if err := i.RevokeProxy(id); err != nil {
+		t.Fatalf("RevokeProxy() error = %v", err)
+	}
+	if err := i.RevokeProxy("other"); err != nil {
+		t.Fatalf("RevokeProxy() error = %v", err)
+	}
+	revoked, err := i.GetRevokedProxies()
+	if err != nil || len(revoked) != 2 {
+		t.Fatalf("GetRevokedProxies() = (%v, %v), want 2 ids", revoked, err)
+	}
+	a.SetRevokedProxies(revoked)
+
+	if err := i.RefreshProxyTokens(); err != nil {
+		t.Fatalf("RefreshProxyTokens() error = %v", err)
+	}
+	if got, _ := getSecret(); got == id {
+		t.Errorf("Refreshed secret still holds revoked node id %s", id)
+	}
+}
+
+func TestIstio_apiKeys(t *testing.T) {
+	i := &Istio{kube: kubeFake.NewSimpleClientset()}
+
+	key := &model.APIKey{ID: "0a1b2c3d4e5f6789", Name: "ci", Project: "todo", Role: "deployer", Hash: "hash"}
+	if err := i.SaveAPIKey(key); err != nil {
+		t.Fatalf("SaveAPIKey() error = %v", err)
+	}
+	keys, err := i.GetAPIKeys()
+	if err != nil {
+		t.Fatalf("GetAPIKeys() error = %v", err)
+	}
+	if len(keys) != 1 || keys[0].ID != key.ID || keys[0].Hash != key.Hash || keys[0].Project != key.Project {
+		t.Errorf("GetAPIKeys() = %+v, want %+v", keys, key)
+	}
+
+	if err := i.DeleteAPIKey(key.ID); err != nil {
+		t.Fatalf("DeleteAPIKey() error = %v", err)
+	}
+	if err := i.DeleteAPIKey(key.ID); err != nil {
+		t.Errorf("DeleteAPIKey() error = %v for key which doesn't exist", err)
+	}
+	if keys, _ := i.GetAPIKeys(); len(keys) != 0 {
+		t.Errorf("GetAPIKeys() = %+v after deleting the key", keys)
+	}
+}
@@ -0,0 +1,40 @@
+package election
+
+import "context"
+
+// Elector is the interface of the modules which elect a single leader amongst the replicas of the runner
+type Elector interface {
+	// Run campaigns for leadership till the context is cancelled. Leadership is released once it returns.
+	Run(ctx context.Context)
+
+	// IsLeader returns true if this replica currently holds the leadership
+	IsLeader() bool
+
+	// Leader returns the identity of the current leader. It is empty if no leader has been observed yet.
+	Leader() string
+}
+
+// Static is an elector for running a single replica. It always considers itself to be the leader.
+type Static struct {
+	identity string
+}
+
+// NewStatic creates a new static elector
+func NewStatic(identity string) *Static {
+	return &Static{identity: identity}
+}
+
+// Run blocks till the context is cancelled
+func (s *Static) Run(ctx context.Context) {
+	<-ctx.Done()
+}
+
+// IsLeader always returns true
+func (s *Static) IsLeader() bool {
+	return true
+}
+
+// Leader returns the identity of this replica
+func (s *Static) Leader() string {
+	return s.identity
+}
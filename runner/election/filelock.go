@@ -0,0 +1,117 @@
+//go:build !windows
+// +build !windows
+
+package election
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FileLock elects the leader by taking an exclusive lock on a file. It can be used when all the replicas run on the
+// same host or share a file system. The leader writes its identity in the file so that the followers can reach it.
+type FileLock struct {
+	path, identity string
+	retryPeriod    time.Duration
+
+	lock   sync.RWMutex
+	file   *os.File
+	leader string
+}
+
+// NewFileLock creates a new file lock elector
+func NewFileLock(path, identity string) *FileLock {
+	return &FileLock{path: path, identity: identity, retryPeriod: 2 * time.Second}
+}
+
+// Run campaigns for leadership till the context is cancelled
+func (f *FileLock) Run(ctx context.Context) {
+	ticker := time.NewTicker(f.retryPeriod)
+	defer ticker.Stop()
+
+	for {
+		if !f.IsLeader() {
+			f.tryAcquire()
+		}
+
+		select {
+		case <-ctx.Done():
+			f.release()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// IsLeader returns true if this replica holds the lock
+func (f *FileLock) IsLeader() bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.file != nil
+}
+
+// Leader returns the identity of the replica holding the lock
+func (f *FileLock) Leader() string {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.leader
+}
+
+func (f *FileLock) tryAcquire() {
+	file, err := os.OpenFile(f.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		logrus.Errorf("Could not open leader election lock file (%s) - %s", f.path, err.Error())
+		return
+	}
+
+	// Some other replica is the leader if we cannot get the lock. Read its identity from the file.
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		data, _ := ioutil.ReadAll(file)
+		_ = file.Close()
+
+		f.lock.Lock()
+		f.leader = strings.TrimSpace(string(data))
+		f.lock.Unlock()
+		return
+	}
+
+	// Write our identity for the followers
+	if err := file.Truncate(0); err == nil {
+		_, err = file.WriteAt([]byte(f.identity), 0)
+	}
+	if err != nil {
+		logrus.Errorf("Could not write identity to leader election lock file (%s) - %s", f.path, err.Error())
+		_ = file.Close()
+		return
+	}
+
+	f.lock.Lock()
+	f.file = file
+	f.leader = f.identity
+	f.lock.Unlock()
+	logrus.Infof("Acquired leadership (%s) using lock file %s", f.identity, f.path)
+}
+
+func (f *FileLock) release() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return
+	}
+
+	// Closing the file releases the lock
+	_ = f.file.Close()
+	f.file = nil
+	f.leader = ""
+	logrus.Infof("Released leadership (%s)", f.identity)
+}
@@ -0,0 +1,59 @@
+//go:build !windows
+// +build !windows
+
+package election
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-election")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "runner.lock")
+
+	// The first replica to campaign becomes the leader
+	first := NewFileLock(path, "runner-1:4050")
+	first.retryPeriod = 10 * time.Millisecond
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	done1 := make(chan struct{})
+	go func() { first.Run(ctx1); close(done1) }()
+	waitFor(t, first.IsLeader)
+
+	second := NewFileLock(path, "runner-2:4050")
+	second.retryPeriod = 10 * time.Millisecond
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	go second.Run(ctx2)
+	waitFor(t, func() bool { return second.Leader() == "runner-1:4050" })
+	if second.IsLeader() {
+		t.Fatalf("second replica acquired leadership while the first one holds it")
+	}
+
+	// The second replica takes over once the first one releases the leadership
+	cancel1()
+	<-done1
+	waitFor(t, second.IsLeader)
+	if first.IsLeader() {
+		t.Errorf("first replica still considers itself the leader")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,33 @@
+package election
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FileLock is not supported on windows. It never acquires the leadership.
+type FileLock struct {
+	path string
+}
+
+// NewFileLock creates a new file lock elector
+func NewFileLock(path, identity string) *FileLock {
+	return &FileLock{path: path}
+}
+
+// Run blocks till the context is cancelled
+func (f *FileLock) Run(ctx context.Context) {
+	logrus.Errorf("Leader election using lock file (%s) is not supported on windows", f.path)
+	<-ctx.Done()
+}
+
+// IsLeader always returns false
+func (f *FileLock) IsLeader() bool {
+	return false
+}
+
+// Leader always returns an empty identity
+func (f *FileLock) Leader() string {
+	return ""
+}
@@ -2,17 +2,19 @@ package runner
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/sirupsen/logrus"
-	"io"
-	"io/ioutil"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 
 	"github.com/spaceuptech/galaxy/model"
 	"github.com/spaceuptech/galaxy/utils"
+	"github.com/spaceuptech/galaxy/utils/audit"
+	"github.com/spaceuptech/galaxy/utils/auth"
 )
 
 func (runner *Runner) handleCreateProject() http.HandlerFunc {
@@ -21,12 +23,13 @@ func (runner *Runner) handleCreateProject() http.HandlerFunc {
 		defer utils.CloseReaderCloser(r.Body)
 
 		// Verify token
-		_, err := runner.auth.VerifyToken(utils.GetToken(r))
+		claims, err := runner.auth.Authenticate(utils.GetToken(r))
 		if err != nil {
 			logrus.Errorf("Failed to create project - %s", err.Error())
 			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
 			return
 		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
 		// Parse request body
 		project := new(model.Project)
 		if err := json.NewDecoder(r.Body).Decode(project); err != nil {
@@ -34,6 +37,19 @@ func (runner *Runner) handleCreateProject() http.HandlerFunc {
 			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
 			return
 		}
+		if project.ID == "" {
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, errors.New("project id not provided"))
+			return
+		}
+
+		audit.SetTarget(r, project.ID, "", project.ID)
+
+		// Check if the token is allowed to manage the project
+		if err := claims.Authorize(auth.ActionManageProject, project.ID, ""); err != nil {
+			logrus.Errorf("Failed to create project (%s) - %s", project.ID, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
 
 		// Apply the service config
 		if err := runner.driver.CreateProject(project); err != nil {
@@ -51,12 +67,13 @@ func (runner *Runner) handleServiceRequest() http.HandlerFunc {
 		defer utils.CloseReaderCloser(r.Body)
 
 		// Verify token
-		_, err := runner.auth.VerifyToken(utils.GetToken(r))
+		claims, err := runner.auth.Authenticate(utils.GetToken(r))
 		if err != nil {
 			logrus.Errorf("Failed to apply service - %s", err.Error())
 			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
 			return
 		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
 		// Parse request body
 		service := new(model.Service)
 		if err := json.NewDecoder(r.Body).Decode(service); err != nil {
@@ -64,7 +81,27 @@ func (runner *Runner) handleServiceRequest() http.HandlerFunc {
 			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
 			return
 		}
-		// TODO: Override the project id present in the service object with the one present in the token if user not admin
+
+		// Users with access to a single project needn't specify it
+		if project, ok := claims.DefaultProject(); ok && service.ProjectID == "" {
+			service.ProjectID = project
+		}
+
+		audit.SetTarget(r, service.ProjectID, service.Environment, service.ID+":"+service.Version)
+
+		// The environment needs to be checked explicitly since the claims grant access to every environment of the
+		// project when none is provided
+		if service.ProjectID == "" || service.Environment == "" {
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, errors.New("project and environment of service need to be provided"))
+			return
+		}
+
+		// Check if the token is allowed to deploy to the environment of the project
+		if err := claims.Authorize(auth.ActionDeploy, service.ProjectID, service.Environment); err != nil {
+			logrus.Errorf("Failed to apply service (%s:%s) - %s", service.ProjectID, service.ID, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
 
 		// Apply the service config
 		if err := runner.driver.ApplyService(service); err != nil {
@@ -72,80 +109,140 @@ func (runner *Runner) handleServiceRequest() http.HandlerFunc {
 			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
 			return
 		}
+
+		// Persist the applied spec so that it survives a restart or a failover of the runner
+		if err := runner.saveService(service); err != nil {
+			logrus.Errorf("Failed to persist service - %s", err.Error())
+		}
 		utils.SendEmptySuccessResponse(w, r)
 	}
 }
 
-func (runner *Runner) handleProxy() http.HandlerFunc {
+func (runner *Runner) handleGetServices() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := runner.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to get services - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+
+		// Only return the services the token has access to
+		all := runner.state.list()
+		services := all[:0]
+		for _, s := range all {
+			if claims.Authorize(auth.ActionRead, s.Service.ProjectID, s.Service.Environment) == nil {
+				services = append(services, s)
+			}
+		}
+
+		// Attach the current status of each service as seen by the driver
+		for _, s := range services {
+			status, err := runner.driver.GetServiceStatus(s.Service)
+			if err != nil {
+				logrus.Debugf("Could not get status of service (%s:%s) - %s", s.Service.ProjectID, s.Service.ID, err.Error())
+				continue
+			}
+			s.Status = status
+		}
+
+		utils.SendResponse(w, r, http.StatusOK, map[string]interface{}{"services": services})
+	}
+}
+
+func (runner *Runner) handleMetricsQuery() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Close the body of the request
 		defer utils.CloseReaderCloser(r.Body)
 
-		// http: Request.RequestURI can't be set in client requests.
-		// http://golang.org/src/pkg/net/http/client.go
-		r.RequestURI = ""
-
-		// Get the meta data from headers
-		project := r.Header.Get("x-og-project")
-		service := r.Header.Get("x-og-service")
-		ogHost := r.Header.Get("x-og-host")
-		ogPort := r.Header.Get("x-og-port")
-		ogEnv := r.Header.Get("x-og-env")
-		ogVersion := r.Header.Get("x-og-version")
-
-		// Delete the headers
-		r.Header.Del("x-og-project")
-		r.Header.Del("x-og-service")
-		r.Header.Del("x-og-host")
-		r.Header.Del("x-og-port")
-		r.Header.Del("x-og-env")
-		r.Header.Del("x-og-version")
-
-		// Change the destination with the original host and port
-		r.Host = ogHost
-		r.URL.Host = fmt.Sprintf("%s:%s", ogHost, ogPort)
-
-		// Set the url scheme to http
-		r.URL.Scheme = "http"
-
-		// Add to active request count
-		// TODO: add support for multiple versions
-		runner.chAppend <- &model.ProxyMessage{Service: service, Project: project, Environment: ogEnv, Version: ogVersion, NodeID: "runner-proxy", ActiveRequests: 1}
-
-		// Wait for the service to scale up
-		if err := runner.debounce.Wait(fmt.Sprintf("proxy-%s-%s", project, service), func() error {
-			return runner.driver.WaitForService(&model.Service{ProjectID: project, ID: service, Environment: ogEnv, Version: ogVersion})
-		}); err != nil {
-			utils.SendErrorResponse(w, r, http.StatusServiceUnavailable, err)
-			return
-		}
-		var res *http.Response
-		for i := 0; i < 5; i++ {
-			// Fire the request
-			var err error
-			res, err = http.DefaultClient.Do(r)
+		// Verify token
+		claims, err := runner.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to query metrics - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+
+		// Get the series from the path parameters
+		vars := mux.Vars(r)
+		project, service, env, version := vars["project"], vars["service"], vars["env"], vars["version"]
+
+		// Check if the token is allowed to read the environment of the project
+		if err := claims.Authorize(auth.ActionRead, project, env); err != nil {
+			logrus.Errorf("Failed to query metrics of service (%s:%s) - %s", project, service, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		// Parse the time range and step. We return the data of the last hour at a resolution of a minute by default.
+		to := time.Now()
+		from := to.Add(-time.Hour)
+		step := time.Minute
+		query := r.URL.Query()
+		if v := query.Get("to"); v != "" {
+			ts, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				utils.SendErrorResponse(w, r, http.StatusBadRequest, fmt.Errorf("invalid value (%s) provided for to", v))
+				return
+			}
+			to = time.Unix(ts, 0)
+		}
+		if v := query.Get("from"); v != "" {
+			ts, err := strconv.ParseInt(v, 10, 64)
 			if err != nil {
-				utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+				utils.SendErrorResponse(w, r, http.StatusBadRequest, fmt.Errorf("invalid value (%s) provided for from", v))
 				return
 			}
-			// TODO: Make this retry logic better
-			if res.StatusCode != http.StatusNotFound && res.StatusCode != http.StatusServiceUnavailable {
-				break
+			from = time.Unix(ts, 0)
+		}
+		if v := query.Get("step"); v != "" {
+			step, err = time.ParseDuration(v)
+			if err != nil {
+				utils.SendErrorResponse(w, r, http.StatusBadRequest, fmt.Errorf("invalid value (%s) provided for step", v))
+				return
 			}
-			time.Sleep(350 * time.Millisecond)
+		}
+
+		res, err := runner.queryRollups(project, service, env, version, from, to, step)
+		if err != nil {
+			logrus.Errorf("Failed to query metrics - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+		utils.SendResponse(w, r, http.StatusOK, res)
+	}
+}
+
+func (runner *Runner) handleForwardedMetrics() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Only other runner replicas are allowed to forward metrics
+		if err := runner.auth.VerifyRunnerToken(utils.GetToken(r)); err != nil {
+			logrus.Errorf("Failed to store forwarded metrics - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
 
-			// Close the body
-			_, _ = io.Copy(ioutil.Discard, res.Body)
-			utils.CloseReaderCloser(res.Body)
+		var messages []*model.ProxyMessage
+		if err := json.NewDecoder(r.Body).Decode(&messages); err != nil {
+			logrus.Errorf("Failed to store forwarded metrics - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
 		}
 
-		defer utils.CloseReaderCloser(res.Body)
-		// Copy headers and status code
-		w.WriteHeader(res.StatusCode)
-		for k, v := range res.Header {
-			w.Header().Set(k, v[0])
+		// The metrics are stored even if we aren't the leader anymore. They get used if we become the leader again.
+		if err := runner.store.add(messages); err != nil {
+			logrus.Errorf("Failed to store forwarded metrics - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
 		}
-		_, _ = io.Copy(w, res.Body)
+		utils.SendEmptySuccessResponse(w, r)
 	}
 }
 
@@ -154,7 +251,32 @@ func (runner *Runner) handleDatabaseService() http.HandlerFunc {
 		// Close the body of the request
 		defer utils.CloseReaderCloser(r.Body)
 
+		// Verify token
+		claims, err := runner.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to manage database service - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+
 		service := new(model.ManagedService)
-		_ = json.NewDecoder(r.Body).Decode(service)
+		if err := json.NewDecoder(r.Body).Decode(service); err != nil {
+			logrus.Errorf("Failed to manage database service - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		audit.SetTarget(r, service.ProjectID, "", service.ID)
+
+		// Check if the token is allowed to manage the services of the project. Managed services aren't tied to an
+		// environment, so tokens restricted to some of the environments can't manage them.
+		if err := claims.AuthorizeProject(auth.ActionManageServices, service.ProjectID); err != nil {
+			logrus.Errorf("Failed to manage database service (%s:%s) - %s", service.ProjectID, service.ID, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		utils.SendEmptySuccessResponse(w, r)
 	}
 }
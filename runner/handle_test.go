@@ -0,0 +1,394 @@
+package runner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/runner/election"
+	"github.com/spaceuptech/galaxy/utils/audit"
+	"github.com/spaceuptech/galaxy/utils/auth"
+)
+
+// stubDriver records the services applied to it and stores the api keys, the revoked proxies and the shared state in
+// memory
+type stubDriver struct {
+	applied   []*model.Service
+	apiKeys   []*model.APIKey
+	revoked   []string
+	refreshes int
+
+	lock  sync.Mutex
+	state map[string]map[string][]byte
+}
+
+func (d *stubDriver) CreateProject(project *model.Project) error { return nil }
+func (d *stubDriver) ApplyService(service *model.Service) error {
+	d.applied = append(d.applied, service)
+	return nil
+}
+func (d *stubDriver) AdjustScale(service *model.Service, activeReqs int32) error { return nil }
+func (d *stubDriver) WaitForService(service *model.Service) error                { return nil }
+func (d *stubDriver) GetServiceStatus(service *model.Service) (*model.ServiceStatus, error) {
+	return nil, errors.New("not found")
+}
+func (d *stubDriver) NewElector(identity string) (election.Elector, error) { return nil, nil }
+func (d *stubDriver) RefreshProxyTokens() error {
+	d.refreshes++
+	return nil
+}
+func (d *stubDriver) RevokeProxy(id string) error {
+	d.revoked = append(d.revoked, id)
+	return nil
+}
+func (d *stubDriver) GetRevokedProxies() ([]string, error) { return d.revoked, nil }
+func (d *stubDriver) SaveAPIKey(key *model.APIKey) error {
+	d.apiKeys = append(d.apiKeys, key)
+	return nil
+}
+func (d *stubDriver) DeleteAPIKey(id string) error {
+	for i, key := range d.apiKeys {
+		if key.ID == id {
+			d.apiKeys = append(d.apiKeys[:i], d.apiKeys[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+func (d *stubDriver) GetAPIKeys() ([]*model.APIKey, error) { return d.apiKeys, nil }
+func (d *stubDriver) SaveState(kind, key string, data []byte) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.state == nil {
+		d.state = map[string]map[string][]byte{}
+	}
+	if d.state[kind] == nil {
+		d.state[kind] = map[string][]byte{}
+	}
+	d.state[kind][key] = data
+	return nil
+}
+func (d *stubDriver) DeleteState(kind, key string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.state[kind], key)
+	return nil
+}
+func (d *stubDriver) GetState(kind string) (map[string][]byte, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	entries := make(map[string][]byte, len(d.state[kind]))
+	for key, data := range d.state[kind] {
+		entries[key] = data
+	}
+	return entries, nil
+}
+func (d *stubDriver) Type() model.DriverType { return "stub" }
+func (d *stubDriver) Close() error           { return nil }
+
+// testRunner is a runner serving its routes with a stub driver. Its tokens are signed with an hs256 secret.
+type testRunner struct {
+	*Runner
+	t    *testing.T
+	stub *stubDriver
+}
+
+func newTestRunner(t *testing.T) (*testRunner, func()) {
+	db, cleanup := openTestDB(t)
+
+	s, err := loadState(db)
+	if err != nil {
+		cleanup()
+		t.Fatalf("loadState() error = %v", err)
+	}
+	a, err := auth.New(&auth.Config{Mode: auth.Runner, JWTAlgorithm: auth.HS256, Secret: "some-secret"})
+	if err != nil {
+		cleanup()
+		t.Fatalf("auth.New() error = %v", err)
+	}
+	d := new(stubDriver)
+	runner := &Runner{
+		router:   mux.NewRouter(),
+		db:       db,
+		auth:     a,
+		audit:    audit.New(db, time.Hour),
+		driver:   d,
+		state:    s,
+		elector:  election.NewStatic("runner"),
+		identity: "runner",
+		client:   http.DefaultClient,
+		scheme:   "http",
+
+		checkpoints: map[string][sha256.Size]byte{},
+	}
+	runner.audit.SetSharedStore(runner.shareAuditEntry)
+	runner.routes()
+	return &testRunner{Runner: runner, t: t, stub: d}, cleanup
+}
+
+// sign issues a token with the claims
+func (r *testRunner) sign(claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("some-secret"))
+	if err != nil {
+		r.t.Fatalf("Could not sign token - %s", err)
+	}
+	return token
+}
+
+// do sends the request with the json encoded body to the runner. The request is sent without a token if none is
+// provided.
+func (r *testRunner) do(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRunner_authorization(t *testing.T) {
+	runner, cleanup := newTestRunner(t)
+	defer cleanup()
+
+	for _, service := range []*model.Service{
+		{ID: "s1", ProjectID: "todo", Environment: "staging", Version: "v1"},
+		{ID: "s2", ProjectID: "todo", Environment: "production", Version: "v1"},
+		{ID: "s3", ProjectID: "chat", Environment: "staging", Version: "v1"},
+	} {
+		if err := runner.state.setService(service); err != nil {
+			t.Fatalf("setService() error = %v", err)
+		}
+	}
+
+	admin := runner.sign(jwt.MapClaims{"role": "admin"})
+	deployer := runner.sign(jwt.MapClaims{"role": "deployer", "projects": []string{"todo"}, "envs": []string{"staging"}})
+	viewer := runner.sign(jwt.MapClaims{"role": "viewer", "projects": []string{"todo"}})
+	projectAdmin := runner.sign(jwt.MapClaims{"role": "project-admin", "projects": []string{"todo"}})
+	restricted := runner.sign(jwt.MapClaims{"role": "project-admin", "projects": []string{"todo"}, "envs": []string{"staging"}})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   interface{}
+		status int
+	}{
+		{name: "no token", method: "GET", path: "/v1/galaxy/services", status: http.StatusUnauthorized},
+		{name: "invalid token", method: "GET", path: "/v1/galaxy/services", token: "invalid", status: http.StatusUnauthorized},
+		{name: "admin creates project", method: "POST", path: "/v1/galaxy/project", token: admin, body: model.Project{ID: "chat"}, status: http.StatusOK},
+		{name: "deployer creates project", method: "POST", path: "/v1/galaxy/project", token: deployer, body: model.Project{ID: "todo"}, status: http.StatusForbidden},
+		{name: "deployer applies service to granted env", method: "POST", path: "/v1/galaxy/service", token: deployer, body: model.Service{ID: "s4", Environment: "staging"}, status: http.StatusOK},
+		{name: "deployer applies service to other env", method: "POST", path: "/v1/galaxy/service", token: deployer, body: model.Service{ID: "s4", ProjectID: "todo", Environment: "production"}, status: http.StatusForbidden},
+		{name: "deployer applies service to other project", method: "POST", path: "/v1/galaxy/service", token: deployer, body: model.Service{ID: "s4", ProjectID: "chat", Environment: "staging"}, status: http.StatusForbidden},
+		{name: "deployer applies service without env", method: "POST", path: "/v1/galaxy/service", token: deployer, body: model.Service{ID: "s4", ProjectID: "todo"}, status: http.StatusBadRequest},
+		{name: "admin applies service without project", method: "POST", path: "/v1/galaxy/service", token: admin, body: model.Service{ID: "s4", Environment: "staging"}, status: http.StatusBadRequest},
+		{name: "viewer applies service", method: "POST", path: "/v1/galaxy/service", token: viewer, body: model.Service{ID: "s4", ProjectID: "todo", Environment: "staging"}, status: http.StatusForbidden},
+		{name: "viewer queries metrics of other project", method: "GET", path: "/v1/galaxy/metrics/chat/s3/staging/v1", token: viewer, status: http.StatusForbidden},
+		{name: "viewer manages database", method: "POST", path: "/v1/galaxy/manageServices/database", token: viewer, body: model.ManagedService{ProjectID: "todo"}, status: http.StatusForbidden},
+		{name: "env restricted project admin manages database", method: "POST", path: "/v1/galaxy/manageServices/database", token: restricted, body: model.ManagedService{ProjectID: "todo"}, status: http.StatusForbidden},
+		{name: "project admin manages database", method: "POST", path: "/v1/galaxy/manageServices/database", token: projectAdmin, body: model.ManagedService{ProjectID: "todo"}, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := runner.do(tt.method, tt.path, tt.token, tt.body); w.Code != tt.status {
+				t.Errorf("%s %s returned status %d, want %d - %s", tt.method, tt.path, w.Code, tt.status, w.Body.String())
+			}
+		})
+	}
+
+	// The project of the deployer gets used when the service doesn't specify one
+	if applied := runner.stub.applied; len(applied) != 1 || applied[0].ProjectID != "todo" {
+		t.Errorf("Applied services = %v, want s4 in project todo", applied)
+	}
+
+	// Only the services of the granted projects and environments are listed
+	getServices := func(token string) []string {
+		w := runner.do("GET", "/v1/galaxy/services", token, nil)
+		res := struct {
+			Services []*model.ServiceState `json:"services"`
+		}{}
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatalf("Could not decode services - %s", err)
+		}
+		ids := make([]string, len(res.Services))
+		for i, s := range res.Services {
+			ids[i] = s.Service.ID
+		}
+		return ids
+	}
+	if got := getServices(deployer); len(got) != 2 || got[0] != "s1" || got[1] != "s4" {
+		t.Errorf("Services listed for deployer = %v, want [s1 s4]", got)
+	}
+	if got := getServices(viewer); len(got) != 3 {
+		t.Errorf("Services listed for viewer = %v, want 3 services of project todo", got)
+	}
+	if got := getServices(admin); len(got) != 4 {
+		t.Errorf("Services listed for admin = %v, want all 4 services", got)
+	}
+}
+
+func TestRunner_apiKeys(t *testing.T) {
+	runner, cleanup := newTestRunner(t)
+	defer cleanup()
+	do, d := runner.do, runner.stub
+
+	token := runner.sign(jwt.MapClaims{"role": "project-admin", "projects": []string{"todo"}})
+
+	// Project admins can only create keys for their projects
+	if w := do("POST", "/v1/galaxy/api-keys", token, model.APIKeyRequest{Project: "chat"}); w.Code != http.StatusForbidden {
+		t.Errorf("Creating key for other project returned status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	w := do("POST", "/v1/galaxy/api-keys", token, model.APIKeyRequest{Name: "ci", Environments: []string{"staging"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Creating key returned status %d - %s", w.Code, w.Body.String())
+	}
+	res := new(model.APIKeyResponse)
+	if err := json.NewDecoder(w.Body).Decode(res); err != nil {
+		t.Fatal(err)
+	}
+	if res.APIKey.Project != "todo" || res.APIKey.Hash != "" || len(d.apiKeys) != 1 || d.apiKeys[0].Hash == "" {
+		t.Errorf("Created key %+v, stored %+v", res.APIKey, d.apiKeys)
+	}
+
+	// The key only grants access to the environments it was created for
+	if w := do("POST", "/v1/galaxy/service", res.Key, model.Service{ID: "s1", ProjectID: "todo", Environment: "staging"}); w.Code != http.StatusOK {
+		t.Errorf("Deploying with key returned status %d - %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/v1/galaxy/service", res.Key, model.Service{ID: "s1", ProjectID: "todo", Environment: "production"}); w.Code != http.StatusForbidden {
+		t.Errorf("Deploying to other environment with key returned status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := do("POST", "/v1/galaxy/api-keys", res.Key, model.APIKeyRequest{Project: "todo"}); w.Code != http.StatusForbidden {
+		t.Errorf("Creating key with key returned status %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	// Keys are listed without their hash
+	w = do("GET", "/v1/galaxy/api-keys?project=todo", token, nil)
+	list := struct {
+		APIKeys []*model.APIKey `json:"apiKeys"`
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.APIKeys) != 1 || list.APIKeys[0].ID != res.APIKey.ID || list.APIKeys[0].Hash != "" {
+		t.Errorf("Listed keys %+v, want key %s without hash", list.APIKeys, res.APIKey.ID)
+	}
+
+	// Project admins restricted to some environments only manage the keys of those environments
+	restricted := runner.sign(jwt.MapClaims{"role": "project-admin", "projects": []string{"todo"}, "envs": []string{"production"}})
+	w = do("GET", "/v1/galaxy/api-keys?project=todo", restricted, nil)
+	list.APIKeys = nil
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.APIKeys) != 0 {
+		t.Errorf("Listed keys %+v for other environment, want none", list.APIKeys)
+	}
+	if w := do("DELETE", "/v1/galaxy/api-keys/"+res.APIKey.ID, restricted, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Revoking key of other environment returned status %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	// Revoked keys are rejected right away
+	if w := do("DELETE", "/v1/galaxy/api-keys/"+res.APIKey.ID, token, nil); w.Code != http.StatusOK {
+		t.Fatalf("Revoking key returned status %d - %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/v1/galaxy/service", res.Key, model.Service{ID: "s1", ProjectID: "todo", Environment: "staging"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("Deploying with revoked key returned status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRunner_revokeProxy(t *testing.T) {
+	runner, cleanup := newTestRunner(t)
+	defer cleanup()
+	do, d := runner.do, runner.stub
+
+	if w := do("POST", "/v1/galaxy/proxy/revoke", runner.sign(jwt.MapClaims{"role": "admin"}), model.ProxyRevocation{ID: "node-1"}); w.Code != http.StatusOK {
+		t.Fatalf("Revoking proxy returned status %d - %s", w.Code, w.Body.String())
+	}
+	if !runner.auth.IsRevoked("node-1") {
+		t.Errorf("Proxy (node-1) not revoked, driver stored %v", d.revoked)
+	}
+
+	// The stored tokens are re-signed right away so that new pods don't start with the revoked node id
+	if d.refreshes != 1 {
+		t.Errorf("Proxy tokens refreshed %d time(s), want 1", d.refreshes)
+	}
+}
+
+func TestRunner_audit(t *testing.T) {
+	runner, cleanup := newTestRunner(t)
+	defer cleanup()
+	do := runner.do
+
+	todo := runner.sign(jwt.MapClaims{"id": "alice", "role": "project-admin", "projects": []string{"todo"}})
+	chat := runner.sign(jwt.MapClaims{"id": "bob", "role": "project-admin", "projects": []string{"chat"}})
+	viewer := runner.sign(jwt.MapClaims{"id": "carol", "role": "viewer", "projects": []string{"todo"}})
+
+	// Both successful and rejected operations are recorded
+	do("POST", "/v1/galaxy/service", todo, model.Service{ID: "s1", ProjectID: "todo", Environment: "staging", Version: "v1"})
+	do("POST", "/v1/galaxy/service", viewer, model.Service{ID: "s1", ProjectID: "todo", Environment: "staging", Version: "v1"})
+	do("POST", "/v1/galaxy/service", chat, model.Service{ID: "s2", ProjectID: "chat", Environment: "staging", Version: "v1"})
+
+	query := func(path, token string) []*model.AuditEntry {
+		w := do("GET", path, token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s returned status %d - %s", path, w.Code, w.Body.String())
+		}
+		res := struct {
+			Entries []*model.AuditEntry `json:"entries"`
+		}{}
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res.Entries
+	}
+
+	// Project admins only see the entries of their projects
+	entries := query("/v1/galaxy/audit", todo)
+	if len(entries) != 2 {
+		t.Fatalf("Query returned %d entries, want 2", len(entries))
+	}
+	for _, e := range entries {
+		switch e.Actor {
+		case "alice":
+			if e.Action != "apply-service" || e.Project != "todo" || e.Environment != "staging" || e.Result != audit.ResultSuccess || e.Digest == "" {
+				t.Errorf("Entry of successful request = %+v", e)
+			}
+		case "carol":
+			if e.Status != http.StatusForbidden || e.Result != audit.ResultFailure || e.Error == "" {
+				t.Errorf("Entry of rejected request = %+v", e)
+			}
+		default:
+			t.Errorf("Query returned entry of actor %s", e.Actor)
+		}
+	}
+	if entries := query("/v1/galaxy/audit?actor=bob", chat); len(entries) != 1 || entries[0].Project != "chat" {
+		t.Errorf("Query by actor returned %+v", entries)
+	}
+
+	// Other projects and roles without access to manage projects are rejected
+	if w := do("GET", "/v1/galaxy/audit?project=chat", todo, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Querying other project returned status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := do("GET", "/v1/galaxy/audit", viewer, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Querying as viewer returned status %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	// Exports are streamed as json lines
+	w := do("GET", "/v1/galaxy/audit/export", todo, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" || bytes.Count(w.Body.Bytes(), []byte("\n")) != 2 {
+		t.Errorf("Export returned status %d with %q", w.Code, w.Body.String())
+	}
+}
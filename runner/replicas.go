@@ -0,0 +1,144 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/runner/driver"
+	"github.com/spaceuptech/galaxy/runner/election"
+	"github.com/spaceuptech/galaxy/utils"
+)
+
+// newElector returns the elector of the configured mode along with the identity of this replica
+func newElector(c *Config, d driver.Driver) (election.Elector, string, error) {
+	e := c.Election
+	if e == nil {
+		e = &ElectionConfig{Mode: ElectionNone}
+	}
+
+	// Use the hostname as the identity if no address was advertised
+	identity := e.AdvertiseAddr
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, "", err
+		}
+		identity = hostname + ":" + c.Port
+	}
+
+	switch e.Mode {
+	case ElectionNone, "":
+		return election.NewStatic(identity), identity, nil
+	case ElectionDriver:
+		elector, err := d.NewElector(identity)
+		return elector, identity, err
+	case ElectionFile:
+		path := e.LockFile
+		if path == "" {
+			path = filepath.Join(os.TempDir(), "galaxy-runner.lock")
+		}
+		return election.NewFileLock(path, identity), identity, nil
+	default:
+		return nil, "", fmt.Errorf("invalid election mode (%s) provided", e.Mode)
+	}
+}
+
+// storeMetrics stores the metrics if this replica is the leader. Otherwise they are forwarded to the leader. The metrics
+// are stored locally as long as no leader has been observed yet.
+func (runner *Runner) storeMetrics(messages []*model.ProxyMessage) error {
+	leader := runner.elector.Leader()
+	if runner.elector.IsLeader() || leader == "" {
+		return runner.store.add(messages)
+	}
+
+	return runner.forwardMetrics(leader, messages)
+}
+
+func (runner *Runner) forwardMetrics(leader string, messages []*model.ProxyMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s://%s/v1/galaxy/metrics", runner.scheme, leader), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// The leader authenticates the metrics forwarded by this replica using this token. It is signed for every request
+	// since it expires.
+	token, err := runner.auth.SignRunnerToken(runner.identity)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := runner.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer utils.CloseReaderCloser(res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("leader (%s) responded with status code %d - %s", leader, res.StatusCode, string(body))
+	}
+	return nil
+}
+
+// forwardedHeader marks the requests forwarded by another replica. They are always served locally so that requests
+// don't bounce between replicas which disagree on the leader.
+const forwardedHeader = "X-Galaxy-Forwarded-By"
+
+// leaderOnly makes sure the request is served by the leader. Only the leader stores metrics and it serves the
+// services, the rollups and the audit log from its local database, so followers forward the requests which read or
+// write them to the leader. The leader restores the state shared by the previous leaders before serving them. The
+// request is served locally as long as no leader has been observed yet.
+func (runner *Runner) leaderOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		leader := runner.elector.Leader()
+		if runner.elector.IsLeader() {
+			if err := runner.ensureSharedState(); err != nil {
+				logrus.Errorln("Could not restore shared state:", err)
+				utils.SendErrorResponse(w, r, http.StatusServiceUnavailable, errors.New("leader is restoring its state"))
+				return
+			}
+			h(w, r)
+			return
+		}
+		if leader == "" || r.Header.Get(forwardedHeader) != "" {
+			h(w, r)
+			return
+		}
+
+		// The leader authenticates and authorizes the request itself
+		proxy := &httputil.ReverseProxy{
+			Director: func(req *http.Request) {
+				req.URL.Scheme, req.URL.Host = runner.scheme, leader
+				req.Header.Set(forwardedHeader, runner.identity)
+			},
+			Transport: runner.client.Transport,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				logrus.Errorf("Failed to forward request to leader (%s) - %s", leader, err.Error())
+				utils.SendErrorResponse(w, r, http.StatusBadGateway, fmt.Errorf("leader (%s) could not be reached", leader))
+			},
+		}
+		proxy.ServeHTTP(w, r)
+	}
+}
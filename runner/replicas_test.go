@@ -0,0 +1,158 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// followerElector is the elector of a replica which follows the leader
+type followerElector struct {
+	leader string
+}
+
+func (e *followerElector) Run(ctx context.Context) { <-ctx.Done() }
+func (e *followerElector) IsLeader() bool          { return false }
+func (e *followerElector) Leader() string          { return e.leader }
+
+func TestRunner_leaderOnly(t *testing.T) {
+	leader, cleanupLeader := newTestRunner(t)
+	defer cleanupLeader()
+	follower, cleanupFollower := newTestRunner(t)
+	defer cleanupFollower()
+
+	ts := httptest.NewServer(leader.router)
+	defer ts.Close()
+	follower.elector = &followerElector{leader: strings.TrimPrefix(ts.URL, "http://")}
+	follower.identity = "follower"
+
+	token := follower.sign(jwt.MapClaims{"id": "alice", "role": "project-admin", "projects": []string{"todo"}})
+
+	// Services applied through the follower end up in the state of the leader
+	if w := follower.do("POST", "/v1/galaxy/service", token, model.Service{ID: "s1", ProjectID: "todo", Environment: "staging", Version: "v1"}); w.Code != http.StatusOK {
+		t.Fatalf("Applying service through follower returned status %d - %s", w.Code, w.Body.String())
+	}
+	if len(leader.stub.applied) != 1 || len(follower.stub.applied) != 0 {
+		t.Errorf("Service applied by leader %d times and by follower %d times, want 1 and 0", len(leader.stub.applied), len(follower.stub.applied))
+	}
+
+	res := struct {
+		Services []*model.ServiceState `json:"services"`
+	}{}
+	if w := follower.do("GET", "/v1/galaxy/services", token, nil); w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&res) != nil || len(res.Services) != 1 {
+		t.Errorf("Listing services through follower returned status %d and %d services, want 1", w.Code, len(res.Services))
+	}
+
+	// The operation is audited once by the leader
+	entries := struct {
+		Entries []*model.AuditEntry `json:"entries"`
+	}{}
+	if w := follower.do("GET", "/v1/galaxy/audit", token, nil); w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&entries) != nil || len(entries.Entries) != 1 {
+		t.Errorf("Querying audit log through follower returned status %d and %d entries, want 1", w.Code, len(entries.Entries))
+	}
+	if local, err := follower.audit.Query(&model.AuditQuery{}, nil); err != nil || len(local) != 0 {
+		t.Errorf("Follower recorded %d audit entries, want 0 - %v", len(local), err)
+	}
+
+	// Requests forwarded by another replica are served locally
+	r := httptest.NewRequest("GET", "/v1/galaxy/services", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set(forwardedHeader, "other")
+	w := httptest.NewRecorder()
+	follower.router.ServeHTTP(w, r)
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || len(res.Services) != 0 {
+		t.Errorf("Forwarded request returned %d services of the leader, want 0", len(res.Services))
+	}
+
+	// The follower reports the leader being unreachable
+	ts.Close()
+	if w := follower.do("GET", "/v1/galaxy/services", token, nil); w.Code != http.StatusBadGateway {
+		t.Errorf("Listing services with unreachable leader returned status %d, want %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestRunner_failover(t *testing.T) {
+	previous, cleanupPrevious := newTestRunner(t)
+	defer cleanupPrevious()
+	token := previous.sign(jwt.MapClaims{"id": "alice", "role": "project-admin", "projects": []string{"todo"}})
+
+	// The previous leader applies a service and records its metrics
+	if w := previous.do("POST", "/v1/galaxy/service", token, model.Service{ID: "s1", ProjectID: "todo", Environment: "staging", Version: "v1"}); w.Code != http.StatusOK {
+		t.Fatalf("Applying service returned status %d - %s", w.Code, w.Body.String())
+	}
+	if err := previous.recordRollups("todo", "s1", "staging", "v1", 5, time.Now().Add(-10*time.Minute)); err != nil {
+		t.Fatalf("recordRollups() error = %v", err)
+	}
+	if err := previous.checkpointRollups(); err != nil {
+		t.Fatalf("checkpointRollups() error = %v", err)
+	}
+
+	// The replica taking over has an empty database of its own but shares the storage of the driver
+	next, cleanupNext := newTestRunner(t)
+	defer cleanupNext()
+	next.driver = previous.stub
+
+	res := struct {
+		Services []*model.ServiceState `json:"services"`
+	}{}
+	if w := next.do("GET", "/v1/galaxy/services", token, nil); w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&res) != nil || len(res.Services) != 1 {
+		t.Errorf("Listing services after failover returned status %d and %d services, want 1", w.Code, len(res.Services))
+	}
+	metrics := new(model.MetricsQueryResponse)
+	if w := next.do("GET", "/v1/galaxy/metrics/todo/s1/staging/v1", token, nil); w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(metrics) != nil || len(metrics.Points) != 1 {
+		t.Errorf("Querying metrics after failover returned status %d and %+v, want 1 point", w.Code, metrics)
+	}
+
+	entries := struct {
+		Entries []*model.AuditEntry `json:"entries"`
+	}{}
+	if w := next.do("GET", "/v1/galaxy/audit", token, nil); w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&entries) != nil || len(entries.Entries) != 1 || entries.Entries[0].Action != "apply-service" {
+		t.Errorf("Querying audit log after failover returned status %d and %+v, want the entry of the previous leader", w.Code, entries.Entries)
+	}
+
+	// The shared audit entries past the retention period get pruned
+	old := &model.AuditEntry{ID: "old", Ts: time.Now().Add(-2*time.Hour).UnixNano() / int64(time.Millisecond)}
+	if err := previous.shareAuditEntry(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := next.pruneSharedAudit(); err != nil {
+		t.Fatalf("pruneSharedAudit() error = %v", err)
+	}
+	if shared, _ := previous.stub.GetState(sharedAudit); len(shared) != 1 || shared["old"] != nil {
+		t.Errorf("pruneSharedAudit() left %d entries, want 1", len(shared))
+	}
+
+	// Unchanged rollups aren't written again
+	previous.stub.state[sharedRollups] = nil
+	if err := previous.checkpointRollups(); err != nil || len(previous.stub.state[sharedRollups]) != 0 {
+		t.Errorf("checkpointRollups() wrote unchanged rollups - %v", err)
+	}
+}
+
+func TestRunner_Close(t *testing.T) {
+	runner, cleanup := newTestRunner(t)
+	defer cleanup()
+	runner.done = make(chan struct{})
+
+	// Closing the runner again must not close the channels or the database twice
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- runner.Close() }()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+	}
+	if err := runner.Close(); err != nil {
+		t.Errorf("Close() error = %v after closing the runner", err)
+	}
+}
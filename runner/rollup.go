@@ -0,0 +1,170 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// rollupTier describes a downsampled retention tier of the service metrics
+type rollupTier struct {
+	name       string
+	resolution time.Duration
+	retention  time.Duration
+}
+
+// The tiers are ordered from the finest resolution to the coarsest
+var rollupTiers = []rollupTier{
+	{name: "1m", resolution: time.Minute, retention: 24 * time.Hour},
+	{name: "1h", resolution: time.Hour, retention: 30 * 24 * time.Hour},
+}
+
+// rollup is the downsampled value of the active requests of a service over a single bucket of a tier
+type rollup struct {
+	Sum   int64 `json:"sum"`
+	Count int64 `json:"count"`
+	Max   int32 `json:"max"`
+}
+
+func (r *rollup) add(value int32) {
+	r.Sum += int64(value)
+	r.Count++
+	if value > r.Max {
+		r.Max = value
+	}
+}
+
+func (r *rollup) merge(other *rollup) {
+	r.Sum += other.Sum
+	r.Count += other.Count
+	if other.Max > r.Max {
+		r.Max = other.Max
+	}
+}
+
+// The bucket timestamp is zero padded to make sure the lexical order of the keys matches the chronological order
+func makeRollupPrefix(tier, project, service, env, version string) string {
+	return fmt.Sprintf("rollups/%s/%s/%s/%s/%s/", tier, project, service, env, version)
+}
+
+func makeRollupKey(tier, project, service, env, version string, bucket int64) string {
+	return fmt.Sprintf("%s%020d", makeRollupPrefix(tier, project, service, env, version), bucket)
+}
+
+// recordRollups adds the aggregated active requests of a service to the bucket of each retention tier
+func (runner *Runner) recordRollups(project, service, env, version string, value int32, now time.Time) error {
+	return runner.db.Update(func(txn *badger.Txn) error {
+		for _, tier := range rollupTiers {
+			bucket := now.Truncate(tier.resolution).Unix()
+			key := []byte(makeRollupKey(tier.name, project, service, env, version, bucket))
+
+			// Load the existing value of the bucket if it exists
+			r := new(rollup)
+			item, err := txn.Get(key)
+			switch err {
+			case nil:
+				if err := item.Value(func(val []byte) error { return json.Unmarshal(val, r) }); err != nil {
+					return err
+				}
+			case badger.ErrKeyNotFound:
+			default:
+				return err
+			}
+
+			r.add(value)
+
+			// Keep the bucket around for the retention period of the tier
+			data, _ := json.Marshal(r)
+			if err := txn.SetEntry(badger.NewEntry(key, data).WithTTL(tier.retention + tier.resolution)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// queryRollups returns the downsampled active requests of a service between the provided time range. The finest tier
+// which still retains data from the start of the range is used. The step gets rounded up to a multiple of its resolution.
+func (runner *Runner) queryRollups(project, service, env, version string, from, to time.Time, step time.Duration) (*model.MetricsQueryResponse, error) {
+	if !from.Before(to) {
+		return nil, fmt.Errorf("invalid time range (%d - %d) provided", from.Unix(), to.Unix())
+	}
+
+	// Select the tier to be used
+	tier := rollupTiers[len(rollupTiers)-1]
+	for _, t := range rollupTiers {
+		if time.Since(from) <= t.retention {
+			tier = t
+			break
+		}
+	}
+
+	// Make sure the step is a multiple of the tier's resolution
+	if step < tier.resolution {
+		step = tier.resolution
+	}
+	step = step.Truncate(tier.resolution)
+
+	res := &model.MetricsQueryResponse{
+		Project:     project,
+		Service:     service,
+		Environment: env,
+		Version:     version,
+		Resolution:  tier.name,
+		Step:        int64(step / time.Second),
+		Points:      []model.MetricPoint{},
+	}
+
+	prefix := makeRollupPrefix(tier.name, project, service, env, version)
+	start := []byte(makeRollupKey(tier.name, project, service, env, version, from.Truncate(tier.resolution).Unix()))
+	end := to.Unix()
+
+	err := runner.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, PrefetchSize: 100, Prefix: []byte(prefix)})
+		defer it.Close()
+
+		var current *rollup
+		var currentTs int64
+		flush := func() {
+			if current != nil && current.Count > 0 {
+				res.Points = append(res.Points, model.MetricPoint{Ts: currentTs, Avg: float64(current.Sum) / float64(current.Count), Max: current.Max})
+			}
+		}
+
+		for it.Seek(start); it.Valid(); it.Next() {
+			item := it.Item()
+
+			var bucket int64
+			if _, err := fmt.Sscanf(string(item.Key()[len(prefix):]), "%d", &bucket); err != nil {
+				return err
+			}
+			if bucket > end {
+				break
+			}
+
+			r := new(rollup)
+			if err := item.Value(func(val []byte) error { return json.Unmarshal(val, r) }); err != nil {
+				return err
+			}
+
+			// Merge the buckets which fall in the same step
+			ts := time.Unix(bucket, 0).Truncate(step).Unix()
+			if current == nil || ts != currentTs {
+				flush()
+				current, currentTs = new(rollup), ts
+			}
+			current.merge(r)
+		}
+		flush()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
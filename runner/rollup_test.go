@@ -0,0 +1,152 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+func TestRunner_queryRollups(t *testing.T) {
+	runner, cleanup := newTestRunner(t)
+	defer cleanup()
+
+	// The samples span three minutes within a single hour. The first two fall in the same minute.
+	start := time.Now().Truncate(time.Hour).Add(-2 * time.Hour)
+	samples := []struct {
+		offset time.Duration
+		value  int32
+	}{
+		{offset: 10 * time.Second, value: 2},
+		{offset: 20 * time.Second, value: 4},
+		{offset: time.Minute + 30*time.Second, value: 6},
+		{offset: 2*time.Minute + 5*time.Second, value: 1},
+	}
+	for _, s := range samples {
+		if err := runner.recordRollups("todo", "s1", "staging", "v1", s.value, start.Add(s.offset)); err != nil {
+			t.Fatalf("recordRollups() error = %v", err)
+		}
+	}
+	ts := func(offset time.Duration) int64 { return start.Add(offset).Unix() }
+
+	tests := []struct {
+		name           string
+		from, to       time.Time
+		step           time.Duration
+		wantResolution string
+		wantStep       int64
+		wantPoints     []model.MetricPoint
+		wantErr        bool
+	}{
+		{
+			name: "buckets are aligned to the minute", from: start.Add(-time.Minute), to: start.Add(time.Hour), step: time.Minute,
+			wantResolution: "1m", wantStep: 60,
+			wantPoints: []model.MetricPoint{{Ts: ts(0), Avg: 3, Max: 4}, {Ts: ts(time.Minute), Avg: 6, Max: 6}, {Ts: ts(2 * time.Minute), Avg: 1, Max: 1}},
+		},
+		{
+			name: "buckets within a step are merged", from: start, to: start.Add(time.Hour), step: 2 * time.Minute,
+			wantResolution: "1m", wantStep: 120,
+			wantPoints: []model.MetricPoint{{Ts: ts(0), Avg: 4, Max: 6}, {Ts: ts(2 * time.Minute), Avg: 1, Max: 1}},
+		},
+		{
+			name: "step is rounded to the resolution", from: start, to: start.Add(time.Hour), step: 90 * time.Second,
+			wantResolution: "1m", wantStep: 60,
+			wantPoints: []model.MetricPoint{{Ts: ts(0), Avg: 3, Max: 4}, {Ts: ts(time.Minute), Avg: 6, Max: 6}, {Ts: ts(2 * time.Minute), Avg: 1, Max: 1}},
+		},
+		{
+			name: "step is raised to the resolution", from: start, to: start.Add(time.Hour), step: 10 * time.Second,
+			wantResolution: "1m", wantStep: 60,
+			wantPoints: []model.MetricPoint{{Ts: ts(0), Avg: 3, Max: 4}, {Ts: ts(time.Minute), Avg: 6, Max: 6}, {Ts: ts(2 * time.Minute), Avg: 1, Max: 1}},
+		},
+		{
+			name: "buckets after the range are skipped", from: start, to: start.Add(time.Minute), step: time.Minute,
+			wantResolution: "1m", wantStep: 60,
+			wantPoints: []model.MetricPoint{{Ts: ts(0), Avg: 3, Max: 4}, {Ts: ts(time.Minute), Avg: 6, Max: 6}},
+		},
+		{
+			name: "hour tier beyond retention of minute tier", from: start.Add(-48 * time.Hour), to: start.Add(time.Hour), step: time.Minute,
+			wantResolution: "1h", wantStep: 3600,
+			wantPoints: []model.MetricPoint{{Ts: ts(0), Avg: 3.25, Max: 6}},
+		},
+		{
+			name: "empty range", from: start.Add(time.Hour), to: start.Add(2 * time.Hour), step: time.Minute,
+			wantResolution: "1m", wantStep: 60, wantPoints: []model.MetricPoint{},
+		},
+		{name: "from after to", from: start.Add(time.Hour), to: start, step: time.Minute, wantErr: true},
+		{name: "from equals to", from: start, to: start, step: time.Minute, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := runner.queryRollups("todo", "s1", "staging", "v1", tt.from, tt.to, tt.step)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("queryRollups() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if res.Resolution != tt.wantResolution || res.Step != tt.wantStep {
+				t.Errorf("queryRollups() resolution = %s, step = %d, want %s, %d", res.Resolution, res.Step, tt.wantResolution, tt.wantStep)
+			}
+			if !reflect.DeepEqual(res.Points, tt.wantPoints) {
+				t.Errorf("queryRollups() points = %v, want %v", res.Points, tt.wantPoints)
+			}
+		})
+	}
+
+	// The series of other versions are kept apart
+	res, err := runner.queryRollups("todo", "s1", "staging", "v2", start, start.Add(time.Hour), time.Minute)
+	if err != nil || len(res.Points) != 0 {
+		t.Errorf("queryRollups(v2) = %v, %v", res, err)
+	}
+}
+
+func TestRunner_handleMetricsQuery(t *testing.T) {
+	runner, cleanup := newTestRunner(t)
+	defer cleanup()
+
+	now := time.Now()
+	if err := runner.recordRollups("todo", "s1", "staging", "v1", 5, now.Add(-10*time.Minute)); err != nil {
+		t.Fatalf("recordRollups() error = %v", err)
+	}
+	token := runner.sign(jwt.MapClaims{"role": "viewer", "projects": []string{"todo"}})
+	path := "/v1/galaxy/metrics/todo/s1/staging/v1"
+
+	tests := []struct {
+		name       string
+		query      string
+		status     int
+		wantPoints int
+	}{
+		{name: "defaults to the last hour", query: "", status: http.StatusOK, wantPoints: 1},
+		{name: "explicit range", query: fmt.Sprintf("?from=%d&to=%d&step=5m", now.Add(-time.Hour).Unix(), now.Unix()), status: http.StatusOK, wantPoints: 1},
+		{name: "range before the samples", query: fmt.Sprintf("?from=%d&to=%d", now.Add(-2*time.Hour).Unix(), now.Add(-time.Hour).Unix()), status: http.StatusOK},
+		{name: "invalid from", query: "?from=yesterday", status: http.StatusBadRequest},
+		{name: "invalid to", query: "?to=1.5", status: http.StatusBadRequest},
+		{name: "invalid step", query: "?step=10", status: http.StatusBadRequest},
+		{name: "from after to", query: fmt.Sprintf("?from=%d&to=%d", now.Unix(), now.Add(-time.Hour).Unix()), status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := runner.do("GET", path+tt.query, token, nil)
+			if w.Code != tt.status {
+				t.Fatalf("GET %s returned status %d, want %d - %s", path+tt.query, w.Code, tt.status, w.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			res := new(model.MetricsQueryResponse)
+			if err := json.NewDecoder(w.Body).Decode(res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Points) != tt.wantPoints || res.Project != "todo" || res.Version != "v1" {
+				t.Errorf("GET %s returned %+v, want %d points", path+tt.query, res, tt.wantPoints)
+			}
+		})
+	}
+}
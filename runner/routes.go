@@ -1,8 +1,20 @@
 package runner
 
 func (runner *Runner) routes() {
-	runner.router.Methods("POST").Path("/v1/galaxy/project").HandlerFunc(runner.handleCreateProject())
-	runner.router.Methods("POST").Path("/v1/galaxy/service").HandlerFunc(runner.handleServiceRequest())
+	// The routes reading or writing the services, the rollups or the audit log are served by the leader
+	runner.router.Methods("POST").Path("/v1/galaxy/project").HandlerFunc(runner.leaderOnly(runner.audit.Handler("create-project", runner.handleCreateProject())))
+	runner.router.Methods("POST").Path("/v1/galaxy/service").HandlerFunc(runner.leaderOnly(runner.audit.Handler("apply-service", runner.handleServiceRequest())))
+	runner.router.Methods("GET").Path("/v1/galaxy/services").HandlerFunc(runner.leaderOnly(runner.handleGetServices()))
+	runner.router.Methods("POST").Path("/v1/galaxy/metrics").HandlerFunc(runner.handleForwardedMetrics())
+	runner.router.Methods("GET").Path("/v1/galaxy/metrics/{project}/{service}/{env}/{version}").HandlerFunc(runner.leaderOnly(runner.handleMetricsQuery()))
 	runner.router.HandleFunc("/v1/galaxy/socket", runner.handleWebsocketRequest())
-	runner.router.HandleFunc("/v1/galaxy/manageServices/database", runner.handleDatabaseService())
+	runner.router.HandleFunc("/v1/galaxy/manageServices/database", runner.leaderOnly(runner.audit.Handler("manage-database", runner.handleDatabaseService())))
+	runner.router.Methods("POST").Path("/v1/galaxy/proxy/token").HandlerFunc(runner.handleRenewProxyToken())
+	runner.router.Methods("POST").Path("/v1/galaxy/proxy/revoke").HandlerFunc(runner.leaderOnly(runner.audit.Handler("revoke-proxy", runner.handleRevokeProxy())))
+	runner.router.Methods("GET").Path("/v1/galaxy/proxy/revoked").HandlerFunc(runner.handleGetRevokedProxies())
+	runner.router.Methods("POST").Path("/v1/galaxy/api-keys").HandlerFunc(runner.leaderOnly(runner.audit.Handler("create-api-key", runner.handleCreateAPIKey())))
+	runner.router.Methods("GET").Path("/v1/galaxy/api-keys").HandlerFunc(runner.handleGetAPIKeys())
+	runner.router.Methods("DELETE").Path("/v1/galaxy/api-keys/{id}").HandlerFunc(runner.leaderOnly(runner.audit.Handler("revoke-api-key", runner.handleRevokeAPIKey())))
+	runner.router.Methods("GET").Path("/v1/galaxy/audit").HandlerFunc(runner.leaderOnly(runner.audit.HandleQuery(runner.auth)))
+	runner.router.Methods("GET").Path("/v1/galaxy/audit/export").HandlerFunc(runner.leaderOnly(runner.audit.HandleExport(runner.auth)))
 }
@@ -1,10 +1,12 @@
 package runner
 
 import (
+	"context"
+	"crypto/sha256"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger"
@@ -12,10 +14,13 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/runner/activator"
 	"github.com/spaceuptech/galaxy/runner/driver"
-	"github.com/spaceuptech/galaxy/runner/services"
+	"github.com/spaceuptech/galaxy/runner/election"
 	"github.com/spaceuptech/galaxy/utils"
+	"github.com/spaceuptech/galaxy/utils/audit"
 	"github.com/spaceuptech/galaxy/utils/auth"
+	"github.com/spaceuptech/galaxy/utils/certs"
 )
 
 // Runner is the module responsible to manage the runner
@@ -27,31 +32,42 @@ type Runner struct {
 	router *mux.Router
 
 	// For internal use
-	auth     *auth.Module
-	driver   driver.Driver
-	debounce *utils.Debounce
+	auth      *auth.Module
+	audit     *audit.Module
+	driver    driver.Driver
+	activator *activator.Activator
 
 	// For autoscaler
 	db       *badger.DB
+	store    metricStore
+	state    *state
 	chAppend chan *model.ProxyMessage
 
-	// For managedServices
-	services *model.ManagedService
-}
+	// For running multiple replicas
+	elector  election.Elector
+	identity string
+	client   *http.Client
+	scheme   string
 
-// Config is the object required to configure the runner
-type Config struct {
-	Port      string
-	ProxyPort string
+	// The certificates used to serve over tls
+	certs *certs.Reloader
 
-	// Configuration for the driver
-	Driver *driver.Config
+	// For sharing the state with the other replicas
+	sharedLock     sync.Mutex
+	sharedRestored bool
+	checkpointLock sync.Mutex
+	checkpoints    map[string][sha256.Size]byte
 
-	// Configuration for the auth module
-	Auth *auth.Config
+	// For tracking the background routines
+	done      chan struct{}
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	socketCtx context.Context
+	closeOnce sync.Once
+	closeErr  error
 
-	// Configuration for DO provider
-	Providers *services.Config
+	// For managedServices
+	services *model.ManagedService
 }
 
 // New creates a new instance of the runner
@@ -74,71 +90,238 @@ func New(c *Config) (*Runner, error) {
 		return nil, err
 	}
 
-	debounce := utils.NewDebounce()
+	// The api keys created on other replicas are loaded as soon as they are used
+	a.SetAPIKeyLoader(d.GetAPIKeys)
+
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 3 * time.Minute
+	}
+
+	// Serve over tls if a certificate was provided. The other replicas are reached over tls as well in that case.
+	var reloader *certs.Reloader
+	client, scheme := http.DefaultClient, "http"
+	if c.TLS.Enabled() {
+		reloader, err = certs.NewReloader(c.TLS)
+		if err != nil {
+			return nil, err
+		}
+		client = &http.Client{Transport: reloader.Transport()}
+		scheme = "https"
+	}
+
+	elector, identity, err := newElector(c, d)
+	if err != nil {
+		return nil, err
+	}
 
-	opts := badger.DefaultOptions("/tmp/galaxy.db")
-	opts.Logger = &logrus.Logger{Out: ioutil.Discard}
-	db, err := badger.Open(opts)
+	db, err := openDB(c.DataDir, c.DB)
 	if err != nil {
 		return nil, err
 	}
 
-	// Periodically run the garbage collector
-	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
-		defer ticker.Stop()
-		for range ticker.C {
-		again:
-			err := db.RunValueLogGC(0.7)
-			if err == nil {
-				goto again
-			}
+	// Reload the persisted state of the services
+	st, err := loadState(db)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Recovered state of %d services", len(st.services))
+
+	store, err := newMetricStore(c.MetricStore, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reload the samples of the last minute if the store was snapshotted before a restart
+	if s, ok := store.(snapshotter); ok {
+		if err := s.restore(); err != nil {
+			logrus.Errorln("Could not restore metrics snapshot:", err)
 		}
-	}()
+	}
 
 	// Return a new runner instance
-	return &Runner{
+	runner := &Runner{
 		config: c,
 		router: mux.NewRouter(),
 
 		// For internal use
-		auth:     a,
-		driver:   d,
-		debounce: debounce,
+		auth:   a,
+		audit:  audit.New(db, c.AuditRetention),
+		driver: d,
 
 		// For autoscaler
 		db:       db,
+		store:    store,
+		state:    st,
 		chAppend: make(chan *model.ProxyMessage, 10),
-	}, nil
+
+		// For running multiple replicas
+		elector:  elector,
+		identity: identity,
+		client:   client,
+		scheme:   scheme,
+		certs:    reloader,
+
+		checkpoints: map[string][sha256.Size]byte{},
+
+		done:      make(chan struct{}),
+		socketCtx: context.Background(),
+	}
+
+	// The audit log has to survive a failover
+	runner.audit.SetSharedStore(runner.shareAuditEntry)
+
+	// The activator scales services up from zero. Every request it receives counts as an active request.
+	runner.activator = activator.New(c.Proxy, d, func(service *model.Service) {
+		runner.chAppend <- &model.ProxyMessage{Service: service.ID, Project: service.ProjectID, Environment: service.Environment, Version: service.Version, NodeID: "runner-proxy", ActiveRequests: 1}
+	})
+	return runner, nil
 }
 
-// Start begins the runner
-func (runner *Runner) Start() error {
+// Start begins the runner. It blocks till the context is cancelled or one of the servers fails. The servers are then
+// shut down gracefully, giving in-flight requests time to complete, and the runner is closed before returning.
+func (runner *Runner) Start(ctx context.Context) error {
 	// Initialise the various routes of the runner
 	runner.routes()
 
+	// Campaign for the leadership amongst the runner replicas
+	electionCtx, cancel := context.WithCancel(context.Background())
+	runner.cancel = cancel
+	runner.wg.Add(1)
+	go func() {
+		defer runner.wg.Done()
+		runner.elector.Run(electionCtx)
+	}()
+
+	// Pick up rotated certificates
+	if runner.certs != nil {
+		runner.wg.Add(1)
+		go func() {
+			defer runner.wg.Done()
+			runner.certs.Run(runner.done)
+		}()
+	}
+
+	// Periodically run the garbage collector
+	runner.wg.Add(1)
+	go runner.routineGarbageCollect()
+
+	// Keep the proxy tokens, the revocations and the api keys up to date
+	runner.syncRevokedProxies()
+	runner.syncAPIKeys()
+	runner.wg.Add(1)
+	go runner.routineSyncAuth()
+
 	// Start necessary routines for autoscaler
+	runner.wg.Add(1)
 	go runner.routineAdjustScale()
+	runner.wg.Add(1)
+	go runner.routineCheckpointSharedState()
+	if s, ok := runner.store.(snapshotter); ok {
+		runner.wg.Add(1)
+		go runner.routineSnapshotMetrics(s)
+	}
 	for i := 0; i < 10; i++ {
+		runner.wg.Add(1)
 		go runner.routineDumpDetails()
 	}
 
-	// Start proxy server
-	go func() {
-		// Create a new router
-		router := mux.NewRouter()
-		router.PathPrefix("/").HandlerFunc(runner.handleProxy())
+	// Create the proxy server. Cross origin requests are left to the services since the proxy only forwards them.
+	proxyRouter := mux.NewRouter()
+	proxyRouter.PathPrefix("/").Handler(runner.activator)
+	proxyServer := &http.Server{Addr: ":" + runner.config.ProxyPort, Handler: activator.WithH2C(proxyRouter)}
+
+	// Create the http server. The websocket connections of the metrics proxies are hijacked and hence not tracked by the
+	// server. We close them explicitly once the shutdown begins so that the proxies reconnect to another replica.
+	socketCtx, closeSockets := context.WithCancel(context.Background())
+	runner.socketCtx = socketCtx
+	server := &http.Server{Addr: ":" + runner.config.Port, Handler: utils.WithCors(runner.config.Cors, runner.router)}
+	server.RegisterOnShutdown(closeSockets)
+	if runner.certs != nil {
+		proxyServer.TLSConfig = runner.certs.ServerConfig()
+		server.TLSConfig = runner.certs.ServerConfig()
+	}
 
-		// Start http server
-		corsObj := utils.CreateCorsObject()
+	// Start both the servers
+	errCh := make(chan error, 2)
+	go func() {
 		logrus.Infof("Starting runner proxy on port %s", runner.config.ProxyPort)
-		if err := http.ListenAndServe(":"+runner.config.ProxyPort, corsObj.Handler(router)); err != nil {
-			logrus.Fatalln("Proxy server failed:", err)
+		if err := utils.ListenAndServe(proxyServer); err != http.ErrServerClosed {
+			errCh <- fmt.Errorf("proxy server failed: %v", err)
 		}
 	}()
+	go func() {
+		logrus.Infof("Starting runner on port %s", runner.config.Port)
+		if err := utils.ListenAndServe(server); err != http.ErrServerClosed {
+			errCh <- fmt.Errorf("runner server failed: %v", err)
+		}
+	}()
+
+	// Wait till we are asked to shut down
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errCh:
+		logrus.Errorln("Shutting down runner:", err)
+	}
+
+	// Give the in-flight requests time to complete. The cold start requests of the proxy can take a while.
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), runner.config.ShutdownTimeout)
+	defer cancelShutdown()
+
+	logrus.Infof("Draining runner servers (timeout %s)", runner.config.ShutdownTimeout)
+	var shutdownWg sync.WaitGroup
+	for _, s := range []*http.Server{server, proxyServer} {
+		shutdownWg.Add(1)
+		go func(s *http.Server) {
+			defer shutdownWg.Done()
+			if err := s.Shutdown(shutdownCtx); err != nil {
+				logrus.Errorf("Could not shut down server on %s gracefully - %s", s.Addr, err.Error())
+			}
+		}(s)
+	}
+	shutdownWg.Wait()
+
+	if closeErr := runner.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close stops the background routines of the runner and the driver and closes the database. Pending metrics are flushed and then
+// snapshotted so that they can be recovered when the runner starts again. Start closes the runner before returning, so
+// calling Close again only returns the result of the first call.
+func (runner *Runner) Close() error {
+	runner.closeOnce.Do(func() {
+		runner.closeErr = runner.close()
+	})
+	return runner.closeErr
+}
+
+func (runner *Runner) close() error {
+	// Hand the latest rollups over to the next leader
+	leader := runner.elector.IsLeader()
+
+	if runner.cancel != nil {
+		runner.cancel()
+	}
+	close(runner.done)
+	runner.wg.Wait()
+
+	if leader {
+		if err := runner.checkpointRollups(); err != nil {
+			logrus.Errorln("Could not checkpoint rollups:", err)
+		}
+	}
+
+	if err := runner.driver.Close(); err != nil {
+		logrus.Errorln("Could not close driver:", err)
+	}
+
+	if s, ok := runner.store.(snapshotter); ok {
+		if err := s.snapshot(); err != nil {
+			logrus.Errorln("Could not snapshot metrics:", err)
+		}
+	}
 
-	// Start the http server
-	corsObj := utils.CreateCorsObject()
-	logrus.Infof("Starting runner on port %s", runner.config.Port)
-	return http.ListenAndServe(":"+runner.config.Port, corsObj.Handler(runner.router))
+	return runner.db.Close()
 }
@@ -0,0 +1,285 @@
+package runner
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// The kinds of the state shared by the runner replicas. It is stored through the driver so that the replica taking over
+// the leadership can pick up where the previous leader left off.
+const (
+	sharedServices = "services"
+	sharedRollups  = "rollups"
+	sharedAudit    = "audit"
+)
+
+// The interval at which the leader copies the rollups to the shared state. A failover loses at most the rollups
+// recorded in this interval.
+const sharedCheckpointInterval = time.Minute
+
+// The interval at which the leader deletes the shared audit entries past the retention period
+const sharedAuditPruneInterval = time.Hour
+
+// rollupSnapshot holds the buckets of every tier of the rollups of a service keyed by the name of the tier and the
+// timestamp of the bucket
+type rollupSnapshot struct {
+	Tiers map[string]map[int64]*rollup `json:"tiers"`
+}
+
+// saveService persists the spec of a service which was applied successfully. It is shared with the other replicas
+// first so that the next leader knows about the service as well.
+func (runner *Runner) saveService(service *model.Service) error {
+	data, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+
+	key := makeStateKey(service.ProjectID, service.Environment, service.ID, service.Version)
+	if err := runner.driver.SaveState(sharedServices, key, data); err != nil {
+		return err
+	}
+	return runner.state.setService(service)
+}
+
+// shareAuditEntry records an audit entry in the shared state so that the audit log survives a failover
+func (runner *Runner) shareAuditEntry(e *model.AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return runner.driver.SaveState(sharedAudit, e.ID, data)
+}
+
+// ensureSharedState restores the state shared by the previous leaders once this replica becomes the leader. It has to
+// complete before the leader serves or records the services, the rollups or the audit log.
+func (runner *Runner) ensureSharedState() error {
+	runner.sharedLock.Lock()
+	defer runner.sharedLock.Unlock()
+
+	if runner.sharedRestored {
+		return nil
+	}
+	if err := runner.restoreSharedState(); err != nil {
+		return err
+	}
+	runner.sharedRestored = true
+	return nil
+}
+
+// releaseSharedState marks the local copy of the shared state as stale once this replica stops being the leader. The
+// state gets restored again if it becomes the leader later on.
+func (runner *Runner) releaseSharedState() {
+	runner.sharedLock.Lock()
+	defer runner.sharedLock.Unlock()
+	runner.sharedRestored = false
+}
+
+// restoreSharedState copies the shared state into the local database. The shared entries replace the local ones since
+// the local copy may be outdated if this replica was the leader before.
+func (runner *Runner) restoreSharedState() error {
+	services, err := runner.driver.GetState(sharedServices)
+	if err != nil {
+		return err
+	}
+	for key, data := range services {
+		service := new(model.Service)
+		if err := json.Unmarshal(data, service); err != nil {
+			logrus.Errorf("Could not parse shared state of service (%s) - %s", key, err.Error())
+			continue
+		}
+		if err := runner.state.setService(service); err != nil {
+			return err
+		}
+	}
+
+	rollups, err := runner.driver.GetState(sharedRollups)
+	if err != nil {
+		return err
+	}
+	for key, data := range rollups {
+		snapshot := new(rollupSnapshot)
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			logrus.Errorf("Could not parse shared rollups of service (%s) - %s", key, err.Error())
+			continue
+		}
+		if err := runner.restoreRollups(key, snapshot); err != nil {
+			return err
+		}
+	}
+
+	entries, err := runner.driver.GetState(sharedAudit)
+	if err != nil {
+		return err
+	}
+	for id, data := range entries {
+		e := new(model.AuditEntry)
+		if err := json.Unmarshal(data, e); err != nil {
+			logrus.Errorf("Could not parse shared audit entry (%s) - %s", id, err.Error())
+			continue
+		}
+		if err := runner.audit.Import(e); err != nil {
+			return err
+		}
+	}
+
+	// The rollups of the other leaders may have been checkpointed in the meantime
+	runner.checkpointLock.Lock()
+	runner.checkpoints = map[string][sha256.Size]byte{}
+	runner.checkpointLock.Unlock()
+
+	logrus.Infof("Restored shared state of %d services and %d audit entries", len(services), len(entries))
+	return nil
+}
+
+// restoreRollups writes the buckets of the snapshot to the local database. The buckets past the retention of their tier
+// are skipped.
+func (runner *Runner) restoreRollups(key string, snapshot *rollupSnapshot) error {
+	parts := strings.Split(key, "/")
+	if len(parts) != 4 {
+		return nil
+	}
+	project, env, service, version := parts[0], parts[1], parts[2], parts[3]
+
+	wb := runner.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, tier := range rollupTiers {
+		for bucket, r := range snapshot.Tiers[tier.name] {
+			ttl := tier.retention + tier.resolution - time.Since(time.Unix(bucket, 0))
+			if ttl <= 0 {
+				continue
+			}
+
+			data, _ := json.Marshal(r)
+			entry := badger.NewEntry([]byte(makeRollupKey(tier.name, project, service, env, version, bucket)), data).WithTTL(ttl)
+			if err := wb.SetEntry(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return wb.Flush()
+}
+
+// checkpointRollups copies the rollups of every service to the shared state. Only the services whose rollups changed
+// since the last checkpoint are written.
+func (runner *Runner) checkpointRollups() error {
+	snapshots := map[string]*rollupSnapshot{}
+	err := runner.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("rollups/")
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			// The keys are of the form rollups/tier/project/service/env/version/bucket
+			parts := strings.Split(string(it.Item().Key()), "/")
+			if len(parts) != 7 {
+				continue
+			}
+			bucket, err := strconv.ParseInt(parts[6], 10, 64)
+			if err != nil {
+				continue
+			}
+
+			r := new(rollup)
+			if err := it.Item().Value(func(val []byte) error { return json.Unmarshal(val, r) }); err != nil {
+				return err
+			}
+
+			key := makeStateKey(parts[2], parts[4], parts[3], parts[5])
+			snapshot, p := snapshots[key]
+			if !p {
+				snapshot = &rollupSnapshot{Tiers: map[string]map[int64]*rollup{}}
+				snapshots[key] = snapshot
+			}
+			if snapshot.Tiers[parts[1]] == nil {
+				snapshot.Tiers[parts[1]] = map[int64]*rollup{}
+			}
+			snapshot.Tiers[parts[1]][bucket] = r
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	runner.checkpointLock.Lock()
+	defer runner.checkpointLock.Unlock()
+	for key, snapshot := range snapshots {
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		if sum == runner.checkpoints[key] {
+			continue
+		}
+		if err := runner.driver.SaveState(sharedRollups, key, data); err != nil {
+			return err
+		}
+		runner.checkpoints[key] = sum
+	}
+	return nil
+}
+
+// pruneSharedAudit deletes the shared audit entries past the retention period. The local copies expire on their own.
+func (runner *Runner) pruneSharedAudit() error {
+	entries, err := runner.driver.GetState(sharedAudit)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-runner.audit.Retention()).UnixNano() / int64(time.Millisecond)
+	for id, data := range entries {
+		e := new(model.AuditEntry)
+		if err := json.Unmarshal(data, e); err == nil && e.Ts >= cutoff {
+			continue
+		}
+		if err := runner.driver.DeleteState(sharedAudit, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routineCheckpointSharedState periodically copies the rollups of the leader to the shared state and prunes the
+// shared audit log
+func (runner *Runner) routineCheckpointSharedState() {
+	defer runner.wg.Done()
+
+	ticker := time.NewTicker(sharedCheckpointInterval)
+	defer ticker.Stop()
+	var lastPrune time.Time
+	for {
+		select {
+		case <-runner.done:
+			return
+		case <-ticker.C:
+			if !runner.elector.IsLeader() {
+				runner.releaseSharedState()
+				continue
+			}
+			if err := runner.ensureSharedState(); err != nil {
+				logrus.Errorln("Could not restore shared state:", err)
+				continue
+			}
+			if err := runner.checkpointRollups(); err != nil {
+				logrus.Errorln("Could not checkpoint rollups:", err)
+			}
+			if time.Since(lastPrune) >= sharedAuditPruneInterval {
+				if err := runner.pruneSharedAudit(); err != nil {
+					logrus.Errorln("Could not prune shared audit log:", err)
+					continue
+				}
+				lastPrune = time.Now()
+			}
+		}
+	}
+}
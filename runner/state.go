@@ -0,0 +1,146 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+const (
+	stateServicesPrefix = "services/"
+	stateScalePrefix    = "scale/"
+)
+
+// state holds the specs of the services applied through the runner along with the last scale decision made for each
+// of them. It is persisted in badger and reloaded when the runner starts so that a restart does not lose history. The
+// specs are shared with the other replicas through the driver as well while the scale decisions are only kept by the
+// leader which made them.
+type state struct {
+	lock     sync.RWMutex
+	db       *badger.DB
+	services map[string]*model.ServiceState
+}
+
+func makeStateKey(project, env, service, version string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", project, env, service, version)
+}
+
+// loadState reloads the persisted state from badger
+func loadState(db *badger.DB) (*state, error) {
+	s := &state{db: db, services: map[string]*model.ServiceState{}}
+
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		// Load the service specs first so that the scale decisions can be attached to them
+		for it.Seek([]byte(stateServicesPrefix)); it.ValidForPrefix([]byte(stateServicesPrefix)); it.Next() {
+			service := new(model.Service)
+			if err := it.Item().Value(func(val []byte) error { return json.Unmarshal(val, service) }); err != nil {
+				return err
+			}
+			s.services[strings.TrimPrefix(string(it.Item().Key()), stateServicesPrefix)] = &model.ServiceState{Service: service}
+		}
+
+		for it.Seek([]byte(stateScalePrefix)); it.ValidForPrefix([]byte(stateScalePrefix)); it.Next() {
+			decision := new(model.ScaleDecision)
+			if err := it.Item().Value(func(val []byte) error { return json.Unmarshal(val, decision) }); err != nil {
+				return err
+			}
+
+			key := strings.TrimPrefix(string(it.Item().Key()), stateScalePrefix)
+			if serviceState, p := s.services[key]; p {
+				serviceState.Scale = decision
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// setService persists the spec of a service which was applied successfully
+func (s *state) setService(service *model.Service) error {
+	key := makeStateKey(service.ProjectID, service.Environment, service.ID, service.Version)
+	data, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(stateServicesPrefix+key), data)
+	}); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if serviceState, p := s.services[key]; p {
+		serviceState.Service = service
+		return nil
+	}
+	s.services[key] = &model.ServiceState{Service: service}
+	return nil
+}
+
+// setScaleDecision persists the last scale decision made by the autoscaler for a service. Decisions are only tracked
+// for the services applied through the runner.
+func (s *state) setScaleDecision(project, service, env, version string, activeReqs int32, now time.Time) error {
+	key := makeStateKey(project, env, service, version)
+
+	s.lock.Lock()
+	serviceState, p := s.services[key]
+	if !p {
+		s.lock.Unlock()
+		return nil
+	}
+	decision := &model.ScaleDecision{ActiveRequests: activeReqs, Ts: now.Unix()}
+	serviceState.Scale = decision
+	s.lock.Unlock()
+
+	data, _ := json.Marshal(decision)
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(stateScalePrefix+key), data)
+	})
+}
+
+// setStats keeps the latest detailed stats of a service in memory. The stats aren't persisted since they are stale
+// by the time the runner restarts.
+func (s *state) setStats(project, service, env, version string, stats *model.ServiceStats) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if serviceState, p := s.services[makeStateKey(project, env, service, version)]; p {
+		serviceState.Stats = stats
+	}
+}
+
+// list returns the state of all the services ordered by their key
+func (s *state) list() []*model.ServiceState {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	keys := make([]string, 0, len(s.services))
+	for key := range s.services {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	services := make([]*model.ServiceState, len(keys))
+	for i, key := range keys {
+		serviceState := *s.services[key]
+		services[i] = &serviceState
+	}
+	return services
+}
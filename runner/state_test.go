@@ -0,0 +1,48 @@
+package runner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+func TestLoadState(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	s, err := loadState(db)
+	if err != nil {
+		t.Fatalf("loadState() error = %v", err)
+	}
+
+	service := &model.Service{ID: "s1", ProjectID: "p1", Environment: "production", Version: "v1"}
+	if err := s.setService(service); err != nil {
+		t.Fatalf("setService() error = %v", err)
+	}
+	if err := s.setScaleDecision("p1", "s1", "production", "v1", 42, time.Unix(100, 0)); err != nil {
+		t.Fatalf("setScaleDecision() error = %v", err)
+	}
+
+	// Decisions of services unknown to the runner are not tracked
+	if err := s.setScaleDecision("p1", "s2", "production", "v1", 7, time.Unix(100, 0)); err != nil {
+		t.Fatalf("setScaleDecision() error = %v", err)
+	}
+
+	// Reload the state like the runner does on startup
+	recovered, err := loadState(db)
+	if err != nil {
+		t.Fatalf("loadState() error = %v", err)
+	}
+
+	services := recovered.list()
+	if len(services) != 1 {
+		t.Fatalf("loadState() recovered %d services, want 1", len(services))
+	}
+	if services[0].Service.ID != "s1" {
+		t.Errorf("loadState() recovered service %s, want s1", services[0].Service.ID)
+	}
+	if services[0].Scale == nil || services[0].Scale.ActiveRequests != 42 || services[0].Scale.Ts != 100 {
+		t.Errorf("loadState() recovered scale decision %v, want 42 at 100", services[0].Scale)
+	}
+}
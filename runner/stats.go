@@ -0,0 +1,115 @@
+package runner
+
+import (
+	"time"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// stats accumulates the detailed metrics sent by the proxies. Counters are turned into rates using the duration
+// covered by the samples since the proxies may collect metrics at any interval.
+type stats struct {
+	Nos               int32             `json:"nos"`
+	Duration          uint64            `json:"ms"`
+	Requests          uint64            `json:"req"`
+	StatusCodes       map[string]uint64 `json:"codes,omitempty"`
+	ActiveConnections uint64            `json:"cx"`
+	Connections       uint64            `json:"newCx"`
+
+	// The sum of the latency quantiles of the samples which recorded requests
+	Latency    model.LatencySummary `json:"lat"`
+	LatencyNos int32                `json:"latNos"`
+}
+
+func (s *stats) add(m *model.ProxyMetrics) {
+	s.Nos++
+	s.Duration += m.Interval
+	if m.Interval == 0 {
+		// Proxies which don't report the interval collect metrics every second
+		s.Duration += 1000
+	}
+	s.Requests += m.Requests
+	s.ActiveConnections += m.ActiveConnections
+	s.Connections += m.Connections
+	for code, count := range m.StatusCodes {
+		if s.StatusCodes == nil {
+			s.StatusCodes = map[string]uint64{}
+		}
+		s.StatusCodes[code] += count
+	}
+	if m.Latency != nil {
+		s.Latency.P50 += m.Latency.P50
+		s.Latency.P95 += m.Latency.P95
+		s.Latency.P99 += m.Latency.P99
+		s.LatencyNos++
+	}
+}
+
+func (s *stats) merge(o *stats) {
+	s.Nos += o.Nos
+	s.Duration += o.Duration
+	s.Requests += o.Requests
+	s.ActiveConnections += o.ActiveConnections
+	s.Connections += o.Connections
+	for code, count := range o.StatusCodes {
+		if s.StatusCodes == nil {
+			s.StatusCodes = map[string]uint64{}
+		}
+		s.StatusCodes[code] += count
+	}
+	s.Latency.P50 += o.Latency.P50
+	s.Latency.P95 += o.Latency.P95
+	s.Latency.P99 += o.Latency.P99
+	s.LatencyNos += o.LatencyNos
+}
+
+// seconds returns the duration covered by the samples in seconds. Stats persisted before the duration was tracked
+// assume a second per sample.
+func (s *stats) seconds() float64 {
+	if s.Duration == 0 {
+		return float64(s.Nos)
+	}
+	return float64(s.Duration) / 1000
+}
+
+// serviceStats combines the stats of all the nodes of a service. Rates and gauges are averaged per node and then
+// added up, while latencies are averaged across all the samples.
+func serviceStats(nodes map[string]*counter, now time.Time) *model.ServiceStats {
+	result := &model.ServiceStats{Ts: now.Unix()}
+
+	var latency model.LatencySummary
+	var latencyNos, nos int32
+	for _, c := range nodes {
+		s := c.stats
+		if s == nil || s.Nos == 0 {
+			continue
+		}
+		nos += s.Nos
+
+		// Gauges are averaged over the samples while counters are divided by the seconds covered by them
+		n, seconds := float64(s.Nos), s.seconds()
+		result.RequestsPerSecond += float64(s.Requests) / seconds
+		result.ActiveConnections += float64(s.ActiveConnections) / n
+		result.ConnectionsPerSecond += float64(s.Connections) / seconds
+		for code, count := range s.StatusCodes {
+			if result.StatusCodes == nil {
+				result.StatusCodes = map[string]float64{}
+			}
+			result.StatusCodes[code] += float64(count) / seconds
+		}
+
+		latency.P50 += s.Latency.P50
+		latency.P95 += s.Latency.P95
+		latency.P99 += s.Latency.P99
+		latencyNos += s.LatencyNos
+	}
+
+	if nos == 0 {
+		return nil
+	}
+	if latencyNos > 0 {
+		n := float64(latencyNos)
+		result.Latency = &model.LatencySummary{P50: latency.P50 / n, P95: latency.P95 / n, P99: latency.P99 / n}
+	}
+	return result
+}
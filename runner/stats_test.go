@@ -0,0 +1,37 @@
+package runner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+func TestServiceStats(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval uint64
+		want     float64
+	}{
+		{name: "interval not reported", interval: 0, want: 50},
+		{name: "one second interval", interval: 1000, want: 50},
+		{name: "five second interval", interval: 5000, want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := new(stats)
+			for i := 0; i < 3; i++ {
+				s.add(&model.ProxyMetrics{Requests: 50, StatusCodes: map[string]uint64{"2xx": 50}, ActiveConnections: 4, Connections: 50, Interval: tt.interval})
+			}
+
+			got := serviceStats(map[string]*counter{"n1": {stats: s}}, time.Now())
+			if got.RequestsPerSecond != tt.want || got.ConnectionsPerSecond != tt.want || got.StatusCodes["2xx"] != tt.want {
+				t.Errorf("serviceStats() = %+v, want %v per second", got, tt.want)
+			}
+			// Gauges don't depend on the interval
+			if got.ActiveConnections != 4 {
+				t.Errorf("serviceStats() active connections = %v, want 4", got.ActiveConnections)
+			}
+		})
+	}
+}
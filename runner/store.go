@@ -0,0 +1,47 @@
+package runner
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// MetricStoreType describes where the samples received from the metrics proxies are stored
+type MetricStoreType string
+
+const (
+	// MetricStoreMemory keeps the samples in in-memory ring buffers
+	MetricStoreMemory MetricStoreType = "memory"
+
+	// MetricStoreBadger stores every sample as a separate entry in badger
+	MetricStoreBadger MetricStoreType = "badger"
+)
+
+// metricStore is the interface of the modules which store the samples used by the autoscaler
+type metricStore interface {
+	// add stores the samples received from the metrics proxies
+	add(messages []*model.ProxyMessage) error
+
+	// aggregate returns the active requests of each service aggregated over the last 60 and 6 seconds
+	aggregate(now time.Time) (a60, a6 *aggregator, err error)
+}
+
+// snapshotter is implemented by the metric stores which need to persist their state across restarts
+type snapshotter interface {
+	snapshot() error
+	restore() error
+}
+
+func newMetricStore(storeType MetricStoreType, db *badger.DB) (metricStore, error) {
+	switch storeType {
+	case MetricStoreMemory, "":
+		return newMemoryStore(db), nil
+	case MetricStoreBadger:
+		return newBadgerStore(db), nil
+	default:
+		return nil, fmt.Errorf("invalid metric store (%s) provided", storeType)
+	}
+}
@@ -0,0 +1,86 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/dgraph-io/badger/pb"
+	"github.com/segmentio/ksuid"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+type metric struct {
+	Value   int32               `json:"val"`
+	Ts      int64               `json:"ts"`
+	Metrics *model.ProxyMetrics `json:"metrics,omitempty"`
+}
+
+// badgerStore stores every sample as a separate entry in badger which expires after a minute
+type badgerStore struct {
+	db *badger.DB
+}
+
+func newBadgerStore(db *badger.DB) *badgerStore {
+	return &badgerStore{db: db}
+}
+
+func (s *badgerStore) add(messages []*model.ProxyMessage) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		for _, m := range messages {
+			// Prepare the key and values
+			key := fmt.Sprintf("metrics/%s/%s/%s/%s/%s/%s", m.Project, m.Service, m.Environment, m.Version, m.NodeID, ksuid.New().String())
+			data, _ := json.Marshal(&metric{Ts: time.Now().Unix(), Value: m.ActiveRequests, Metrics: m.Metrics})
+			// Set entry in badger
+			e := badger.NewEntry([]byte(key), data).WithTTL(time.Minute)
+			if err := txn.SetEntry(e); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *badgerStore) aggregate(t time.Time) (*aggregator, *aggregator, error) {
+	// Create a 60s aggregator and a 6s aggregator
+	a60 := newAggregator()
+	a6 := newAggregator()
+
+	// Take the current time snapshot
+	now := t.Unix()
+
+	// Create stream
+	stream := s.db.NewStream()
+	stream.NumGo = 16
+	stream.Prefix = []byte("metrics/")
+	stream.Send = func(list *pb.KVList) error {
+		for _, kv := range list.Kv {
+			// Get the project id, service, version and node id
+			array := strings.Split(string(kv.Key), "/")
+			project, service, env, version, nodeID := array[1], array[2], array[3], array[4], array[5]
+
+			// Unmarshal the metrics from badger
+			m := new(metric)
+			_ = json.Unmarshal(kv.Value, m)
+
+			// Add the metric to the 60s aggregator. Add it to the 6s aggregator only if its less that 6s old.
+			a60.add(project, service, env, version, nodeID, m.Value, m.Metrics)
+			if m.Ts+6 >= now {
+				a6.add(project, service, env, version, nodeID, m.Value, m.Metrics)
+			}
+		}
+		return nil
+	}
+
+	// Orchestrate the stream
+	if err := stream.Orchestrate(context.Background()); err != nil {
+		return nil, nil, err
+	}
+
+	return a60, a6, nil
+}
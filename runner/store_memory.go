@@ -0,0 +1,178 @@
+package runner
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// The number of one second slots kept per series. This needs to cover the largest aggregation window.
+const ringSize = 60
+
+const snapshotKey = "snapshots/metrics"
+
+type seriesKey struct {
+	Project     string `json:"project"`
+	Service     string `json:"service"`
+	Environment string `json:"env"`
+	Version     string `json:"version"`
+	NodeID      string `json:"id"`
+}
+
+// slot holds the samples of a series received in a single second
+type slot struct {
+	Ts    int64  `json:"ts"`
+	Value int32  `json:"val"`
+	Nos   int32  `json:"nos"`
+	Stats *stats `json:"stats,omitempty"`
+}
+
+// ring is a fixed size buffer of one second slots. Samples received in the same second get pre-aggregated in a
+// single slot, so the cost of aggregating a series is independent of the rate at which the proxies send samples.
+type ring struct {
+	Slots [ringSize]slot `json:"slots"`
+}
+
+func (r *ring) add(ts int64, value int32, metrics *model.ProxyMetrics) {
+	s := &r.Slots[ts%ringSize]
+	if s.Ts != ts {
+		*s = slot{Ts: ts}
+	}
+	s.Value += value
+	s.Nos++
+	if metrics != nil {
+		if s.Stats == nil {
+			s.Stats = new(stats)
+		}
+		s.Stats.add(metrics)
+	}
+}
+
+// window returns the sum, the number of samples and the detailed stats received in the last `seconds` seconds
+func (r *ring) window(now, seconds int64) (value, nos int32, st *stats) {
+	for _, s := range r.Slots {
+		if s.Nos > 0 && s.Ts+seconds >= now {
+			value += s.Value
+			nos += s.Nos
+			if s.Stats != nil {
+				if st == nil {
+					st = new(stats)
+				}
+				st.merge(s.Stats)
+			}
+		}
+	}
+	return
+}
+
+// memoryStore keeps the samples of each series in an in-memory ring buffer. It can snapshot its state to badger
+// so that a restart of the runner doesn't make the autoscaler lose the last minute of samples.
+type memoryStore struct {
+	lock   sync.RWMutex
+	series map[seriesKey]*ring
+
+	db *badger.DB
+}
+
+func newMemoryStore(db *badger.DB) *memoryStore {
+	return &memoryStore{series: map[seriesKey]*ring{}, db: db}
+}
+
+func (s *memoryStore) add(messages []*model.ProxyMessage) error {
+	now := time.Now().Unix()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, m := range messages {
+		key := seriesKey{Project: m.Project, Service: m.Service, Environment: m.Environment, Version: m.Version, NodeID: m.NodeID}
+		r, p := s.series[key]
+		if !p {
+			r = new(ring)
+			s.series[key] = r
+		}
+		r.add(now, m.ActiveRequests, m.Metrics)
+	}
+
+	return nil
+}
+
+func (s *memoryStore) aggregate(t time.Time) (*aggregator, *aggregator, error) {
+	// Create a 60s aggregator and a 6s aggregator
+	a60 := newAggregator()
+	a6 := newAggregator()
+
+	now := t.Unix()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, r := range s.series {
+		value, nos, st := r.window(now, ringSize)
+
+		// Evict the series which haven't received a sample in the entire window
+		if nos == 0 {
+			delete(s.series, key)
+			continue
+		}
+		a60.addCounter(key.Project, key.Service, key.Environment, key.Version, key.NodeID, value, nos, st)
+
+		if value, nos, st := r.window(now, 6); nos > 0 {
+			a6.addCounter(key.Project, key.Service, key.Environment, key.Version, key.NodeID, value, nos, st)
+		}
+	}
+
+	return a60, a6, nil
+}
+
+type snapshotEntry struct {
+	Key  seriesKey `json:"key"`
+	Ring *ring     `json:"ring"`
+}
+
+func (s *memoryStore) snapshot() error {
+	s.lock.RLock()
+	entries := make([]snapshotEntry, 0, len(s.series))
+	for key, r := range s.series {
+		entries = append(entries, snapshotEntry{Key: key, Ring: r})
+	}
+	data, err := json.Marshal(entries)
+	s.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// The samples are useless for the autoscaler once they are older than the aggregation window
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte(snapshotKey), data).WithTTL(ringSize * time.Second))
+	})
+}
+
+func (s *memoryStore) restore() error {
+	var entries []snapshotEntry
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(snapshotKey))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error { return json.Unmarshal(val, &entries) })
+	})
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, e := range entries {
+		s.series[e.Key] = e.Ring
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+func openTestDB(tb testing.TB) (*badger.DB, func()) {
+	dir, err := ioutil.TempDir("", "galaxy-store")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	opts := badger.DefaultOptions(dir)
+	opts.Logger = &logrus.Logger{Out: ioutil.Discard}
+	db, err := badger.Open(opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return db, func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func prepareMessages(services, nodes int) []*model.ProxyMessage {
+	messages := make([]*model.ProxyMessage, 0, services*nodes)
+	for i := 0; i < services; i++ {
+		for j := 0; j < nodes; j++ {
+			messages = append(messages, &model.ProxyMessage{
+				Project:        "p1",
+				Service:        fmt.Sprintf("s%d", i),
+				Environment:    "production",
+				Version:        "v1",
+				NodeID:         fmt.Sprintf("n%d", j),
+				ActiveRequests: int32(10 * (j + 1)),
+				Metrics: &model.ProxyMetrics{
+					Requests:    uint64(5 * (j + 1)),
+					StatusCodes: map[string]uint64{"2xx": uint64(5 * (j + 1))},
+					Latency:     &model.LatencySummary{P50: float64(10 * (j + 1)), P95: 50, P99: 100},
+				},
+			})
+		}
+	}
+	return messages
+}
+
+func TestMetricStores_aggregate(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	tests := []struct {
+		name  string
+		store metricStore
+	}{
+		{name: "memory store", store: newMemoryStore(db)},
+		{name: "badger store", store: newBadgerStore(db)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Node n0 sends 10 and node n1 sends 20 active requests, twice each
+			messages := prepareMessages(2, 2)
+			if err := tt.store.add(messages); err != nil {
+				t.Fatalf("add() error = %v", err)
+			}
+			if err := tt.store.add(messages); err != nil {
+				t.Fatalf("add() error = %v", err)
+			}
+
+			a60, a6, err := tt.store.aggregate(time.Now())
+			if err != nil {
+				t.Fatalf("aggregate() error = %v", err)
+			}
+			for _, service := range []string{"s0", "s1"} {
+				if got := a60.get("p1", service, "production", "v1"); got != 30 {
+					t.Errorf("aggregate() 60s value of %s = %d, want 30", service, got)
+				}
+				if got := a6.get("p1", service, "production", "v1"); got != 30 {
+					t.Errorf("aggregate() 6s value of %s = %d, want 30", service, got)
+				}
+
+				// Rates are added up across nodes while latencies are averaged
+				stats := a60.stats("p1", service, "production", "v1", time.Now())
+				if stats == nil {
+					t.Fatalf("aggregate() did not aggregate the stats of %s", service)
+				}
+				if stats.RequestsPerSecond != 15 || stats.StatusCodes["2xx"] != 15 {
+					t.Errorf("aggregate() rps of %s = %v (2xx = %v), want 15", service, stats.RequestsPerSecond, stats.StatusCodes["2xx"])
+				}
+				if stats.Latency == nil || stats.Latency.P50 != 15 || stats.Latency.P99 != 100 {
+					t.Errorf("aggregate() latency of %s = %+v, want p50 = 15 and p99 = 100", service, stats.Latency)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStore_snapshot(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	s := newMemoryStore(db)
+	if err := s.add(prepareMessages(1, 1)); err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+	if err := s.snapshot(); err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+
+	restored := newMemoryStore(db)
+	if err := restored.restore(); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	a60, _, _ := restored.aggregate(time.Now())
+	if got := a60.get("p1", "s0", "production", "v1"); got != 10 {
+		t.Errorf("restored 60s value = %d, want 10", got)
+	}
+}
+
+func benchmarkStoreAdd(b *testing.B, newStore func(db *badger.DB) metricStore) {
+	db, cleanup := openTestDB(b)
+	defer cleanup()
+
+	s := newStore(db)
+	messages := prepareMessages(100, 3)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.add(messages); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkStoreAggregate(b *testing.B, newStore func(db *badger.DB) metricStore) {
+	db, cleanup := openTestDB(b)
+	defer cleanup()
+
+	// Fill the store with a few seconds worth of samples of 100 services with 3 nodes each
+	s := newStore(db)
+	messages := prepareMessages(100, 3)
+	for i := 0; i < 10; i++ {
+		if err := s.add(messages); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := s.aggregate(time.Now()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func newTestMemoryStore(db *badger.DB) metricStore { return newMemoryStore(db) }
+func newTestBadgerStore(db *badger.DB) metricStore { return newBadgerStore(db) }
+
+func BenchmarkMemoryStore_add(b *testing.B)       { benchmarkStoreAdd(b, newTestMemoryStore) }
+func BenchmarkBadgerStore_add(b *testing.B)       { benchmarkStoreAdd(b, newTestBadgerStore) }
+func BenchmarkMemoryStore_aggregate(b *testing.B) { benchmarkStoreAggregate(b, newTestMemoryStore) }
+func BenchmarkBadgerStore_aggregate(b *testing.B) { benchmarkStoreAggregate(b, newTestBadgerStore) }
@@ -0,0 +1,161 @@
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils"
+	"github.com/spaceuptech/galaxy/utils/audit"
+	"github.com/spaceuptech/galaxy/utils/auth"
+)
+
+// The interval at which the revoked proxies and the api keys are synced from the driver
+const revocationSyncInterval = 30 * time.Second
+
+// routineSyncAuth keeps the revoked proxies and the api keys in sync with the driver. The leader also re-signs the
+// tokens stored by the driver well before they expire.
+func (runner *Runner) routineSyncAuth() {
+	defer runner.wg.Done()
+
+	ticker := time.NewTicker(revocationSyncInterval)
+	defer ticker.Stop()
+
+	refreshInterval := runner.auth.ProxyTokenTTL() / 4
+	var lastRefresh time.Time
+	for {
+		select {
+		case <-runner.done:
+			return
+		case <-ticker.C:
+			runner.syncRevokedProxies()
+			runner.syncAPIKeys()
+
+			if !runner.elector.IsLeader() || time.Since(lastRefresh) < refreshInterval {
+				continue
+			}
+			if err := runner.driver.RefreshProxyTokens(); err != nil {
+				logrus.Errorf("Could not refresh proxy tokens - %s", err.Error())
+				continue
+			}
+			lastRefresh = time.Now()
+		}
+	}
+}
+
+func (runner *Runner) syncRevokedProxies() {
+	ids, err := runner.driver.GetRevokedProxies()
+	if err != nil {
+		logrus.Errorf("Could not sync revoked proxies - %s", err.Error())
+		return
+	}
+	runner.auth.SetRevokedProxies(ids)
+}
+
+func (runner *Runner) handleRenewProxyToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Only a valid proxy token can be renewed
+		claims, err := runner.auth.VerifyProxyToken(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to renew proxy token - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+
+		token, err := runner.auth.RenewProxyToken(claims)
+		if err != nil {
+			logrus.Errorf("Failed to renew proxy token - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		utils.SendResponse(w, r, http.StatusOK, &model.ProxyToken{Token: token})
+	}
+}
+
+func (runner *Runner) handleRevokeProxy() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := runner.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to revoke proxy - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+		if err := claims.Authorize(auth.ActionManageProxies, "", ""); err != nil {
+			logrus.Errorf("Failed to revoke proxy - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		// Parse request body
+		req := new(model.ProxyRevocation)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			logrus.Errorf("Failed to revoke proxy - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if req.ID == "" {
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, errors.New("id of proxy not provided"))
+			return
+		}
+
+		audit.SetTarget(r, "", "", req.ID)
+
+		if err := runner.driver.RevokeProxy(req.ID); err != nil {
+			logrus.Errorf("Failed to revoke proxy (%s) - %s", req.ID, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		// The revocation takes effect on this replica right away. The other replicas pick it up on their next sync.
+		runner.syncRevokedProxies()
+
+		// Re-sign the stored tokens right away so that new pods don't start with the revoked node id
+		if err := runner.driver.RefreshProxyTokens(); err != nil {
+			logrus.Errorf("Failed to refresh proxy tokens after revoking proxy (%s) - %s", req.ID, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		logrus.Infof("Revoked tokens of proxy (%s)", req.ID)
+		utils.SendEmptySuccessResponse(w, r)
+	}
+}
+
+func (runner *Runner) handleGetRevokedProxies() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := runner.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to get revoked proxies - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		if err := claims.Authorize(auth.ActionManageProxies, "", ""); err != nil {
+			logrus.Errorf("Failed to get revoked proxies - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		ids, err := runner.driver.GetRevokedProxies()
+		if err != nil {
+			logrus.Errorf("Failed to get revoked proxies - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		utils.SendResponse(w, r, http.StatusOK, map[string]interface{}{"ids": ids})
+	}
+}
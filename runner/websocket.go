@@ -2,18 +2,31 @@ package runner
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 
 	"github.com/spaceuptech/galaxy/model"
 	"github.com/spaceuptech/galaxy/utils"
+	"github.com/spaceuptech/galaxy/utils/auth"
 )
 
-var upgrader = websocket.Upgrader{}
+// Proxies negotiate the binary protocol through the websocket sub protocol. Older proxies don't ask for any sub
+// protocol and continue to use json.
+var upgrader = websocket.Upgrader{Subprotocols: []string{model.ProtocolBinary}}
 
 func (runner *Runner) handleWebsocketRequest() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Check if token is valid. The request is rejected before the upgrade so that the proxy can tell that its
+		// token isn't accepted anymore.
+		claims, err := runner.verifyProxy(r)
+		if err != nil {
+			logrus.Errorf("Failed to verify autoscaler socket connection - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+
 		c, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			logrus.Errorln("Could not upgrade to websocket (autoscaler):", err)
@@ -21,10 +34,45 @@ func (runner *Runner) handleWebsocketRequest() http.HandlerFunc {
 		}
 		defer utils.CloseReaderCloser(c)
 
-		// Check if token is valid
-		claims, err := runner.auth.VerifyProxyToken(utils.GetToken(r))
-		if err != nil {
-			logrus.Errorf("Failed to verify autoscaler socket connection - %s", err.Error())
+		// Close the connection once the runner starts shutting down. The proxy will reconnect to another replica. The
+		// connection is also closed once the token expires or gets revoked. The proxy reconnects with its renewed
+		// token in the first case.
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			id, _ := claims["id"].(string)
+			expiry := time.NewTimer(time.Until(auth.GetExpiry(claims)))
+			defer expiry.Stop()
+			ticker := time.NewTicker(revocationSyncInterval)
+			defer ticker.Stop()
+
+			closeConn := func(code int, reason string) {
+				_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+				utils.CloseReaderCloser(c)
+			}
+			for {
+				select {
+				case <-runner.socketCtx.Done():
+					closeConn(websocket.CloseGoingAway, "runner shutting down")
+					return
+				case <-expiry.C:
+					closeConn(websocket.ClosePolicyViolation, "token expired")
+					return
+				case <-ticker.C:
+					if runner.auth.IsRevoked(id) {
+						logrus.Infof("Closing socket connection of revoked proxy (%s)", id)
+						closeConn(websocket.ClosePolicyViolation, "token revoked")
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		// Node agents send the metrics of all the services on their node. The messages carry their own meta data.
+		if auth.IsAgent(claims) {
+			runner.handleAgent(c)
 			return
 		}
 
@@ -45,22 +93,112 @@ func (runner *Runner) handleWebsocketRequest() http.HandlerFunc {
 		env := envTemp.(string)
 		version := versionTemp.(string)
 
-		for {
-			msg := new(model.ProxyMessage)
-			if err := c.ReadJSON(msg); err != nil {
-				logrus.Errorf("Failed to receive message from proxy (%s:%s): %s", project, service, err.Error())
-				return
-			}
-
+		setMeta := func(msg *model.ProxyMessage) bool {
 			// Set crucial meta data
 			msg.NodeID = nodeID
 			msg.Project = project
 			msg.Service = service
 			msg.Environment = env
 			msg.Version = version
+			return true
+		}
+
+		if c.Subprotocol() == model.ProtocolBinary {
+			runner.handleBinaryProtocol(c, setMeta)
+			return
+		}
+
+		// Json messages carry a single sample each
+		c.SetReadLimit(model.MaxMessageSize)
+		for {
+			msg := new(model.ProxyMessage)
+			if err := c.ReadJSON(msg); err != nil {
+				logrus.Errorf("Failed to receive message from proxy (%s:%s): %s", project, service, err.Error())
+				return
+			}
+			setMeta(msg)
 
 			// Append msg to disk
 			runner.chAppend <- msg
 		}
 	}
 }
+
+// verifyProxy authenticates a metrics proxy. Proxies which presented a client certificate during the tls handshake
+// don't need a token.
+func (runner *Runner) verifyProxy(r *http.Request) (map[string]interface{}, error) {
+	token := utils.GetToken(r)
+	if token == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return runner.auth.VerifyProxyCertificate(r.TLS.VerifiedChains[0][0])
+	}
+	return runner.auth.VerifyProxyToken(token)
+}
+
+// handleAgent receives the messages of a node agent. Messages which don't identify the service they belong to are
+// dropped.
+func (runner *Runner) handleAgent(c *websocket.Conn) {
+	if c.Subprotocol() != model.ProtocolBinary {
+		logrus.Errorln("Failed to establish agent socket connection - agents need to use the binary protocol")
+		return
+	}
+
+	runner.handleBinaryProtocol(c, func(msg *model.ProxyMessage) bool {
+		if msg.NodeID == "" || msg.Project == "" || msg.Service == "" || msg.Environment == "" || msg.Version == "" {
+			logrus.Debugln("Dropping message without meta data from agent:", msg)
+			return false
+		}
+		return true
+	})
+}
+
+// handleBinaryProtocol receives batches of messages from a proxy. Each batch is stored as a whole and then
+// acknowledged so that the proxy can discard it. The connection is closed if a batch can't be stored. The prepare callback sets the meta data of each message and reports
+// whether the message should be stored. Frames larger than a full batch or of an unknown version close the connection.
+func (runner *Runner) handleBinaryProtocol(c *websocket.Conn, prepare func(msg *model.ProxyMessage) bool) {
+	c.SetReadLimit(model.MaxFrameSize)
+	for {
+		msgType, data, err := c.ReadMessage()
+		if err != nil {
+			logrus.Errorf("Failed to receive frame from proxy: %s", err.Error())
+			return
+		}
+		if msgType != websocket.BinaryMessage {
+			logrus.Errorf("Failed to receive frame from proxy: unexpected message type (%d)", msgType)
+			return
+		}
+
+		frame := new(model.Frame)
+		if err := frame.Unmarshal(data); err != nil {
+			logrus.Errorf("Failed to decode frame from proxy: %s", err.Error())
+			return
+		}
+		if frame.Version != model.ProtocolVersion {
+			logrus.Errorf("Failed to decode frame from proxy: unsupported protocol version (%d)", frame.Version)
+			_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, "unsupported protocol version"), time.Now().Add(time.Second))
+			return
+		}
+		if frame.Ack {
+			continue
+		}
+
+		messages := make([]*model.ProxyMessage, 0, len(frame.Messages))
+		for _, msg := range frame.Messages {
+			if prepare(msg) {
+				messages = append(messages, msg)
+			}
+		}
+		if err := runner.storeMetrics(messages); err != nil {
+			// The proxy treats an ack as acknowledging all the batches before it as well. The connection is closed
+			// instead of skipping the batch so that the proxy sends all the batches in flight again.
+			logrus.Errorf("Could not store batch (%d) received from proxy: %s", frame.Seq, err.Error())
+			_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "could not store metrics"), time.Now().Add(time.Second))
+			return
+		}
+
+		ack := &model.Frame{Version: model.ProtocolVersion, Seq: frame.Seq, Ack: true}
+		if err := c.WriteMessage(websocket.BinaryMessage, ack.Marshal()); err != nil {
+			logrus.Errorf("Failed to acknowledge batch (%d) of proxy: %s", frame.Seq, err.Error())
+			return
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package runner
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/runner/election"
+)
+
+// flakyStore fails to store the first batch it receives
+type flakyStore struct {
+	lock   sync.Mutex
+	failed bool
+	stored []int32
+}
+
+func (s *flakyStore) add(messages []*model.ProxyMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.failed {
+		s.failed = true
+		return errors.New("disk full")
+	}
+	for _, msg := range messages {
+		s.stored = append(s.stored, msg.ActiveRequests)
+	}
+	return nil
+}
+
+func (s *flakyStore) aggregate(now time.Time) (a60, a6 *aggregator, err error) { return nil, nil, nil }
+
+func TestRunner_handleBinaryProtocol(t *testing.T) {
+	store := new(flakyStore)
+	runner := &Runner{store: store, elector: election.NewStatic("runner")}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = c.Close() }()
+		runner.handleBinaryProtocol(c, func(msg *model.ProxyMessage) bool { return true })
+	}))
+	defer server.Close()
+
+	// connect sends the batches over a new connection and returns the acks received till the runner closes it
+	connect := func(seqs ...uint64) ([]uint64, error) {
+		dialer := websocket.Dialer{Subprotocols: []string{model.ProtocolBinary}}
+		c, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("Could not connect to runner - %s", err)
+		}
+		defer func() { _ = c.Close() }()
+
+		for _, seq := range seqs {
+			frame := &model.Frame{Version: model.ProtocolVersion, Seq: seq, Messages: []*model.ProxyMessage{{ActiveRequests: int32(seq)}}}
+			// The runner may have closed the connection already
+			if err := c.WriteMessage(websocket.BinaryMessage, frame.Marshal()); err != nil {
+				break
+			}
+		}
+
+		var acks []uint64
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for len(acks) < len(seqs) {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				return acks, err
+			}
+			frame := new(model.Frame)
+			if err := frame.Unmarshal(data); err != nil || !frame.Ack {
+				t.Fatalf("Runner sent an invalid frame")
+			}
+			acks = append(acks, frame.Seq)
+		}
+		return acks, nil
+	}
+
+	// The first batch fails to store. The runner must not acknowledge the later batch since the proxy would discard
+	// the failed one along with it.
+	acks, err := connect(1, 2)
+	if len(acks) != 0 {
+		t.Errorf("Runner acknowledged batches %v after failing to store batch 1", acks)
+	}
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Errorf("Runner closed connection with error %v, want close code %d", err, websocket.CloseTryAgainLater)
+	}
+
+	// The proxy sends the batches in flight again over the next connection
+	acks, err = connect(1, 2)
+	if err != nil || len(acks) != 2 || acks[0] != 1 || acks[1] != 2 {
+		t.Fatalf("Runner acknowledged batches %v with error %v, want [1 2]", acks, err)
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if len(store.stored) != 2 || store.stored[0] != 1 || store.stored[1] != 2 {
+		t.Errorf("Runner stored %v, want [1 2]", store.stored)
+	}
+}
+
+func TestRunner_handleBinaryProtocolLimits(t *testing.T) {
+	runner := &Runner{store: new(flakyStore), elector: election.NewStatic("runner")}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = c.Close() }()
+		runner.handleBinaryProtocol(c, func(msg *model.ProxyMessage) bool { return true })
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantCode int
+	}{
+		{
+			name:     "unknown version",
+			data:     (&model.Frame{Version: model.ProtocolVersion + 1, Seq: 1, Messages: []*model.ProxyMessage{{ActiveRequests: 1}}}).Marshal(),
+			wantCode: websocket.CloseUnsupportedData,
+		},
+		{
+			name:     "frame larger than a batch",
+			data:     make([]byte, model.MaxFrameSize+1),
+			wantCode: websocket.CloseMessageTooBig,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: []string{model.ProtocolBinary}}
+			c, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatalf("Could not connect to runner - %s", err)
+			}
+			defer func() { _ = c.Close() }()
+
+			if err := c.WriteMessage(websocket.BinaryMessage, tt.data); err != nil {
+				t.Fatalf("Could not send frame - %s", err)
+			}
+			_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, _, err := c.ReadMessage(); !websocket.IsCloseError(err, tt.wantCode) {
+				t.Errorf("Runner closed connection with error %v, want close code %d", err, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils"
+	"github.com/spaceuptech/galaxy/utils/audit"
+	"github.com/spaceuptech/galaxy/utils/auth"
+)
+
+var (
+	errInvalidCredentials = errors.New("invalid username or key provided")
+	errTooManyLogins      = errors.New("too many failed login attempts")
+)
+
+// withoutHash returns a copy of the account which can be handed out
+func withoutHash(account *model.UserAccount) *model.UserAccount {
+	a := *account
+	a.Hash = ""
+	return &a
+}
+
+// getAccountByName returns the account with the username. It returns nil if no such account exists.
+func (s *Server) getAccountByName(name string) (*model.UserAccount, error) {
+	accounts, err := s.store.GetAccounts()
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range accounts {
+		if account.UserName == name {
+			return account, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *Server) handleLogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Parse request body
+		req := new(model.LoginRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			logrus.Errorf("Failed to login - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		// Lock out the clients guessing keys. The attempts to guess the key of an account only get slowed down since
+		// anyone could lock the account out otherwise.
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		userKey, ipKey := "user:"+req.UserName, "ip:"+ip
+		wait := s.logins.blocked(ipKey)
+		if d := s.logins.backoff(userKey); d > wait {
+			wait = d
+		}
+		if wait > 0 {
+			logrus.Errorf("Failed to login (%s) from %s - %s", req.UserName, ip, errTooManyLogins.Error())
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			utils.SendErrorResponse(w, r, http.StatusTooManyRequests, errTooManyLogins)
+			return
+		}
+
+		account, err := s.getAccountByName(req.UserName)
+		if err != nil {
+			logrus.Errorf("Failed to login - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		// Verify a key even if the account doesn't exist so that the usernames can't be told apart by the response time
+		var valid bool
+		if account == nil {
+			valid = auth.VerifyMissingAccessKey(req.Key)
+		} else {
+			valid = auth.VerifyAccessKey(account, req.Key)
+		}
+		if !valid {
+			s.logins.fail(userKey, ipKey)
+			logrus.Errorf("Failed to login (%s) - %s", req.UserName, errInvalidCredentials.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, errInvalidCredentials)
+			return
+		}
+		s.logins.reset(userKey)
+
+		token, err := s.auth.SignToken(account, s.config.TokenTTL)
+		if err != nil {
+			logrus.Errorf("Failed to login - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		fileToken, err := s.auth.SignFileToken(account, s.config.TokenTTL)
+		if err != nil {
+			logrus.Errorf("Failed to login - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		// Hand out the projects, environments and clusters the account has access to
+		claims := &auth.Claims{ID: account.ID, Role: auth.Role(account.Role), Projects: account.Projects, Environments: account.Environments}
+		projects, err := s.getVisibleProjects(claims)
+		if err != nil {
+			logrus.Errorf("Failed to login - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		utils.SendResponse(w, r, http.StatusOK, &model.LoginResponse{AccountID: account.ID, Token: token, FileToken: fileToken, Projects: projects})
+	}
+}
+
+func (s *Server) handleGetAccounts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to get accounts - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		if err := claims.Authorize(auth.ActionManageAccounts, "", ""); err != nil {
+			logrus.Errorf("Failed to get accounts - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		accounts, err := s.store.GetAccounts()
+		if err != nil {
+			logrus.Errorf("Failed to get accounts - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		result := make([]*model.UserAccount, len(accounts))
+		for i, account := range accounts {
+			result[i] = withoutHash(account)
+		}
+		utils.SendResponse(w, r, http.StatusOK, map[string]interface{}{"accounts": result})
+	}
+}
+
+func (s *Server) handleCreateAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to create account - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+		if err := claims.Authorize(auth.ActionManageAccounts, "", ""); err != nil {
+			logrus.Errorf("Failed to create account - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		// Parse request body
+		req := new(model.UserAccountRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			logrus.Errorf("Failed to create account - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		// Usernames need to be unique since they are used to login
+		if existing, err := s.getAccountByName(req.UserName); err != nil || existing != nil {
+			if err == nil {
+				err = errors.New("username is already taken")
+			}
+			logrus.Errorf("Failed to create account (%s) - %s", req.UserName, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusConflict, err)
+			return
+		}
+
+		key, account, err := auth.NewAccount(req)
+		if err != nil {
+			logrus.Errorf("Failed to create account - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+		audit.SetTarget(r, "", "", account.ID)
+
+		if err := s.store.SaveAccount(account); err != nil {
+			logrus.Errorf("Failed to create account - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		logrus.Infof("Created account (%s) with role %s", account.UserName, account.Role)
+		utils.SendResponse(w, r, http.StatusOK, &model.UserAccountResponse{Key: key, Account: withoutHash(account)})
+	}
+}
+
+func (s *Server) handleUpdateAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to update account - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+		id := mux.Vars(r)["id"]
+		audit.SetTarget(r, "", "", id)
+		if err := claims.Authorize(auth.ActionManageAccounts, "", ""); err != nil {
+			logrus.Errorf("Failed to update account - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		// Parse request body
+		req := new(model.UserAccountRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			logrus.Errorf("Failed to update account - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		account, err := s.store.GetAccount(id)
+		if err != nil {
+			logrus.Errorf("Failed to update account (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, storeErrorStatus(err), err)
+			return
+		}
+		if req.UserName != "" && req.UserName != account.UserName {
+			if existing, err := s.getAccountByName(req.UserName); err != nil || existing != nil {
+				if err == nil {
+					err = errors.New("username is already taken")
+				}
+				logrus.Errorf("Failed to update account (%s) - %s", id, err.Error())
+				utils.SendErrorResponse(w, r, http.StatusConflict, err)
+				return
+			}
+			account.UserName = req.UserName
+		}
+		if req.Role != "" {
+			if !auth.IsValidRole(req.Role) {
+				utils.SendErrorResponse(w, r, http.StatusBadRequest, errors.New("invalid role provided for account"))
+				return
+			}
+			account.Role = req.Role
+		}
+		account.Projects, account.Environments = req.Projects, req.Environments
+
+		if err := s.store.SaveAccount(account); err != nil {
+			logrus.Errorf("Failed to update account (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		utils.SendResponse(w, r, http.StatusOK, withoutHash(account))
+	}
+}
+
+func (s *Server) handleRotateAccountKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to rotate account key - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+		id := mux.Vars(r)["id"]
+		audit.SetTarget(r, "", "", id)
+
+		// Users can rotate their own key
+		if claims.ID != id {
+			if err := claims.Authorize(auth.ActionManageAccounts, "", ""); err != nil {
+				logrus.Errorf("Failed to rotate account key - %s", err.Error())
+				utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+				return
+			}
+		}
+
+		account, err := s.store.GetAccount(id)
+		if err != nil {
+			logrus.Errorf("Failed to rotate account key (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, storeErrorStatus(err), err)
+			return
+		}
+		key, hash, err := auth.NewAccessKey()
+		if err != nil {
+			logrus.Errorf("Failed to rotate account key (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		account.Hash = hash
+
+		if err := s.store.SaveAccount(account); err != nil {
+			logrus.Errorf("Failed to rotate account key (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		logrus.Infof("Rotated key of account (%s)", account.UserName)
+		utils.SendResponse(w, r, http.StatusOK, &model.UserAccountResponse{Key: key, Account: withoutHash(account)})
+	}
+}
+
+func (s *Server) handleDeleteAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to delete account - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+		id := mux.Vars(r)["id"]
+		audit.SetTarget(r, "", "", id)
+		if err := claims.Authorize(auth.ActionManageAccounts, "", ""); err != nil {
+			logrus.Errorf("Failed to delete account - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		// Admins can't lock themselves out
+		if claims.ID == id {
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, errors.New("accounts cannot delete themselves"))
+			return
+		}
+
+		if err := s.store.DeleteAccount(id); err != nil {
+			logrus.Errorf("Failed to delete account (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, storeErrorStatus(err), err)
+			return
+		}
+		utils.SendEmptySuccessResponse(w, r)
+	}
+}
+
+// storeErrorStatus returns the status code of the response for an error returned by the store
+func storeErrorStatus(err error) int {
+	if err == ErrNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils"
+	"github.com/spaceuptech/galaxy/utils/audit"
+	"github.com/spaceuptech/galaxy/utils/auth"
+)
+
+func (s *Server) handleGetClusters() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to get clusters - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		if err := claims.Authorize(auth.ActionManageClusters, "", ""); err != nil {
+			logrus.Errorf("Failed to get clusters - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		clusters, err := s.store.GetClusters()
+		if err != nil {
+			logrus.Errorf("Failed to get clusters - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		utils.SendResponse(w, r, http.StatusOK, map[string]interface{}{"clusters": clusters})
+	}
+}
+
+func (s *Server) handleSaveCluster() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to save cluster - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+		if err := claims.Authorize(auth.ActionManageClusters, "", ""); err != nil {
+			logrus.Errorf("Failed to save cluster - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		// Parse request body
+		cluster := new(model.Cluster)
+		if err := json.NewDecoder(r.Body).Decode(cluster); err != nil {
+			logrus.Errorf("Failed to save cluster - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if err := validateID("cluster", cluster.ID); err != nil {
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if cluster.URL == "" {
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, errors.New("url of cluster not provided"))
+			return
+		}
+		audit.SetTarget(r, "", "", cluster.ID)
+
+		if err := s.store.SaveCluster(cluster); err != nil {
+			logrus.Errorf("Failed to save cluster (%s) - %s", cluster.ID, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		utils.SendEmptySuccessResponse(w, r)
+	}
+}
+
+func (s *Server) handleDeleteCluster() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to delete cluster - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+		id := mux.Vars(r)["id"]
+		audit.SetTarget(r, "", "", id)
+		if err := claims.Authorize(auth.ActionManageClusters, "", ""); err != nil {
+			logrus.Errorf("Failed to delete cluster (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		if err := s.store.DeleteCluster(id); err != nil {
+			logrus.Errorf("Failed to delete cluster (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, storeErrorStatus(err), err)
+			return
+		}
+		utils.SendEmptySuccessResponse(w, r)
+	}
+}
@@ -1,6 +1,56 @@
 package server
 
+import (
+	"time"
+
+	"github.com/spaceuptech/galaxy/utils"
+	"github.com/spaceuptech/galaxy/utils/auth"
+	"github.com/spaceuptech/galaxy/utils/certs"
+)
+
 // Config describes the config required by the galaxy server
 type Config struct {
 	Port string
+
+	// The time given to in-flight requests to complete when shutting down
+	ShutdownTimeout time.Duration
+
+	// Certificates for serving over tls
+	TLS *certs.Config
+
+	// The cross origin requests accepted by the server
+	Cors *utils.CorsConfig
+
+	// The directory in which the server persists its state
+	DataDir string
+
+	// The store used for the accounts, projects, environments and clusters
+	Store StoreType
+
+	// The duration the audit entries are retained for
+	AuditRetention time.Duration
+
+	// Configuration for the auth module. The tokens issued on login are valid for the ttl.
+	Auth     *auth.Config
+	TokenTTL time.Duration
+
+	// The rsa keys the tokens are signed with get replaced after the rotation interval. The retired keys continue
+	// to be published for the grace period so that the tokens signed with them remain valid.
+	KeyRotationInterval time.Duration
+	KeyGracePeriod      time.Duration
+
+	// The services are applied to the runner of each cluster of an environment. Failed attempts are retried with
+	// an exponential backoff till the attempts are exhausted or the timeout of the deployment elapses. Deployments
+	// still running when the server shuts down are cancelled and can be retried later on.
+	DeployAttempts     int
+	DeployRetryBackoff time.Duration
+	DeployTimeout      time.Duration
+
+	// Logins from a client ip are rejected for the lockout duration once the attempts have failed. The logins of a
+	// username have to back off between attempts instead.
+	LoginAttempts int
+	LoginLockout  time.Duration
+
+	// The admin account created if the server doesn't have any accounts yet
+	AdminUser, AdminKey string
 }
@@ -0,0 +1,507 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils"
+	"github.com/spaceuptech/galaxy/utils/audit"
+	"github.com/spaceuptech/galaxy/utils/auth"
+)
+
+var (
+	errDeploymentRunning     = errors.New("deployment is still running")
+	errDeploymentInterrupted = errors.New("deployment was interrupted by a restart of the server")
+)
+
+// newDeployment returns a pending deployment of the service to the clusters
+func newDeployment(actor string, service *model.Service, clusters []*model.Cluster) *model.Deployment {
+	deployment := &model.Deployment{
+		ID:          ksuid.New().String(),
+		ProjectID:   service.ProjectID,
+		Environment: service.Environment,
+		ServiceID:   service.ID,
+		Version:     service.Version,
+		Actor:       actor,
+		Status:      model.DeploymentPending,
+		Clusters:    make([]*model.ClusterDeployment, len(clusters)),
+		Service:     service,
+		CreatedAt:   time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	for i, cluster := range clusters {
+		deployment.Clusters[i] = &model.ClusterDeployment{ClusterID: cluster.ID, URL: cluster.URL, Status: model.DeploymentPending}
+	}
+	return deployment
+}
+
+// copyDeployment returns a copy of the deployment which can be handed out while the deployment is running
+func copyDeployment(deployment *model.Deployment) *model.Deployment {
+	d := *deployment
+	d.Clusters = make([]*model.ClusterDeployment, len(deployment.Clusters))
+	for i, c := range deployment.Clusters {
+		cluster := *c
+		d.Clusters[i] = &cluster
+	}
+	return &d
+}
+
+// withoutService returns a copy of the deployment without the service it applies, which may hold secrets
+func withoutService(deployment *model.Deployment) *model.Deployment {
+	d := *deployment
+	d.Service = nil
+	return &d
+}
+
+// startDeployment applies the service to the clusters of the deployment which haven't succeeded yet. The clusters
+// are applied to in the background and the server waits for them before shutting down. It returns a copy of the
+// deployment as persisted before it started.
+func (s *Server) startDeployment(token string, deployment *model.Deployment) (*model.Deployment, error) {
+	s.deploymentsLock.Lock()
+	defer s.deploymentsLock.Unlock()
+	if s.running[deployment.ID] {
+		return nil, errDeploymentRunning
+	}
+
+	for _, c := range deployment.Clusters {
+		if c.Status != model.DeploymentSucceeded {
+			c.Status, c.Error = model.DeploymentPending, ""
+		}
+	}
+	deployment.Status, deployment.CompletedAt = model.DeploymentPending, 0
+	if err := s.store.SaveDeployment(deployment); err != nil {
+		return nil, err
+	}
+
+	// The copy has to be taken before the clusters get applied to
+	snapshot := copyDeployment(deployment)
+
+	s.running[deployment.ID] = true
+	s.deployments.Add(1)
+	go func() {
+		defer s.deployments.Done()
+		ctx, cancel := context.WithTimeout(s.deployCtx, s.config.DeployTimeout)
+		defer cancel()
+		s.deployService(ctx, token, deployment)
+
+		s.deploymentsLock.Lock()
+		delete(s.running, deployment.ID)
+		s.deploymentsLock.Unlock()
+	}()
+	return snapshot, nil
+}
+
+// deployService applies the service to the pending clusters of the deployment in parallel. The token of the caller
+// is forwarded so that the runners authorize and audit the request themselves. The deployment is persisted every
+// time a cluster completes so that its progress can be followed.
+func (s *Server) deployService(ctx context.Context, token string, deployment *model.Deployment) {
+	body, err := json.Marshal(deployment.Service)
+	if err != nil {
+		logrus.Errorf("Failed to deploy service (%s:%s) - %s", deployment.ProjectID, deployment.ServiceID, err.Error())
+		return
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range deployment.Clusters {
+		if c.Status != model.DeploymentPending {
+			continue
+		}
+
+		wg.Add(1)
+		go func(c *model.ClusterDeployment) {
+			defer wg.Done()
+			attempts, statusCode, err := s.applyService(ctx, token, c.URL, body)
+
+			lock.Lock()
+			defer lock.Unlock()
+			c.Attempts, c.StatusCode, c.Status = c.Attempts+attempts, statusCode, model.DeploymentSucceeded
+			if err != nil {
+				logrus.Errorf("Failed to apply service (%s:%s) to cluster (%s) - %s", deployment.ProjectID, deployment.ServiceID, c.ClusterID, err.Error())
+				c.Status, c.Error = model.DeploymentFailed, err.Error()
+			}
+			if err := s.store.SaveDeployment(deployment); err != nil {
+				logrus.Errorf("Failed to save deployment (%s) - %s", deployment.ID, err.Error())
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	deployment.Status = aggregateStatus(deployment.Clusters)
+	deployment.CompletedAt = time.Now().UnixNano() / int64(time.Millisecond)
+	logrus.Infof("Deployment (%s) of service (%s:%s) to %d cluster(s) %s", deployment.ID, deployment.ProjectID, deployment.ServiceID, len(deployment.Clusters), deployment.Status)
+	if err := s.store.SaveDeployment(deployment); err != nil {
+		logrus.Errorf("Failed to save deployment (%s) - %s", deployment.ID, err.Error())
+	}
+}
+
+// waitForDeployments waits for the running deployments to complete. The deployments still running once the context
+// is done get cancelled. Their pending clusters are marked as failed so that they can be retried.
+func (s *Server) waitForDeployments(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		s.deployments.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	logrus.Warnln("Cancelling the deployments which are still running")
+	s.cancelDeployments()
+	<-done
+}
+
+// failInterruptedDeployments marks the deployments which were still running when the server stopped as failed so
+// that they can be retried. The token of the caller isn't persisted, so they can't be resumed.
+func (s *Server) failInterruptedDeployments() error {
+	deployments, err := s.store.GetDeployments()
+	if err != nil {
+		return err
+	}
+
+	for _, deployment := range deployments {
+		if deployment.Status != model.DeploymentPending {
+			continue
+		}
+		for _, c := range deployment.Clusters {
+			if c.Status == model.DeploymentPending {
+				c.Status, c.Error = model.DeploymentFailed, errDeploymentInterrupted.Error()
+			}
+		}
+		deployment.Status = aggregateStatus(deployment.Clusters)
+		deployment.CompletedAt = time.Now().UnixNano() / int64(time.Millisecond)
+
+		logrus.Warnf("Deployment (%s) of service (%s:%s) was interrupted", deployment.ID, deployment.ProjectID, deployment.ServiceID)
+		if err := s.store.SaveDeployment(deployment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// aggregateStatus returns the status of a deployment based on the status of its clusters
+func aggregateStatus(clusters []*model.ClusterDeployment) model.DeploymentStatus {
+	succeeded := 0
+	for _, c := range clusters {
+		if c.Status == model.DeploymentSucceeded {
+			succeeded++
+		}
+	}
+	switch succeeded {
+	case len(clusters):
+		return model.DeploymentSucceeded
+	case 0:
+		return model.DeploymentFailed
+	}
+	return model.DeploymentPartial
+}
+
+// applyService posts the service to the runner till it succeeds, the attempts are exhausted or the runner rejects the
+// request. It returns the number of attempts made along with the status code of the last response.
+func (s *Server) applyService(ctx context.Context, token, url string, body []byte) (int, int, error) {
+	backoff := s.config.DeployRetryBackoff
+	for attempt := 1; ; attempt++ {
+		statusCode, err := s.postService(ctx, token, url, body)
+		if err == nil || attempt >= s.config.DeployAttempts || !shouldRetry(statusCode) {
+			return attempt, statusCode, err
+		}
+		logrus.Warnf("Attempt %d to apply service to runner (%s) failed - %s", attempt, url, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return attempt, statusCode, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// shouldRetry returns true if the runner couldn't be reached or failed to process the request. Requests rejected by
+// the runner would be rejected again.
+func shouldRetry(statusCode int) bool {
+	return statusCode == 0 || statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+func (s *Server) postService(ctx context.Context, token, url string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(url, "/")+"/v1/galaxy/service", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer utils.CloseReaderCloser(res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		// The runners describe the error in the body of the response
+		v := map[string]interface{}{}
+		if err := json.NewDecoder(res.Body).Decode(&v); err == nil {
+			if msg, ok := v["error"].(string); ok && msg != "" {
+				return res.StatusCode, fmt.Errorf("runner responded with status code %d - %s", res.StatusCode, msg)
+			}
+		}
+		return res.StatusCode, fmt.Errorf("runner responded with status code %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// getDeploymentClusters returns the clusters of the environment the service is to be applied to. The clusters can be
+// narrowed down to a subset of the clusters of the environment.
+func (s *Server) getDeploymentClusters(project, env string, selected []string) ([]*model.Cluster, error) {
+	envs, err := s.store.GetEnvironments(project)
+	if err != nil {
+		return nil, err
+	}
+	var config *model.EnvironmentConfig
+	for _, e := range envs {
+		if e.ID == env {
+			config = e
+			break
+		}
+	}
+	if config == nil {
+		return nil, ErrNotFound
+	}
+
+	ids := config.Clusters
+	if len(selected) > 0 {
+		allowed := make(map[string]bool, len(config.Clusters))
+		for _, id := range config.Clusters {
+			allowed[id] = true
+		}
+		for _, id := range selected {
+			if !allowed[id] {
+				return nil, fmt.Errorf("cluster (%s) is not part of environment (%s)", id, env)
+			}
+		}
+		ids = selected
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("environment (%s) does not have any clusters", env)
+	}
+
+	clusters := make([]*model.Cluster, 0, len(ids))
+	for _, id := range ids {
+		cluster, err := s.store.GetCluster(id)
+		if err == ErrNotFound {
+			return nil, fmt.Errorf("cluster (%s) has not been registered", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+func (s *Server) handleDeployService() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		token := utils.GetToken(r)
+		claims, err := s.auth.Authenticate(token)
+		if err != nil {
+			logrus.Errorf("Failed to deploy service - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+
+		// Parse request body
+		service := new(model.Service)
+		if err := json.NewDecoder(r.Body).Decode(service); err != nil {
+			logrus.Errorf("Failed to deploy service - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		// Users with access to a single project needn't specify it
+		if project, ok := claims.DefaultProject(); ok && service.ProjectID == "" {
+			service.ProjectID = project
+		}
+		audit.SetTarget(r, service.ProjectID, service.Environment, service.ID+":"+service.Version)
+
+		// Check if the token is allowed to deploy to the environment of the project
+		if err := claims.Authorize(auth.ActionDeploy, service.ProjectID, service.Environment); err != nil {
+			logrus.Errorf("Failed to deploy service (%s:%s) - %s", service.ProjectID, service.ID, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		var selected []string
+		if v := r.URL.Query().Get("clusters"); v != "" {
+			selected = strings.Split(v, ",")
+		}
+		clusters, err := s.getDeploymentClusters(service.ProjectID, service.Environment, selected)
+		if err != nil {
+			logrus.Errorf("Failed to deploy service (%s:%s) - %s", service.ProjectID, service.ID, err.Error())
+			status := http.StatusBadRequest
+			if err == ErrNotFound {
+				err, status = fmt.Errorf("environment (%s) of project (%s) does not exist", service.Environment, service.ProjectID), http.StatusNotFound
+			}
+			utils.SendErrorResponse(w, r, status, err)
+			return
+		}
+
+		// The deployment continues in the background. Its progress can be followed through the deployments api.
+		deployment, err := s.startDeployment(token, newDeployment(claims.ID, service, clusters))
+		if err != nil {
+			logrus.Errorf("Failed to deploy service (%s:%s) - %s", service.ProjectID, service.ID, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		utils.SendResponse(w, r, http.StatusAccepted, withoutService(deployment))
+	}
+}
+
+func (s *Server) handleRetryDeployment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		token := utils.GetToken(r)
+		claims, err := s.auth.Authenticate(token)
+		if err != nil {
+			logrus.Errorf("Failed to retry deployment - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+
+		id := mux.Vars(r)["id"]
+		deployment, err := s.store.GetDeployment(id)
+		if err != nil {
+			logrus.Errorf("Failed to retry deployment (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, storeErrorStatus(err), err)
+			return
+		}
+		audit.SetTarget(r, deployment.ProjectID, deployment.Environment, deployment.ServiceID+":"+deployment.Version)
+
+		// Check if the token is allowed to deploy to the environment of the project
+		if err := claims.Authorize(auth.ActionDeploy, deployment.ProjectID, deployment.Environment); err != nil {
+			logrus.Errorf("Failed to retry deployment (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+		if deployment.Status == model.DeploymentSucceeded || deployment.Service == nil {
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, fmt.Errorf("deployment (%s) does not have any clusters to retry", id))
+			return
+		}
+
+		// The address of a cluster may have changed since the deployment was made
+		for _, c := range deployment.Clusters {
+			if c.Status == model.DeploymentSucceeded {
+				continue
+			}
+			cluster, err := s.store.GetCluster(c.ClusterID)
+			if err == ErrNotFound {
+				utils.SendErrorResponse(w, r, http.StatusBadRequest, fmt.Errorf("cluster (%s) has not been registered", c.ClusterID))
+				return
+			}
+			if err != nil {
+				logrus.Errorf("Failed to retry deployment (%s) - %s", id, err.Error())
+				utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			c.URL = cluster.URL
+		}
+
+		deployment, err = s.startDeployment(token, deployment)
+		if err != nil {
+			logrus.Errorf("Failed to retry deployment (%s) - %s", id, err.Error())
+			status := http.StatusInternalServerError
+			if err == errDeploymentRunning {
+				status = http.StatusConflict
+			}
+			utils.SendErrorResponse(w, r, status, err)
+			return
+		}
+		utils.SendResponse(w, r, http.StatusAccepted, withoutService(deployment))
+	}
+}
+
+func (s *Server) handleGetDeployments() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to get deployments - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+
+		deployments, err := s.store.GetDeployments()
+		if err != nil {
+			logrus.Errorf("Failed to get deployments - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		// Only return the deployments the token has access to
+		q := r.URL.Query()
+		project, env, service := q.Get("project"), q.Get("env"), q.Get("service")
+		result := make([]*model.Deployment, 0)
+		for _, d := range deployments {
+			if (project != "" && d.ProjectID != project) || (env != "" && d.Environment != env) || (service != "" && d.ServiceID != service) {
+				continue
+			}
+			if claims.Authorize(auth.ActionRead, d.ProjectID, d.Environment) == nil {
+				result = append(result, withoutService(d))
+			}
+		}
+		utils.SendResponse(w, r, http.StatusOK, map[string]interface{}{"deployments": result})
+	}
+}
+
+func (s *Server) handleGetDeployment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to get deployment - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+		deployment, err := s.store.GetDeployment(id)
+		if err != nil {
+			logrus.Errorf("Failed to get deployment (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, storeErrorStatus(err), err)
+			return
+		}
+		if err := claims.Authorize(auth.ActionRead, deployment.ProjectID, deployment.Environment); err != nil {
+			logrus.Errorf("Failed to get deployment (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+		utils.SendResponse(w, r, http.StatusOK, withoutService(deployment))
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils"
+	"github.com/spaceuptech/galaxy/utils/auth"
+)
+
+// The interval at which the server checks if its signing key is due for rotation
+const keyCheckInterval = time.Minute
+
+// rotateKeys generates a new signing key if the current one is older than the rotation interval and drops the
+// retired keys whose grace period is over. The remaining keys are handed to the auth module.
+func (s *Server) rotateKeys(now time.Time) error {
+	keys, err := s.store.GetSigningKeys()
+	if err != nil {
+		return err
+	}
+
+	var current *model.SigningKey
+	for _, key := range keys {
+		if key.RetiredAt == 0 && (current == nil || key.CreatedAt > current.CreatedAt) {
+			current = key
+		}
+	}
+
+	if current == nil || now.Sub(time.Unix(current.CreatedAt, 0)) >= s.config.KeyRotationInterval {
+		key, err := auth.NewSigningKey()
+		if err != nil {
+			return err
+		}
+		key.CreatedAt = now.Unix()
+
+		// The new key is saved before the old ones get retired so that there is always a key to sign with
+		if err := s.store.SaveSigningKey(key); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if k.RetiredAt == 0 {
+				k.RetiredAt = now.Unix()
+				if err := s.store.SaveSigningKey(k); err != nil {
+					return err
+				}
+			}
+		}
+		keys = append(keys, key)
+		logrus.Infof("Generated signing key (%s)", key.ID)
+	}
+
+	// Retired keys continue to be published till the tokens signed with them have expired
+	remaining := make([]*model.SigningKey, 0, len(keys))
+	for _, key := range keys {
+		if key.RetiredAt != 0 && now.Sub(time.Unix(key.RetiredAt, 0)) >= s.config.KeyGracePeriod {
+			if err := s.store.DeleteSigningKey(key.ID); err != nil {
+				return err
+			}
+			logrus.Infof("Removed retired signing key (%s)", key.ID)
+			continue
+		}
+		remaining = append(remaining, key)
+	}
+
+	return s.auth.SetSigningKeys(remaining)
+}
+
+// routineRotateKeys rotates the signing keys on schedule till the stop channel is closed
+func (s *Server) routineRotateKeys(stop <-chan struct{}) {
+	ticker := time.NewTicker(keyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.rotateKeys(time.Now()); err != nil {
+				logrus.Errorf("Failed to rotate signing keys - %s", err.Error())
+			}
+		}
+	}
+}
+
+func (s *Server) handlePublicKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		set := s.auth.PublicKeySet()
+		if set == nil {
+			utils.SendErrorResponse(w, r, http.StatusNotFound, errors.New("server signs tokens with a shared secret"))
+			return
+		}
+
+		// The pem blocks can be fetched on their own for tools which don't understand json
+		if r.URL.Query().Get("format") == "pem" {
+			w.Header().Set("Content-Type", "application/x-pem-file")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(set.PemData))
+			return
+		}
+		utils.SendResponse(w, r, http.StatusOK, set)
+	}
+}
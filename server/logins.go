@@ -0,0 +1,107 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// The number of tracked keys after which the expired failures get dropped
+const maxTrackedLogins = 1024
+
+// The longest delay between the logins of a username once its attempts have failed
+const maxLoginBackoff = 30 * time.Second
+
+// loginLimiter rejects the logins of a key (a username or a client ip) once too many attempts have failed. Keys are
+// either locked out for the lockout duration or have to back off between their attempts. The failures are forgotten
+// once the lockout duration has passed since the first of them.
+type loginLimiter struct {
+	attempts int
+	lockout  time.Duration
+
+	lock     sync.Mutex
+	failures map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count int
+	since time.Time
+	last  time.Time
+}
+
+func newLoginLimiter(attempts int, lockout time.Duration) *loginLimiter {
+	return &loginLimiter{attempts: attempts, lockout: lockout, failures: map[string]*loginFailures{}}
+}
+
+// blocked returns the duration till the logins of the keys are accepted again. It returns zero if they are accepted.
+func (l *loginLimiter) blocked(keys ...string) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var wait time.Duration
+	for _, key := range keys {
+		f, p := l.failures[key]
+		if !p || f.count < l.attempts {
+			continue
+		}
+		if d := l.lockout - time.Since(f.since); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// backoff returns the duration till the next login of the key is accepted. The delay doubles with every failed attempt
+// past the allowed ones, up to maxLoginBackoff. It returns zero if the login is accepted.
+func (l *loginLimiter) backoff(key string) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	f, p := l.failures[key]
+	if !p || f.count < l.attempts || time.Since(f.since) >= l.lockout {
+		return 0
+	}
+
+	delay := maxLoginBackoff
+	if n := f.count - l.attempts; n < 5 {
+		delay = time.Second << uint(n)
+	}
+	if d := delay - time.Since(f.last); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// fail records a failed login of the keys
+func (l *loginLimiter) fail(keys ...string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	if len(l.failures) >= maxTrackedLogins {
+		for key, f := range l.failures {
+			if now.Sub(f.since) >= l.lockout {
+				delete(l.failures, key)
+			}
+		}
+	}
+
+	for _, key := range keys {
+		f, p := l.failures[key]
+		if !p || now.Sub(f.since) >= l.lockout {
+			f = &loginFailures{since: now}
+			l.failures[key] = f
+		}
+		f.count++
+		f.last = now
+	}
+}
+
+// reset forgets the failed logins of the keys
+func (l *loginLimiter) reset(keys ...string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, key := range keys {
+		delete(l.failures, key)
+	}
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils"
+	"github.com/spaceuptech/galaxy/utils/audit"
+	"github.com/spaceuptech/galaxy/utils/auth"
+)
+
+// validateID checks that an id can be used as part of the keys of the store and the paths of the api
+func validateID(kind, id string) error {
+	if id == "" {
+		return fmt.Errorf("%s id not provided", kind)
+	}
+	if strings.ContainsAny(id, "/ ") {
+		return fmt.Errorf("invalid %s id (%s) provided", kind, id)
+	}
+	return nil
+}
+
+// getVisibleProjects returns the projects the claims can read along with their environments and clusters
+func (s *Server) getVisibleProjects(claims *auth.Claims) ([]model.Projects, error) {
+	projects, err := s.store.GetProjects()
+	if err != nil {
+		return nil, err
+	}
+	clusters, err := s.store.GetClusters()
+	if err != nil {
+		return nil, err
+	}
+	clusterByID := make(map[string]*model.Cluster, len(clusters))
+	for _, cluster := range clusters {
+		clusterByID[cluster.ID] = cluster
+	}
+
+	result := make([]model.Projects, 0)
+	for _, project := range projects {
+		if claims.Authorize(auth.ActionRead, project.ID, "") != nil {
+			continue
+		}
+
+		envs, err := s.store.GetEnvironments(project.ID)
+		if err != nil {
+			return nil, err
+		}
+		p := model.Projects{ID: project.ID, Name: project.Name, Environments: make([]model.Environment, 0)}
+		for _, env := range envs {
+			if claims.Authorize(auth.ActionRead, project.ID, env.ID) != nil {
+				continue
+			}
+
+			// Clusters which have been deleted since are skipped
+			e := model.Environment{ID: env.ID, Name: env.Name, Clusters: make([]model.Cluster, 0)}
+			for _, id := range env.Clusters {
+				if cluster, ok := clusterByID[id]; ok {
+					e.Clusters = append(e.Clusters, *cluster)
+				}
+			}
+			p.Environments = append(p.Environments, e)
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+func (s *Server) handleGetProjects() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to get projects - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+
+		projects, err := s.getVisibleProjects(claims)
+		if err != nil {
+			logrus.Errorf("Failed to get projects - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		utils.SendResponse(w, r, http.StatusOK, map[string]interface{}{"projects": projects})
+	}
+}
+
+func (s *Server) handleGetProject() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to get project - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		id := mux.Vars(r)["project"]
+		if err := claims.Authorize(auth.ActionRead, id, ""); err != nil {
+			logrus.Errorf("Failed to get project (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		project, err := s.store.GetProject(id)
+		if err != nil {
+			logrus.Errorf("Failed to get project (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, storeErrorStatus(err), err)
+			return
+		}
+		utils.SendResponse(w, r, http.StatusOK, project)
+	}
+}
+
+func (s *Server) handleSaveProject() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to save project - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+
+		// Parse request body
+		project := new(model.Project)
+		if err := json.NewDecoder(r.Body).Decode(project); err != nil {
+			logrus.Errorf("Failed to save project - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if err := validateID("project", project.ID); err != nil {
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+		audit.SetTarget(r, project.ID, "", project.ID)
+
+		// Check if the token is allowed to manage the project
+		if err := claims.Authorize(auth.ActionManageProject, project.ID, ""); err != nil {
+			logrus.Errorf("Failed to save project (%s) - %s", project.ID, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		if err := s.store.SaveProject(project); err != nil {
+			logrus.Errorf("Failed to save project (%s) - %s", project.ID, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		utils.SendEmptySuccessResponse(w, r)
+	}
+}
+
+func (s *Server) handleDeleteProject() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to delete project - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+		id := mux.Vars(r)["project"]
+		audit.SetTarget(r, id, "", id)
+		if err := claims.Authorize(auth.ActionManageProject, id, ""); err != nil {
+			logrus.Errorf("Failed to delete project (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		if err := s.store.DeleteProject(id); err != nil {
+			logrus.Errorf("Failed to delete project (%s) - %s", id, err.Error())
+			utils.SendErrorResponse(w, r, storeErrorStatus(err), err)
+			return
+		}
+		utils.SendEmptySuccessResponse(w, r)
+	}
+}
+
+func (s *Server) handleGetEnvironments() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to get environments - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		project := mux.Vars(r)["project"]
+		if err := claims.Authorize(auth.ActionRead, project, ""); err != nil {
+			logrus.Errorf("Failed to get environments of project (%s) - %s", project, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		envs, err := s.store.GetEnvironments(project)
+		if err != nil {
+			logrus.Errorf("Failed to get environments of project (%s) - %s", project, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		// Only return the environments the token has access to
+		result := make([]*model.EnvironmentConfig, 0, len(envs))
+		for _, env := range envs {
+			if claims.Authorize(auth.ActionRead, project, env.ID) == nil {
+				result = append(result, env)
+			}
+		}
+		utils.SendResponse(w, r, http.StatusOK, map[string]interface{}{"environments": result})
+	}
+}
+
+func (s *Server) handleSaveEnvironment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to save environment - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+
+		// Parse request body
+		env := new(model.EnvironmentConfig)
+		if err := json.NewDecoder(r.Body).Decode(env); err != nil {
+			logrus.Errorf("Failed to save environment - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+		env.ProjectID = mux.Vars(r)["project"]
+		if err := validateID("environment", env.ID); err != nil {
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+		audit.SetTarget(r, env.ProjectID, env.ID, env.ID)
+
+		// Check if the token is allowed to manage the environment of the project
+		if err := claims.Authorize(auth.ActionManageProject, env.ProjectID, env.ID); err != nil {
+			logrus.Errorf("Failed to save environment (%s) of project (%s) - %s", env.ID, env.ProjectID, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		// The project and the clusters of the environment need to exist
+		if _, err := s.store.GetProject(env.ProjectID); err != nil {
+			logrus.Errorf("Failed to save environment (%s) of project (%s) - %s", env.ID, env.ProjectID, err.Error())
+			utils.SendErrorResponse(w, r, storeErrorStatus(err), err)
+			return
+		}
+		for _, id := range env.Clusters {
+			if _, err := s.store.GetCluster(id); err != nil {
+				if err == ErrNotFound {
+					err = fmt.Errorf("cluster (%s) has not been registered", id)
+					utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+					return
+				}
+				logrus.Errorf("Failed to save environment (%s) of project (%s) - %s", env.ID, env.ProjectID, err.Error())
+				utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		if err := s.store.SaveEnvironment(env); err != nil {
+			logrus.Errorf("Failed to save environment (%s) of project (%s) - %s", env.ID, env.ProjectID, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		utils.SendEmptySuccessResponse(w, r)
+	}
+}
+
+func (s *Server) handleDeleteEnvironment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		// Verify token
+		claims, err := s.auth.Authenticate(utils.GetToken(r))
+		if err != nil {
+			logrus.Errorf("Failed to delete environment - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		audit.SetActor(r, claims.ID, string(claims.Role))
+		vars := mux.Vars(r)
+		project, id := vars["project"], vars["env"]
+		audit.SetTarget(r, project, id, id)
+		if err := claims.Authorize(auth.ActionManageProject, project, id); err != nil {
+			logrus.Errorf("Failed to delete environment (%s) of project (%s) - %s", id, project, err.Error())
+			utils.SendErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		if err := s.store.DeleteEnvironment(project, id); err != nil {
+			logrus.Errorf("Failed to delete environment (%s) of project (%s) - %s", id, project, err.Error())
+			utils.SendErrorResponse(w, r, storeErrorStatus(err), err)
+			return
+		}
+		utils.SendEmptySuccessResponse(w, r)
+	}
+}
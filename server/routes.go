@@ -1,5 +1,33 @@
 package server
 
 func (s *Server) routes() {
+	s.router.Methods("POST").Path("/v1/galaxy/login").HandlerFunc(s.handleLogin())
+	s.router.Methods("GET").Path("/v1/galaxy/galaxy/public-key").HandlerFunc(s.handlePublicKey())
 
+	s.router.Methods("GET").Path("/v1/galaxy/accounts").HandlerFunc(s.handleGetAccounts())
+	s.router.Methods("POST").Path("/v1/galaxy/accounts").HandlerFunc(s.audit.Handler("create-account", s.handleCreateAccount()))
+	s.router.Methods("POST").Path("/v1/galaxy/accounts/{id}").HandlerFunc(s.audit.Handler("update-account", s.handleUpdateAccount()))
+	s.router.Methods("POST").Path("/v1/galaxy/accounts/{id}/key").HandlerFunc(s.audit.Handler("rotate-account-key", s.handleRotateAccountKey()))
+	s.router.Methods("DELETE").Path("/v1/galaxy/accounts/{id}").HandlerFunc(s.audit.Handler("delete-account", s.handleDeleteAccount()))
+
+	s.router.Methods("GET").Path("/v1/galaxy/projects").HandlerFunc(s.handleGetProjects())
+	s.router.Methods("POST").Path("/v1/galaxy/projects").HandlerFunc(s.audit.Handler("save-project", s.handleSaveProject()))
+	s.router.Methods("GET").Path("/v1/galaxy/projects/{project}").HandlerFunc(s.handleGetProject())
+	s.router.Methods("DELETE").Path("/v1/galaxy/projects/{project}").HandlerFunc(s.audit.Handler("delete-project", s.handleDeleteProject()))
+
+	s.router.Methods("GET").Path("/v1/galaxy/projects/{project}/environments").HandlerFunc(s.handleGetEnvironments())
+	s.router.Methods("POST").Path("/v1/galaxy/projects/{project}/environments").HandlerFunc(s.audit.Handler("save-environment", s.handleSaveEnvironment()))
+	s.router.Methods("DELETE").Path("/v1/galaxy/projects/{project}/environments/{env}").HandlerFunc(s.audit.Handler("delete-environment", s.handleDeleteEnvironment()))
+
+	s.router.Methods("GET").Path("/v1/galaxy/clusters").HandlerFunc(s.handleGetClusters())
+	s.router.Methods("POST").Path("/v1/galaxy/clusters").HandlerFunc(s.audit.Handler("save-cluster", s.handleSaveCluster()))
+	s.router.Methods("DELETE").Path("/v1/galaxy/clusters/{id}").HandlerFunc(s.audit.Handler("delete-cluster", s.handleDeleteCluster()))
+
+	s.router.Methods("POST").Path("/v1/galaxy/service").HandlerFunc(s.audit.Handler("deploy-service", s.handleDeployService()))
+	s.router.Methods("GET").Path("/v1/galaxy/deployments").HandlerFunc(s.handleGetDeployments())
+	s.router.Methods("GET").Path("/v1/galaxy/deployments/{id}").HandlerFunc(s.handleGetDeployment())
+	s.router.Methods("POST").Path("/v1/galaxy/deployments/{id}/retry").HandlerFunc(s.audit.Handler("retry-deployment", s.handleRetryDeployment()))
+
+	s.router.Methods("GET").Path("/v1/galaxy/audit").HandlerFunc(s.audit.HandleQuery(s.auth))
+	s.router.Methods("GET").Path("/v1/galaxy/audit/export").HandlerFunc(s.audit.HandleExport(s.auth))
 }
@@ -1,10 +1,25 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/dgraph-io/badger"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils"
+	"github.com/spaceuptech/galaxy/utils/audit"
+	"github.com/spaceuptech/galaxy/utils/auth"
+	"github.com/spaceuptech/galaxy/utils/certs"
 )
 
 // Server modules manager the various clusters of galaxy
@@ -12,22 +27,231 @@ type Server struct {
 	// For internal use
 	router *mux.Router
 	config *Config
+	db     *badger.DB
+	store  Store
+	auth   *auth.Module
+	audit  *audit.Module
+
+	// For reaching the runners of the clusters
+	client *http.Client
+	certs  *certs.Reloader
+
+	// For throttling the attempts to guess access keys
+	logins *loginLimiter
+
+	// For tracking the deployments running in the background
+	deployments       sync.WaitGroup
+	deploymentsLock   sync.Mutex
+	running           map[string]bool
+	deployCtx         context.Context
+	cancelDeployments context.CancelFunc
 }
 
 // New creates a new galaxy server instance
-func New(config *Config) *Server {
-	return &Server{
+func New(config *Config) (*Server, error) {
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = 30 * time.Second
+	}
+	if config.TokenTTL == 0 {
+		config.TokenTTL = 24 * time.Hour
+	}
+	if config.Auth == nil {
+		config.Auth = &auth.Config{}
+	}
+	config.Auth.Mode = auth.Server
+
+	// The server manages its own rsa keys unless a shared secret was provided
+	if config.Auth.JWTAlgorithm == "" {
+		config.Auth.JWTAlgorithm = auth.RSA256
+		if config.Auth.Secret != "" {
+			config.Auth.JWTAlgorithm = auth.HS256
+		}
+	}
+	switch config.Auth.JWTAlgorithm {
+	case auth.HS256:
+		if config.Auth.Secret == "" {
+			return nil, errors.New("jwt secret needs to be provided to sign tokens")
+		}
+	case auth.RSA256:
+	default:
+		return nil, fmt.Errorf("tokens cannot be signed with the %s algorithm", config.Auth.JWTAlgorithm)
+	}
+	if config.KeyRotationInterval == 0 {
+		config.KeyRotationInterval = 30 * 24 * time.Hour
+	}
+	if config.KeyGracePeriod == 0 {
+		config.KeyGracePeriod = config.TokenTTL
+	}
+	if config.DeployAttempts == 0 {
+		config.DeployAttempts = 3
+	}
+	if config.DeployRetryBackoff == 0 {
+		config.DeployRetryBackoff = 2 * time.Second
+	}
+	if config.DeployTimeout == 0 {
+		config.DeployTimeout = 5 * time.Minute
+	}
+	if config.LoginAttempts == 0 {
+		config.LoginAttempts = 5
+	}
+	if config.LoginLockout == 0 {
+		config.LoginLockout = 15 * time.Minute
+	}
+
+	// Serve over tls if a certificate was provided. The runners are trusted if their certificates are issued by the
+	// authorities of the server in that case.
+	var reloader *certs.Reloader
+	client := http.DefaultClient
+	if config.TLS.Enabled() {
+		var err error
+		reloader, err = certs.NewReloader(config.TLS)
+		if err != nil {
+			return nil, err
+		}
+		client = &http.Client{Transport: reloader.Transport()}
+	}
+
+	a, err := auth.New(config.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openDB(config.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newStore(config.Store, db)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	deployCtx, cancelDeployments := context.WithCancel(context.Background())
+	s := &Server{
 		router: mux.NewRouter(),
 		config: config,
+		db:     db,
+		store:  store,
+		auth:   a,
+		audit:  audit.New(db, config.AuditRetention),
+		client: client,
+		certs:  reloader,
+		logins: newLoginLimiter(config.LoginAttempts, config.LoginLockout),
+
+		running:           map[string]bool{},
+		deployCtx:         deployCtx,
+		cancelDeployments: cancelDeployments,
+	}
+	if err := s.createAdminAccount(); err != nil {
+		_ = db.Close()
+		return nil, err
 	}
+	if err := s.failInterruptedDeployments(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	// Load the signing keys before any tokens get issued
+	if config.Auth.JWTAlgorithm == auth.RSA256 {
+		if err := s.rotateKeys(time.Now()); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func openDB(dataDir string) (*badger.DB, error) {
+	// Make sure the data directory exists
+	dir := filepath.Join(dataDir, "galaxy-server.db")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	opts := badger.DefaultOptions(dir)
+	opts.Logger = &logrus.Logger{Out: ioutil.Discard}
+
+	logrus.Infof("Opening server database at %s", dir)
+	return badger.Open(opts)
 }
 
-// Start begins the galaxy server operations
-func (s *Server) Start() error {
+// createAdminAccount creates the configured admin account if the server doesn't have any accounts yet
+func (s *Server) createAdminAccount() error {
+	if s.config.AdminUser == "" {
+		return nil
+	}
+
+	accounts, err := s.store.GetAccounts()
+	if err != nil || len(accounts) > 0 {
+		return err
+	}
+	if s.config.AdminKey == "" {
+		logrus.Warnf("Not creating admin account (%s) since no key was provided", s.config.AdminUser)
+		return nil
+	}
+
+	_, account, err := auth.NewAccount(&model.UserAccountRequest{UserName: s.config.AdminUser, Role: string(auth.RoleAdmin)})
+	if err != nil {
+		return err
+	}
+	account.Hash, err = auth.HashAccessKey(s.config.AdminKey)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Creating admin account (%s)", account.UserName)
+	return s.store.SaveAccount(account)
+}
+
+// Start begins the galaxy server operations. It blocks till the context is cancelled and then shuts the server down
+// gracefully.
+func (s *Server) Start(ctx context.Context) error {
+	defer func() { _ = s.db.Close() }()
+
 	// Initialise the routes
 	s.routes()
 
+	// Rotate the signing keys till the server shuts down
+	if s.config.Auth.JWTAlgorithm == auth.RSA256 {
+		stop, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(done)
+			s.routineRotateKeys(stop)
+		}()
+		defer func() {
+			close(stop)
+			<-done
+		}()
+	}
+
 	// Start the galaxy server
-	logrus.Infof("Starting galaxy server on port %s", s.config.Port)
-	return http.ListenAndServe(":"+s.config.Port, s.router)
+	server := &http.Server{Addr: ":" + s.config.Port, Handler: utils.WithCors(s.config.Cors, s.router)}
+
+	// Rotated certificates are picked up till the server shuts down
+	if s.certs != nil {
+		server.TLSConfig = s.certs.ServerConfig()
+		go s.certs.Run(ctx.Done())
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		logrus.Infof("Starting galaxy server on port %s", s.config.Port)
+		errCh <- utils.ListenAndServe(server)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Give the in-flight requests and the running deployments time to complete. The deployments need to be done
+	// before the database gets closed.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	logrus.Infof("Shutting down galaxy server (timeout %s)", s.config.ShutdownTimeout)
+	err := server.Shutdown(shutdownCtx)
+	s.waitForDeployments(shutdownCtx)
+	return err
 }
@@ -0,0 +1,533 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils/auth"
+)
+
+func newTestServer(t *testing.T) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "galaxy-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(&Config{DataDir: dir, Auth: &auth.Config{JWTAlgorithm: auth.HS256, Secret: "some-secret"}, AdminUser: "admin", AdminKey: "admin-key"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	s.routes()
+
+	return s, func() {
+		s.waitForDeployments(context.Background())
+		_ = s.db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func (s *Server) do(t *testing.T, method, path, token string, body interface{}, res interface{}) int {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	r := httptest.NewRequest(method, path, bytes.NewReader(data))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, r)
+
+	if res != nil && (w.Code == http.StatusOK || w.Code == http.StatusAccepted) {
+		if err := json.NewDecoder(w.Body).Decode(res); err != nil {
+			t.Fatalf("%s %s returned invalid response - %s", method, path, err)
+		}
+	}
+	return w.Code
+}
+
+func (s *Server) login(t *testing.T, username, key string) *model.LoginResponse {
+	res := new(model.LoginResponse)
+	if status := s.do(t, "POST", "/v1/galaxy/login", "", model.LoginRequest{UserName: username, Key: key}, res); status != http.StatusOK {
+		t.Fatalf("Login of %s returned status %d", username, status)
+	}
+	return res
+}
+
+// waitForDeployment polls the deployment till it completes
+func (s *Server) waitForDeployment(t *testing.T, token, id string) *model.Deployment {
+	for i := 0; i < 500; i++ {
+		d := new(model.Deployment)
+		if status := s.do(t, "GET", "/v1/galaxy/deployments/"+id, token, nil, d); status != http.StatusOK {
+			t.Fatalf("Getting deployment returned status %d", status)
+		}
+		if d.Status != model.DeploymentPending {
+			return d
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Deployment (%s) did not complete", id)
+	return nil
+}
+
+func TestServer_login(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// The admin account gets created on the first start
+	if status := s.do(t, "POST", "/v1/galaxy/login", "", model.LoginRequest{UserName: "admin", Key: "wrong-key"}, nil); status != http.StatusUnauthorized {
+		t.Errorf("Login with wrong key returned status %d, want %d", status, http.StatusUnauthorized)
+	}
+	admin := s.login(t, "admin", "admin-key").Token
+
+	// Set up a project with two environments deployed to a cluster
+	requests := []struct {
+		path string
+		body interface{}
+	}{
+		{path: "/v1/galaxy/clusters", body: model.Cluster{ID: "gcp", URL: "https://runner.gcp.example.com"}},
+		{path: "/v1/galaxy/projects", body: model.Project{ID: "todo", Name: "Todo App"}},
+		{path: "/v1/galaxy/projects/todo/environments", body: model.EnvironmentConfig{ID: "staging", Clusters: []string{"gcp"}}},
+		{path: "/v1/galaxy/projects/todo/environments", body: model.EnvironmentConfig{ID: "production", Clusters: []string{"gcp"}}},
+		{path: "/v1/galaxy/projects", body: model.Project{ID: "chat"}},
+	}
+	for _, req := range requests {
+		if status := s.do(t, "POST", req.path, admin, req.body, nil); status != http.StatusOK {
+			t.Fatalf("POST %s returned status %d", req.path, status)
+		}
+	}
+	if status := s.do(t, "POST", "/v1/galaxy/projects/todo/environments", admin, model.EnvironmentConfig{ID: "dev", Clusters: []string{"aws"}}, nil); status != http.StatusBadRequest {
+		t.Errorf("Saving environment with unknown cluster returned status %d, want %d", status, http.StatusBadRequest)
+	}
+
+	// Create an account which can deploy to the staging environment of a single project
+	account := new(model.UserAccountResponse)
+	req := model.UserAccountRequest{UserName: "alice", Role: "deployer", Projects: []string{"todo"}, Environments: []string{"staging"}}
+	if status := s.do(t, "POST", "/v1/galaxy/accounts", admin, req, account); status != http.StatusOK {
+		t.Fatalf("Creating account returned status %d", status)
+	}
+	if account.Key == "" || account.Account.Hash != "" {
+		t.Errorf("Created account %+v with key %q", account.Account, account.Key)
+	}
+	if status := s.do(t, "POST", "/v1/galaxy/accounts", admin, req, nil); status != http.StatusConflict {
+		t.Errorf("Creating account with taken username returned status %d, want %d", status, http.StatusConflict)
+	}
+
+	// The login response only holds what the account has access to
+	res := s.login(t, "alice", account.Key)
+	if res.AccountID != account.Account.ID || len(res.Projects) != 1 || res.Projects[0].ID != "todo" || res.Projects[0].Name != "Todo App" {
+		t.Fatalf("Login returned %+v", res)
+	}
+	if envs := res.Projects[0].Environments; len(envs) != 1 || envs[0].ID != "staging" || len(envs[0].Clusters) != 1 || envs[0].Clusters[0].URL != "https://runner.gcp.example.com" {
+		t.Errorf("Login returned environments %+v", envs)
+	}
+
+	// The tokens carry the claims of the account. The file token can't do more than deploying.
+	a, err := auth.New(&auth.Config{Mode: auth.Runner, JWTAlgorithm: auth.HS256, Secret: "some-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := a.Authenticate(res.Token)
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if claims.ID != account.Account.ID || claims.Authorize(auth.ActionDeploy, "todo", "staging") != nil || claims.Authorize(auth.ActionDeploy, "todo", "production") == nil {
+		t.Errorf("Token of account has claims %+v", claims)
+	}
+	if claims, err := a.Authenticate(res.FileToken); err != nil || claims.Role != auth.RoleDeployer {
+		t.Errorf("Authenticate(file token) = %+v, %v", claims, err)
+	}
+
+	// Accounts can't manage what they haven't been granted
+	if status := s.do(t, "POST", "/v1/galaxy/projects", res.Token, model.Project{ID: "todo"}, nil); status != http.StatusForbidden {
+		t.Errorf("Saving project as deployer returned status %d, want %d", status, http.StatusForbidden)
+	}
+	if status := s.do(t, "GET", "/v1/galaxy/accounts", res.Token, nil, nil); status != http.StatusForbidden {
+		t.Errorf("Listing accounts as deployer returned status %d, want %d", status, http.StatusForbidden)
+	}
+
+	// Rotated keys replace the previous ones
+	rotated := new(model.UserAccountResponse)
+	if status := s.do(t, "POST", "/v1/galaxy/accounts/"+account.Account.ID+"/key", res.Token, nil, rotated); status != http.StatusOK {
+		t.Fatalf("Rotating own key returned status %d", status)
+	}
+	if status := s.do(t, "POST", "/v1/galaxy/login", "", model.LoginRequest{UserName: "alice", Key: account.Key}, nil); status != http.StatusUnauthorized {
+		t.Errorf("Login with rotated key returned status %d, want %d", status, http.StatusUnauthorized)
+	}
+	s.login(t, "alice", rotated.Key)
+
+	// Deleting a project deletes its environments
+	if status := s.do(t, "DELETE", "/v1/galaxy/projects/todo", admin, nil, nil); status != http.StatusOK {
+		t.Fatalf("Deleting project returned status %d", status)
+	}
+	if envs, err := s.store.GetEnvironments("todo"); err != nil || len(envs) != 0 {
+		t.Errorf("GetEnvironments() = %v, %v after deleting project", envs, err)
+	}
+	if status := s.do(t, "DELETE", "/v1/galaxy/projects/todo", admin, nil, nil); status != http.StatusNotFound {
+		t.Errorf("Deleting missing project returned status %d, want %d", status, http.StatusNotFound)
+	}
+
+	// The mutating operations are audited
+	entries := struct {
+		Entries []*model.AuditEntry `json:"entries"`
+	}{}
+	if status := s.do(t, "GET", "/v1/galaxy/audit?action=create-account", admin, nil, &entries); status != http.StatusOK {
+		t.Fatalf("Querying audit log returned status %d", status)
+	}
+	if len(entries.Entries) != 2 {
+		t.Fatalf("Audit log holds %d entries, want 2", len(entries.Entries))
+	}
+	statuses := map[int]string{}
+	for _, e := range entries.Entries {
+		statuses[e.Status] = e.Target
+	}
+	if target, ok := statuses[http.StatusOK]; !ok || target != account.Account.ID {
+		t.Errorf("Audit log holds %v, want created account (%s)", statuses, account.Account.ID)
+	}
+	if _, ok := statuses[http.StatusConflict]; !ok {
+		t.Errorf("Audit log holds %v, want rejected account", statuses)
+	}
+}
+
+func TestServer_loginThrottling(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.logins = newLoginLimiter(3, time.Minute)
+
+	// The key chosen by the operator is hashed with bcrypt
+	if account, err := s.getAccountByName("admin"); err != nil || !strings.HasPrefix(account.Hash, "$2") {
+		t.Errorf("Admin account stored with hash %v (error %v), want a bcrypt hash", account, err)
+	}
+
+	login := func(username, key, ip string) int {
+		data, _ := json.Marshal(model.LoginRequest{UserName: username, Key: key})
+		r := httptest.NewRequest("POST", "/v1/galaxy/login", bytes.NewReader(data))
+		r.RemoteAddr = ip + ":4321"
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if status := login("admin", "wrong-key", "10.0.0.1"); status != http.StatusUnauthorized {
+			t.Fatalf("Login with wrong key returned status %d, want %d", status, http.StatusUnauthorized)
+		}
+	}
+
+	// The client ip is locked out while the username only has to back off
+	if status := login("alice", "some-key", "10.0.0.1"); status != http.StatusTooManyRequests {
+		t.Errorf("Login from locked out ip returned status %d, want %d", status, http.StatusTooManyRequests)
+	}
+	if status := login("admin", "admin-key", "10.0.0.2"); status != http.StatusTooManyRequests {
+		t.Errorf("Login of username backing off returned status %d, want %d", status, http.StatusTooManyRequests)
+	}
+	s.logins.failures["user:admin"].last = time.Now().Add(-time.Second)
+	if status := login("admin", "admin-key", "10.0.0.2"); status != http.StatusOK {
+		t.Errorf("Login of username after backoff returned status %d, want %d", status, http.StatusOK)
+	}
+
+	// Unknown usernames are throttled like the existing ones
+	for i := 0; i < 3; i++ {
+		if status := login("mallory", "wrong-key", "10.0.0.3"); status != http.StatusUnauthorized {
+			t.Fatalf("Login of unknown username returned status %d, want %d", status, http.StatusUnauthorized)
+		}
+	}
+	if status := login("mallory", "wrong-key", "10.0.0.4"); status != http.StatusTooManyRequests {
+		t.Errorf("Login of unknown username backing off returned status %d, want %d", status, http.StatusTooManyRequests)
+	}
+
+	// Logins are accepted again once the lockout has passed
+	for _, f := range s.logins.failures {
+		f.since = f.since.Add(-time.Minute)
+	}
+	if status := login("alice", "some-key", "10.0.0.1"); status != http.StatusUnauthorized {
+		t.Errorf("Login after lockout returned status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestServer_rotateKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	// Without a secret the server signs the tokens with its own keys
+	s, err := New(&Config{DataDir: dir, TokenTTL: time.Hour, KeyRotationInterval: 24 * time.Hour, AdminUser: "admin", AdminKey: "admin-key"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer func() { _ = s.db.Close() }()
+	s.routes()
+	ts := httptest.NewServer(s.router)
+	defer ts.Close()
+
+	first := s.login(t, "admin", "admin-key").Token
+
+	// The key doesn't get rotated before the interval
+	now := time.Now()
+	if err := s.rotateKeys(now.Add(time.Hour)); err != nil {
+		t.Fatalf("rotateKeys() error = %v", err)
+	}
+	if keys, _ := s.store.GetSigningKeys(); len(keys) != 1 {
+		t.Fatalf("Server has %d signing keys before the rotation interval, want 1", len(keys))
+	}
+
+	// The previous key remains published after the rotation
+	if err := s.rotateKeys(now.Add(25 * time.Hour)); err != nil {
+		t.Fatalf("rotateKeys() error = %v", err)
+	}
+	second := s.login(t, "admin", "admin-key").Token
+	if first == second {
+		t.Fatalf("Tokens signed before and after the rotation are the same")
+	}
+
+	// Runners fetching the keys of the server accept the tokens signed with both keys
+	runner, err := auth.New(&auth.Config{Mode: auth.Runner, JWTAlgorithm: auth.RSA256, KeyURL: ts.URL + "/v1/galaxy/galaxy/public-key"})
+	if err != nil {
+		t.Fatalf("auth.New() error = %v", err)
+	}
+	for name, token := range map[string]string{"token signed with previous key": first, "token signed with current key": second} {
+		if _, err := runner.Authenticate(token); err != nil {
+			t.Errorf("Authenticate(%s) error = %v", name, err)
+		}
+	}
+
+	res, err := http.Get(ts.URL + "/v1/galaxy/galaxy/public-key?format=pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK || bytes.Count(data, []byte("BEGIN PUBLIC KEY")) != 2 {
+		t.Errorf("Fetching pem returned status %d and %s", res.StatusCode, data)
+	}
+
+	// The previous key is dropped once its grace period is over
+	if err := s.rotateKeys(now.Add(26 * time.Hour)); err != nil {
+		t.Fatalf("rotateKeys() error = %v", err)
+	}
+	set := new(model.PublicKeySet)
+	if status := s.do(t, "GET", "/v1/galaxy/galaxy/public-key", "", nil, set); status != http.StatusOK || len(set.Keys) != 1 {
+		t.Errorf("Fetching keys returned status %d and %d keys, want 1", status, len(set.Keys))
+	}
+	if _, err := s.auth.Authenticate(first); err == nil {
+		t.Errorf("Authenticate() accepted token signed with removed key")
+	}
+
+	// The keys survive restarts
+	_ = s.db.Close()
+	s, err = New(&Config{DataDir: dir, TokenTTL: time.Hour, KeyRotationInterval: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if _, err := s.auth.Authenticate(second); err != nil {
+		t.Errorf("Authenticate() after restart error = %v", err)
+	}
+}
+
+func TestServer_deployService(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.config.DeployRetryBackoff = time.Millisecond
+	admin := s.login(t, "admin", "admin-key").Token
+
+	// The runner in the first region fails once before applying the service while the one in the second region
+	// rejects the services of the chat project
+	var lock sync.Mutex
+	received := map[string][]string{}
+	runner := func(region string, status func(service *model.Service, attempt int) int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			service := new(model.Service)
+			_ = json.NewDecoder(r.Body).Decode(service)
+
+			lock.Lock()
+			received[region] = append(received[region], service.ProjectID+":"+r.Header.Get("Authorization"))
+			attempt := len(received[region])
+			lock.Unlock()
+
+			w.WriteHeader(status(service, attempt))
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "some error"})
+		}))
+	}
+	gcp := runner("gcp", func(_ *model.Service, attempt int) int {
+		if attempt == 1 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	defer gcp.Close()
+	rejectChat := true
+	aws := runner("aws", func(service *model.Service, _ int) int {
+		lock.Lock()
+		defer lock.Unlock()
+		if rejectChat && service.ProjectID == "chat" {
+			return http.StatusForbidden
+		}
+		return http.StatusOK
+	})
+	defer aws.Close()
+
+	for _, project := range []string{"todo", "chat"} {
+		requests := []struct {
+			path string
+			body interface{}
+		}{
+			{path: "/v1/galaxy/clusters", body: model.Cluster{ID: "gcp", URL: gcp.URL}},
+			{path: "/v1/galaxy/clusters", body: model.Cluster{ID: "aws", URL: aws.URL}},
+			{path: "/v1/galaxy/projects", body: model.Project{ID: project}},
+			{path: "/v1/galaxy/projects/" + project + "/environments", body: model.EnvironmentConfig{ID: "production", Clusters: []string{"gcp", "aws"}}},
+		}
+		for _, req := range requests {
+			if status := s.do(t, "POST", req.path, admin, req.body, nil); status != http.StatusOK {
+				t.Fatalf("POST %s returned status %d", req.path, status)
+			}
+		}
+	}
+
+	// The service is applied in the background and failures of the runners are retried
+	d := new(model.Deployment)
+	if status := s.do(t, "POST", "/v1/galaxy/service", admin, model.Service{ID: "app", ProjectID: "todo", Environment: "production", Version: "v1"}, d); status != http.StatusAccepted {
+		t.Fatalf("Deploying service returned status %d", status)
+	}
+	if d.Status != model.DeploymentPending || d.Service != nil {
+		t.Errorf("Deploying service returned %+v, want a pending deployment without the service", d)
+	}
+	d = s.waitForDeployment(t, admin, d.ID)
+	if d.Status != model.DeploymentSucceeded || len(d.Clusters) != 2 || d.Clusters[0].Attempts != 2 || d.Clusters[1].Attempts != 1 {
+		t.Errorf("Deployment = %+v", d)
+	}
+	if got := received["aws"]; len(got) != 1 || got[0] != "todo:Bearer "+admin {
+		t.Errorf("Runner received %v, want the service along with the token of the caller", got)
+	}
+
+	// Rejected requests aren't retried and the results of the clusters are reported separately
+	partial := new(model.Deployment)
+	if status := s.do(t, "POST", "/v1/galaxy/service", admin, model.Service{ID: "app", ProjectID: "chat", Environment: "production"}, partial); status != http.StatusAccepted {
+		t.Fatalf("Deploying rejected service returned status %d", status)
+	}
+	partial = s.waitForDeployment(t, admin, partial.ID)
+	if partial.Status != model.DeploymentPartial || partial.Clusters[0].Status != model.DeploymentSucceeded || partial.Clusters[1].Status != model.DeploymentFailed ||
+		partial.Clusters[1].Attempts != 1 || partial.Clusters[1].StatusCode != http.StatusForbidden {
+		t.Errorf("Deployment = %+v, clusters %+v %+v", partial, partial.Clusters[0], partial.Clusters[1])
+	}
+
+	// The failed clusters can be retried later on while the successful ones are left alone
+	if status := s.do(t, "POST", "/v1/galaxy/deployments/"+d.ID+"/retry", admin, nil, nil); status != http.StatusBadRequest {
+		t.Errorf("Retrying successful deployment returned status %d, want %d", status, http.StatusBadRequest)
+	}
+	lock.Lock()
+	rejectChat = false
+	gcpReceived := len(received["gcp"])
+	lock.Unlock()
+	if status := s.do(t, "POST", "/v1/galaxy/deployments/"+partial.ID+"/retry", admin, nil, nil); status != http.StatusAccepted {
+		t.Fatalf("Retrying deployment returned status %d", status)
+	}
+	partial = s.waitForDeployment(t, admin, partial.ID)
+	if partial.Status != model.DeploymentSucceeded || partial.Clusters[1].Attempts != 2 || partial.Clusters[1].Error != "" {
+		t.Errorf("Retried deployment = %+v, clusters %+v %+v", partial, partial.Clusters[0], partial.Clusters[1])
+	}
+	if len(received["gcp"]) != gcpReceived {
+		t.Errorf("Retrying deployment applied service to cluster which already succeeded")
+	}
+
+	// The clusters can be narrowed down to the ones of the environment
+	tests := []struct {
+		name   string
+		path   string
+		env    string
+		status int
+	}{
+		{name: "single cluster", path: "/v1/galaxy/service?clusters=aws", env: "production", status: http.StatusAccepted},
+		{name: "cluster of other environment", path: "/v1/galaxy/service?clusters=azure", env: "production", status: http.StatusBadRequest},
+		{name: "unknown environment", path: "/v1/galaxy/service", env: "staging", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := s.do(t, "POST", tt.path, admin, model.Service{ID: "app", ProjectID: "todo", Environment: tt.env}, nil); status != tt.status {
+				t.Errorf("Deploying service returned status %d, want %d", status, tt.status)
+			}
+		})
+	}
+
+	// The deployments are tracked
+	list := struct {
+		Deployments []*model.Deployment `json:"deployments"`
+	}{}
+	s.waitForDeployments(context.Background())
+	if status := s.do(t, "GET", "/v1/galaxy/deployments?project=todo", admin, nil, &list); status != http.StatusOK || len(list.Deployments) != 2 {
+		t.Fatalf("Listing deployments returned status %d and %d deployments, want 2", status, len(list.Deployments))
+	}
+	if list.Deployments[0].ID != d.ID || len(list.Deployments[1].Clusters) != 1 {
+		t.Errorf("Listed deployments %+v %+v", list.Deployments[0], list.Deployments[1])
+	}
+	got := new(model.Deployment)
+	if status := s.do(t, "GET", "/v1/galaxy/deployments/"+partial.ID, admin, nil, got); status != http.StatusOK || got.Status != model.DeploymentSucceeded {
+		t.Errorf("Getting deployment returned status %d and %+v", status, got)
+	}
+}
+
+func TestServer_interruptedDeployments(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	admin := s.login(t, "admin", "admin-key").Token
+
+	// The runner holds on to the request till the deployment gets cancelled
+	runner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer runner.Close()
+
+	requests := []struct {
+		path string
+		body interface{}
+	}{
+		{path: "/v1/galaxy/clusters", body: model.Cluster{ID: "gcp", URL: runner.URL}},
+		{path: "/v1/galaxy/projects", body: model.Project{ID: "todo"}},
+		{path: "/v1/galaxy/projects/todo/environments", body: model.EnvironmentConfig{ID: "production", Clusters: []string{"gcp"}}},
+	}
+	for _, req := range requests {
+		if status := s.do(t, "POST", req.path, admin, req.body, nil); status != http.StatusOK {
+			t.Fatalf("POST %s returned status %d", req.path, status)
+		}
+	}
+
+	d := new(model.Deployment)
+	if status := s.do(t, "POST", "/v1/galaxy/service", admin, model.Service{ID: "app", ProjectID: "todo", Environment: "production"}, d); status != http.StatusAccepted {
+		t.Fatalf("Deploying service returned status %d", status)
+	}
+	if status := s.do(t, "POST", "/v1/galaxy/deployments/"+d.ID+"/retry", admin, nil, nil); status != http.StatusConflict {
+		t.Errorf("Retrying running deployment returned status %d, want %d", status, http.StatusConflict)
+	}
+
+	// Shutting down waits for the deployment till the timeout and then cancels it
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	s.waitForDeployments(ctx)
+	got, err := s.store.GetDeployment(d.ID)
+	if err != nil || got.Status != model.DeploymentFailed || got.Clusters[0].Status != model.DeploymentFailed {
+		t.Errorf("GetDeployment() after shutdown = %+v, error = %v", got, err)
+	}
+
+	// Deployments which were running when the server stopped are marked as failed on the next start
+	got.Status, got.Clusters[0].Status, got.Clusters[0].Error = model.DeploymentPending, model.DeploymentPending, ""
+	if err := s.store.SaveDeployment(got); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.failInterruptedDeployments(); err != nil {
+		t.Fatalf("failInterruptedDeployments() error = %v", err)
+	}
+	got, err = s.store.GetDeployment(d.ID)
+	if err != nil || got.Status != model.DeploymentFailed || got.Clusters[0].Error != errDeploymentInterrupted.Error() || got.CompletedAt == 0 {
+		t.Errorf("GetDeployment() after restart = %+v, error = %v", got, err)
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// StoreType describes where the server persists its resources
+type StoreType string
+
+const (
+	// StoreBadger keeps everything in the embedded badger database
+	StoreBadger StoreType = "badger"
+)
+
+// ErrNotFound is returned by the stores when a resource doesn't exist
+var ErrNotFound = errors.New("resource not found")
+
+// Store is the interface of the modules which persist the resources managed by the server
+type Store interface {
+	GetAccounts() ([]*model.UserAccount, error)
+	GetAccount(id string) (*model.UserAccount, error)
+	SaveAccount(account *model.UserAccount) error
+	DeleteAccount(id string) error
+
+	GetProjects() ([]*model.Project, error)
+	GetProject(id string) (*model.Project, error)
+	SaveProject(project *model.Project) error
+
+	// DeleteProject deletes the environments of the project as well
+	DeleteProject(id string) error
+
+	GetEnvironments(project string) ([]*model.EnvironmentConfig, error)
+	SaveEnvironment(env *model.EnvironmentConfig) error
+	DeleteEnvironment(project, id string) error
+
+	GetClusters() ([]*model.Cluster, error)
+	GetCluster(id string) (*model.Cluster, error)
+	SaveCluster(cluster *model.Cluster) error
+	DeleteCluster(id string) error
+
+	GetSigningKeys() ([]*model.SigningKey, error)
+	SaveSigningKey(key *model.SigningKey) error
+	DeleteSigningKey(id string) error
+
+	// GetDeployments returns the deployments in the order they were created in
+	GetDeployments() ([]*model.Deployment, error)
+	GetDeployment(id string) (*model.Deployment, error)
+	SaveDeployment(deployment *model.Deployment) error
+}
+
+func newStore(storeType StoreType, db *badger.DB) (Store, error) {
+	switch storeType {
+	case StoreBadger, "":
+		return newBadgerStore(db), nil
+	default:
+		return nil, fmt.Errorf("invalid store (%s) provided", storeType)
+	}
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/dgraph-io/badger"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// The prefixes of the keys of the resources. The environments are prefixed with their project as well.
+const (
+	accountPrefix     = "accounts/"
+	projectPrefix     = "projects/"
+	environmentPrefix = "environments/"
+	clusterPrefix     = "clusters/"
+	signingKeyPrefix  = "signing-keys/"
+	deploymentPrefix  = "deployments/"
+)
+
+// badgerStore stores every resource as a json encoded entry in badger
+type badgerStore struct {
+	db *badger.DB
+}
+
+func newBadgerStore(db *badger.DB) *badgerStore {
+	return &badgerStore{db: db}
+}
+
+func (s *badgerStore) get(key string, v interface{}) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, v)
+		})
+	})
+}
+
+func (s *badgerStore) set(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), data)
+	})
+}
+
+// delete removes the key along with all the keys having the given prefixes
+func (s *badgerStore) delete(key string, prefixes ...string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get([]byte(key)); err == badger.ErrKeyNotFound {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+
+		keys := [][]byte{[]byte(key)}
+		for _, prefix := range prefixes {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix, opts.PrefetchValues = []byte(prefix), false
+			it := txn.NewIterator(opts)
+			for it.Rewind(); it.Valid(); it.Next() {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+			it.Close()
+		}
+
+		for _, k := range keys {
+			if err := txn.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// list decodes all the entries having the prefix. The new function returns the value to decode an entry into.
+func (s *badgerStore) list(prefix string, newValue func() interface{}) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			v := newValue()
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, v)
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *badgerStore) GetAccounts() ([]*model.UserAccount, error) {
+	accounts := make([]*model.UserAccount, 0)
+	err := s.list(accountPrefix, func() interface{} {
+		account := new(model.UserAccount)
+		accounts = append(accounts, account)
+		return account
+	})
+	return accounts, err
+}
+
+func (s *badgerStore) GetAccount(id string) (*model.UserAccount, error) {
+	account := new(model.UserAccount)
+	return account, s.get(accountPrefix+id, account)
+}
+
+func (s *badgerStore) SaveAccount(account *model.UserAccount) error {
+	return s.set(accountPrefix+account.ID, account)
+}
+
+func (s *badgerStore) DeleteAccount(id string) error {
+	return s.delete(accountPrefix + id)
+}
+
+func (s *badgerStore) GetProjects() ([]*model.Project, error) {
+	projects := make([]*model.Project, 0)
+	err := s.list(projectPrefix, func() interface{} {
+		project := new(model.Project)
+		projects = append(projects, project)
+		return project
+	})
+	return projects, err
+}
+
+func (s *badgerStore) GetProject(id string) (*model.Project, error) {
+	project := new(model.Project)
+	return project, s.get(projectPrefix+id, project)
+}
+
+func (s *badgerStore) SaveProject(project *model.Project) error {
+	return s.set(projectPrefix+project.ID, project)
+}
+
+func (s *badgerStore) DeleteProject(id string) error {
+	return s.delete(projectPrefix+id, environmentPrefix+id+"/")
+}
+
+func (s *badgerStore) GetEnvironments(project string) ([]*model.EnvironmentConfig, error) {
+	envs := make([]*model.EnvironmentConfig, 0)
+	err := s.list(environmentPrefix+project+"/", func() interface{} {
+		env := new(model.EnvironmentConfig)
+		envs = append(envs, env)
+		return env
+	})
+	return envs, err
+}
+
+func (s *badgerStore) SaveEnvironment(env *model.EnvironmentConfig) error {
+	return s.set(environmentPrefix+env.ProjectID+"/"+env.ID, env)
+}
+
+func (s *badgerStore) DeleteEnvironment(project, id string) error {
+	return s.delete(environmentPrefix + project + "/" + id)
+}
+
+func (s *badgerStore) GetClusters() ([]*model.Cluster, error) {
+	clusters := make([]*model.Cluster, 0)
+	err := s.list(clusterPrefix, func() interface{} {
+		cluster := new(model.Cluster)
+		clusters = append(clusters, cluster)
+		return cluster
+	})
+	return clusters, err
+}
+
+func (s *badgerStore) GetCluster(id string) (*model.Cluster, error) {
+	cluster := new(model.Cluster)
+	return cluster, s.get(clusterPrefix+id, cluster)
+}
+
+func (s *badgerStore) SaveCluster(cluster *model.Cluster) error {
+	return s.set(clusterPrefix+cluster.ID, cluster)
+}
+
+func (s *badgerStore) DeleteCluster(id string) error {
+	return s.delete(clusterPrefix + id)
+}
+
+func (s *badgerStore) GetSigningKeys() ([]*model.SigningKey, error) {
+	keys := make([]*model.SigningKey, 0)
+	err := s.list(signingKeyPrefix, func() interface{} {
+		key := new(model.SigningKey)
+		keys = append(keys, key)
+		return key
+	})
+	return keys, err
+}
+
+func (s *badgerStore) SaveSigningKey(key *model.SigningKey) error {
+	return s.set(signingKeyPrefix+key.ID, key)
+}
+
+func (s *badgerStore) DeleteSigningKey(id string) error {
+	return s.delete(signingKeyPrefix + id)
+}
+
+func (s *badgerStore) GetDeployments() ([]*model.Deployment, error) {
+	deployments := make([]*model.Deployment, 0)
+	if err := s.list(deploymentPrefix, func() interface{} {
+		deployment := new(model.Deployment)
+		deployments = append(deployments, deployment)
+		return deployment
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(deployments, func(i, j int) bool { return deployments[i].CreatedAt < deployments[j].CreatedAt })
+	return deployments, nil
+}
+
+func (s *badgerStore) GetDeployment(id string) (*model.Deployment, error) {
+	deployment := new(model.Deployment)
+	return deployment, s.get(deploymentPrefix+id, deployment)
+}
+
+func (s *badgerStore) SaveDeployment(deployment *model.Deployment) error {
+	return s.set(deploymentPrefix+deployment.ID, deployment)
+}
@@ -0,0 +1,160 @@
+package audit
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/segmentio/ksuid"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// The prefix of the keys of the audit entries. It is followed by the big endian timestamp so that the entries are
+// ordered by time.
+const keyPrefix = "audit/"
+
+// The results of an operation
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Module records the mutating operations in a badger database. The entries expire after the retention period.
+type Module struct {
+	db        *badger.DB
+	retention time.Duration
+
+	// Records the entries in the storage shared by the replicas as well
+	share func(e *model.AuditEntry) error
+}
+
+// New creates a new instance of the audit module
+func New(db *badger.DB, retention time.Duration) *Module {
+	if retention == 0 {
+		retention = 90 * 24 * time.Hour
+	}
+	return &Module{db: db, retention: retention}
+}
+
+// SetSharedStore makes the module record every entry in storage shared with the other replicas as well. The entries
+// recorded by other replicas are added to the local database with Import.
+func (m *Module) SetSharedStore(save func(e *model.AuditEntry) error) {
+	m.share = save
+}
+
+// Retention returns the duration for which the entries are kept
+func (m *Module) Retention() time.Duration {
+	return m.retention
+}
+
+func entryKey(e *model.AuditEntry) []byte {
+	key := make([]byte, 0, len(keyPrefix)+8+len(e.ID))
+	key = append(key, keyPrefix...)
+	key = append(key, tsBytes(e.Ts)...)
+	return append(key, e.ID...)
+}
+
+func tsBytes(ts int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(ts))
+	return b
+}
+
+// Record persists an audit entry. It is recorded in the shared store as well if one was set.
+func (m *Module) Record(e *model.AuditEntry) error {
+	if e.ID == "" {
+		e.ID = ksuid.New().String()
+	}
+	if e.Ts == 0 {
+		e.Ts = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+
+	if err := m.store(e, m.retention); err != nil {
+		return err
+	}
+	if m.share != nil {
+		return m.share(e)
+	}
+	return nil
+}
+
+// Import adds an entry recorded by another replica to the local database. It expires at the same time as the original
+// entry. The entries past the retention period are skipped.
+func (m *Module) Import(e *model.AuditEntry) error {
+	ttl := m.retention - time.Since(time.Unix(0, e.Ts*int64(time.Millisecond)))
+	if ttl <= 0 {
+		return nil
+	}
+	return m.store(e, ttl)
+}
+
+func (m *Module) store(e *model.AuditEntry, ttl time.Duration) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return m.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry(entryKey(e), data).WithTTL(ttl))
+	})
+}
+
+// Query returns the entries matching the query in the order they were recorded. Only the entries the allow function
+// returns true for are considered. All entries are considered if it is nil.
+func (m *Module) Query(q *model.AuditQuery, allow func(e *model.AuditEntry) bool) ([]*model.AuditEntry, error) {
+	entries := make([]*model.AuditEntry, 0)
+	err := m.iterate(q, allow, func(e *model.AuditEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// Export writes the entries matching the query as json lines
+func (m *Module) Export(w io.Writer, q *model.AuditQuery, allow func(e *model.AuditEntry) bool) error {
+	enc := json.NewEncoder(w)
+	return m.iterate(q, allow, func(e *model.AuditEntry) error {
+		return enc.Encode(e)
+	})
+}
+
+func (m *Module) iterate(q *model.AuditQuery, allow func(e *model.AuditEntry) bool, cb func(e *model.AuditEntry) error) error {
+	return m.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(keyPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		count := 0
+		for it.Seek(append([]byte(keyPrefix), tsBytes(q.From)...)); it.ValidForPrefix([]byte(keyPrefix)); it.Next() {
+			e := new(model.AuditEntry)
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, e)
+			}); err != nil {
+				return err
+			}
+
+			if q.To != 0 && e.Ts > q.To {
+				return nil
+			}
+			if !matches(q, e) || (allow != nil && !allow(e)) {
+				continue
+			}
+			if err := cb(e); err != nil {
+				return err
+			}
+
+			count++
+			if q.Limit > 0 && count >= q.Limit {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func matches(q *model.AuditQuery, e *model.AuditEntry) bool {
+	return (q.Actor == "" || q.Actor == e.Actor) && (q.Action == "" || q.Action == e.Action) && (q.Project == "" || q.Project == e.Project)
+}
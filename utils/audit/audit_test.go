@@ -0,0 +1,200 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils"
+)
+
+func newTestModule(t *testing.T) (*Module, func()) {
+	dir, err := ioutil.TempDir("", "galaxy-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := badger.DefaultOptions(dir)
+	opts.Logger = &logrus.Logger{Out: ioutil.Discard}
+	db, err := badger.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(db, time.Hour), func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestModule_Query(t *testing.T) {
+	m, cleanup := newTestModule(t)
+	defer cleanup()
+
+	// Record the entries out of order to check that they are returned by time
+	for _, e := range []*model.AuditEntry{
+		{Ts: 3000, Actor: "bob", Action: "apply-service", Project: "chat"},
+		{Ts: 1000, Actor: "alice", Action: "create-project", Project: "todo"},
+		{Ts: 2000, Actor: "alice", Action: "apply-service", Project: "todo"},
+		{Ts: 4000, Actor: "alice", Action: "apply-service", Project: "todo"},
+	} {
+		if err := m.Record(e); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query model.AuditQuery
+		allow func(e *model.AuditEntry) bool
+		want  []int64
+	}{
+		{name: "all", want: []int64{1000, 2000, 3000, 4000}},
+		{name: "time range", query: model.AuditQuery{From: 2000, To: 3000}, want: []int64{2000, 3000}},
+		{name: "actor and action", query: model.AuditQuery{Actor: "alice", Action: "apply-service"}, want: []int64{2000, 4000}},
+		{name: "project", query: model.AuditQuery{Project: "chat"}, want: []int64{3000}},
+		{name: "limit", query: model.AuditQuery{Limit: 2}, want: []int64{1000, 2000}},
+		{
+			name:  "allowed entries",
+			query: model.AuditQuery{Limit: 1},
+			allow: func(e *model.AuditEntry) bool { return e.Project == "chat" },
+			want:  []int64{3000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := m.Query(&tt.query, tt.allow)
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			if len(entries) != len(tt.want) {
+				t.Fatalf("Query() returned %d entries, want %d", len(entries), len(tt.want))
+			}
+			for i, e := range entries {
+				if e.Ts != tt.want[i] {
+					t.Errorf("Query()[%d].Ts = %d, want %d", i, e.Ts, tt.want[i])
+				}
+			}
+		})
+	}
+
+	// Exports contain one entry per line
+	buf := new(bytes.Buffer)
+	if err := m.Export(buf, &model.AuditQuery{Actor: "alice"}, nil); err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Export() wrote %d lines, want 3", len(lines))
+	}
+	e := new(model.AuditEntry)
+	if err := json.Unmarshal([]byte(lines[0]), e); err != nil || e.Ts != 1000 || e.Action != "create-project" {
+		t.Errorf("Export() first line = %s", lines[0])
+	}
+}
+
+func TestModule_Handler(t *testing.T) {
+	m, cleanup := newTestModule(t)
+	defer cleanup()
+
+	h := m.Handler("apply-service", func(w http.ResponseWriter, r *http.Request) {
+		SetActor(r, "alice", "deployer")
+		SetTarget(r, "todo", "staging", "s1")
+
+		// The handler still gets to read the body
+		service := new(model.Service)
+		if err := json.NewDecoder(r.Body).Decode(service); err != nil {
+			utils.SendErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if service.Environment != "staging" {
+			utils.SendErrorResponse(w, r, http.StatusForbidden, http.ErrNotSupported)
+			return
+		}
+		utils.SendEmptySuccessResponse(w, r)
+	})
+
+	for _, env := range []string{"staging", "production"} {
+		data, _ := json.Marshal(model.Service{ID: "s1", ProjectID: "todo", Environment: env})
+		h(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/galaxy/service", bytes.NewReader(data)))
+	}
+
+	entries, err := m.Query(&model.AuditQuery{}, nil)
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Query() returned %d entries, want 2", len(entries))
+	}
+
+	// Both requests may have been recorded within the same millisecond
+	ok, failed := entries[0], entries[1]
+	if ok.Status != http.StatusOK {
+		ok, failed = failed, ok
+	}
+	if ok.Actor != "alice" || ok.Role != "deployer" || ok.Project != "todo" || ok.Target != "s1" || ok.Method != "POST" || ok.Path != "/v1/galaxy/service" {
+		t.Errorf("Handler() recorded %+v", ok)
+	}
+	if ok.Status != http.StatusOK || ok.Result != ResultSuccess || ok.Error != "" {
+		t.Errorf("Handler() recorded status %d, result %s, error %q for a successful request", ok.Status, ok.Result, ok.Error)
+	}
+	if failed.Status != http.StatusForbidden || failed.Result != ResultFailure || failed.Error != http.ErrNotSupported.Error() {
+		t.Errorf("Handler() recorded status %d, result %s, error %q for a failed request", failed.Status, failed.Result, failed.Error)
+	}
+	if ok.Digest == "" || ok.Digest == failed.Digest {
+		t.Errorf("Handler() recorded digests %q and %q, want distinct digests", ok.Digest, failed.Digest)
+	}
+}
+
+func TestModule_HandlerBodyLimit(t *testing.T) {
+	m, cleanup := newTestModule(t)
+	defer cleanup()
+
+	called := false
+	h := m.Handler("apply-service", func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		utils.SendEmptySuccessResponse(w, r)
+	})
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/v1/galaxy/service", bytes.NewReader(make([]byte, maxBodyBytes+1))))
+	if w.Code != http.StatusRequestEntityTooLarge || called {
+		t.Errorf("Handler() returned status %d for an oversized body and called handler = %v, want %d", w.Code, called, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestModule_Import(t *testing.T) {
+	m, cleanup := newTestModule(t)
+	defer cleanup()
+
+	var shared []*model.AuditEntry
+	m.SetSharedStore(func(e *model.AuditEntry) error {
+		shared = append(shared, e)
+		return nil
+	})
+	if err := m.Record(&model.AuditEntry{Action: "create-project"}); err != nil || len(shared) != 1 {
+		t.Fatalf("Record() shared %d entries, want 1 - %v", len(shared), err)
+	}
+
+	// The entries of other replicas are added unless they have expired
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for _, e := range []*model.AuditEntry{{ID: "recent", Ts: now, Action: "apply-service"}, {ID: "expired", Ts: now - 2*time.Hour.Milliseconds(), Action: "apply-service"}} {
+		if err := m.Import(e); err != nil {
+			t.Fatalf("Import() error = %v", err)
+		}
+	}
+	entries, err := m.Query(&model.AuditQuery{Action: "apply-service"}, nil)
+	if err != nil || len(entries) != 1 || entries[0].ID != "recent" {
+		t.Errorf("Query() = %+v, %v, want the recent entry only", entries, err)
+	}
+}
@@ -0,0 +1,109 @@
+package audit
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils"
+	"github.com/spaceuptech/galaxy/utils/auth"
+)
+
+// The number of entries returned by the audit query endpoint when no limit is provided
+const defaultAuditLimit = 100
+
+// HandleQuery returns a handler which responds with the entries matching the query parameters. Users who aren't admins
+// only get to see the entries of the projects they manage.
+func (m *Module) HandleQuery(a *auth.Module) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		q, allow, status, err := parseQuery(a, r)
+		if err != nil {
+			logrus.Errorf("Failed to query audit log - %s", err.Error())
+			utils.SendErrorResponse(w, r, status, err)
+			return
+		}
+		if q.Limit == 0 {
+			q.Limit = defaultAuditLimit
+		}
+
+		entries, err := m.Query(q, allow)
+		if err != nil {
+			logrus.Errorf("Failed to query audit log - %s", err.Error())
+			utils.SendErrorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		utils.SendResponse(w, r, http.StatusOK, map[string]interface{}{"entries": entries})
+	}
+}
+
+// HandleExport returns a handler which streams the entries matching the query parameters as json lines
+func (m *Module) HandleExport(a *auth.Module) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Close the body of the request
+		defer utils.CloseReaderCloser(r.Body)
+
+		q, allow, status, err := parseQuery(a, r)
+		if err != nil {
+			logrus.Errorf("Failed to export audit log - %s", err.Error())
+			utils.SendErrorResponse(w, r, status, err)
+			return
+		}
+
+		// The entries are streamed as json lines. Errors can't be reported to the client once the response has started.
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		if err := m.Export(w, q, allow); err != nil {
+			logrus.Errorf("Failed to export audit log - %s", err.Error())
+		}
+	}
+}
+
+// parseQuery authenticates the request and parses the query from its parameters. The returned function only allows
+// the entries of the projects the user manages.
+func parseQuery(a *auth.Module, r *http.Request) (*model.AuditQuery, func(e *model.AuditEntry) bool, int, error) {
+	// Verify token
+	claims, err := a.Authenticate(utils.GetToken(r))
+	if err != nil {
+		return nil, nil, http.StatusUnauthorized, err
+	}
+
+	params := r.URL.Query()
+	q := &model.AuditQuery{Actor: params.Get("actor"), Action: params.Get("action"), Project: params.Get("project")}
+	if !claims.Allows(auth.ActionManageProject) {
+		return nil, nil, http.StatusForbidden, auth.ErrForbidden
+	}
+	if q.Project != "" {
+		if err := claims.Authorize(auth.ActionManageProject, q.Project, ""); err != nil {
+			return nil, nil, http.StatusForbidden, err
+		}
+	}
+
+	for key, value := range map[string]*int64{"from": &q.From, "to": &q.To} {
+		if v := params.Get(key); v != "" {
+			ts, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, nil, http.StatusBadRequest, err
+			}
+			*value = ts
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, nil, http.StatusBadRequest, err
+		}
+		q.Limit = limit
+	}
+
+	if claims.IsAdmin() {
+		return q, nil, http.StatusOK, nil
+	}
+	return q, func(e *model.AuditEntry) bool {
+		return claims.Authorize(auth.ActionManageProject, e.Project, "") == nil
+	}, http.StatusOK, nil
+}
@@ -0,0 +1,104 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/spaceuptech/galaxy/model"
+	"github.com/spaceuptech/galaxy/utils"
+)
+
+// The maximum size of the error responses captured in the entries
+const maxErrorBytes = 1024
+
+// The maximum size of the bodies of the audited requests. The body is read before the handler authenticates the
+// request, so it has to be bounded.
+const maxBodyBytes = 4 << 20
+
+type contextKey struct{}
+
+// Handler records an audit entry for every request served by the handler. The handler provides the actor and the
+// target of the operation with SetActor and SetTarget.
+func (m *Module) Handler(action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := &model.AuditEntry{Action: action, Method: r.Method, Path: r.URL.Path, RemoteAddr: r.RemoteAddr}
+
+		// Take a digest of the body and hand a copy of it to the handler
+		if r.Body != nil {
+			data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+			utils.CloseReaderCloser(r.Body)
+			if err != nil {
+				status := http.StatusBadRequest
+				if len(data) >= maxBodyBytes {
+					status = http.StatusRequestEntityTooLarge
+				}
+				utils.SendErrorResponse(w, r, status, err)
+				return
+			}
+			if len(data) > 0 {
+				sum := sha256.Sum256(data)
+				e.Digest = hex.EncodeToString(sum[:])
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		}
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r.WithContext(context.WithValue(r.Context(), contextKey{}, e)))
+
+		e.Status = rec.status
+		e.Result = ResultSuccess
+		if rec.status >= http.StatusBadRequest {
+			e.Result = ResultFailure
+			res := struct {
+				Error string `json:"error"`
+			}{}
+			if json.Unmarshal(rec.body.Bytes(), &res) == nil {
+				e.Error = res.Error
+			}
+		}
+
+		if err := m.Record(e); err != nil {
+			logrus.Errorf("Could not record audit entry of %s %s - %s", r.Method, r.URL.Path, err.Error())
+		}
+	}
+}
+
+// SetActor sets the user or api key performing the operation
+func SetActor(r *http.Request, actor, role string) {
+	if e, ok := r.Context().Value(contextKey{}).(*model.AuditEntry); ok {
+		e.Actor, e.Role = actor, role
+	}
+}
+
+// SetTarget sets the resource the operation is performed on
+func SetTarget(r *http.Request, project, env, target string) {
+	if e, ok := r.Context().Value(contextKey{}).(*model.AuditEntry); ok {
+		e.Project, e.Environment, e.Target = project, env, target
+	}
+}
+
+// recorder captures the status code and the error responses of a handler
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status >= http.StatusBadRequest && r.body.Len() < maxErrorBytes {
+		r.body.Write(b)
+	}
+	return r.ResponseWriter.Write(b)
+}
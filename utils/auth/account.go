@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/segmentio/ksuid"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// The claim marking the tokens handed to the code runners of the cli
+const scopeFile = "file"
+
+// NewAccount creates an account for the request. It returns the access key to be handed out and the account holding
+// the hash to be persisted.
+func NewAccount(req *model.UserAccountRequest) (string, *model.UserAccount, error) {
+	if req.UserName == "" {
+		return "", nil, errors.New("username of account not provided")
+	}
+	if !IsValidRole(req.Role) {
+		return "", nil, errors.New("invalid role provided for account")
+	}
+
+	key, hash, err := NewAccessKey()
+	if err != nil {
+		return "", nil, err
+	}
+	return key, &model.UserAccount{
+		ID:           ksuid.New().String(),
+		UserName:     req.UserName,
+		Role:         req.Role,
+		Projects:     req.Projects,
+		Environments: req.Environments,
+		CreatedAt:    time.Now().Unix(),
+		Hash:         hash,
+	}, nil
+}
+
+// IsValidRole returns true if the role is known
+func IsValidRole(role string) bool {
+	_, p := permissions[Role(role)]
+	return p
+}
+
+// NewAccessKey generates a random access key along with its hash
+func NewAccessKey() (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	key := base64.RawURLEncoding.EncodeToString(secret)
+	return key, hashAPIKeySecret(key), nil
+}
+
+// HashAccessKey returns the hash of an access key chosen by the operator. Unlike the random keys, such keys may be
+// guessed, so they are hashed with bcrypt.
+func HashAccessKey(key string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// missingAccount is verified against when no account exists with the username so that the response takes as long
+// as it does for an existing account. None of the keys match its hash.
+var missingAccount = &model.UserAccount{Hash: "$2a$10$q6nEPrhlEFCwtcC/3QxJXev51IGHRdZU.g5ZKBo61ZiqL08l3m5Vy"}
+
+// VerifyMissingAccessKey spends as much time as verifying the key of an account would. It always returns false.
+func VerifyMissingAccessKey(key string) bool {
+	_ = VerifyAccessKey(missingAccount, key)
+	return false
+}
+
+// VerifyAccessKey checks the access key against the hash stored for the account
+func VerifyAccessKey(account *model.UserAccount, key string) bool {
+	// Keys chosen by the operator are hashed with bcrypt while the random ones use sha256
+	if strings.HasPrefix(account.Hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(account.Hash), []byte(key)) == nil
+	}
+	return account.Hash != "" && subtle.ConstantTimeCompare([]byte(account.Hash), []byte(hashAPIKeySecret(key))) == 1
+}
+
+// SignToken issues a token for the account which is valid for the ttl
+func (m *Module) SignToken(account *model.UserAccount, ttl time.Duration) (string, error) {
+	return m.signToken(account, Role(account.Role), ttl, nil)
+}
+
+// SignFileToken issues the token used by the code runners of the cli. It carries the projects of the account but
+// doesn't grant more than deploying to them, so a leaked token can't be used to manage the projects.
+func (m *Module) SignFileToken(account *model.UserAccount, ttl time.Duration) (string, error) {
+	role := RoleDeployer
+	if !permissions[Role(account.Role)][ActionDeploy] {
+		role = RoleViewer
+	}
+	return m.signToken(account, role, ttl, jwt.MapClaims{"scope": scopeFile})
+}
+
+func (m *Module) signToken(account *model.UserAccount, role Role, ttl time.Duration, extra jwt.MapClaims) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{"id": account.ID, "role": string(role), "iat": now.Unix(), "exp": now.Add(ttl).Unix()}
+	if len(account.Projects) > 0 {
+		claims["projects"] = account.Projects
+	}
+	if len(account.Environments) > 0 {
+		claims["envs"] = account.Environments
+	}
+	for key, val := range extra {
+		claims[key] = val
+	}
+
+	m.lock.RLock()
+	alg, secret := m.config.JWTAlgorithm, m.config.Secret
+	signingKey, kid := m.signingKey, m.signingKeyID
+	m.lock.RUnlock()
+
+	switch alg {
+	case HS256:
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	case RSA256:
+		if signingKey == nil {
+			return "", errors.New("signing key of galaxy server has not been set")
+		}
+		// The key id lets the runners pick the right key while the keys are being rotated
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = kid
+		return token.SignedString(signingKey)
+	}
+	return "", errors.New("tokens can only be signed with the hs256 or rsa256 algorithms")
+}
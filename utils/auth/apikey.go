@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// APIKeyPrefix is the prefix of all api keys. It tells them apart from json web tokens.
+const APIKeyPrefix = "gxk_"
+
+// The minimum time between two reloads of the api keys triggered by unknown keys
+const minAPIKeyReloadInterval = 5 * time.Second
+
+var errInvalidAPIKey = errors.New("invalid api key")
+
+// APIKeyLoader loads all the api keys from the store they are persisted in
+type APIKeyLoader func() ([]*model.APIKey, error)
+
+// SetAPIKeyLoader sets the loader used to reload the api keys when an unknown key is received
+func (m *Module) SetAPIKeyLoader(loader APIKeyLoader) {
+	m.lock.Lock()
+	m.apiKeyLoader = loader
+	m.lock.Unlock()
+}
+
+// SetAPIKeys replaces the api keys accepted by the module
+func (m *Module) SetAPIKeys(keys []*model.APIKey) {
+	apiKeys := make(map[string]*model.APIKey, len(keys))
+	for _, key := range keys {
+		apiKeys[key.ID] = key
+	}
+
+	m.lock.Lock()
+	m.apiKeys = apiKeys
+	m.lock.Unlock()
+}
+
+// NewAPIKey generates a new api key for the request. It returns the key to be handed out and its description holding
+// the hash to be persisted.
+func NewAPIKey(req *model.APIKeyRequest) (string, *model.APIKey, error) {
+	if req.Project == "" {
+		return "", nil, errors.New("project of api key not provided")
+	}
+	role := Role(req.Role)
+	if role == "" {
+		role = RoleDeployer
+	}
+	if _, p := permissions[role]; !p || role == RoleAdmin {
+		return "", nil, errors.New("invalid role provided for api key")
+	}
+
+	// The id is lower case hex since it is used in the names of resources
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	key := &model.APIKey{
+		ID:           hex.EncodeToString(id),
+		Name:         req.Name,
+		Project:      req.Project,
+		Environments: req.Environments,
+		Role:         string(role),
+		CreatedAt:    now.Unix(),
+	}
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			return "", nil, errors.New("invalid expiry provided for api key")
+		}
+		key.ExpiresAt = now.Add(d).Unix()
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	key.Hash = hashAPIKeySecret(encoded)
+
+	return APIKeyPrefix + key.ID + "_" + encoded, key, nil
+}
+
+// The secrets are random, so a plain hash is enough to protect them. There is no need for a slow password hash.
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyAPIKey checks the api key and returns the claims it grants
+func (m *Module) verifyAPIKey(token string) (*Claims, error) {
+	parts := strings.SplitN(strings.TrimPrefix(token, APIKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidAPIKey
+	}
+	id, secret := parts[0], parts[1]
+
+	key := m.getAPIKey(id)
+	if key == nil {
+		// The key may have been created by another runner replica
+		m.reloadAPIKeys()
+		key = m.getAPIKey(id)
+	}
+	if key == nil || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKeySecret(secret))) != 1 {
+		return nil, errInvalidAPIKey
+	}
+	if key.ExpiresAt != 0 && time.Now().Unix() >= key.ExpiresAt {
+		return nil, errors.New("api key has expired")
+	}
+
+	// The id is prefixed so that api keys can be told apart from users in the audit log
+	return &Claims{ID: "api-key:" + key.ID, Role: Role(key.Role), Projects: []string{key.Project}, Environments: key.Environments}, nil
+}
+
+func (m *Module) getAPIKey(id string) *model.APIKey {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.apiKeys[id]
+}
+
+// reloadAPIKeys loads the api keys again unless they have been loaded very recently
+func (m *Module) reloadAPIKeys() {
+	m.lock.RLock()
+	loader := m.apiKeyLoader
+	m.lock.RUnlock()
+	if loader == nil {
+		return
+	}
+
+	m.apiKeyLock.Lock()
+	defer m.apiKeyLock.Unlock()
+	if time.Since(m.lastAPIKeyReload) < minAPIKeyReloadInterval {
+		return
+	}
+	m.lastAPIKeyReload = time.Now()
+
+	keys, err := loader()
+	if err != nil {
+		return
+	}
+	m.SetAPIKeys(keys)
+}
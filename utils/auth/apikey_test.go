@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+func TestNewAPIKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      *model.APIKeyRequest
+		wantRole Role
+		wantErr  bool
+	}{
+		{name: "default role", req: &model.APIKeyRequest{Project: "todo"}, wantRole: RoleDeployer},
+		{name: "viewer with expiry", req: &model.APIKeyRequest{Project: "todo", Role: "viewer", ExpiresIn: "24h"}, wantRole: RoleViewer},
+		{name: "without project", req: &model.APIKeyRequest{}, wantErr: true},
+		{name: "admin role", req: &model.APIKeyRequest{Project: "todo", Role: "admin"}, wantErr: true},
+		{name: "unknown role", req: &model.APIKeyRequest{Project: "todo", Role: "root"}, wantErr: true},
+		{name: "invalid expiry", req: &model.APIKeyRequest{Project: "todo", ExpiresIn: "-1h"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, apiKey, err := NewAPIKey(tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewAPIKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if Role(apiKey.Role) != tt.wantRole {
+				t.Errorf("NewAPIKey() role = %s, want %s", apiKey.Role, tt.wantRole)
+			}
+			if !strings.HasPrefix(key, APIKeyPrefix+apiKey.ID+"_") {
+				t.Errorf("NewAPIKey() key = %s, want prefix %s", key, APIKeyPrefix+apiKey.ID)
+			}
+			if strings.Contains(apiKey.Hash, strings.TrimPrefix(key, APIKeyPrefix+apiKey.ID+"_")) {
+				t.Errorf("NewAPIKey() stores the secret of the key")
+			}
+			if (tt.req.ExpiresIn != "") != (apiKey.ExpiresAt != 0) {
+				t.Errorf("NewAPIKey() expiry = %d for request expiring in %q", apiKey.ExpiresAt, tt.req.ExpiresIn)
+			}
+		})
+	}
+}
+
+func TestModule_Authenticate_apiKey(t *testing.T) {
+	m, err := New(&Config{JWTAlgorithm: HS256, Secret: "some-secret"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	key, apiKey, err := NewAPIKey(&model.APIKeyRequest{Project: "todo", Environments: []string{"staging"}})
+	if err != nil {
+		t.Fatalf("NewAPIKey() error = %v", err)
+	}
+	expiredKey, expired, err := NewAPIKey(&model.APIKeyRequest{Project: "todo", ExpiresIn: "1h"})
+	if err != nil {
+		t.Fatalf("NewAPIKey() error = %v", err)
+	}
+	expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+
+	// The keys are only known to the store at first
+	store := []*model.APIKey{apiKey, expired}
+	loads := 0
+	m.SetAPIKeyLoader(func() ([]*model.APIKey, error) {
+		loads++
+		return store, nil
+	})
+
+	claims, err := m.Authenticate(key)
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if claims.Role != RoleDeployer || claims.Authorize(ActionDeploy, "todo", "staging") != nil || claims.Authorize(ActionDeploy, "todo", "production") == nil {
+		t.Errorf("Authenticate() returned claims %+v which don't match the key", claims)
+	}
+
+	for name, token := range map[string]string{
+		"expired key":  expiredKey,
+		"wrong secret": APIKeyPrefix + apiKey.ID + "_secret",
+		"unknown key":  APIKeyPrefix + "unknown_secret",
+		"malformed":    APIKeyPrefix + "malformed",
+	} {
+		if _, err := m.Authenticate(token); err == nil {
+			t.Errorf("Authenticate() accepted %s", name)
+		}
+	}
+
+	// Unknown keys don't reload the keys more than once within the interval
+	if loads != 1 {
+		t.Errorf("Keys loaded %d times, want 1", loads)
+	}
+
+	// Revoked keys are rejected once the keys are synced
+	m.SetAPIKeys(nil)
+	if _, err := m.Authenticate(key); err == nil {
+		t.Errorf("Authenticate() accepted revoked key")
+	}
+}
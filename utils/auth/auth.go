@@ -1,9 +1,13 @@
 package auth
 
 import (
+	"crypto"
 	"crypto/rsa"
 	"errors"
 	"sync"
+	"time"
+
+	"github.com/spaceuptech/galaxy/model"
 )
 
 // Module manages the auth module
@@ -12,17 +16,47 @@ type Module struct {
 
 	// For internal use
 	config *Config
+
+	// The public keys of the galaxy server keyed by their id
+	keys        map[string]crypto.PublicKey
+	refreshLock sync.Mutex
+	lastRefresh time.Time
+
+	// The key the galaxy server signs tokens with along with the public keys it publishes
+	signingKey   *rsa.PrivateKey
+	signingKeyID string
+	publicKeySet *model.PublicKeySet
+
+	// For the proxy tokens
+	previousSecretExpiry time.Time
+	revoked              map[string]struct{}
+
+	// The api keys keyed by their id
+	apiKeys          map[string]*model.APIKey
+	apiKeyLoader     APIKeyLoader
+	apiKeyLock       sync.Mutex
+	lastAPIKeyReload time.Time
 }
 
 // Config is the object used to configure the auth module
 type Config struct {
 	// JWT related stuff
 	JWTAlgorithm JWTAlgorithm
-	PublicKey    *rsa.PublicKey // for RSA
-	Secret       string         // for HSA
-
-	// For proxy authentication
-	ProxySecret string
+	PublicKey    crypto.PublicKey // for RSA, ES256 and EdDSA
+	Secret       string           // for HSA
+
+	// The source of the public keys of the galaxy server. The keys are loaded from the file if provided or fetched
+	// from the url otherwise. Both can either contain a pem encoded public key or a json web key set.
+	KeyURL             string
+	KeyFile            string
+	KeyRefreshInterval time.Duration
+
+	// For proxy authentication. The tokens signed with the previous secret continue to be accepted for the grace
+	// period after a rotation.
+	ProxySecret            string
+	PreviousProxySecret    string
+	ProxySecretGracePeriod time.Duration
+	ProxyTokenTTL          time.Duration
 
 	Mode OperatingMode
 }
@@ -36,8 +70,22 @@ const (
 
 	// HS256 is used for hs256 algorithm
 	HS256 JWTAlgorithm = "hs256"
+
+	// ES256 is used for ecdsa with the p-256 curve
+	ES256 JWTAlgorithm = "es256"
+
+	// EdDSA is used for ed25519
+	EdDSA JWTAlgorithm = "eddsa"
 )
 
+// DefaultKeyURL is the url the public keys of the galaxy server are fetched from by default
+const DefaultKeyURL = "https://api.spaceuptech.com/v1/galaxy/galaxy/public-key"
+
+// isAsymmetric returns true if the tokens are verified with the public keys of the galaxy server
+func (a JWTAlgorithm) isAsymmetric() bool {
+	return a == RSA256 || a == ES256 || a == EdDSA
+}
+
 // OperatingMode indicates the mode of operation
 type OperatingMode string
 
@@ -52,15 +100,32 @@ const (
 // New creates a new instance of the auth module
 func New(config *Config) (*Module, error) {
 	m := &Module{config: config}
+	if config.KeyURL == "" {
+		config.KeyURL = DefaultKeyURL
+	}
+	if config.KeyRefreshInterval == 0 {
+		config.KeyRefreshInterval = 24 * time.Hour
+	}
+	if config.ProxyTokenTTL == 0 {
+		config.ProxyTokenTTL = 24 * time.Hour
+	}
+
+	// By default, the previous secret is accepted till the tokens signed with it would have expired anyway
+	if config.PreviousProxySecret != "" {
+		if config.ProxySecretGracePeriod == 0 {
+			config.ProxySecretGracePeriod = config.ProxyTokenTTL
+		}
+		m.previousSecretExpiry = time.Now().Add(config.ProxySecretGracePeriod)
+	}
 
-	// The runner needs to fetch the public key from the server for rsa
-	if config.JWTAlgorithm == RSA256 && config.Mode == "runner" {
-		// Attempt fetching public key
-		if success := m.fetchPublicKey(); !success {
+	// The runner needs to load the public keys of the server for asymmetric algorithms
+	if config.JWTAlgorithm.isAsymmetric() && config.Mode == Runner {
+		// Attempt loading the public keys
+		if success := m.loadPublicKeys(); !success {
 			return nil, errors.New("could not initialise the auth module")
 		}
 
-		// Start the public key fetch routine
+		// Start the public key refresh routine
 		go m.routineGetPublicKey()
 	}
 
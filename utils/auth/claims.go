@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Role describes the role of the user a token has been issued to
+type Role string
+
+const (
+	// RoleAdmin has complete access to all the projects
+	RoleAdmin Role = "admin"
+
+	// RoleProjectAdmin has complete access to the projects it has been granted
+	RoleProjectAdmin Role = "project-admin"
+
+	// RoleDeployer can deploy services to and read the projects it has been granted
+	RoleDeployer Role = "deployer"
+
+	// RoleViewer can only read the projects it has been granted
+	RoleViewer Role = "viewer"
+)
+
+// Action describes the operation which needs to be authorized
+type Action string
+
+const (
+	// ActionRead is used for reading services and their metrics
+	ActionRead Action = "read"
+
+	// ActionDeploy is used for applying services
+	ActionDeploy Action = "deploy"
+
+	// ActionManageProject is used for creating projects
+	ActionManageProject Action = "manage-project"
+
+	// ActionManageServices is used for managed services like databases
+	ActionManageServices Action = "manage-services"
+
+	// ActionManageProxies is used for revoking the tokens of the metrics proxies
+	ActionManageProxies Action = "manage-proxies"
+
+	// ActionManageAccounts is used for managing the accounts of the galaxy server
+	ActionManageAccounts Action = "manage-accounts"
+
+	// ActionManageClusters is used for registering clusters with the galaxy server
+	ActionManageClusters Action = "manage-clusters"
+)
+
+// The actions each role is allowed to perform
+var permissions = map[Role]map[Action]bool{
+	RoleAdmin: {
+		ActionRead: true, ActionDeploy: true, ActionManageProject: true, ActionManageServices: true, ActionManageProxies: true,
+		ActionManageAccounts: true, ActionManageClusters: true,
+	},
+	RoleProjectAdmin: {ActionRead: true, ActionDeploy: true, ActionManageProject: true, ActionManageServices: true},
+	RoleDeployer:     {ActionRead: true, ActionDeploy: true},
+	RoleViewer:       {ActionRead: true},
+}
+
+// The wildcard which grants access to all projects or environments
+const wildcard = "*"
+
+// ErrForbidden is returned when a valid token isn't allowed to perform an action
+var ErrForbidden = errors.New("token is not authorized to perform this operation")
+
+// Claims are the claims of a token used to access the runner. The token grants the role access to the listed projects
+// and environments. An empty list of environments grants access to all the environments of those projects.
+type Claims struct {
+	ID           string
+	Role         Role
+	Projects     []string
+	Environments []string
+}
+
+// ParseClaims extracts the claims of a verified token
+func ParseClaims(claims map[string]interface{}) (*Claims, error) {
+	c := new(Claims)
+	c.ID, _ = claims["id"].(string)
+
+	role, _ := claims["role"].(string)
+	c.Role = Role(role)
+	if _, p := permissions[c.Role]; !p {
+		return nil, fmt.Errorf("token does not contain a valid role (%s)", role)
+	}
+
+	var err error
+	if c.Projects, err = getStringSlice(claims, "projects"); err != nil {
+		return nil, err
+	}
+	if c.Environments, err = getStringSlice(claims, "envs"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func getStringSlice(claims map[string]interface{}, key string) ([]string, error) {
+	v, p := claims[key]
+	if !p {
+		return nil, nil
+	}
+
+	values, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("token contains invalid claim (%s)", key)
+	}
+
+	arr := make([]string, len(values))
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("token contains invalid claim (%s)", key)
+		}
+		arr[i] = s
+	}
+	return arr, nil
+}
+
+// IsAdmin returns true if the claims belong to an admin
+func (c *Claims) IsAdmin() bool {
+	return c.Role == RoleAdmin
+}
+
+// Allows returns true if the role of the claims permits the action on any of the projects it has access to
+func (c *Claims) Allows(action Action) bool {
+	return permissions[c.Role][action]
+}
+
+// Authorize checks if the claims allow the action to be performed on the environment of a project. An empty
+// environment only checks access to the project.
+func (c *Claims) Authorize(action Action, project, env string) error {
+	if !c.Allows(action) {
+		return ErrForbidden
+	}
+	if c.IsAdmin() {
+		return nil
+	}
+
+	if !contains(c.Projects, project) {
+		return ErrForbidden
+	}
+	if env != "" && len(c.Environments) > 0 && !contains(c.Environments, env) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// AuthorizeProject checks if the claims allow the action to be performed on the project as a whole. Such actions
+// affect all the environments of the project, so claims restricted to some of them are rejected.
+func (c *Claims) AuthorizeProject(action Action, project string) error {
+	if err := c.Authorize(action, project, ""); err != nil {
+		return err
+	}
+	if !c.IsAdmin() && len(c.Environments) > 0 {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// DefaultProject returns the project to use when the request doesn't specify one. It is only available when the
+// claims grant access to a single project.
+func (c *Claims) DefaultProject() (string, bool) {
+	if c.IsAdmin() || len(c.Projects) != 1 || c.Projects[0] == wildcard {
+		return "", false
+	}
+	return c.Projects[0], true
+}
+
+func contains(arr []string, value string) bool {
+	for _, v := range arr {
+		if v == wildcard || v == value {
+			return true
+		}
+	}
+	return false
+}
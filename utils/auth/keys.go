@@ -1,81 +1,299 @@
 package auth
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/sirupsen/logrus"
 
 	"github.com/spaceuptech/galaxy/model"
 )
 
-func (m *Module) setPublicKey(pemData string) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// The minimum time between two refreshes of the public keys triggered by tokens signed with an unknown key
+const minKeyRefreshInterval = time.Minute
 
-	block, _ := pem.Decode([]byte(pemData))
-	if block == nil {
-		return errors.New("failed to parse PEM block containing the key")
+// We need to retrieve the public keys used by the galaxy server instance. This needs to be done on a periodic
+// basis since the server may generate new pair of public private keys.
+func (m *Module) routineGetPublicKey() {
+	ticker := time.NewTicker(m.config.KeyRefreshInterval)
+	for range ticker.C {
+		m.refreshLock.Lock()
+		m.loadPublicKeys()
+		m.refreshLock.Unlock()
 	}
+}
 
-	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
-	if err != nil {
-		return err
+// refreshPublicKeys loads the public keys again unless they have been loaded very recently. It gets invoked when a
+// token signed by an unknown key is received since the server may have rotated its keys.
+func (m *Module) refreshPublicKeys() {
+	// Only runners load the keys of the server
+	if m.config.Mode != Runner {
+		return
 	}
 
-	key, ok := pub.(*rsa.PublicKey)
+	m.refreshLock.Lock()
+	defer m.refreshLock.Unlock()
 
-	if !ok {
-		return errors.New("key type is not a RSA public key")
+	if time.Since(m.lastRefresh) < minKeyRefreshInterval {
+		return
 	}
-
-	// Set the public key
-	m.config.PublicKey = key
-	logrus.Infoln("Public key of galaxy server set successfully")
-	return nil
+	m.loadPublicKeys()
 }
 
-// We need to retrieve the public key used by the galaxy server instance. This needs to be done on a periodic
-// basis since the server may generate new pair of public private keys. Let's call this once a week
-func (m *Module) routineGetPublicKey() {
-	ticker := time.NewTicker(168 * time.Hour)
-	for range ticker.C {
-		m.fetchPublicKey()
+// loadPublicKeys loads the public keys from the configured file or url. The caller must hold the refresh lock.
+func (m *Module) loadPublicKeys() (success bool) {
+	m.lastRefresh = time.Now()
+
+	source := m.config.KeyURL
+	var data []byte
+	var err error
+	if m.config.KeyFile != "" {
+		source = m.config.KeyFile
+		data, err = ioutil.ReadFile(m.config.KeyFile)
+	} else {
+		data, err = fetchPublicKeys(m.config.KeyURL)
+	}
+	if err != nil {
+		logrus.Errorf("Could not fetch galaxy public keys from (%s) - %s", source, err.Error())
+		return false
+	}
+
+	keys, err := parsePublicKeys(data)
+	if err != nil {
+		logrus.Errorf("Could not parse galaxy public keys from (%s) - %s", source, err.Error())
+		return false
 	}
+
+	m.lock.Lock()
+	m.keys = keys
+	m.lock.Unlock()
+
+	logrus.Infof("Loaded %d public key(s) of galaxy server from (%s)", len(keys), source)
+	return true
 }
 
-func (m *Module) fetchPublicKey() (success bool) {
+func fetchPublicKeys(url string) ([]byte, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", "http://api.spaceuptech.com/v1/galaxy/galaxy/public-key", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		logrus.Errorf("Could not fetch galaxy public key - %s", err.Error())
-		return false
+		return nil, err
 	}
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		logrus.Errorf("Could not fetch galaxy public key - %s", err.Error())
-		return false
+		return nil, err
 	}
+	defer func() { _ = res.Body.Close() }()
 
-	publicKey := new(model.PublicKeyPayload)
-	if err := json.NewDecoder(res.Body).Decode(publicKey); err != nil {
-		logrus.Errorf("Could not decode galaxy public key payload - %s", err.Error())
-		return false
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server responded with status code %d", res.StatusCode)
 	}
+	return ioutil.ReadAll(res.Body)
+}
 
-	if err := m.setPublicKey(publicKey.PemData); err != nil {
-		logrus.Errorf("Could not parse galaxy public key - %s", err.Error())
-		return false
+// getPublicKey returns the public key with the provided id. Tokens without a key id are verified with the key
+// without an id or the only key available.
+func (m *Module) getPublicKey(kid string) crypto.PublicKey {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if key, p := m.keys[kid]; p {
+		return key
+	}
+	if kid != "" {
+		return nil
+	}
+	if len(m.keys) == 1 {
+		for _, key := range m.keys {
+			return key
+		}
+	}
+	if len(m.keys) == 0 && m.config.PublicKey != nil {
+		return m.config.PublicKey
 	}
+	return nil
+}
 
-	return true
+// parsePublicKeys parses either a json web key set, the json payload holding a pem encoded key or pem encoded keys.
+// The pem blocks may carry the id of the key in a `kid` header.
+func parsePublicKeys(data []byte) (map[string]crypto.PublicKey, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("{")) {
+		payload := model.PublicKeySet{}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return nil, err
+		}
+		if len(payload.Keys) > 0 {
+			return parseJWKS(&payload.JWKS)
+		}
+		data = []byte(payload.PemData)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key crypto.PublicKey
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		kid := block.Headers["kid"]
+		if _, p := keys[kid]; p {
+			return nil, fmt.Errorf("multiple keys with id (%s) provided", kid)
+		}
+		keys[kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("failed to parse PEM block containing the key")
+	}
+	return keys, nil
+}
+
+// parseJWKS returns the signing keys of a json web key set. Keys of unsupported types are skipped.
+func parseJWKS(jwks *model.JWKS) (map[string]crypto.PublicKey, error) {
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := parseJWK(&jwk)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key (%s) - %s", jwk.Kid, err.Error())
+		}
+		if key == nil {
+			logrus.Debugf("Skipping key (%s) of unsupported type (%s)", jwk.Kid, jwk.Kty)
+			continue
+		}
+		if _, p := keys[jwk.Kid]; p {
+			return nil, fmt.Errorf("multiple keys with id (%s) provided", jwk.Kid)
+		}
+		keys[jwk.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("key set does not contain any signing keys")
+	}
+	return keys, nil
+}
+
+// parseJWK returns the public key described by a json web key. It returns nil if the key type isn't supported.
+func parseJWK(jwk *model.JWK) (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve (%s)", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve (%s)", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("missing key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// NewJWK returns the json web key of a public key
+func NewJWK(kid string, key crypto.PublicKey) (model.JWK, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return model.JWK{Kty: "RSA", Kid: kid, Use: "sig", Alg: jwt.SigningMethodRS256.Alg(), N: encode(k.N.Bytes()), E: encode(big.NewInt(int64(k.E)).Bytes())}, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return model.JWK{}, errors.New("unsupported curve")
+		}
+		// The coordinates must be padded to the size of the curve
+		pad := func(n *big.Int) []byte {
+			b := n.Bytes()
+			return append(make([]byte, 32-len(b)), b...)
+		}
+		return model.JWK{Kty: "EC", Kid: kid, Use: "sig", Alg: jwt.SigningMethodES256.Alg(), Crv: "P-256", X: encode(pad(k.X)), Y: encode(pad(k.Y))}, nil
+	case ed25519.PublicKey:
+		return model.JWK{Kty: "OKP", Kid: kid, Use: "sig", Alg: SigningMethodEdDSA.Alg(), Crv: "Ed25519", X: encode(k)}, nil
+	}
+	return model.JWK{}, errors.New("unsupported key type")
 }
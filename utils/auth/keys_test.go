@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+func generateKeys(t *testing.T) (*rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate rsa key - %s", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate ecdsa key - %s", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate ed25519 key - %s", err)
+	}
+	return rsaKey, ecKey, edKey
+}
+
+func encodePEM(t *testing.T, kid string, key crypto.PublicKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("Could not marshal public key - %s", err)
+	}
+	block := &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	if kid != "" {
+		block.Headers = map[string]string{"kid": kid}
+	}
+	return pem.EncodeToMemory(block)
+}
+
+func encodeJWKS(t *testing.T, keys map[string]crypto.PublicKey) []byte {
+	jwks := new(model.JWKS)
+	for kid, key := range keys {
+		jwk, err := NewJWK(kid, key)
+		if err != nil {
+			t.Fatalf("NewJWK() error = %v", err)
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	data, _ := json.Marshal(jwks)
+	return data
+}
+
+func TestParsePublicKeys(t *testing.T) {
+	rsaKey, ecKey, edKey := generateKeys(t)
+	legacy, _ := json.Marshal(model.PublicKeyPayload{PemData: string(encodePEM(t, "", &rsaKey.PublicKey))})
+	edJWK, _ := NewJWK("ed", edKey.Public())
+	mixed, _ := json.Marshal(model.JWKS{Keys: []model.JWK{{Kty: "RSA", Kid: "enc", Use: "enc"}, {Kty: "oct", Kid: "sym"}, edJWK}})
+
+	tests := []struct {
+		name    string
+		data    []byte
+		kids    []string
+		wantErr bool
+	}{
+		{name: "legacy pem payload", data: legacy, kids: []string{""}},
+		{name: "single pem key", data: encodePEM(t, "", &ecKey.PublicKey), kids: []string{""}},
+		{name: "multiple pem keys with ids", data: append(encodePEM(t, "a", &rsaKey.PublicKey), encodePEM(t, "b", edKey.Public())...), kids: []string{"a", "b"}},
+		{name: "multiple pem keys without ids", data: append(encodePEM(t, "", &rsaKey.PublicKey), encodePEM(t, "", edKey.Public())...), wantErr: true},
+		{name: "jwks", data: encodeJWKS(t, map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey, "ed": edKey.Public()}), kids: []string{"rsa", "ec", "ed"}},
+		{name: "jwks skips encryption and unsupported keys", data: mixed, kids: []string{"ed"}},
+		{name: "jwks with invalid point", data: []byte(`{"keys":[{"kty":"EC","kid":"ec","crv":"P-256","x":"AQ","y":"AQ"}]}`), wantErr: true},
+		{name: "garbage", data: []byte("not a key"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parsePublicKeys(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePublicKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(keys) != len(tt.kids) {
+				t.Errorf("parsePublicKeys() returned %d keys, want %d", len(keys), len(tt.kids))
+			}
+			for _, kid := range tt.kids {
+				if _, p := keys[kid]; !p {
+					t.Errorf("parsePublicKeys() did not return key (%s)", kid)
+				}
+			}
+		})
+	}
+}
+
+func TestModule_VerifyToken_keySources(t *testing.T) {
+	rsaKey, ecKey, edKey := generateKeys(t)
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		token := jwt.NewWithClaims(method, jwt.MapClaims{"role": "admin"})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("Could not sign token - %s", err)
+		}
+		return s
+	}
+
+	dir, err := ioutil.TempDir("", "galaxy-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	writeFile := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	jwksFile := writeFile("jwks.json", encodeJWKS(t, map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey, "ed": edKey.Public()}))
+	pemFile := writeFile("key.pem", encodePEM(t, "", edKey.Public()))
+
+	tests := []struct {
+		name    string
+		algo    JWTAlgorithm
+		file    string
+		token   string
+		wantErr bool
+	}{
+		{name: "rs256 token from jwks file", algo: RSA256, file: jwksFile, token: sign(jwt.SigningMethodRS256, "rsa", rsaKey)},
+		{name: "es256 token from jwks file", algo: ES256, file: jwksFile, token: sign(jwt.SigningMethodES256, "ec", ecKey)},
+		{name: "eddsa token from jwks file", algo: EdDSA, file: jwksFile, token: sign(SigningMethodEdDSA, "ed", edKey)},
+		{name: "eddsa token without kid from pem file", algo: EdDSA, file: pemFile, token: sign(SigningMethodEdDSA, "", edKey)},
+		{name: "token without kid with multiple keys", algo: EdDSA, file: jwksFile, token: sign(SigningMethodEdDSA, "", edKey), wantErr: true},
+		{name: "token with unknown kid", algo: EdDSA, file: jwksFile, token: sign(SigningMethodEdDSA, "other", edKey), wantErr: true},
+		{name: "token signed with key of another type", algo: ES256, file: jwksFile, token: sign(jwt.SigningMethodES256, "rsa", ecKey), wantErr: true},
+		{name: "token with algorithm not configured", algo: RSA256, file: jwksFile, token: sign(jwt.SigningMethodES256, "ec", ecKey), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(&Config{Mode: Runner, JWTAlgorithm: tt.algo, KeyFile: tt.file})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			if _, err := m.VerifyToken(tt.token); (err != nil) != tt.wantErr {
+				t.Errorf("VerifyToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestModule_VerifyToken_refreshOnUnknownKid(t *testing.T) {
+	_, oldKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, newKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server starts serving the new key after it has been rotated
+	var lock sync.Mutex
+	keys := map[string]crypto.PublicKey{"old": oldKey.Public()}
+	fetches := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		fetches++
+		_, _ = w.Write(encodeJWKS(t, keys))
+	}))
+	defer s.Close()
+
+	m, err := New(&Config{Mode: Runner, JWTAlgorithm: EdDSA, KeyURL: s.URL, KeyRefreshInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	sign := func(kid string, key ed25519.PrivateKey) string {
+		token := jwt.NewWithClaims(SigningMethodEdDSA, jwt.MapClaims{"role": "admin"})
+		token.Header["kid"] = kid
+		str, _ := token.SignedString(key)
+		return str
+	}
+
+	if _, err := m.VerifyToken(sign("old", oldKey)); err != nil {
+		t.Fatalf("VerifyToken() error = %v", err)
+	}
+
+	lock.Lock()
+	keys = map[string]crypto.PublicKey{"old": oldKey.Public(), "new": newKey.Public()}
+	lock.Unlock()
+
+	// The keys were loaded too recently to be refreshed
+	if _, err := m.VerifyToken(sign("new", newKey)); err == nil {
+		t.Fatalf("VerifyToken() verified token while keys were refreshed too recently")
+	}
+
+	m.refreshLock.Lock()
+	m.lastRefresh = time.Now().Add(-2 * minKeyRefreshInterval)
+	m.refreshLock.Unlock()
+	if _, err := m.VerifyToken(sign("new", newKey)); err != nil {
+		t.Fatalf("VerifyToken() error = %v after key rotation", err)
+	}
+
+	// Tokens signed with unknown keys don't trigger more than one refresh within the interval
+	for i := 0; i < 5; i++ {
+		if _, err := m.VerifyToken(sign("unknown", newKey)); err == nil {
+			t.Fatalf("VerifyToken() verified token with unknown key")
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if fetches != 2 {
+		t.Errorf("Keys fetched %d times, want 2", fetches)
+	}
+}
@@ -1,49 +1,222 @@
 package auth
 
 import (
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
+const (
+	roleRunner = "runner"
+	roleAgent  = "agent"
+)
+
+// The audiences of the tokens used internally. They prevent the token of a proxy from being used by a runner replica
+// and vice versa.
+const (
+	audienceProxy  = "galaxy-proxy"
+	audienceRunner = "galaxy-runner"
+)
+
+// The scheme of the uri SAN identifying the service of a proxy which authenticates with a client certificate
+const certificateURIScheme = "galaxy"
+
+// The claims set while signing a token. They are dropped when a token is renewed.
+var registeredClaims = []string{"iat", "exp", "aud"}
+
 // VerifyProxyToken is used for authenticating websocket requests from metrics proxy
 func (m *Module) VerifyProxyToken(token string) (map[string]interface{}, error) {
-	// Parse the JWT token
-	tokenObj, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+	return m.verifyInternalToken(token, audienceProxy)
+}
 
-		// Don't forget to validate the alg is what you expect:
-		if token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
-			return nil, errors.New("invalid signing method")
+// VerifyProxyCertificate returns the claims of a metrics proxy which authenticated with a client certificate instead of
+// a token. The certificate needs to have been verified by the tls layer already. Its common name is the id of the proxy
+// and the uri SAN galaxy://<project>/<env>/<service>/<version> identifies the service. Node agents use galaxy://agent
+// instead.
+func (m *Module) VerifyProxyCertificate(cert *x509.Certificate) (map[string]interface{}, error) {
+	id := cert.Subject.CommonName
+	if id == "" {
+		return nil, errors.New("certificate does not have a common name")
+	}
+	if m.IsRevoked(id) {
+		return nil, errors.New("certificate has been revoked")
+	}
+
+	// The connection is closed once the certificate expires just like it is for tokens
+	claims := map[string]interface{}{"id": id, "exp": float64(cert.NotAfter.Unix())}
+	for _, u := range cert.URIs {
+		if u.Scheme != certificateURIScheme {
+			continue
+		}
+		if u.Host == roleAgent && strings.Trim(u.Path, "/") == "" {
+			claims["role"] = roleAgent
+			return claims, nil
 		}
 
-		// Return the key
-		return []byte(m.config.ProxySecret), nil
-	})
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if u.Host == "" || len(parts) != 3 {
+			return nil, fmt.Errorf("invalid uri (%s) provided in certificate", u)
+		}
+		claims["project"], claims["env"], claims["service"], claims["version"] = u.Host, parts[0], parts[1], parts[2]
+		return claims, nil
+	}
+	return nil, errors.New("certificate does not identify a service")
+}
+
+// verifyInternalToken verifies a token signed with the proxy secret. The previous secret is accepted till the end of
+// its grace period so that the tokens issued before a rotation continue to work till they get renewed.
+func (m *Module) verifyInternalToken(token, audience string) (map[string]interface{}, error) {
+	m.lock.RLock()
+	secret, previous := m.config.ProxySecret, m.config.PreviousProxySecret
+	if time.Now().After(m.previousSecretExpiry) {
+		previous = ""
+	}
+	m.lock.RUnlock()
+
+	tokenObj, err := parseHS256(token, secret)
+	if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&jwt.ValidationErrorSignatureInvalid != 0 && previous != "" {
+		tokenObj, err = parseHS256(token, previous)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	// Get the claims
-	if claims, ok := tokenObj.Claims.(jwt.MapClaims); ok && tokenObj.Valid {
-		tokenClaims := make(map[string]interface{}, len(claims))
-		for key, val := range claims {
-			tokenClaims[key] = val
-		}
+	claims, ok := tokenObj.Claims.(jwt.MapClaims)
+	if !ok || !tokenObj.Valid {
+		return nil, errors.New("token could not be verified")
+	}
 
-		return tokenClaims, nil
+	// Tokens which never expire aren't accepted anymore
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("token does not have a valid expiry")
+	}
+	if !claims.VerifyAudience(audience, true) {
+		return nil, errors.New("token is not meant for this audience")
+	}
+	if id, _ := claims["id"].(string); m.IsRevoked(id) {
+		return nil, errors.New("token has been revoked")
 	}
 
-	return nil, errors.New("token could not be verified")
+	tokenClaims := make(map[string]interface{}, len(claims))
+	for key, val := range claims {
+		tokenClaims[key] = val
+	}
+	return tokenClaims, nil
+}
+
+func parseHS256(token, secret string) (*jwt.Token, error) {
+	return jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		// Don't forget to validate the alg is what you expect:
+		if token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+			return nil, errors.New("invalid signing method")
+		}
+
+		// Return the key
+		return []byte(secret), nil
+	})
+}
+
+// signInternalToken signs the claims with the proxy secret. The token expires after the configured ttl.
+func (m *Module) signInternalToken(claims jwt.MapClaims, audience string) (string, error) {
+	m.lock.RLock()
+	secret, ttl := m.config.ProxySecret, m.config.ProxyTokenTTL
+	m.lock.RUnlock()
+
+	now := time.Now()
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(ttl).Unix()
+	claims["aud"] = audience
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(secret))
 }
 
 // SignProxyToken returns a token to be used by a proxy service
 func (m *Module) SignProxyToken(nodeID, project, service, env, version string) (string, error) {
 	claims := jwt.MapClaims{"id": nodeID, "project": project, "service": service, "env": env, "version": version}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(m.config.ProxySecret))
+	return m.signInternalToken(claims, audienceProxy)
+}
+
+// RenewProxyToken returns a fresh token with the claims of a verified proxy token
+func (m *Module) RenewProxyToken(claims map[string]interface{}) (string, error) {
+	newClaims := make(jwt.MapClaims, len(claims))
+	for key, val := range claims {
+		newClaims[key] = val
+	}
+	for _, key := range registeredClaims {
+		delete(newClaims, key)
+	}
+	return m.signInternalToken(newClaims, audienceProxy)
+}
+
+// SignRunnerToken returns a token used by a runner replica to forward metrics to the leader
+func (m *Module) SignRunnerToken(id string) (string, error) {
+	claims := jwt.MapClaims{"id": id, "role": roleRunner}
+	return m.signInternalToken(claims, audienceRunner)
+}
+
+// VerifyRunnerToken is used for authenticating the requests of other runner replicas
+func (m *Module) VerifyRunnerToken(token string) error {
+	claims, err := m.verifyInternalToken(token, audienceRunner)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return tokenString, nil
+	if role, ok := claims["role"].(string); !ok || role != roleRunner {
+		return errors.New("token does not belong to a runner")
+	}
+	return nil
+}
+
+// SignAgentToken returns a token used by the metrics proxy running as a node agent. Unlike the tokens of the proxies
+// running alongside a service, it isn't bound to any service since the agent sends the metrics of all the services
+// on its node.
+func (m *Module) SignAgentToken(id string) (string, error) {
+	claims := jwt.MapClaims{"id": id, "role": roleAgent}
+	return m.signInternalToken(claims, audienceProxy)
+}
+
+// IsAgent returns true if the claims of a verified proxy token belong to a node agent
+func IsAgent(claims map[string]interface{}) bool {
+	role, ok := claims["role"].(string)
+	return ok && role == roleAgent
+}
+
+// GetExpiry returns the time a verified token expires at
+func GetExpiry(claims map[string]interface{}) time.Time {
+	exp, _ := claims["exp"].(float64)
+	return time.Unix(int64(exp), 0)
+}
+
+// ProxyTokenTTL returns the duration the tokens of the proxies are valid for
+func (m *Module) ProxyTokenTTL() time.Duration {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.config.ProxyTokenTTL
+}
+
+// SetRevokedProxies replaces the node ids whose tokens are no longer accepted
+func (m *Module) SetRevokedProxies(ids []string) {
+	revoked := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		revoked[id] = struct{}{}
+	}
+
+	m.lock.Lock()
+	m.revoked = revoked
+	m.lock.Unlock()
+}
+
+// IsRevoked returns true if the tokens of the node id have been revoked
+func (m *Module) IsRevoked(id string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	_, p := m.revoked[id]
+	return p
 }
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestModule_VerifyProxyToken(t *testing.T) {
+	m, err := New(&Config{ProxySecret: "new-secret", PreviousProxySecret: "old-secret", ProxyTokenTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	old, err := New(&Config{ProxySecret: "old-secret", ProxyTokenTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	sign := func(secret string, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatalf("Could not sign token - %s", err)
+		}
+		return token
+	}
+	mustSign := func(token string, err error) string {
+		if err != nil {
+			t.Fatalf("Could not sign token - %s", err)
+		}
+		return token
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "proxy token", token: mustSign(m.SignProxyToken("node", "todo", "s1", "production", "v1"))},
+		{name: "agent token", token: mustSign(m.SignAgentToken("agent"))},
+		{name: "token signed with previous secret", token: mustSign(old.SignProxyToken("node", "todo", "s1", "production", "v1"))},
+		{name: "token signed with unknown secret", token: sign("other-secret", jwt.MapClaims{"id": "node", "aud": audienceProxy, "exp": now.Add(time.Hour).Unix()}), wantErr: true},
+		{name: "token without expiry", token: sign("new-secret", jwt.MapClaims{"id": "node", "aud": audienceProxy}), wantErr: true},
+		{name: "expired token", token: sign("new-secret", jwt.MapClaims{"id": "node", "aud": audienceProxy, "exp": now.Add(-time.Minute).Unix()}), wantErr: true},
+		{name: "token without audience", token: sign("new-secret", jwt.MapClaims{"id": "node", "exp": now.Add(time.Hour).Unix()}), wantErr: true},
+		{name: "runner token", token: mustSign(m.SignRunnerToken("runner")), wantErr: true},
+		{name: "revoked token", token: mustSign(m.SignProxyToken("revoked", "todo", "s1", "production", "v1")), wantErr: true},
+	}
+
+	m.SetRevokedProxies([]string{"revoked"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := m.VerifyProxyToken(tt.token); (err != nil) != tt.wantErr {
+				t.Errorf("VerifyProxyToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The previous secret isn't accepted once the grace period is over
+	m.previousSecretExpiry = now.Add(-time.Second)
+	if _, err := m.VerifyProxyToken(tests[2].token); err == nil {
+		t.Errorf("VerifyProxyToken() accepted token signed with previous secret after the grace period")
+	}
+
+	// Proxy tokens can't be used by runner replicas
+	if err := m.VerifyRunnerToken(tests[0].token); err == nil {
+		t.Errorf("VerifyRunnerToken() accepted proxy token")
+	}
+	if err := m.VerifyRunnerToken(tests[7].token); err != nil {
+		t.Errorf("VerifyRunnerToken() error = %v", err)
+	}
+}
+
+func TestModule_RenewProxyToken(t *testing.T) {
+	m, err := New(&Config{ProxySecret: "some-secret", ProxyTokenTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	// Sign a token which is about to expire
+	claims := jwt.MapClaims{"id": "node", "project": "todo", "service": "s1", "env": "production", "version": "v1", "aud": audienceProxy, "iat": time.Now().Add(-time.Hour).Unix(), "exp": time.Now().Add(time.Minute).Unix()}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("some-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verified, err := m.VerifyProxyToken(token)
+	if err != nil {
+		t.Fatalf("VerifyProxyToken() error = %v", err)
+	}
+	renewed, err := m.RenewProxyToken(verified)
+	if err != nil {
+		t.Fatalf("RenewProxyToken() error = %v", err)
+	}
+
+	got, err := m.VerifyProxyToken(renewed)
+	if err != nil {
+		t.Fatalf("VerifyProxyToken() error = %v on renewed token", err)
+	}
+	for _, key := range []string{"id", "project", "service", "env", "version"} {
+		if got[key] != claims[key] {
+			t.Errorf("Renewed token has %s = %v, want %v", key, got[key], claims[key])
+		}
+	}
+	if exp := GetExpiry(got); exp.Before(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("Renewed token expires at %s, want an hour from now", exp)
+	}
+}
+
+func TestModule_VerifyProxyCertificate(t *testing.T) {
+	m, err := New(&Config{ProxySecret: "some-secret"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	m.SetRevokedProxies([]string{"revoked"})
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	cert := func(id string, uris ...string) *x509.Certificate {
+		c := &x509.Certificate{Subject: pkix.Name{CommonName: id}, NotAfter: expiry}
+		for _, uri := range uris {
+			u, err := url.Parse(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.URIs = append(c.URIs, u)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		cert    *x509.Certificate
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name: "service",
+			cert: cert("node-1", "spiffe://cluster.local/ns/todo", "galaxy://todo/staging/s1/v1"),
+			want: map[string]interface{}{"id": "node-1", "project": "todo", "env": "staging", "service": "s1", "version": "v1"},
+		},
+		{name: "agent", cert: cert("node-1", "galaxy://agent"), want: map[string]interface{}{"id": "node-1", "role": roleAgent}},
+		{name: "no common name", cert: cert("", "galaxy://todo/staging/s1/v1"), wantErr: true},
+		{name: "no service", cert: cert("node-1"), wantErr: true},
+		{name: "incomplete service", cert: cert("node-1", "galaxy://todo/staging"), wantErr: true},
+		{name: "revoked", cert: cert("revoked", "galaxy://todo/staging/s1/v1"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.VerifyProxyCertificate(tt.cert)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyProxyCertificate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			for key, val := range tt.want {
+				if got[key] != val {
+					t.Errorf("VerifyProxyCertificate() claim %s = %v, want %v", key, got[key], val)
+				}
+			}
+			if !GetExpiry(got).Equal(expiry) {
+				t.Errorf("VerifyProxyCertificate() expiry = %v, want %v", GetExpiry(got), expiry)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+// The size of the rsa keys generated by the galaxy server
+const signingKeyBits = 2048
+
+// NewSigningKey generates a new rsa key pair for the galaxy server to sign tokens with
+func NewSigningKey() (*model.SigningKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+	if err != nil {
+		return nil, err
+	}
+
+	// The id ends up in the kid header of the tokens
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return &model.SigningKey{ID: hex.EncodeToString(id), PrivateKey: string(data), CreatedAt: time.Now().Unix()}, nil
+}
+
+func parsePrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, errors.New("failed to parse PEM block containing the private key")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// SetSigningKeys replaces the keys of the galaxy server. The newest key which hasn't been retired signs the tokens
+// while all of them are published and accepted.
+func (m *Module) SetSigningKeys(keys []*model.SigningKey) error {
+	// Publish the newest keys first
+	sorted := make([]*model.SigningKey, len(keys))
+	copy(sorted, keys)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].CreatedAt > sorted[j].CreatedAt })
+
+	publicKeys := make(map[string]crypto.PublicKey, len(sorted))
+	set := &model.PublicKeySet{JWKS: model.JWKS{Keys: make([]model.JWK, 0, len(sorted))}}
+	var signer *rsa.PrivateKey
+	var signerID string
+	for _, key := range sorted {
+		privateKey, err := parsePrivateKey(key.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("invalid signing key (%s) - %s", key.ID, err.Error())
+		}
+		if signer == nil && key.RetiredAt == 0 {
+			signer, signerID = privateKey, key.ID
+		}
+
+		jwk, err := NewJWK(key.ID, &privateKey.PublicKey)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+		if err != nil {
+			return err
+		}
+		publicKeys[key.ID] = &privateKey.PublicKey
+		set.Keys = append(set.Keys, jwk)
+		set.PemData += string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Headers: map[string]string{"kid": key.ID}, Bytes: der}))
+	}
+
+	m.lock.Lock()
+	m.keys = publicKeys
+	m.signingKey, m.signingKeyID = signer, signerID
+	m.publicKeySet = set
+	m.lock.Unlock()
+	return nil
+}
+
+// PublicKeySet returns the public keys of the galaxy server in the format fetched by the runners. It returns nil if
+// no signing keys have been set.
+func (m *Module) PublicKeySet() *model.PublicKeySet {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.publicKeySet
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/spaceuptech/galaxy/model"
+)
+
+func TestModule_SetSigningKeys(t *testing.T) {
+	m, err := New(&Config{Mode: Server, JWTAlgorithm: RSA256})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	account := &model.UserAccount{ID: "1", Role: string(RoleDeployer), Projects: []string{"todo"}}
+
+	if _, err := m.SignToken(account, time.Hour); err == nil {
+		t.Errorf("SignToken() signed token without signing key")
+	}
+	if m.PublicKeySet() != nil {
+		t.Errorf("PublicKeySet() returned keys without signing keys")
+	}
+
+	// The newest key which hasn't been retired signs the tokens
+	var keys []*model.SigningKey
+	for i := 0; i < 3; i++ {
+		key, err := NewSigningKey()
+		if err != nil {
+			t.Fatalf("NewSigningKey() error = %v", err)
+		}
+		key.CreatedAt = int64(i + 1)
+		keys = append(keys, key)
+	}
+	keys[0].RetiredAt, keys[2].RetiredAt = 2, 3
+	if err := m.SetSigningKeys(keys); err != nil {
+		t.Fatalf("SetSigningKeys() error = %v", err)
+	}
+
+	token, err := m.SignToken(account, time.Hour)
+	if err != nil {
+		t.Fatalf("SignToken() error = %v", err)
+	}
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := parsed.Header["kid"]; kid != keys[1].ID {
+		t.Errorf("SignToken() signed with key %v, want %s", kid, keys[1].ID)
+	}
+	if claims, err := m.Authenticate(token); err != nil || claims.ID != account.ID {
+		t.Errorf("Authenticate() = %+v, %v", claims, err)
+	}
+
+	// All the keys are published in both formats with the newest first
+	set := m.PublicKeySet()
+	if len(set.Keys) != 3 || set.Keys[0].Kid != keys[2].ID {
+		t.Errorf("PublicKeySet() returned keys %+v", set.Keys)
+	}
+	pemKeys, err := parsePublicKeys([]byte(set.PemData))
+	if err != nil || len(pemKeys) != 3 {
+		t.Errorf("parsePublicKeys(pem) = %d keys, %v", len(pemKeys), err)
+	}
+	for _, key := range keys {
+		if _, ok := pemKeys[key.ID]; !ok {
+			t.Errorf("Published pem blocks are missing key (%s)", key.ID)
+		}
+	}
+
+	if err := m.SetSigningKeys([]*model.SigningKey{{ID: "invalid", PrivateKey: "invalid"}}); err == nil {
+		t.Errorf("SetSigningKeys() accepted invalid key")
+	}
+}
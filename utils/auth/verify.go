@@ -1,33 +1,31 @@
 package auth
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
 // VerifyToken checks if the token is valid and returns the token claims
 func (m *Module) VerifyToken(token string) (map[string]interface{}, error) {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
-
-	return nil, nil
-
 	// Parse the JWT token
 	tokenObj, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-
-		// Declare the variables
-		var alg string
-		var key interface{}
-
 		// See which algorithm has been configured
+		var alg string
 		switch m.config.JWTAlgorithm {
 		case RSA256:
 			alg = jwt.SigningMethodRS256.Alg()
-			key = m.config.PublicKey
+		case ES256:
+			alg = jwt.SigningMethodES256.Alg()
+		case EdDSA:
+			alg = SigningMethodEdDSA.Alg()
 		case HS256:
 			alg = jwt.SigningMethodHS256.Alg()
-			key = []byte(m.config.Secret)
 		default:
 			return nil, errors.New("invalid signing methods configured")
 		}
@@ -37,8 +35,12 @@ func (m *Module) VerifyToken(token string) (map[string]interface{}, error) {
 			return nil, errors.New("invalid signing method")
 		}
 
-		// Return the key
-		return key, nil
+		if m.config.JWTAlgorithm == HS256 {
+			m.lock.RLock()
+			defer m.lock.RUnlock()
+			return []byte(m.config.Secret), nil
+		}
+		return m.getVerificationKey(token)
 	})
 	if err != nil {
 		return nil, err
@@ -56,3 +58,51 @@ func (m *Module) VerifyToken(token string) (map[string]interface{}, error) {
 
 	return nil, errors.New("token could not be verified")
 }
+
+// getVerificationKey returns the public key the token has been signed with. The keys are refreshed if the token
+// refers to an unknown key since the server may have rotated its keys.
+func (m *Module) getVerificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key := m.getPublicKey(kid)
+	if key == nil && kid != "" {
+		m.refreshPublicKeys()
+		key = m.getPublicKey(kid)
+	}
+	if key == nil {
+		if kid == "" {
+			return nil, errors.New("public key of galaxy server has not been set")
+		}
+		return nil, fmt.Errorf("unknown key id (%s)", kid)
+	}
+
+	// Make sure the key is meant for the configured algorithm
+	var ok bool
+	switch m.config.JWTAlgorithm {
+	case RSA256:
+		_, ok = key.(*rsa.PublicKey)
+	case ES256:
+		_, ok = key.(*ecdsa.PublicKey)
+	case EdDSA:
+		_, ok = key.(ed25519.PublicKey)
+	}
+	if !ok {
+		return nil, fmt.Errorf("key (%s) does not match the configured algorithm", kid)
+	}
+	return key, nil
+}
+
+// Authenticate verifies the token or api key and returns the claims used for authorizing the request
+func (m *Module) Authenticate(token string) (*Claims, error) {
+	if token == "" {
+		return nil, errors.New("token not provided")
+	}
+	if strings.HasPrefix(token, APIKeyPrefix) {
+		return m.verifyAPIKey(token)
+	}
+
+	claims, err := m.VerifyToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return ParseClaims(claims)
+}
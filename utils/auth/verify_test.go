@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestModule_Authenticate(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate rsa key - %s", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate rsa key - %s", err)
+	}
+
+	hs256 := &Module{config: &Config{JWTAlgorithm: HS256, Secret: "some-secret"}}
+	rsa256 := &Module{config: &Config{JWTAlgorithm: RSA256, PublicKey: &key.PublicKey}}
+
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatalf("Could not sign token - %s", err)
+		}
+		return token
+	}
+	deployer := jwt.MapClaims{"id": "user", "role": "deployer", "projects": []string{"todo"}, "envs": []string{"staging"}}
+
+	tests := []struct {
+		name    string
+		module  *Module
+		token   string
+		want    *Claims
+		wantErr bool
+	}{
+		{
+			name:   "valid hs256 token",
+			module: hs256,
+			token:  sign(jwt.SigningMethodHS256, []byte("some-secret"), deployer),
+			want:   &Claims{ID: "user", Role: RoleDeployer, Projects: []string{"todo"}, Environments: []string{"staging"}},
+		},
+		{
+			name:   "valid rsa256 token",
+			module: rsa256,
+			token:  sign(jwt.SigningMethodRS256, key, jwt.MapClaims{"id": "admin", "role": "admin"}),
+			want:   &Claims{ID: "admin", Role: RoleAdmin},
+		},
+		{
+			name:    "hs256 token signed with wrong secret",
+			module:  hs256,
+			token:   sign(jwt.SigningMethodHS256, []byte("other-secret"), deployer),
+			wantErr: true,
+		},
+		{
+			name:    "rsa256 token signed with wrong key",
+			module:  rsa256,
+			token:   sign(jwt.SigningMethodRS256, otherKey, deployer),
+			wantErr: true,
+		},
+		{
+			name:    "rsa256 token sent to hs256 module",
+			module:  hs256,
+			token:   sign(jwt.SigningMethodRS256, key, deployer),
+			wantErr: true,
+		},
+		{
+			name:    "hs256 token sent to rsa256 module",
+			module:  rsa256,
+			token:   sign(jwt.SigningMethodHS256, []byte("some-secret"), deployer),
+			wantErr: true,
+		},
+		{
+			name:    "rsa256 module without public key",
+			module:  &Module{config: &Config{JWTAlgorithm: RSA256}},
+			token:   sign(jwt.SigningMethodRS256, key, deployer),
+			wantErr: true,
+		},
+		{
+			name:    "expired token",
+			module:  hs256,
+			token:   sign(jwt.SigningMethodHS256, []byte("some-secret"), jwt.MapClaims{"role": "admin", "exp": time.Now().Add(-time.Minute).Unix()}),
+			wantErr: true,
+		},
+		{
+			name:    "token without role",
+			module:  hs256,
+			token:   sign(jwt.SigningMethodHS256, []byte("some-secret"), jwt.MapClaims{"id": "user", "projects": []string{"todo"}}),
+			wantErr: true,
+		},
+		{
+			name:    "token with unknown role",
+			module:  rsa256,
+			token:   sign(jwt.SigningMethodRS256, key, jwt.MapClaims{"role": "root"}),
+			wantErr: true,
+		},
+		{
+			name:    "token with invalid projects",
+			module:  hs256,
+			token:   sign(jwt.SigningMethodHS256, []byte("some-secret"), jwt.MapClaims{"role": "viewer", "projects": "todo"}),
+			wantErr: true,
+		},
+		{
+			name:    "empty token",
+			module:  hs256,
+			token:   "",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.module.Authenticate(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.ID != tt.want.ID || got.Role != tt.want.Role || !equal(got.Projects, tt.want.Projects) || !equal(got.Environments, tt.want.Environments) {
+				t.Errorf("Authenticate() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaims_Authorize(t *testing.T) {
+	tests := []struct {
+		name    string
+		claims  *Claims
+		action  Action
+		project string
+		env     string
+		allowed bool
+	}{
+		{name: "admin can create any project", claims: &Claims{Role: RoleAdmin}, action: ActionManageProject, project: "todo", allowed: true},
+		{name: "admin can deploy anywhere", claims: &Claims{Role: RoleAdmin}, action: ActionDeploy, project: "todo", env: "production", allowed: true},
+		{name: "project admin can create granted project", claims: &Claims{Role: RoleProjectAdmin, Projects: []string{"todo"}}, action: ActionManageProject, project: "todo", allowed: true},
+		{name: "project admin cannot create other project", claims: &Claims{Role: RoleProjectAdmin, Projects: []string{"todo"}}, action: ActionManageProject, project: "chat"},
+		{name: "project admin can manage services", claims: &Claims{Role: RoleProjectAdmin, Projects: []string{"todo"}}, action: ActionManageServices, project: "todo", allowed: true},
+		{name: "deployer can deploy to granted env", claims: &Claims{Role: RoleDeployer, Projects: []string{"todo"}, Environments: []string{"staging"}}, action: ActionDeploy, project: "todo", env: "staging", allowed: true},
+		{name: "deployer cannot deploy to other env", claims: &Claims{Role: RoleDeployer, Projects: []string{"todo"}, Environments: []string{"staging"}}, action: ActionDeploy, project: "todo", env: "production"},
+		{name: "deployer without envs can deploy to any env", claims: &Claims{Role: RoleDeployer, Projects: []string{"todo"}}, action: ActionDeploy, project: "todo", env: "production", allowed: true},
+		{name: "deployer cannot deploy to other project", claims: &Claims{Role: RoleDeployer, Projects: []string{"todo"}}, action: ActionDeploy, project: "chat", env: "staging"},
+		{name: "deployer cannot create project", claims: &Claims{Role: RoleDeployer, Projects: []string{"todo"}}, action: ActionManageProject, project: "todo"},
+		{name: "deployer cannot manage services", claims: &Claims{Role: RoleDeployer, Projects: []string{"todo"}}, action: ActionManageServices, project: "todo"},
+		{name: "deployer with wildcard can deploy to any project", claims: &Claims{Role: RoleDeployer, Projects: []string{"*"}}, action: ActionDeploy, project: "chat", env: "staging", allowed: true},
+		{name: "viewer can read granted project", claims: &Claims{Role: RoleViewer, Projects: []string{"todo"}}, action: ActionRead, project: "todo", env: "staging", allowed: true},
+		{name: "viewer cannot deploy", claims: &Claims{Role: RoleViewer, Projects: []string{"todo"}}, action: ActionDeploy, project: "todo", env: "staging"},
+		{name: "viewer without projects cannot read", claims: &Claims{Role: RoleViewer}, action: ActionRead, project: "todo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.claims.Authorize(tt.action, tt.project, tt.env)
+			if (err == nil) != tt.allowed {
+				t.Errorf("Authorize() error = %v, allowed %v", err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestClaims_AuthorizeProject(t *testing.T) {
+	tests := []struct {
+		name    string
+		claims  *Claims
+		allowed bool
+	}{
+		{name: "admin", claims: &Claims{Role: RoleAdmin}, allowed: true},
+		{name: "project admin of all envs", claims: &Claims{Role: RoleProjectAdmin, Projects: []string{"todo"}}, allowed: true},
+		{name: "project admin restricted to some envs", claims: &Claims{Role: RoleProjectAdmin, Projects: []string{"todo"}, Environments: []string{"staging"}}},
+		{name: "project admin of other project", claims: &Claims{Role: RoleProjectAdmin, Projects: []string{"chat"}}},
+		{name: "deployer", claims: &Claims{Role: RoleDeployer, Projects: []string{"todo"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.claims.AuthorizeProject(ActionManageServices, "todo")
+			if (err == nil) != tt.allowed {
+				t.Errorf("AuthorizeProject() error = %v, allowed %v", err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestClaims_DefaultProject(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims *Claims
+		want   string
+		wantOk bool
+	}{
+		{name: "single project", claims: &Claims{Role: RoleDeployer, Projects: []string{"todo"}}, want: "todo", wantOk: true},
+		{name: "multiple projects", claims: &Claims{Role: RoleDeployer, Projects: []string{"todo", "chat"}}},
+		{name: "wildcard", claims: &Claims{Role: RoleDeployer, Projects: []string{"*"}}},
+		{name: "admin", claims: &Claims{Role: RoleAdmin, Projects: []string{"todo"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.claims.DefaultProject()
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("DefaultProject() = (%v, %v), want (%v, %v)", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,224 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The interval at which the files are checked for changes by default
+const defaultReloadInterval = time.Minute
+
+// The time allowed to establish a connection by the clients
+const dialTimeout = 30 * time.Second
+
+// Config describes the certificates used for TLS
+type Config struct {
+	// The pem encoded certificate and its private key
+	CertFile, KeyFile string
+
+	// The pem encoded certificates of the authorities used to verify the certificates of the other party. Servers
+	// verify the client certificates with it and clients the certificate of the server. Clients use the system
+	// roots if it isn't provided.
+	CAFile string
+
+	// The interval at which the files are checked for changes
+	ReloadInterval time.Duration
+}
+
+// Enabled returns true if a certificate was provided
+func (c *Config) Enabled() bool {
+	return c != nil && c.CertFile != "" && c.KeyFile != ""
+}
+
+// Reloader keeps the certificate and the authorities in sync with the files they were loaded from. Certificates can
+// hence be rotated without restarting the process.
+type Reloader struct {
+	lock sync.RWMutex
+
+	// For internal use
+	config  *Config
+	modTime time.Time
+
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+// NewReloader loads the files of the config. An error is returned if they can't be loaded.
+func NewReloader(c *Config) (*Reloader, error) {
+	if c.ReloadInterval == 0 {
+		c.ReloadInterval = defaultReloadInterval
+	}
+
+	r := &Reloader{config: c}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Run checks the files for changes at the configured interval till the stop channel is closed
+func (r *Reloader) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(r.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			// The previous certificate continues to be used if the new one can't be loaded. This can happen if
+			// we catch the files midway through an update.
+			reloaded, err := r.reload()
+			if err != nil {
+				logrus.Errorf("Could not reload certificates - %s", err.Error())
+				continue
+			}
+			if reloaded {
+				logrus.Infof("Reloaded certificate (%s)", r.config.CertFile)
+			}
+		}
+	}
+}
+
+// reload loads the files if any of them changed since they were last loaded
+func (r *Reloader) reload() (bool, error) {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return false, err
+	}
+
+	r.lock.RLock()
+	changed := modTime.After(r.modTime)
+	r.lock.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	var cert *tls.Certificate
+	if r.config.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+		if err != nil {
+			return false, err
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if r.config.CAFile != "" {
+		data, err := ioutil.ReadFile(r.config.CAFile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return false, fmt.Errorf("no certificates found in %s", r.config.CAFile)
+		}
+	}
+
+	r.lock.Lock()
+	r.cert, r.pool, r.modTime = cert, pool, modTime
+	r.lock.Unlock()
+	return true, nil
+}
+
+func (r *Reloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.config.CertFile, r.config.KeyFile, r.config.CAFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *Reloader) getCertificate() (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if r.cert == nil {
+		return nil, errors.New("no certificate has been configured")
+	}
+	return r.cert, nil
+}
+
+// CertPool returns the authorities loaded from the ca file. It is nil if no file was provided.
+func (r *Reloader) CertPool() *x509.CertPool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.pool
+}
+
+// ServerConfig returns the tls config for a server. Clients may present a certificate if the config has authorities.
+// It is verified during the handshake and made available in the verified chains of the connection state.
+func (r *Reloader) ServerConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.getCertificate()
+		},
+	}
+	if r.config.CAFile == "" {
+		return base
+	}
+
+	// The authorities are picked up for every handshake so that they can be rotated as well
+	config := base.Clone()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		c.ClientCAs = r.CertPool()
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		return c, nil
+	}
+	return config
+}
+
+// Transport returns an http transport for the clients talking to the other galaxy components. Every connection uses a
+// fresh client config, so the certificate of the server is verified with the authorities loaded at the time of the
+// handshake and the authorities can be rotated without restarting the process.
+func (r *Reloader) Transport() *http.Transport {
+	dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+	return &http.Transport{
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			config := r.ClientConfig()
+			config.ServerName = host
+			return tls.DialWithDialer(dialer, network, addr, config)
+		},
+		MaxIdleConns:    100,
+		IdleConnTimeout: 90 * time.Second,
+	}
+}
+
+// ClientConfig returns the tls config for a client. The certificate of the server is verified with the authorities
+// loaded at the time. The certificate of the config is presented to the server if one was provided and is kept up to
+// date.
+func (r *Reloader) ClientConfig() *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: r.CertPool()}
+	if r.config.CertFile != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.getCertificate()
+		}
+	}
+	return config
+}
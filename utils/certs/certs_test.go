@@ -0,0 +1,264 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate signed by the parent. The certificate is self signed if the parent is nil.
+func newTestCert(t *testing.T, serial int64, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "galaxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+// write writes the certificate and its key to the directory and returns their paths
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Push the modification time ahead so that the change is noticed even within the resolution of the file system
+	future := time.Now().Add(time.Duration(c.cert.SerialNumber.Int64()) * time.Second)
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+// serve starts a tls server which responds with the common name of the verified client certificate
+func serve(t *testing.T, config *tls.Config) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			_, _ = w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+		}
+	})}
+	go func() { _ = s.Serve(tls.NewListener(l, config)) }()
+	return "https://" + l.Addr().String(), func() { _ = s.Close() }
+}
+
+func get(client *http.Client, url string) (*http.Response, string, error) {
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	body, err := ioutil.ReadAll(res.Body)
+	return res, string(body), err
+}
+
+func TestReloader_rotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	ca := newTestCert(t, 1, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, 2, ca).write(t, dir, "server")
+
+	r, err := NewReloader(&Config{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("NewReloader() error = %v", err)
+	}
+	url, stop := serve(t, r.ServerConfig())
+	defer stop()
+
+	clientCerts, err := NewReloader(&Config{CAFile: caFile})
+	if err != nil {
+		t.Fatalf("NewReloader() error = %v", err)
+	}
+	client := func() *http.Client {
+		// A new transport makes sure that every request performs a fresh handshake
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: clientCerts.ClientConfig()}}
+	}
+
+	res, _, err := get(client(), url)
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	if serial := res.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Errorf("Server presented certificate %d, want 2", serial)
+	}
+
+	// Rotated certificates are served without restarting the server
+	newTestCert(t, 3, ca).write(t, dir, "server")
+	if reloaded, err := r.reload(); err != nil || !reloaded {
+		t.Fatalf("reload() = %v, %v, want true", reloaded, err)
+	}
+	res, _, err = get(client(), url)
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	if serial := res.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 3 {
+		t.Errorf("Server presented certificate %d after rotation, want 3", serial)
+	}
+
+	// Unchanged files aren't loaded again
+	if reloaded, err := r.reload(); err != nil || reloaded {
+		t.Errorf("reload() = %v, %v, want false", reloaded, err)
+	}
+}
+
+func TestReloader_clientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	ca := newTestCert(t, 1, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	serverCert, serverKey := newTestCert(t, 2, ca).write(t, dir, "server")
+	clientCert, clientKey := newTestCert(t, 3, ca).write(t, dir, "client")
+	otherCert, otherKey := newTestCert(t, 4, nil).write(t, dir, "other")
+
+	r, err := NewReloader(&Config{CertFile: serverCert, KeyFile: serverKey, CAFile: caFile})
+	if err != nil {
+		t.Fatalf("NewReloader() error = %v", err)
+	}
+	url, stop := serve(t, r.ServerConfig())
+	defer stop()
+
+	tests := []struct {
+		name     string
+		config   *Config
+		wantErr  bool
+		wantName string
+	}{
+		{name: "verified certificate", config: &Config{CertFile: clientCert, KeyFile: clientKey, CAFile: caFile}, wantName: "galaxy"},
+		{name: "no certificate", config: &Config{CAFile: caFile}},
+		{name: "certificate of unknown authority", config: &Config{CertFile: otherCert, KeyFile: otherKey, CAFile: caFile}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewReloader(tt.config)
+			if err != nil {
+				t.Fatalf("NewReloader() error = %v", err)
+			}
+
+			_, name, err := get(&http.Client{Transport: &http.Transport{TLSClientConfig: c.ClientConfig()}}, url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GET error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if name != tt.wantName {
+				t.Errorf("Server verified client %q, want %q", name, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestReloader_Transport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	ca := newTestCert(t, 1, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	serverCert, serverKey := newTestCert(t, 2, ca).write(t, dir, "server")
+	clientCert, clientKey := newTestCert(t, 3, ca).write(t, dir, "client")
+
+	r, err := NewReloader(&Config{CertFile: serverCert, KeyFile: serverKey, CAFile: caFile})
+	if err != nil {
+		t.Fatalf("NewReloader() error = %v", err)
+	}
+	url, stop := serve(t, r.ServerConfig())
+	defer stop()
+
+	c, err := NewReloader(&Config{CertFile: clientCert, KeyFile: clientKey, CAFile: caFile})
+	if err != nil {
+		t.Fatalf("NewReloader() error = %v", err)
+	}
+	transport := c.Transport()
+	client := &http.Client{Transport: transport}
+
+	// The client presents its certificate
+	if _, name, err := get(client, url); err != nil || name != "galaxy" {
+		t.Fatalf("GET = %q, %v, want verified client", name, err)
+	}
+
+	// The same transport trusts the rotated authority once it is reloaded
+	newCA := newTestCert(t, 5, nil)
+	newCA.write(t, dir, "ca")
+	newTestCert(t, 6, newCA).write(t, dir, "server")
+	newTestCert(t, 7, newCA).write(t, dir, "client")
+	for _, reloader := range []*Reloader{r, c} {
+		if reloaded, err := reloader.reload(); err != nil || !reloaded {
+			t.Fatalf("reload() = %v, %v, want true", reloaded, err)
+		}
+	}
+	transport.CloseIdleConnections()
+
+	res, name, err := get(client, url)
+	if err != nil {
+		t.Fatalf("GET error = %v after rotating the authority", err)
+	}
+	if serial := res.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 6 || name != "galaxy" {
+		t.Errorf("Server presented certificate %d to client %q, want 6 to verified client", serial, name)
+	}
+}
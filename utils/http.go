@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
@@ -56,20 +57,70 @@ func SendEmptySuccessResponse(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// SendResponse sends a json encoded http response with the provided status code
+func SendResponse(w http.ResponseWriter, r *http.Request, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logrus.Errorf("Error while sending response for %s %s - %s", r.Method, r.URL.String(), err.Error())
+	}
+}
+
 // CloseReaderCloser closes an io read closer while explicitly ignoring the error
 func CloseReaderCloser(r io.Closer) {
 	_ = r.Close()
 }
 
-// CreateCorsObject returns a new cors object
-func CreateCorsObject() *cors.Cors {
+// CorsConfig describes the cross origin requests a listener accepts
+type CorsConfig struct {
+	// The origins allowed to make cross origin requests. A "*" allows all origins. Cross origin requests are not
+	// allowed if it is empty.
+	AllowedOrigins []string
+
+	AllowedMethods []string
+	AllowedHeaders []string
+
+	// The duration the results of a preflight request can be cached for
+	MaxAge time.Duration
+}
+
+// WithCors returns a handler which responds to the cross origin requests allowed by the config. The handler is returned
+// as is if no origins are allowed, in which case browsers block the cross origin requests.
+func WithCors(c *CorsConfig, h http.Handler) http.Handler {
+	if c == nil || len(c.AllowedOrigins) == 0 {
+		return h
+	}
+
+	methods, headers := c.AllowedMethods, c.AllowedHeaders
+	if len(methods) == 0 {
+		methods = []string{"GET", "PUT", "POST", "DELETE"}
+	}
+	if len(headers) == 0 {
+		headers = []string{"Authorization", "Content-Type"}
+	}
+
+	// Credentials are only allowed for origins which are explicitly listed
+	wildcard := false
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			wildcard = true
+		}
+	}
+
 	return cors.New(cors.Options{
-		AllowCredentials: true,
-		AllowOriginFunc: func(s string) bool {
-			return true
-		},
-		AllowedMethods: []string{"GET", "PUT", "POST", "DELETE"},
-		AllowedHeaders: []string{"Authorization", "Content-Type"},
-		ExposedHeaders: []string{"Authorization", "Content-Type"},
-	})
+		AllowedOrigins:   c.AllowedOrigins,
+		AllowCredentials: !wildcard,
+		AllowedMethods:   methods,
+		AllowedHeaders:   headers,
+		ExposedHeaders:   []string{"Authorization", "Content-Type"},
+		MaxAge:           int(c.MaxAge / time.Second),
+	}).Handler(h)
+}
+
+// ListenAndServe serves over tls if the server has a tls config and over plain http otherwise
+func ListenAndServe(s *http.Server) error {
+	if s.TLSConfig != nil {
+		return s.ListenAndServeTLS("", "")
+	}
+	return s.ListenAndServe()
 }
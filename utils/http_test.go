@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithCors(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name            string
+		config          *CorsConfig
+		origin          string
+		wantOrigin      string
+		wantCredentials bool
+	}{
+		{name: "no config", origin: "https://evil.com"},
+		{name: "no origins", config: &CorsConfig{}, origin: "https://evil.com"},
+		{
+			name:            "allowed origin",
+			config:          &CorsConfig{AllowedOrigins: []string{"https://console.example.com"}},
+			origin:          "https://console.example.com",
+			wantOrigin:      "https://console.example.com",
+			wantCredentials: true,
+		},
+		{name: "other origin", config: &CorsConfig{AllowedOrigins: []string{"https://console.example.com"}}, origin: "https://evil.com"},
+		{name: "wildcard", config: &CorsConfig{AllowedOrigins: []string{"*"}}, origin: "https://evil.com", wantOrigin: "*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/galaxy/services", nil)
+			r.Header.Set("Origin", tt.origin)
+			w := httptest.NewRecorder()
+			WithCors(tt.config, h).ServeHTTP(w, r)
+
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != tt.wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials = %v, want %v", got, tt.wantCredentials)
+			}
+		})
+	}
+
+	// Preflight requests are answered with the configured methods and max age
+	r := httptest.NewRequest("OPTIONS", "/v1/galaxy/service", nil)
+	r.Header.Set("Origin", "https://console.example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	WithCors(&CorsConfig{AllowedOrigins: []string{"https://console.example.com"}, AllowedMethods: []string{"POST"}, MaxAge: time.Minute}, h).ServeHTTP(w, r)
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "POST" {
+		t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, "POST")
+	}
+	if got := w.Header().Get("Access-Control-Max-Age"); got != "60" {
+		t.Errorf("Access-Control-Max-Age = %q, want %q", got, "60")
+	}
+}